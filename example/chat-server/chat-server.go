@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/sdk-golang/ziti"
@@ -134,7 +135,10 @@ func main() {
 	}
 	logger.Infof("binding service %v\n", service)
 	listener, err := ziti.NewContext().ListenWithOptions(service, &options)
-	if err != nil {
+	var partialErr *ziti.PartialListenError
+	if errors.As(err, &partialErr) {
+		logger.Warnf("service only partially bound, continuing while the remaining routers are retried: %v", partialErr)
+	} else if err != nil {
 		logrus.Errorf("Error binding service %+v", err)
 		panic(err)
 	}
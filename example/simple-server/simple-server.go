@@ -17,6 +17,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/sdk-golang/ziti"
@@ -65,7 +66,11 @@ func withZiti(service string) {
 		MaxConnections: 3,
 	}
 	listener, err := ziti.NewContext().ListenWithOptions(service, &options)
-	if err != nil {
+	var partialErr *ziti.PartialListenError
+	if errors.As(err, &partialErr) {
+		// the listener is bound on some routers and keeps trying the rest, so it's fine to carry on with it
+		fmt.Printf("Service only partially bound %v\n", partialErr)
+	} else if err != nil {
 		fmt.Printf("Error binding service %+v\n", err)
 		panic(err)
 	}
@@ -15,12 +15,22 @@ const (
 
 type serviceCB func(eventType ServiceEventType, service *edge.Service)
 
+// DefaultSessionExpiryWarning is how long before the api session expires the session expiry handler is called
+const DefaultSessionExpiryWarning = time.Minute
+
 type Options struct {
 	RefreshInterval time.Duration
 	OnServiceUpdate serviceCB
+	// SessionExpiryWarning is how long before the api session expires the handler set with
+	// Context.SetSessionExpiryHandler is called. Zero uses DefaultSessionExpiryWarning
+	SessionExpiryWarning time.Duration
+	// MsgMuxOptions configures the message mux on each edge router connection, such as its dispatch worker pool.
+	// Nil uses edge.DefaultMsgMuxOptions
+	MsgMuxOptions *edge.MsgMuxOptions
 }
 
 var DefaultOptions = &Options{
-	RefreshInterval: 5 * time.Minute,
-	OnServiceUpdate: nil,
+	RefreshInterval:      5 * time.Minute,
+	OnServiceUpdate:      nil,
+	SessionExpiryWarning: DefaultSessionExpiryWarning,
 }
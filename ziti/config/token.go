@@ -24,8 +24,8 @@ import (
 	"reflect"
 
 	"github.com/dgrijalva/jwt-go"
-	"github.com/michaelquigley/pfxlog"
 	"github.com/mitchellh/mapstructure"
+	"github.com/openziti/sdk-golang/ziti/edge"
 	"github.com/pkg/errors"
 )
 
@@ -50,7 +50,8 @@ func (t *EnrollmentClaims) EnrolmentUrl() string {
 	enrollmentUrl, err := url.Parse(t.Issuer)
 
 	if err != nil {
-		pfxlog.Logger().WithError(err).WithField("url", t.Issuer).Panic("could not parse issuer as URL")
+		edge.Log().WithError(err).WithField("url", t.Issuer).Error("could not parse issuer as URL")
+		panic(errors.Wrapf(err, "could not parse issuer %v as URL", t.Issuer))
 	}
 
 	enrollmentUrl.Path = path.Join(enrollmentUrl.Path, "enroll")
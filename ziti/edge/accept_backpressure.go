@@ -0,0 +1,102 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import "sync"
+
+// AcceptBackpressure tells the application when conns waiting to be accepted pile up because its Accept loop is
+// falling behind, and when they've drained again. As with AcceptRateLimit, the listeners created for each router by
+// a single Listen share it, so it tracks the conns waiting across all of them
+type AcceptBackpressure struct {
+	// HighWater is the number of waiting conns at which OnBackpressure is called. Zero uses three quarters of the
+	// room the listeners have for waiting conns
+	HighWater int
+	// LowWater is the number of waiting conns at or below which OnCleared is called, once OnBackpressure has been.
+	// Zero uses a quarter of the room the listeners have for waiting conns
+	LowWater int
+	// OnBackpressure and OnCleared are passed the number of waiting conns and the room for them. They're called on
+	// the accept path, so they should return quickly
+	OnBackpressure func(queueDepth, capacity int)
+	OnCleared      func(queueDepth, capacity int)
+
+	lock      sync.Mutex
+	queues    map[interface{}]acceptQueueState
+	pressured bool
+}
+
+type acceptQueueState struct {
+	depth    int
+	capacity int
+}
+
+func NewAcceptBackpressure(onBackpressure, onCleared func(queueDepth, capacity int)) *AcceptBackpressure {
+	return &AcceptBackpressure{
+		OnBackpressure: onBackpressure,
+		OnCleared:      onCleared,
+	}
+}
+
+// Update records the number of conns waiting on one of the listeners sharing the tracker, and the room it has for
+// them, calling OnBackpressure or OnCleared if that crossed a mark. A capacity of zero removes the listener
+func (pressure *AcceptBackpressure) Update(listener interface{}, depth, capacity int) {
+	pressure.lock.Lock()
+	defer pressure.lock.Unlock()
+
+	if pressure.queues == nil {
+		pressure.queues = map[interface{}]acceptQueueState{}
+	}
+	if capacity <= 0 {
+		delete(pressure.queues, listener)
+	} else {
+		pressure.queues[listener] = acceptQueueState{depth: depth, capacity: capacity}
+	}
+
+	totalDepth, totalCapacity := 0, 0
+	for _, state := range pressure.queues {
+		totalDepth += state.depth
+		totalCapacity += state.capacity
+	}
+
+	if !pressure.pressured && totalCapacity > 0 && totalDepth >= pressure.highWater(totalCapacity) {
+		pressure.pressured = true
+		if pressure.OnBackpressure != nil {
+			pressure.OnBackpressure(totalDepth, totalCapacity)
+		}
+	} else if pressure.pressured && totalDepth <= pressure.lowWater(totalCapacity) {
+		pressure.pressured = false
+		if pressure.OnCleared != nil {
+			pressure.OnCleared(totalDepth, totalCapacity)
+		}
+	}
+}
+
+func (pressure *AcceptBackpressure) highWater(capacity int) int {
+	if pressure.HighWater > 0 {
+		return pressure.HighWater
+	}
+	if mark := capacity * 3 / 4; mark > 0 {
+		return mark
+	}
+	return 1
+}
+
+func (pressure *AcceptBackpressure) lowWater(capacity int) int {
+	if pressure.LowWater > 0 {
+		return pressure.LowWater
+	}
+	return capacity / 4
+}
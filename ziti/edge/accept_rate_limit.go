@@ -0,0 +1,72 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// AcceptRateLimit is a token bucket bounding how fast a listener accepts new conns. Unlike MaxConnections, it
+// doesn't bound how many routers are bound on, but the rate new conns arrive at across them. The listeners created
+// for each router by a single Listen share the limit, so it bounds their combined rate
+type AcceptRateLimit struct {
+	// Rate is the number of conns per second accepted once the burst is used up. Zero or less disables the limit
+	Rate float64
+	// Burst is the number of conns which may be accepted back to back. Values below 1 are treated as 1
+	Burst int
+	// Reject fails dials beyond the rate straight away. Otherwise they're held until the rate allows them, for up
+	// to the listen ConnectTimeout
+	Reject bool
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewAcceptRateLimit(rate float64, burst int) *AcceptRateLimit {
+	return &AcceptRateLimit{
+		Rate:  rate,
+		Burst: burst,
+	}
+}
+
+// TryAcquire takes a token if one is available. If not, it returns how long until one will be
+func (limit *AcceptRateLimit) TryAcquire() (bool, time.Duration) {
+	if limit.Rate <= 0 {
+		return true, 0
+	}
+
+	limit.lock.Lock()
+	defer limit.lock.Unlock()
+
+	burst := math.Max(float64(limit.Burst), 1)
+	now := time.Now()
+	if limit.last.IsZero() {
+		limit.tokens = burst
+	} else {
+		limit.tokens = math.Min(burst, limit.tokens+now.Sub(limit.last).Seconds()*limit.Rate)
+	}
+	limit.last = now
+
+	if limit.tokens >= 1 {
+		limit.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - limit.tokens) / limit.Rate * float64(time.Second))
+}
@@ -6,10 +6,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/foundation/common/constants"
 	"github.com/openziti/sdk-golang/ziti/edge"
-	"github.com/sirupsen/logrus"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -56,6 +54,7 @@ type Client interface {
 	GetServices() ([]*edge.Service, error)
 	CreateSession(svcId string, kind edge.SessionType) (*edge.Session, error)
 	RefreshSession(id string) (*edge.Session, error)
+	GetServiceTerminators(svcId string) ([]*edge.TerminatorState, error)
 }
 
 func NewClient(ctrl *url.URL, tlsCfg *tls.Config) (Client, error) {
@@ -86,12 +85,12 @@ func (c *ctrlClient) CreateSession(svcId string, kind edge.SessionType) (*edge.S
 	reqBody := bytes.NewBufferString(body)
 
 	fullSessionUrl := c.zitiUrl.ResolveReference(sessionUrl).String()
-	pfxlog.Logger().Debugf("requesting session from %v", fullSessionUrl)
+	edge.Log().Debugf("requesting session from %v", fullSessionUrl)
 	req, _ := http.NewRequest("POST", fullSessionUrl, reqBody)
 	req.Header.Set(constants.ZitiSession, c.apiSession.Token)
 	req.Header.Set("content-type", "application/json")
 
-	logrus.WithField("service_id", svcId).Debug("requesting session")
+	edge.Log().WithField("service_id", svcId).Debug("requesting session")
 	resp, err := c.clt.Do(req)
 
 	if err != nil {
@@ -104,12 +103,12 @@ func (c *ctrlClient) CreateSession(svcId string, kind edge.SessionType) (*edge.S
 func (c *ctrlClient) RefreshSession(id string) (*edge.Session, error) {
 	sessionLookupUrl, _ := url.Parse(fmt.Sprintf("/sessions/%v", id))
 	sessionLookupUrlStr := c.zitiUrl.ResolveReference(sessionLookupUrl).String()
-	pfxlog.Logger().Debugf("requesting session from %v", sessionLookupUrlStr)
+	edge.Log().Debugf("requesting session from %v", sessionLookupUrlStr)
 	req, _ := http.NewRequest(http.MethodGet, sessionLookupUrlStr, nil)
 	req.Header.Set(constants.ZitiSession, c.apiSession.Token)
 	req.Header.Set("content-type", "application/json")
 
-	logrus.WithField("sessionId", id).Debug("requesting session")
+	edge.Log().WithField("sessionId", id).Debug("requesting session")
 	resp, err := c.clt.Do(req)
 
 	if err != nil {
@@ -135,7 +134,7 @@ func (c *ctrlClient) Login(info map[string]interface{}, configTypes []string) (*
 	}
 	resp, err := c.clt.Post(c.zitiUrl.ResolveReference(authUrl).String(), "application/json", req)
 	if err != nil {
-		pfxlog.Logger().Errorf("failure to post auth %+v", err)
+		edge.Log().Errorf("failure to post auth %+v", err)
 		return nil, err
 	}
 
@@ -143,7 +142,7 @@ func (c *ctrlClient) Login(info map[string]interface{}, configTypes []string) (*
 
 	if resp.StatusCode != 200 {
 		msg, _ := ioutil.ReadAll(resp.Body)
-		pfxlog.Logger().Errorf("failed to authenticate with Ziti controller, result status: %v, msg: %v", resp.StatusCode, string(msg))
+		edge.Log().Errorf("failed to authenticate with Ziti controller, result status: %v, msg: %v", resp.StatusCode, string(msg))
 		return nil, AuthFailure{
 			httpCode: resp.StatusCode,
 			msg:      string(msg),
@@ -157,7 +156,7 @@ func (c *ctrlClient) Login(info map[string]interface{}, configTypes []string) (*
 		return nil, err
 	}
 
-	logrus.
+	edge.Log().
 		WithField("apiSession", apiSessionResp.Id).
 		Debugf("logged in as %s/%s", apiSessionResp.Identity.Name, apiSessionResp.Identity.Id)
 
@@ -167,7 +166,7 @@ func (c *ctrlClient) Login(info map[string]interface{}, configTypes []string) (*
 }
 
 func (c *ctrlClient) Refresh() (*time.Time, error) {
-	log := pfxlog.Logger()
+	log := edge.Log()
 
 	log.Debugf("refreshing apiSession apiSession")
 	req, err := http.NewRequest("GET", c.zitiUrl.ResolveReference(currSess).String(), nil)
@@ -219,7 +218,7 @@ func (c *ctrlClient) GetServices() ([]*edge.Service, error) {
 	if c.apiSession.Token == "" {
 		return nil, errors.New("apiSession apiSession token is empty")
 	} else {
-		pfxlog.Logger().Debugf("using apiSession apiSession token %v", c.apiSession.Token)
+		edge.Log().Debugf("using apiSession apiSession token %v", c.apiSession.Token)
 	}
 	servReq.Header.Set(constants.ZitiSession, c.apiSession.Token)
 	pgOffset := 0
@@ -235,7 +234,7 @@ func (c *ctrlClient) GetServices() ([]*edge.Service, error) {
 
 		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
 			if body, err := ioutil.ReadAll(resp.Body); err != nil {
-				pfxlog.Logger().Debugf("error response: %v", body)
+				edge.Log().Debugf("error response: %v", body)
 			}
 			return nil, errors.New("unauthorized")
 		}
@@ -277,6 +276,57 @@ func (c *ctrlClient) GetServices() ([]*edge.Service, error) {
 
 }
 
+func (c *ctrlClient) GetServiceTerminators(svcId string) ([]*edge.TerminatorState, error) {
+	terminatorsUrl, _ := url.Parse(fmt.Sprintf("/services/%v/terminators", svcId))
+	req, _ := http.NewRequest(http.MethodGet, c.zitiUrl.ResolveReference(terminatorsUrl).String(), nil)
+	req.Header.Set(constants.ZitiSession, c.apiSession.Token)
+	pgOffset := 0
+	pgLimit := 100
+
+	var terminators []*edge.TerminatorState
+	for {
+		q := req.URL.Query()
+		q.Set("limit", strconv.Itoa(pgLimit))
+		q.Set("offset", strconv.Itoa(pgOffset))
+		req.URL.RawQuery = q.Encode()
+		resp, err := c.clt.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			respBody, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if resp.StatusCode == http.StatusUnauthorized {
+				return nil, NotAuthorized
+			}
+			return nil, NotAccessible{
+				httpCode: resp.StatusCode,
+				msg:      string(respBody),
+			}
+		}
+
+		page := &[]*edge.TerminatorState{}
+		meta, err := edge.ApiResponseDecode(page, resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if meta == nil || meta.Pagination == nil {
+			return nil, fmt.Errorf("nil pagination in response to GET %v", terminatorsUrl)
+		}
+
+		terminators = append(terminators, *page...)
+
+		pgOffset += pgLimit
+		if pgOffset >= meta.Pagination.TotalCount {
+			break
+		}
+	}
+
+	return terminators, nil
+}
+
 func decodeSession(resp *http.Response) (*edge.Session, error) {
 	defer func() { _ = resp.Body.Close() }()
 
@@ -304,7 +354,7 @@ func decodeSession(resp *http.Response) (*edge.Session, error) {
 	session := new(edge.Session)
 	_, err := edge.ApiResponseDecode(session, resp.Body)
 	if err != nil {
-		pfxlog.Logger().WithError(err).Error("failed to decode session response")
+		edge.Log().WithError(err).Error("failed to decode session response")
 		return nil, err
 	}
 	return session, nil
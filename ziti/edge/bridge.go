@@ -0,0 +1,96 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/openziti/foundation/util/concurrenz"
+)
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Bridge copies data both ways between a and b, such as an accepted ziti conn and a conn to a local service, until
+// both directions are done. See BridgeContext
+func Bridge(a, b net.Conn) error {
+	return BridgeContext(context.Background(), a, b)
+}
+
+// BridgeContext copies data both ways between a and b until both directions are done, ctx is done or a copy fails.
+// When one side finishes sending, the other side's write half is closed if it supports CloseWrite, as TCP conns
+// do. ServiceConn doesn't, so the end of the stream can't be passed on to it, and the other direction carries on
+// until it finishes too. A reply can still come back after a local client half closes, but if the other direction
+// never finishes the bridge doesn't return, so use ctx to bound it. Both conns are always closed by the time it
+// returns. It returns nil if both directions finished cleanly and otherwise the first error, which is ctx.Err() if
+// ctx was done first
+func BridgeContext(ctx context.Context, a, b net.Conn) error {
+	var closing concurrenz.AtomicBoolean
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			closing.Set(true)
+			_ = a.Close()
+			_ = b.Close()
+		})
+	}
+	defer closeBoth()
+
+	errC := make(chan error, 2)
+	go bridgeCopy(b, a, &closing, errC)
+	go bridgeCopy(a, b, &closing, errC)
+
+	var result error
+	doneC := ctx.Done()
+	for pending := 2; pending > 0; {
+		select {
+		case err := <-errC:
+			pending--
+			if err != nil && result == nil {
+				result = err
+				closeBoth()
+			}
+		case <-doneC:
+			doneC = nil
+			if result == nil {
+				result = ctx.Err()
+			}
+			closeBoth()
+		}
+	}
+	return result
+}
+
+// bridgeCopy copies src to dst, passing on the end of the stream when src is done if dst can take it. io.Copy uses
+// src's WriteTo or dst's ReadFrom where they have them, which covers ServiceConn and TCP conns. Errors caused by the
+// bridge closing the conns itself aren't reported
+func bridgeCopy(dst, src net.Conn, closing *concurrenz.AtomicBoolean, errC chan<- error) {
+	_, err := io.Copy(dst, src)
+	if err == nil {
+		if cw, ok := dst.(closeWriter); ok {
+			err = cw.CloseWrite()
+		}
+	}
+	if closing.Get() {
+		err = nil
+	}
+	errC <- err
+}
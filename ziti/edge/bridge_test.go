@@ -0,0 +1,199 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer func() { _ = listener.Close() }()
+
+	acceptedC := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		acceptedC <- conn
+	}()
+
+	dialed, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	accepted := <-acceptedC
+	require.NotNil(t, accepted)
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+func Test_BridgeHalfClose(t *testing.T) {
+	assert := require.New(t)
+	client, a := tcpPair(t)
+	b, server := tcpPair(t)
+	defer func() { _ = client.Close() }()
+	defer func() { _ = server.Close() }()
+
+	bridgedC := make(chan error, 1)
+	go func() {
+		bridgedC <- Bridge(a, b)
+	}()
+
+	// the client finishes sending first, the server still answers over the half-closed bridge
+	_, err := client.Write([]byte("request"))
+	assert.NoError(err)
+	assert.NoError(client.CloseWrite())
+
+	request, err := ioutil.ReadAll(server)
+	assert.NoError(err)
+	assert.Equal("request", string(request))
+
+	_, err = server.Write([]byte("response"))
+	assert.NoError(err)
+	assert.NoError(server.CloseWrite())
+
+	response, err := ioutil.ReadAll(client)
+	assert.NoError(err)
+	assert.Equal("response", string(response))
+
+	select {
+	case err := <-bridgedC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("bridge didn't return once both directions finished")
+	}
+}
+
+// failingConn fails every read with err
+type failingConn struct {
+	net.Conn
+	err error
+}
+
+func (conn *failingConn) Read([]byte) (int, error) {
+	return 0, conn.err
+}
+
+func Test_BridgeErrors(t *testing.T) {
+	assert := require.New(t)
+
+	client, a := tcpPair(t)
+	defer func() { _ = client.Close() }()
+	failure := errors.New("read failed")
+	b, server := tcpPair(t)
+	defer func() { _ = server.Close() }()
+
+	// a failed copy ends the bridge and closes both sides
+	err := Bridge(a, &failingConn{Conn: b, err: failure})
+	assert.True(errors.Is(err, failure), "unexpected error %v", err)
+	_, err = ioutil.ReadAll(client)
+	assert.NoError(err)
+	_, err = ioutil.ReadAll(server)
+	assert.NoError(err)
+
+	// as does ctx being done
+	client, a = tcpPair(t)
+	defer func() { _ = client.Close() }()
+	b, server = tcpPair(t)
+	defer func() { _ = server.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, BridgeContext(ctx, a, b))
+	_, err = a.Write([]byte("data"))
+	assert.Error(err)
+}
+
+// noHalfCloseConn hides CloseWrite, as ServiceConn doesn't have it
+type noHalfCloseConn struct {
+	net.Conn
+}
+
+func Test_BridgeWithoutHalfClose(t *testing.T) {
+	assert := require.New(t)
+	peer, a := tcpPair(t)
+	b, client := tcpPair(t)
+	defer func() { _ = peer.Close() }()
+	defer func() { _ = client.Close() }()
+
+	bridgedC := make(chan error, 1)
+	go func() {
+		bridgedC <- Bridge(&noHalfCloseConn{Conn: a}, b)
+	}()
+
+	// the local client half closes after its request, which can't be passed on, but the reply still gets back
+	_, err := client.Write([]byte("request"))
+	assert.NoError(err)
+	assert.NoError(client.CloseWrite())
+
+	request := make([]byte, len("request"))
+	_, err = io.ReadFull(peer, request)
+	assert.NoError(err)
+	assert.Equal("request", string(request))
+
+	time.Sleep(50 * time.Millisecond)
+	_, err = peer.Write([]byte("response"))
+	assert.NoError(err)
+	assert.NoError(peer.Close())
+
+	response, err := ioutil.ReadAll(client)
+	assert.NoError(err)
+	assert.Equal("response", string(response))
+
+	select {
+	case err := <-bridgedC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("bridge didn't return")
+	}
+}
+
+func Test_BridgePipes(t *testing.T) {
+	assert := require.New(t)
+	client, a := net.Pipe()
+	b, server := net.Pipe()
+
+	bridgedC := make(chan error, 1)
+	go func() {
+		bridgedC <- Bridge(a, b)
+	}()
+
+	go func() {
+		_, _ = client.Write([]byte("data"))
+	}()
+
+	// neither side can be half closed, so the bridge runs until both have closed
+	data := make([]byte, len("data"))
+	_, err := io.ReadFull(server, data)
+	assert.NoError(err)
+	assert.Equal("data", string(data))
+	assert.NoError(server.Close())
+	assert.NoError(client.Close())
+
+	select {
+	case err := <-bridgedC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("bridge didn't return")
+	}
+}
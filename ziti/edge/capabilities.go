@@ -0,0 +1,90 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"strings"
+
+	"github.com/openziti/foundation/channel2"
+	"github.com/openziti/sdk-golang/ziti/sdkinfo"
+)
+
+// Capabilities are the features which need the peer to take part. They're advertised in the connect handshake, so
+// that a conn can check what the other end supports rather than assuming it runs the same SDK version
+const (
+	// CapabilityCompression means the peer can compress data, see DialOptions.Compression
+	CapabilityCompression = "compression"
+	// CapabilityProtocolSelection means the peer can select an application protocol, see DialOptions.Protocols
+	CapabilityProtocolSelection = "protocol-selection"
+	// CapabilityClientHint means the peer reads or sends ClientHintHeader
+	CapabilityClientHint = "client-hint"
+	// CapabilityAppData means the peer reads or sends AppDataHeader
+	CapabilityAppData = "app-data"
+	// CapabilityReceipts means the peer acknowledges data messages sent with ReceiptHeader, see WriteWithReceipt
+	CapabilityReceipts = "receipts"
+)
+
+var capabilities = []string{
+	CapabilityCompression,
+	CapabilityProtocolSelection,
+	CapabilityClientHint,
+	CapabilityAppData,
+	CapabilityReceipts,
+}
+
+// Version returns the version of this SDK build
+func Version() string {
+	return sdkinfo.Version
+}
+
+// Capabilities returns the capabilities this SDK build supports
+func Capabilities() []string {
+	result := make([]string, len(capabilities))
+	copy(result, capabilities)
+	return result
+}
+
+// PutCapabilitiesHeaders advertises this build's version and capabilities on a connect handshake message
+func PutCapabilitiesHeaders(msg *channel2.Message) {
+	msg.Headers[SdkVersionHeader] = []byte(Version())
+	msg.Headers[CapabilitiesHeader] = []byte(strings.Join(capabilities, "\n"))
+}
+
+// PeerVersion returns the SDK version the other end of conn advertised in the connect handshake. It's empty if
+// the peer didn't advertise one, which is the case for SDK versions from before capabilities were advertised
+func PeerVersion(conn ServiceConn) string {
+	val, _ := conn.GetConnectHeader(SdkVersionHeader)
+	return string(val)
+}
+
+// PeerCapabilities returns the capabilities the other end of conn advertised in the connect handshake
+func PeerCapabilities(conn ServiceConn) []string {
+	if val, found := conn.GetConnectHeader(CapabilitiesHeader); found && len(val) > 0 {
+		return strings.Split(string(val), "\n")
+	}
+	return nil
+}
+
+// PeerSupports returns true if the other end of conn advertised the given capability
+func PeerSupports(conn ServiceConn, capability string) bool {
+	for _, c := range PeerCapabilities(conn) {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
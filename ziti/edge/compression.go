@@ -0,0 +1,117 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/snappy"
+	"github.com/openziti/foundation/channel2"
+	"github.com/pkg/errors"
+)
+
+type Compression byte
+
+const (
+	CompressionNone   Compression = 0
+	CompressionGzip   Compression = 1
+	CompressionSnappy Compression = 2
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionSnappy:
+		return "snappy"
+	}
+	return "unknown"
+}
+
+func (c Compression) Compress(data []byte) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		buf := &bytes.Buffer{}
+		writer := gzip.NewWriter(buf)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionSnappy:
+		return snappy.Encode(nil, data), nil
+	}
+	return nil, errors.Errorf("unsupported compression %v", byte(c))
+}
+
+// Decompress inflates data, failing with ErrMessageTooLarge rather than returning more than max bytes, so a small
+// payload can't expand past the conn's MaxMessageSize
+func (c Compression) Decompress(data []byte, max int) ([]byte, error) {
+	switch c {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = reader.Close() }()
+		result, err := ioutil.ReadAll(io.LimitReader(reader, int64(max)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(result) > max {
+			return nil, ErrMessageTooLarge
+		}
+		return result, nil
+	case CompressionSnappy:
+		size, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if size > max {
+			return nil, ErrMessageTooLarge
+		}
+		return snappy.Decode(nil, data)
+	}
+	return nil, errors.Errorf("unsupported compression %v", byte(c))
+}
+
+// GetCompressionHeader returns the compression requested or agreed to in a connect, dial or reply message
+func GetCompressionHeader(msg *channel2.Message) Compression {
+	if val, found := msg.Headers[CompressionHeader]; found && len(val) == 1 {
+		return Compression(val[0])
+	}
+	return CompressionNone
+}
+
+// GetCompressedHeader returns the compression used on an individual data message payload
+func GetCompressedHeader(msg *channel2.Message) Compression {
+	if val, found := msg.Headers[CompressedHeader]; found && len(val) == 1 {
+		return Compression(val[0])
+	}
+	return CompressionNone
+}
@@ -0,0 +1,107 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var compressions = []Compression{CompressionNone, CompressionGzip, CompressionSnappy}
+
+func testPayload(size int) []byte {
+	// half repetitive text, half random bytes, to roughly approximate real traffic
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog "), size/88+1)[:size/2]
+	random := make([]byte, size-len(data))
+	rand.New(rand.NewSource(1)).Read(random)
+	return append(data, random...)
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	assert := require.New(t)
+	for _, compression := range compressions {
+		for _, size := range []int{0, 1, 100, 64 * 1024} {
+			data := testPayload(size)
+			compressed, err := compression.Compress(data)
+			assert.NoError(err)
+			result, err := compression.Decompress(compressed, DefaultMaxMessageSize)
+			assert.NoError(err)
+			assert.Equal(len(data), len(result), "%v: %v", compression, size)
+			assert.True(bytes.Equal(data, result), "%v: %v", compression, size)
+		}
+	}
+
+	_, err := Compression(99).Compress([]byte("hello"))
+	assert.Error(err)
+}
+
+func TestDecompressMaxSize(t *testing.T) {
+	assert := require.New(t)
+
+	// zeros compress to a tiny fraction of their size, as a decompression bomb would
+	data := make([]byte, 1024*1024)
+	for _, compression := range []Compression{CompressionGzip, CompressionSnappy} {
+		compressed, err := compression.Compress(data)
+		assert.NoError(err)
+		assert.True(len(compressed) < 64*1024, "%v: %v", compression, len(compressed))
+
+		_, err = compression.Decompress(compressed, 64*1024)
+		assert.Equal(ErrMessageTooLarge, err, "%v", compression)
+
+		result, err := compression.Decompress(compressed, len(data))
+		assert.NoError(err, "%v", compression)
+		assert.Equal(len(data), len(result), "%v", compression)
+	}
+}
+
+func TestCompressionHeaders(t *testing.T) {
+	assert := require.New(t)
+	msg := NewDataMsg(1, 1, nil)
+	assert.Equal(CompressionNone, GetCompressedHeader(msg))
+	msg.Headers[CompressedHeader] = []byte{byte(CompressionSnappy)}
+	assert.Equal(CompressionSnappy, GetCompressedHeader(msg))
+
+	connect := NewConnectMsg(1, "token", nil)
+	assert.Equal(CompressionNone, GetCompressionHeader(connect))
+	connect.Headers[CompressionHeader] = []byte{byte(CompressionGzip)}
+	assert.Equal(CompressionGzip, GetCompressionHeader(connect))
+}
+
+// BenchmarkCompression reports compressed size as a percentage of the input alongside the CPU cost
+func BenchmarkCompression(b *testing.B) {
+	data := testPayload(64 * 1024)
+	for _, compression := range compressions {
+		b.Run(compression.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var compressedLen int
+			for i := 0; i < b.N; i++ {
+				compressed, err := compression.Compress(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err = compression.Decompress(compressed, DefaultMaxMessageSize); err != nil {
+					b.Fatal(err)
+				}
+				compressedLen = len(compressed)
+			}
+			b.ReportMetric(float64(compressedLen)*100/float64(len(data)), "%size")
+		})
+	}
+}
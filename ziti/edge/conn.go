@@ -17,18 +17,21 @@
 package edge
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
-	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/foundation/channel2"
 	"github.com/openziti/foundation/transport"
 	"github.com/openziti/foundation/transport/tls"
+	"github.com/openziti/foundation/util/concurrenz"
 	"github.com/openziti/foundation/util/sequence"
 	"github.com/pkg/errors"
 )
@@ -51,62 +54,395 @@ type RouterConn interface {
 	Key() string
 	NewConn(service string) Conn
 	GetRouterName() string
+	// Stats returns counters aggregated across the conns on this router connection
+	Stats() RouterStats
+	// TransportAddress returns the remote address the router channel is connected to, or an empty string if
+	// it isn't known
+	TransportAddress() string
+	// ConnectBatch dials count conns to the service, running up to DialOptions.MaxConcurrentDials at once. It
+	// returns the conns which connected and an error for each dial which didn't. If ctx is done first, dials not
+	// yet complete fail with the context error and any conns they later make are closed. A count of zero or less
+	// dials nothing
+	ConnectBatch(ctx context.Context, session *Session, serviceName string, count int, options *DialOptions) ([]ServiceConn, []error)
+	// CloseGracefully retires the router connection without cutting off active conns. New conns are refused with
+	// ErrRouterConnDraining, listeners on it are closed, and conns implementing Drainable are told to finish up.
+	// The channel is closed once every conn has closed, or when ctx is done, in which case ctx.Err() is returned
+	CloseGracefully(ctx context.Context) error
+	// SetPinned exempts the router connection from being closed by the idle reaper set up with
+	// impl.SetRouterConnIdleTimeout. The reaper's idea of a conn is Stats().ActiveConns, which counts dialed,
+	// accepted and listening conns alike
+	SetPinned(pinned bool)
+	// SetMemoryBudget caps the received data buffered across all the conns on the router connection, on top of
+	// each conn's RecvBufferSize. Once it's reached, reading from the router pauses until conns are read or closed,
+	// so the router holds back further data. Usage can go over the budget by the messages already read. As reads
+	// pause for every conn, a conn waiting for data can be held up until the others are read. Zero or less
+	// removes the cap, which is the default
+	SetMemoryBudget(bytes int)
+}
+
+// Drainable is implemented by conns which can be told that their router connection is closing gracefully
+type Drainable interface {
+	// OnDrain registers a handler which is called once, asynchronously, when RouterConn.CloseGracefully is called
+	// on the conn's router connection. The conn should be closed once it's finished with. Handlers registered
+	// after the drain started are called immediately
+	OnDrain(handler func())
 }
 
 type Identifiable interface {
+	// Id returns the conn id used on the wire, which is only unique within a single router channel
 	Id() uint32
+	// GlobalId returns an id which is unique within the process, such as "router-3/42", for use in logging
+	GlobalId() string
+}
+
+// GlobalConnId combines a router name and a conn id into an id which is unique within the process
+func GlobalConnId(routerName string, id uint32) string {
+	if routerName == "" {
+		routerName = "unknown"
+	}
+	return fmt.Sprintf("%v/%v", routerName, id)
 }
 
 type Listener interface {
 	net.Listener
+	// TryAccept returns a connection and true if one is ready, or false if none is queued, without blocking
+	TryAccept() (net.Conn, bool, error)
+	// AcceptWithTimeout waits up to the given duration for a connection. On expiry it returns ErrAcceptTimeout,
+	// which is a net.Error with Timeout() returning true
+	AcceptWithTimeout(timeout time.Duration) (net.Conn, error)
+	// AcceptChannel returns a channel delivering accepted conns, for select based event loops. The first call
+	// starts accepting in the background, so it shouldn't be mixed with calls to Accept. When the listener closes,
+	// a result carrying the closing error is sent, unless a conn is still waiting to be received, and the channel
+	// is closed
+	AcceptChannel() <-chan AcceptResult
 	IsClosed() bool
 	UpdateCost(cost uint16) error
+	// UpdateCostPercent sets the cost as a fraction (0.0 - 1.0) of the maximum cost
+	UpdateCostPercent(pct float64) error
 	UpdatePrecedence(precedence Precedence) error
 	UpdateCostAndPrecedence(cost uint16, precedence Precedence) error
+	// UpdateCostAndPrecedenceContext is UpdateCostAndPrecedence which gives up once ctx is done, rather than waiting
+	// out the send timeout when the router isn't taking messages. It returns ctx.Err() if it gave up
+	UpdateCostAndPrecedenceContext(ctx context.Context, cost uint16, precedence Precedence) error
+	// BindToken returns the session token the listener is bound with, redacted unless ShowFullTokens is set
+	BindToken() string
+	// GracefulClose raises the cost to the maximum so new dials go elsewhere, waits for dials to stop arriving
+	// for up to ListenOptions.DrainGracePeriod, then closes the listener. If ctx is done first, the listener is
+	// closed straight away and ctx.Err() is returned
+	GracefulClose(ctx context.Context) error
+	// BoundIdentity returns the terminator identity the router reported in the bind reply. Not all routers report
+	// it, so it's empty if the router didn't, even when an identity was requested and bound
+	BoundIdentity() string
+	// TerminatorInstanceId returns the ListenOptions.TerminatorInstanceId the listener bound with
+	TerminatorInstanceId() string
+	// CloseNoUnbind closes the listener without unbinding from the router, for shutdown paths where the router
+	// may be unreachable and Close could block. The terminator stays on the router until it notices the listener's
+	// conn is gone or the session expires, so dials may fail in the meantime
+	CloseNoUnbind() error
+	// UpdateIdentitySecret sends a bind update with a new ListenOptions.IdentitySecret, without unbinding. Accepted
+	// conns are untouched and the terminator stays in place throughout, so dials keep arriving while the router
+	// switches secrets. Like other bind updates it isn't acknowledged by the router. Later binds, such as rebinds
+	// for a refreshed session or binds on new routers, use the new secret
+	UpdateIdentitySecret(secret string) error
+}
+
+// AcceptResult is an accepted conn, or the error which ended accepting, delivered by Listener.AcceptChannel
+type AcceptResult struct {
+	Conn net.Conn
+	Err  error
+}
+
+// ShowFullTokens controls whether session tokens are shown in full by BindToken and in state dumps. It's off by
+// default, so tokens are cut down to a prefix which is enough to match against router logs
+var ShowFullTokens concurrenz.AtomicBoolean
+
+const redactedTokenPrefixLen = 8
+
+// RedactToken returns the prefix of a session token, or the whole token if ShowFullTokens is set
+func RedactToken(token string) string {
+	if ShowFullTokens.Get() || token == "" {
+		return token
+	}
+	if len(token) <= redactedTokenPrefixLen {
+		return "..."
+	}
+	return token[:redactedTokenPrefixLen] + "..."
+}
+
+// CostFromPercent maps a fraction from 0.0 to 1.0 onto the cost range. Values above 1.0 are clamped to the maximum
+// cost and negative values are an error
+func CostFromPercent(pct float64) (uint16, error) {
+	if pct < 0 || math.IsNaN(pct) {
+		return 0, errors.Errorf("invalid cost percentage %v, must be between 0.0 and 1.0", pct)
+	}
+	if pct > 1 {
+		pct = 1
+	}
+	return uint16(math.Round(pct * math.MaxUint16)), nil
 }
 
 type SessionListener interface {
 	Listener
 	GetCurrentSession() *Session
 	SetConnectionChangeHandler(func(conn []Listener))
+	// RefreshSession rebinds on each router using the given session, such as one replacing a session which is
+	// about to expire. The new binds are made before the old ones are removed, so binds aren't dropped
+	RefreshSession(session *Session) error
+}
+
+// MigratableConn is implemented by conns dialed with DialOptions.Migratable
+type MigratableConn interface {
+	ServiceConn
+	// OnMigrate registers a handler which is called, asynchronously, each time the conn moves to a new router
+	OnMigrate(handler func(from, to RouterConn))
+	// Migrations returns the number of times the conn has moved to a new router
+	Migrations() int
 }
 
 type ServiceConn interface {
 	net.Conn
+	io.WriterTo
 	IsClosed() bool
+	Stats() ConnStats
+	SetWriteTimeout(timeout time.Duration)
+	// SetReadTimeout bounds each Read to the given duration, starting afresh with every call. A Read which times
+	// out returns ErrReadTimeout and leaves the conn open. If a read deadline is also set, whichever comes first
+	// applies. Zero disables the timeout
+	SetReadTimeout(timeout time.Duration)
+	// WriteNoSync writes without waiting for the data to reach the wire. UNSAFE: data is retained after the
+	// call returns, so the caller must not modify it afterwards
+	WriteNoSync(data []byte) (int, error)
+	// IsInbound returns true if the conn was accepted by a listener, false if it was dialed
+	IsInbound() bool
+	// ServiceName returns the name of the service the conn was dialed to or accepted for
+	ServiceName() string
+	// OnClose registers a handler which is called once, asynchronously, when the conn is closed. The cause is nil
+	// for a local close. Handlers registered after the conn has closed are called immediately
+	OnClose(handler func(cause error))
+	// Router returns the router connection carrying this conn
+	Router() RouterConn
+	// SelectedProtocol returns the application protocol negotiated at connect, or an empty string if none was
+	SelectedProtocol() string
+	// WriteWithReceipt writes data as a single message, as WriteMessage does, and returns a Receipt which resolves
+	// once the peer has read the message. If the peer doesn't advertise CapabilityReceipts the data is still
+	// written, but the receipt's Wait returns ErrReceiptsUnsupported
+	WriteWithReceipt(data []byte) (Receipt, error)
+	// SetCorrelationId sets an id sent on every message the conn writes from now on, and GetCorrelationId returns
+	// the one the peer last sent, see MsgChannel.SetCorrelationId
+	SetCorrelationId(id string)
+	GetCorrelationId() string
+	// TerminatorInstanceId returns the instance id of the terminator the conn reached: the listener's
+	// ListenOptions.TerminatorInstanceId for accepted conns, and the one the host reported for dialed conns. It's
+	// empty if the host bound without one
+	TerminatorInstanceId() string
+	// GetConnectHeader returns a header from the connect handshake: the connect reply for dialed conns, or the
+	// dial request for accepted conns. Keys from 1000 to 1999 are reserved for the SDK, see messages.go
+	GetConnectHeader(key int32) ([]byte, bool)
+	// SetSendWindow changes the data async writes may have queued ahead of the wire, as set initially by
+	// MaxUnackedBytes. It fails if async writes aren't enabled. See CheckWindowSize for the allowed range
+	SetSendWindow(size int) error
+	// SetRecvWindow changes the received data which may be buffered until it's read, as set initially by
+	// RecvBufferSize. It should be at least the largest message the peer writes, as a message which doesn't fit
+	// closes the conn. See CheckWindowSize for the allowed range
+	SetRecvWindow(size int) error
+	// CloseContext closes the conn like Close, but gives up waiting for the close to reach the router once ctx is
+	// done, so that closing many conns at shutdown isn't held up by a slow or dead router
+	CloseContext(ctx context.Context) error
+	// Abort closes the conn straight away, without sending coalesced writes or waiting out the Linger for async
+	// writes. Whatever hasn't reached the wire is dropped
+	Abort() error
+	// QualityStats returns estimates of the conn's path quality, such as a smoothed RTT, for applications which
+	// adapt to degraded paths. See QualityStats for how they're made and what they measure
+	QualityStats() QualityStats
+	// WriteMessage sends msg as exactly one data message, which the peer's ReadMessage returns whole. Messages
+	// larger than the conn's MaxMessageSize once on the wire are rejected with ErrMessageTooLarge
+	WriteMessage(msg []byte) error
+	// ReadMessage returns exactly one message as sent by the peer, never coalesced with or split from another.
+	// A conn should be used either with Read and Write or with ReadMessage and WriteMessage; mixing the two for
+	// reads or for writes on one conn is unsupported
+	ReadMessage() ([]byte, error)
+}
+
+// ErrReadTimeout is returned by reads which pass their read deadline or read timeout. It's a net.Error with
+// Timeout() returning true, and the conn can still be read from afterwards
+var ErrReadTimeout net.Error = readTimeoutError{}
+
+type readTimeoutError struct{}
+
+func (readTimeoutError) Error() string   { return "timed out waiting for data" }
+func (readTimeoutError) Timeout() bool   { return true }
+func (readTimeoutError) Temporary() bool { return true }
+
+// ErrAcceptTimeout is returned by Listener.AcceptWithTimeout when no connection arrives in time
+var ErrAcceptTimeout net.Error = acceptTimeoutError{}
+
+type acceptTimeoutError struct{}
+
+func (acceptTimeoutError) Error() string   { return "timed out waiting for connection" }
+func (acceptTimeoutError) Timeout() bool   { return true }
+func (acceptTimeoutError) Temporary() bool { return true }
+
+var ErrClosedByRemote = errors.New("connection closed by remote")
+var ErrRouterConnClosed = errors.New("router connection closed")
+var ErrRouterConnShutdown = errors.New("router connection shut down")
+var ErrRouterConnDraining = errors.New("router connection draining")
+var ErrRecvBufferExceeded = errors.New("receive buffer size exceeded")
+var ErrMessageTooLarge = errors.New("message exceeds maximum message size")
+var ErrTooManyHeaders = errors.New("message exceeds maximum header count")
+
+// ErrOutOfOrder is the read error of a conn using StrictOrdering which received a message with a sequence number
+// other than the next one expected, either because one was skipped or because it was a duplicate
+var ErrOutOfOrder = errors.New("message received out of order")
+
+// ErrMigrationFailed is the close cause of a migratable conn which couldn't be redialed after its router failed
+var ErrMigrationFailed = errors.New("unable to migrate conn to a new router")
+
+// ErrConnClosed is returned by writes on a conn which has been closed, including writes which were blocked
+// when it closed
+var ErrConnClosed = errors.New("conn closed")
+
+// DefaultRecvBufferSize is the maximum number of bytes buffered for a conn waiting to be read
+const DefaultRecvBufferSize = 4 * 1024 * 1024
+
+// WriteCoalesceFrameSize is how much data writes coalesced under a WriteCoalesceWindow gather before they're sent
+// without waiting for the window to pass
+const WriteCoalesceFrameSize = 16 * 1024
+
+const (
+	// MinWindowSize is the smallest send or receive window which may be set on a conn
+	MinWindowSize = 64 * 1024
+	// MaxWindowSize is the largest send or receive window which may be set on a conn
+	MaxWindowSize = 1024 * 1024 * 1024
+)
+
+// CheckWindowSize returns an error if size isn't between MinWindowSize and MaxWindowSize. Windows take effect for
+// data sent or received after they're set and are local to this side of the conn, so the peer isn't told
+func CheckWindowSize(size int) error {
+	if size < MinWindowSize || size > MaxWindowSize {
+		return errors.Errorf("invalid window size %v, must be between %v and %v", size, MinWindowSize, MaxWindowSize)
+	}
+	return nil
+}
+
+// DefaultDrainGracePeriod is the longest Listener.GracefulClose waits for dials to stop by default
+const DefaultDrainGracePeriod = 10 * time.Second
+
+// DefaultMaxConcurrentDials is how many dials RouterConn.ConnectBatch runs at once by default
+const DefaultMaxConcurrentDials = 8
+
+// DefaultMaxMessageSize is the largest data message a conn accepts from its peer
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+
+// DefaultMaxHeaders is the most headers a conn accepts on a message from its peer. The SDK and routers use a dozen
+// or so, which leaves plenty for application headers
+const DefaultMaxHeaders = 256
+
+type ConnStats struct {
+	BytesRead    uint64 `json:"bytesRead"`
+	BytesWritten uint64 `json:"bytesWritten"`
+	MsgsRead     uint64 `json:"msgsRead"`
+	MsgsWritten  uint64 `json:"msgsWritten"`
+	UnackedBytes uint64 `json:"unackedBytes"`
+	// WireBytesRead and WireBytesWritten count data message bodies as they were on the wire, after compression and
+	// encryption. Each Write goes out as exactly one data message, unless writes are coalesced, so MsgsWritten is
+	// also the frame count
+	WireBytesRead    uint64 `json:"wireBytesRead"`
+	WireBytesWritten uint64 `json:"wireBytesWritten"`
+	// LargestMsgRead and LargestMsgWritten are the largest data message bodies seen on the wire, to compare with
+	// the MaxMessageSize each side accepts
+	LargestMsgRead    uint64 `json:"largestMsgRead"`
+	LargestMsgWritten uint64 `json:"largestMsgWritten"`
+	// ReorderedMsgs counts messages which arrived after a message with a later sequence number, including
+	// duplicates. Without StrictOrdering reordered messages are put back in order before they're read
+	ReorderedMsgs uint64 `json:"reorderedMsgs"`
+}
+
+type RouterStats struct {
+	ActiveConns    uint64 `json:"activeConns"`
+	TotalConns     uint64 `json:"totalConns"`
+	BytesRead      uint64 `json:"bytesRead"`
+	BytesWritten   uint64 `json:"bytesWritten"`
+	MsgsRead       uint64 `json:"msgsRead"`
+	MsgsWritten    uint64 `json:"msgsWritten"`
+	DispatchErrors uint64 `json:"dispatchErrors"`
+	// ConnIdCollisions counts conn ids which were already in use when registering a new conn
+	ConnIdCollisions uint64 `json:"connIdCollisions"`
+	// BufferedBytes is the received data buffered across the conns, which SetMemoryBudget caps, and ReadPauses
+	// counts the times reads from the router paused because it reached the budget
+	BufferedBytes uint64 `json:"bufferedBytes"`
+	ReadPauses    uint64 `json:"readPauses"`
+}
+
+// MultiListenerMetrics is a snapshot of a MultiListener's counters
+type MultiListenerMetrics struct {
+	Children uint64 `json:"children"`
+	Accepts  uint64 `json:"accepts"`
+	// Rejects counts dials failed because the child listener's AcceptRateLimit didn't allow them
+	Rejects uint64 `json:"rejects"`
+	// QueuedAccepts is the number of conns which have arrived and are waiting to be accepted
+	QueuedAccepts uint64            `json:"queuedAccepts"`
+	RouterAccepts map[string]uint64 `json:"routerAccepts"`
 }
 
 type Conn interface {
 	net.Conn
 	Identifiable
 	NewConn(service string) Conn
+	// Connect dials with the service's defaults, see RegisterServiceDefaults
 	Connect(session *Session) (ServiceConn, error)
+	// ConnectWithOptions and Listen use the service's defaults, as Connect does, if options is nil
+	ConnectWithOptions(session *Session, options *DialOptions) (ServiceConn, error)
 	Listen(session *Session, serviceName string, options *ListenOptions) (Listener, error)
 	IsClosed() bool
 }
 
+const DefaultStateTimeout = 5 * time.Second
+
+var ErrStateSendTimeout = errors.New("timed out waiting for state message send to complete")
+
 type MsgChannel struct {
 	channel2.Channel
-	id            uint32
-	msgIdSeq      *sequence.Sequence
-	writeDeadline time.Time
-	trace         bool
+	id                uint32
+	msgIdSeq          *sequence.Sequence
+	writeDeadline     time.Time
+	writeTimeout      time.Duration
+	stateTimeout      time.Duration
+	trace             bool
+	window            *writeWindow
+	closedC           chan struct{}
+	writesClosed      int32
+	interceptors      *msgInterceptors
+	writeHeaders      atomic.Value
+	quality           *qualityEstimator
+	correlationId     atomic.Value
+	peerCorrelationId atomic.Value
+	receipts          *receiptTracker
 }
 
 func NewEdgeMsgChannel(ch channel2.Channel, connId uint32) *MsgChannel {
 	traceEnabled := strings.EqualFold("true", os.Getenv("ZITI_TRACE_ENABLED"))
 	if traceEnabled {
-		pfxlog.Logger().Info("Ziti message tracing ENABLED")
+		Log().Info("Ziti message tracing ENABLED")
 	}
 
 	return &MsgChannel{
-		Channel:  ch,
-		id:       connId,
-		msgIdSeq: sequence.NewSequence(),
-		trace:    traceEnabled,
+		Channel:      ch,
+		id:           connId,
+		msgIdSeq:     sequence.NewSequence(),
+		stateTimeout: DefaultStateTimeout,
+		trace:        traceEnabled,
+		closedC:      make(chan struct{}),
+		interceptors: &msgInterceptors{},
+		quality:      newQualityEstimator(),
+		receipts:     &receiptTracker{},
 	}
 }
 
+// QualityStats returns estimates of the conn's path quality, see QualityStats for how they're made
+func (ec *MsgChannel) QualityStats() QualityStats {
+	return ec.quality.get()
+}
+
 func (ec *MsgChannel) Id() uint32 {
 	return ec.id
 }
@@ -116,41 +452,328 @@ func (ec *MsgChannel) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// SetWriteTimeout sets a rolling timeout which is applied afresh to each write. If a write deadline is also set,
+// whichever expires first applies. A zero timeout disables it
+func (ec *MsgChannel) SetWriteTimeout(timeout time.Duration) {
+	ec.writeTimeout = timeout
+}
+
+// SetAsyncWrites switches the channel to async writes, where Write returns once the data is queued rather than once
+// it's on the wire. At most maxUnackedBytes may be queued, after which writes block. Zero uses DefaultMaxUnackedBytes
+func (ec *MsgChannel) SetAsyncWrites(maxUnackedBytes int) {
+	ec.window = newWriteWindow(maxUnackedBytes)
+}
+
+func (ec *MsgChannel) SetSendWindow(size int) error {
+	if err := CheckWindowSize(size); err != nil {
+		return err
+	}
+	if ec.window == nil {
+		return errors.New("send window only applies to async writes, which aren't enabled")
+	}
+	ec.window.setMax(size)
+	return nil
+}
+
+// SendQueueDepthReporter is implemented by channels which can report how many messages are queued to be sent
+type SendQueueDepthReporter interface {
+	SendQueueDepth() int
+}
+
+// SendQueueDepth returns the number of messages queued in the underlying channel waiting for the transport, or -1
+// if the channel doesn't report it, see SendQueueDepthReporter. It reflects queuing at the transport, shared by
+// every conn on the channel, and not data buffered by this conn, such as async or coalesced writes, which
+// GetUnackedBytes covers. A queue which stays deep points at the network rather than the application
+func (ec *MsgChannel) SendQueueDepth() int {
+	if reporter, ok := ec.Channel.(SendQueueDepthReporter); ok {
+		return reporter.SendQueueDepth()
+	}
+	return -1
+}
+
+// GetUnackedBytes returns the number of bytes written asynchronously which aren't yet on the wire
+func (ec *MsgChannel) GetUnackedBytes() int {
+	if ec.window == nil {
+		return 0
+	}
+	return ec.window.getCurrent()
+}
+
+// WaitForWrites blocks until every async write is on the wire, or ctx is done. It returns straight away if async
+// writes aren't enabled
+func (ec *MsgChannel) WaitForWrites(ctx context.Context) error {
+	if ec.window == nil {
+		return nil
+	}
+	return ec.window.waitEmpty(ctx)
+}
+
+// CancelWrites fails writes waiting for their data to reach the wire with ErrConnClosed, along with any later
+// writes. It's called when the conn closes. Data from a cancelled write may still be sent
+func (ec *MsgChannel) CancelWrites() {
+	if atomic.CompareAndSwapInt32(&ec.writesClosed, 0, 1) {
+		close(ec.closedC)
+	}
+}
+
+func (ec *MsgChannel) writesCancelled() bool {
+	return atomic.LoadInt32(&ec.writesClosed) == 1
+}
+
+func (ec *MsgChannel) getWriteDeadline() time.Time {
+	deadline := ec.writeDeadline
+	if ec.writeTimeout > 0 {
+		timeoutDeadline := time.Now().Add(ec.writeTimeout)
+		if deadline.IsZero() || timeoutDeadline.Before(deadline) {
+			deadline = timeoutDeadline
+		}
+	}
+	return deadline
+}
+
+// SetStateTimeout controls how long SendState waits for a state message to reach the wire
+func (ec *MsgChannel) SetStateTimeout(timeout time.Duration) {
+	ec.stateTimeout = timeout
+}
+
+// SetDefaultWriteHeaders sets headers which are added to every data message written from now on, such as a stream
+// epoch or shard id. Headers passed to WriteTracedWithHeaders for a message take precedence. Keys reserved for channel2 or the
+// SDK are rejected, see IsReservedHeader. Passing an empty map stops adding headers
+func (ec *MsgChannel) SetDefaultWriteHeaders(headers map[int32][]byte) error {
+	copied := make(map[int32][]byte, len(headers))
+	for k, v := range headers {
+		if IsReservedHeader(k) {
+			return errors.Errorf("header key %v is reserved", k)
+		}
+		copied[k] = v
+	}
+	ec.writeHeaders.Store(copied)
+	return nil
+}
+
+// SetCorrelationId sets an id, such as an application request id, which is sent in the CorrelationIdHeader of
+// every message written from now on, and is included in the log fields of those messages, so that they can be tied
+// to the application's own logs on both ends. An empty id stops sending it
+func (ec *MsgChannel) SetCorrelationId(id string) {
+	ec.correlationId.Store(id)
+}
+
+// GetCorrelationId returns the correlation id on the last message received from the peer which carried one, or an
+// empty string if none has
+func (ec *MsgChannel) GetCorrelationId() string {
+	id, _ := ec.peerCorrelationId.Load().(string)
+	return id
+}
+
+func (ec *MsgChannel) putCorrelationId(msg *channel2.Message) {
+	if id, _ := ec.correlationId.Load().(string); id != "" {
+		msg.Headers[CorrelationIdHeader] = []byte(id)
+	}
+}
+
+// newDataMsg builds a data message, without a sequence number, see assignSeq. If receipt is set, the peer is asked
+// to acknowledge it
+func (ec *MsgChannel) newDataMsg(data []byte, msgUUID []byte, hdrs map[int32][]byte, receipt *receipt) *channel2.Message {
+	msg := channel2.NewMessage(ContentTypeData, data)
+	msg.PutUint32Header(ConnIdHeader, ec.id)
+	ec.putCorrelationId(msg)
+	if defaults, ok := ec.writeHeaders.Load().(map[int32][]byte); ok {
+		for k, v := range defaults {
+			msg.Headers[k] = v
+		}
+	}
+	if msgUUID != nil {
+		msg.Headers[UUIDHeader] = msgUUID
+	}
+	for k, v := range hdrs {
+		msg.Headers[k] = v
+	}
+	if receipt != nil {
+		msg.Headers[ReceiptHeader] = []byte{1}
+	}
+	return msg
+}
+
+// assignSeq gives msg the next sequence number, and starts tracking its receipt if it has one. It's called once
+// the outbound interceptors have passed the message, since the peer waits for every number in turn, and one taken
+// by an aborted message would hold back everything after it
+func (ec *MsgChannel) assignSeq(msg *channel2.Message, receipt *receipt) {
+	seq := ec.msgIdSeq.Next()
+	msg.PutUint32Header(SeqHeader, seq)
+	if receipt != nil {
+		receipt.seq = seq
+		ec.receipts.add(receipt)
+	}
+}
+
 func (ec *MsgChannel) Write(data []byte) (n int, err error) {
 	return ec.WriteTraced(data, nil)
 }
 
 func (ec *MsgChannel) WriteTraced(data []byte, msgUUID []byte) (int, error) {
-	msg := NewDataMsg(ec.id, ec.msgIdSeq.Next(), data)
-	if msgUUID != nil {
-		msg.Headers[UUIDHeader] = msgUUID
+	return ec.writeTraced(data, msgUUID, nil, nil)
+}
+
+// WriteTracedWithHeaders is WriteTraced, with extra headers added to the data message
+func (ec *MsgChannel) WriteTracedWithHeaders(data []byte, msgUUID []byte, hdrs map[int32][]byte) (int, error) {
+	return ec.writeTraced(data, msgUUID, hdrs, nil)
+}
+
+// WriteTracedWithReceipt is WriteTracedWithHeaders, but also asks the peer to acknowledge the message once it's read it. The
+// returned Receipt resolves when HandleAck is passed the ack. Only peers advertising CapabilityReceipts send acks
+func (ec *MsgChannel) WriteTracedWithReceipt(data []byte, msgUUID []byte, hdrs map[int32][]byte) (Receipt, error) {
+	receipt := newReceipt(ec.closedC)
+	if _, err := ec.writeTraced(data, msgUUID, hdrs, receipt); err != nil {
+		ec.receipts.remove(receipt.seq)
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// HandleAck resolves the receipt of the message with sequence number seq, when the peer acknowledges it
+func (ec *MsgChannel) HandleAck(seq uint32) {
+	ec.receipts.ack(seq)
+}
+
+func (ec *MsgChannel) writeTraced(data []byte, msgUUID []byte, hdrs map[int32][]byte, receipt *receipt) (int, error) {
+	if ec.writesCancelled() {
+		return 0, ErrConnClosed
 	}
+
+	if ec.window != nil {
+		return ec.writeAsync(data, msgUUID, hdrs, receipt)
+	}
+
+	msg := ec.newDataMsg(data, msgUUID, hdrs, receipt)
+	if err := ec.interceptOutbound(msg); err != nil {
+		Log().WithFields(GetLoggerFields(msg)).WithError(err).Debug("write aborted by outbound interceptor")
+		return 0, err
+	}
+	ec.assignSeq(msg, receipt)
 	ec.TraceMsg("write", msg)
-	pfxlog.Logger().WithFields(GetLoggerFields(msg)).Debugf("writing %v bytes", len(data))
+	Log().WithFields(GetLoggerFields(msg)).Debugf("writing %v bytes", len(data))
 
 	// NOTE: We need to wait for the buffer to be on the wire before returning. The Writer contract
 	//       states that buffers are not allowed be retained, and if we have it queued asynchronously
 	//       it is retained and we can cause data corruption
 	var err error
-	if ec.writeDeadline.IsZero() {
+	start := time.Now()
+	if deadline := ec.getWriteDeadline(); deadline.IsZero() {
 		var errC chan error
 		errC, err = ec.Channel.SendAndSync(msg)
 		if err == nil {
-			err = <-errC
+			select {
+			case err = <-errC:
+			case <-ec.closedC:
+				err = ErrConnClosed
+			}
 		}
 	} else {
-		err = ec.Channel.SendWithTimeout(msg, time.Until(ec.writeDeadline))
+		err = ec.sendWithTimeout(msg, time.Until(deadline))
+	}
+	ec.quality.record(time.Since(start), err)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data), nil
+}
+
+// sendWithTimeout sends msg with the channel's timeout, returning early if writes are cancelled
+func (ec *MsgChannel) sendWithTimeout(msg *channel2.Message, timeout time.Duration) error {
+	errC := make(chan error, 1)
+	go func() {
+		errC <- ec.Channel.SendWithTimeout(msg, timeout)
+	}()
+
+	select {
+	case err := <-errC:
+		return err
+	case <-ec.closedC:
+		return ErrConnClosed
 	}
+}
+
+// WriteNoSync queues data to be sent without waiting for it to reach the wire and without copying it.
+// UNSAFE: the caller must not modify data after calling WriteNoSync. Send errors are only logged
+func (ec *MsgChannel) WriteNoSync(data []byte) (int, error) {
+	return ec.WriteNoSyncTraced(data, nil, nil)
+}
+
+func (ec *MsgChannel) WriteNoSyncTraced(data []byte, msgUUID []byte, hdrs map[int32][]byte) (int, error) {
+	msg := ec.newDataMsg(data, msgUUID, hdrs, nil)
+	if err := ec.interceptOutbound(msg); err != nil {
+		Log().WithFields(GetLoggerFields(msg)).WithError(err).Debug("write aborted by outbound interceptor")
+		return 0, err
+	}
+	ec.assignSeq(msg, nil)
+	ec.TraceMsg("writeNoSync", msg)
+	Log().WithFields(GetLoggerFields(msg)).Debugf("writing %v bytes without sync", len(data))
+
+	if err := ec.Channel.Send(msg); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
 
+func (ec *MsgChannel) writeAsync(data []byte, msgUUID []byte, hdrs map[int32][]byte, receipt *receipt) (int, error) {
+	// we return before the data is on the wire, so we have to copy it to honor the Writer contract
+	buf := make([]byte, len(data))
+	copy(buf, data)
+
+	if err := ec.window.acquire(len(buf), ec.getWriteDeadline(), ec.closedC); err != nil {
+		return 0, err
+	}
+
+	msg := ec.newDataMsg(buf, msgUUID, hdrs, receipt)
+	if err := ec.interceptOutbound(msg); err != nil {
+		ec.window.release(len(buf), nil)
+		Log().WithFields(GetLoggerFields(msg)).WithError(err).Debug("write aborted by outbound interceptor")
+		return 0, err
+	}
+	ec.assignSeq(msg, receipt)
+	ec.TraceMsg("write", msg)
+	Log().WithFields(GetLoggerFields(msg)).Debugf("writing %v bytes async", len(buf))
+
+	start := time.Now()
+	errC, err := ec.Channel.SendAndSync(msg)
 	if err != nil {
+		ec.window.release(len(buf), nil)
+		ec.quality.record(time.Since(start), err)
 		return 0, err
 	}
 
+	go func() {
+		err := <-errC
+		ec.quality.record(time.Since(start), err)
+		ec.window.release(len(buf), err)
+	}()
+
 	return len(data), nil
 }
 
+// SendState sends a state message, waiting up to the state timeout for it to reach the wire
 func (ec *MsgChannel) SendState(msg *channel2.Message) error {
-	msg.PutUint32Header(SeqHeader, ec.msgIdSeq.Next())
+	ctx, cancel := context.WithTimeout(context.Background(), ec.stateTimeout)
+	defer cancel()
+	return ec.SendStateContext(ctx, msg)
+}
+
+// GetStateTimeout returns the longest SendState waits for a state message to reach the wire
+func (ec *MsgChannel) GetStateTimeout() time.Duration {
+	return ec.stateTimeout
+}
+
+// SendStateContext sends a state message, waiting until it reaches the wire or ctx is done. If the ctx deadline
+// passes first the error wraps ErrStateSendTimeout, and if ctx is cancelled it's ctx.Err()
+func (ec *MsgChannel) SendStateContext(ctx context.Context, msg *channel2.Message) error {
+	ec.putCorrelationId(msg)
+	if err := ec.interceptOutbound(msg); err != nil {
+		Log().WithFields(GetLoggerFields(msg)).WithError(err).Debug("state message aborted by outbound interceptor")
+		return err
+	}
+	ec.assignSeq(msg, nil)
 	ec.TraceMsg("SendState", msg)
 	syncC, err := ec.SendAndSyncWithPriority(msg, channel2.High)
 	if err != nil {
@@ -160,8 +783,11 @@ func (ec *MsgChannel) SendState(msg *channel2.Message) error {
 	select {
 	case err = <-syncC:
 		return err
-	case <-time.After(time.Second * 5):
-		return errors.New("timed out waiting for close message send to complete")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("state message not sent before deadline (%w)", ErrStateSendTimeout)
+		}
+		return ctx.Err()
 	}
 }
 
@@ -173,12 +799,12 @@ func (ec *MsgChannel) TraceMsg(source string, msg *channel2.Message) {
 			msgUUID = newUUID[:]
 			msg.Headers[UUIDHeader] = msgUUID
 		} else {
-			pfxlog.Logger().WithField("connId", ec.id).WithError(err).Infof("failed to create trace uuid")
+			Log().WithField("connId", ec.id).WithError(err).Infof("failed to create trace uuid")
 		}
 	}
 
 	if msgUUID != nil {
-		pfxlog.Logger().WithFields(GetLoggerFields(msg)).WithField("source", source).Debug("tracing message")
+		Log().WithFields(GetLoggerFields(msg)).WithField("source", source).Debug("tracing message")
 	}
 }
 
@@ -192,11 +818,244 @@ func (d DialConnOptions) GetConnectTimeout() time.Duration {
 	return 5 * time.Second
 }
 
+type DialOptions struct {
+	ConnectTimeout time.Duration
+	// PerAttemptTimeout bounds the connect through each edge router. If it passes, the dial moves on to the next
+	// router which connected, with ConnectTimeout still bounding the dial as a whole. Zero dials through the
+	// first router to connect only
+	PerAttemptTimeout time.Duration
+	// ReplyTimeout bounds only the wait for the router to reply to the connect request, once it's been sent over
+	// a router conn which is already up, so a router which takes the conn but never answers fails the dial on its
+	// own budget. Zero waits for up to ConnectTimeout
+	ReplyTimeout time.Duration
+	// Compression requests compression of data payloads. It's only used if the hosting side agrees to it
+	Compression Compression
+	// AsyncWrites makes Write return once data is queued, rather than once it's on the wire
+	AsyncWrites bool
+	// MaxUnackedBytes bounds the data queued by async writes. Zero uses DefaultMaxUnackedBytes
+	MaxUnackedBytes int
+	// WriteCoalesceWindow gathers small writes into one data message, sent once WriteCoalesceFrameSize bytes
+	// have gathered or the window has passed since the first of them, whichever comes first. Coalesced writes
+	// return once their data is copied, and a failed send is returned by the next write or by Close. Zero sends
+	// each write as its own message
+	WriteCoalesceWindow time.Duration
+	// Linger bounds how long Close waits for async writes to reach the wire before sending the close, so that the
+	// peer gets everything written ahead of it. Coalesced writes are always sent first. Zero doesn't wait, and
+	// async writes which aren't on the wire yet may be lost. Abort never waits
+	Linger time.Duration
+	// RecvBufferSize bounds the received data buffered until it's read. If it's exceeded the conn is closed
+	// and reads return ErrRecvBufferExceeded. Zero uses DefaultRecvBufferSize
+	RecvBufferSize int
+	// MaxMessageSize is the largest data message accepted from the peer, both as received and once decompressed.
+	// If it's exceeded the conn is closed and reads return ErrMessageTooLarge. Zero uses DefaultMaxMessageSize
+	MaxMessageSize int
+	// MaxHeaders is the most headers accepted on a message from the peer. If it's exceeded the conn is closed and
+	// reads return ErrTooManyHeaders. Zero uses DefaultMaxHeaders
+	MaxHeaders int
+	// ReadAhead decrypts and decompresses the next message in the background while the application handles the
+	// current one. Messages read ahead still count against RecvBufferSize until they're read
+	ReadAhead bool
+	// StrictOrdering closes the conn if a message arrives with a sequence number other than the next one
+	// expected, with reads returning ErrOutOfOrder, rather than waiting for missing messages and reordering
+	StrictOrdering bool
+	// Protocols are the application protocols the dialer supports, in order of preference. The hosting side
+	// picks one, which is available from SelectedProtocol on the conn
+	Protocols []string
+	// MaxConcurrentDials bounds how many dials ConnectBatch runs at once. Zero uses DefaultMaxConcurrentDials
+	MaxConcurrentDials int
+	// Migratable redials the service if the router carrying the conn fails, and carries on over the new conn.
+	// The host sees a new conn, and data in flight when the router failed may be lost, so it suits protocols
+	// which tolerate that. Writes made while redialing are buffered, up to MaxUnackedBytes. Conns dialed with
+	// it implement MigratableConn
+	Migratable bool
+	// Identity names the identity to dial as, as registered with ziti.RegisterIdentity, for processes holding
+	// several identities. Empty dials as the identity of the context dialing. It's applied by the context's dial
+	// methods, not by RouterConn
+	Identity string
+	// ClientHint is passed to the hosting side in the ClientHintHeader connect header, where it can be read with
+	// GetConnectHeader. It's meant for things like a sticky session key or a tenant tag for the host to route or
+	// log by. It's supplied by the dialer and not verified by anyone, so unlike the dialer's identity it must not
+	// be used to make access decisions
+	ClientHint string
+	// AppData is passed to the hosting side in the AppDataHeader connect header, and is included in the ConnInfo
+	// given to a listener's PriorityFunc
+	AppData []byte
+	// Terminators are the candidates for TerminatorSelector. The controller API doesn't list a service's
+	// terminators, so they come from the application, for example from its own service registry
+	Terminators []Terminator
+	// TerminatorSelector picks one of Terminators, and the dial is routed to the chosen terminator's identity
+	// by sending it in the TerminatorIdentityHeader. The dial fails if that terminator isn't available. Nil, or no
+	// candidates, leaves the choice to the router
+	TerminatorSelector TerminatorSelector
+}
+
+func (options *DialOptions) GetConnectTimeout() time.Duration {
+	return options.ConnectTimeout
+}
+
+// GetReplyTimeout returns how long to wait for the reply to a connect request
+func (options *DialOptions) GetReplyTimeout() time.Duration {
+	if options.ReplyTimeout > 0 {
+		return options.ReplyTimeout
+	}
+	return options.ConnectTimeout
+}
+
+func (options *DialOptions) String() string {
+	return fmt.Sprintf("[DialOptions connect-timeout=%v, compression=%v]", options.ConnectTimeout, options.Compression)
+}
+
+// Validate checks that the options are within range, so bad options fail the dial straight away
+func (options *DialOptions) Validate() error {
+	if options.ConnectTimeout <= 0 {
+		return errors.Errorf("invalid connect timeout %v, must be positive", options.ConnectTimeout)
+	}
+	if options.PerAttemptTimeout < 0 {
+		return errors.Errorf("invalid per attempt timeout %v, must not be negative", options.PerAttemptTimeout)
+	}
+	if options.ReplyTimeout < 0 {
+		return errors.Errorf("invalid reply timeout %v, must not be negative", options.ReplyTimeout)
+	}
+	if options.WriteCoalesceWindow < 0 {
+		return errors.Errorf("invalid write coalesce window %v, must not be negative", options.WriteCoalesceWindow)
+	}
+	if options.Linger < 0 {
+		return errors.Errorf("invalid linger %v, must not be negative", options.Linger)
+	}
+	if options.Compression > CompressionSnappy {
+		return errors.Errorf("unsupported compression %v", byte(options.Compression))
+	}
+	return validateSizes(map[string]int{
+		"max unacked bytes":    options.MaxUnackedBytes,
+		"recv buffer size":     options.RecvBufferSize,
+		"max message size":     options.MaxMessageSize,
+		"max headers":          options.MaxHeaders,
+		"max concurrent dials": options.MaxConcurrentDials,
+	})
+}
+
+// Clone returns a copy of the options which can be changed without affecting the original. Protocols, AppData and
+// Terminators are copied, while callbacks such as TerminatorSelector are shared
+func (options *DialOptions) Clone() *DialOptions {
+	if options == nil {
+		return nil
+	}
+	clone := *options
+	if options.Protocols != nil {
+		clone.Protocols = append([]string{}, options.Protocols...)
+	}
+	if options.AppData != nil {
+		clone.AppData = append([]byte{}, options.AppData...)
+	}
+	if options.Terminators != nil {
+		clone.Terminators = append([]Terminator{}, options.Terminators...)
+	}
+	return &clone
+}
+
+func DefaultDialOptions() *DialOptions {
+	return &DialOptions{
+		ConnectTimeout: 5 * time.Second,
+		Compression:    CompressionNone,
+	}
+}
+
 type ListenOptions struct {
 	Cost           uint16
 	Precedence     Precedence
 	ConnectTimeout time.Duration
+	// Compression is the payload compression the hosting side will agree to if a dialer requests it
+	Compression Compression
+	// AsyncWrites makes Write on accepted conns return once data is queued, rather than once it's on the wire
+	AsyncWrites bool
+	// MaxUnackedBytes bounds the data queued by async writes. Zero uses DefaultMaxUnackedBytes
+	MaxUnackedBytes int
+	// WriteCoalesceWindow coalesces writes on accepted conns, as for DialOptions.WriteCoalesceWindow
+	WriteCoalesceWindow time.Duration
+	// Linger bounds how long Close on accepted conns waits for async writes, as for DialOptions.Linger
+	Linger time.Duration
+	// RecvBufferSize bounds the received data buffered on accepted conns until it's read. Zero uses
+	// DefaultRecvBufferSize
+	RecvBufferSize int
+	// MaxMessageSize is the largest data message accepted from dialers on accepted conns. Zero uses
+	// DefaultMaxMessageSize
+	MaxMessageSize int
+	// MaxHeaders is the most headers accepted on messages from dialers on accepted conns, and on dial requests,
+	// which are failed if they carry more. Zero uses DefaultMaxHeaders
+	MaxHeaders int
+	// ReadAhead enables read ahead on accepted conns, as for DialOptions.ReadAhead
+	ReadAhead bool
+	// StrictOrdering enables strict ordering on accepted conns, as for DialOptions.StrictOrdering
+	StrictOrdering bool
+	// ProtocolSelector picks one of the protocols offered by a dialer, or returns an empty string to select none
+	ProtocolSelector func(offered []string) string
+	// DrainGracePeriod is the longest GracefulClose waits for dials to stop arriving before closing. Zero uses
+	// DefaultDrainGracePeriod
+	DrainGracePeriod time.Duration
+	// MaxConnections is the number of routers to bind on. Zero means bind on all available routers, adding
+	// and removing bindings as routers come and go
 	MaxConnections int
+	// ResumeBindWindow is how long the listener keeps reconnecting to a router whose conn dropped, to bind there
+	// again with the same session, before falling back to refreshing the session and binding wherever it can. It
+	// saves a controller round trip and a gap in the terminator on flaky router links. Zero falls back straight away
+	ResumeBindWindow time.Duration
+	// RouterSelector orders and filters the routers available to bind on, each time the listener looks for more.
+	// Routers are bound in the order it returns them, up to MaxConnections, and routers it leaves out aren't bound
+	// on. Nil binds on whichever routers connect first
+	RouterSelector func(available []RouterInfo) []RouterInfo
+	// AcceptRateLimit bounds how fast new conns are accepted. Nil means no limit
+	AcceptRateLimit *AcceptRateLimit
+	// AcceptBackpressure is told when conns waiting to be accepted pass its high water mark, and when they drain
+	// back to its low water mark. Each router's listener has room for 10 waiting conns, or 20 with a PriorityFunc
+	AcceptBackpressure *AcceptBackpressure
+	// Identity is the terminator identity to bind with, letting dialers address this particular host
+	Identity string
+	// IdentitySecret is presented with Identity, so that only hosts holding the secret can bind as that identity.
+	// It can be rotated while listening with Listener.UpdateIdentitySecret
+	IdentitySecret string
+	// TerminatorInstanceId identifies this instance of the service's hosts, for example a pod name, independent of
+	// the identity it binds as. It's reported to dialers on each conn it accepts, and dialers can ask for it with
+	// Terminator.InstanceId
+	TerminatorInstanceId string
+	// BindUsingEdgeIdentity binds with the name of the SDK's own edge identity as the terminator identity. It takes
+	// precedence over Identity
+	BindUsingEdgeIdentity bool
+	// PriorityFunc orders conns waiting to be accepted, so that higher priority conns are handed to Accept first.
+	// Conns of equal priority are accepted in the order they arrived. Nil accepts conns in arrival order
+	PriorityFunc func(info ConnInfo) int
+	// AdmitDial is called as each dial arrives, before the conn is set up. Returning an error rejects the dial. An
+	// error made with RejectWith reaches the dialer's Connect as a *DialRejectedError with its code and message,
+	// while other errors only pass on their text. Nil admits every dial
+	AdmitDial func(info ConnInfo) error
+	// ConnectHandler is called as each dial arrives, after AdmitDial, and decides whether to accept it, which
+	// protocol to select and what headers to send back in the connect reply. Nil accepts every dial
+	ConnectHandler func(req ConnectRequest) ConnectDecision
+}
+
+// RouterInfo describes an edge router which a listener could bind on
+type RouterInfo struct {
+	Name string
+	// Address is the router's first url, in sorted order
+	Address string
+	// Latency is the lowest mean latency measured to any of the router's urls, or zero if it hasn't been measured
+	Latency time.Duration
+}
+
+// ConnInfo describes a conn which a listener has accepted, whether it's still waiting in the accept queue or has
+// been handed to Accept
+type ConnInfo struct {
+	// SourceIdentity is the name of the dialing identity, if the router reported it
+	SourceIdentity string
+	// AppData is the dialer's DialOptions.AppData
+	AppData []byte
+	// Arrived is when the dial reached the listener
+	Arrived time.Time
+	// Label is the correlation id the dialer last sent on the conn, see ServiceConn.SetCorrelationId
+	Label string
+	// ServiceName is the service the conn was dialed on
+	ServiceName string
+	// Stats is a snapshot of the conn's counters
+	Stats ConnStats
 }
 
 func (options *ListenOptions) GetConnectTimeout() time.Duration {
@@ -207,6 +1066,66 @@ func (options *ListenOptions) String() string {
 	return fmt.Sprintf("[ListenOptions cost=%v, max-connections=%v]", options.Cost, options.MaxConnections)
 }
 
+// Validate checks that the options are within range, so bad options fail the listen straight away
+func (options *ListenOptions) Validate() error {
+	if options.ConnectTimeout <= 0 {
+		return errors.Errorf("invalid connect timeout %v, must be positive", options.ConnectTimeout)
+	}
+	if options.DrainGracePeriod < 0 {
+		return errors.Errorf("invalid drain grace period %v, must not be negative", options.DrainGracePeriod)
+	}
+	if options.ResumeBindWindow < 0 {
+		return errors.Errorf("invalid resume bind window %v, must not be negative", options.ResumeBindWindow)
+	}
+	if options.WriteCoalesceWindow < 0 {
+		return errors.Errorf("invalid write coalesce window %v, must not be negative", options.WriteCoalesceWindow)
+	}
+	if options.Linger < 0 {
+		return errors.Errorf("invalid linger %v, must not be negative", options.Linger)
+	}
+	if options.Precedence > PrecedenceFailed {
+		return errors.Errorf("invalid precedence %v", byte(options.Precedence))
+	}
+	if options.Compression > CompressionSnappy {
+		return errors.Errorf("unsupported compression %v", byte(options.Compression))
+	}
+	if pressure := options.AcceptBackpressure; pressure != nil {
+		if pressure.HighWater < 0 || pressure.LowWater < 0 {
+			return errors.Errorf("invalid accept backpressure marks %v/%v, must not be negative", pressure.HighWater, pressure.LowWater)
+		}
+		if pressure.HighWater > 0 && pressure.LowWater >= pressure.HighWater {
+			return errors.Errorf("invalid accept backpressure low water mark %v, must be below high water mark %v", pressure.LowWater, pressure.HighWater)
+		}
+	}
+	return validateSizes(map[string]int{
+		"max unacked bytes": options.MaxUnackedBytes,
+		"recv buffer size":  options.RecvBufferSize,
+		"max message size":  options.MaxMessageSize,
+		"max headers":       options.MaxHeaders,
+		"max connections":   options.MaxConnections,
+	})
+}
+
+// validateSizes checks that none of the given sizes or counts are negative. Zero is allowed, as it selects the default
+func validateSizes(sizes map[string]int) error {
+	for name, size := range sizes {
+		if size < 0 {
+			return errors.Errorf("invalid %v %v, must not be negative", name, size)
+		}
+	}
+	return nil
+}
+
+// Clone returns a copy of the options which can be changed without affecting the original. Callbacks are shared, as
+// are AcceptRateLimit and AcceptBackpressure, which hold the state that listeners using them share
+func (options *ListenOptions) Clone() *ListenOptions {
+	if options == nil {
+		return nil
+	}
+	clone := *options
+	return &clone
+}
+
 func DefaultListenOptions() *ListenOptions {
 	return &ListenOptions{
 		Cost:           0,
@@ -0,0 +1,250 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrConnPoolClosed = errors.New("connection pool closed")
+
+const DefaultConnPoolMaxIdle = 2
+
+// ConnPoolDialer dials a new conn for a ConnPool, typically to a single service
+type ConnPoolDialer func(ctx context.Context) (ServiceConn, error)
+
+type ConnPoolOptions struct {
+	// MaxIdle is the number of idle conns kept for reuse. Conns put back beyond that are closed
+	MaxIdle int
+	// MaxTotal bounds the number of open conns, idle or in use. Once reached, Get waits for a conn to be put back
+	// or closed. Zero means no limit
+	MaxTotal int
+	// IdleTimeout closes conns which have been idle longer than this. Zero means idle conns don't expire
+	IdleTimeout time.Duration
+	// Validate is called on an idle conn before it's handed out again. Conns it returns false for are closed and
+	// another conn is taken or dialed in their place. Closed conns are always discarded, whether or not Validate is
+	// set, but that's the only check made without it, so a conn whose router has stopped responding without
+	// closing is handed out as it is. Set Validate to something which exercises the conn, such as a ping in the
+	// application's protocol, to catch those
+	Validate func(conn ServiceConn) bool
+}
+
+// DefaultConnPoolOptions keeps DefaultConnPoolMaxIdle idle conns, with no limit on open conns, no idle timeout and no
+// Validate, so idle conns are only checked for having closed
+func DefaultConnPoolOptions() *ConnPoolOptions {
+	return &ConnPoolOptions{
+		MaxIdle: DefaultConnPoolMaxIdle,
+	}
+}
+
+// ConnPool keeps idle conns for reuse, so that applications which repeatedly dial the same service don't have to
+// set up a new conn each time. Conns come from Get and are handed back with Put once the caller is done with them.
+// Unless ConnPoolOptions.Validate is set, idle conns are handed out without checking they still work
+type ConnPool struct {
+	dial     ConnPoolDialer
+	options  ConnPoolOptions
+	lock     sync.Mutex
+	idle     []*pooledConn
+	conns    map[ServiceConn]*pooledConn
+	pending  int
+	closed   bool
+	changedC chan struct{}
+}
+
+type pooledConn struct {
+	conn      ServiceConn
+	idleSince time.Time
+}
+
+func NewConnPool(dial ConnPoolDialer, options *ConnPoolOptions) *ConnPool {
+	if options == nil {
+		options = DefaultConnPoolOptions()
+	}
+	return &ConnPool{
+		dial:     dial,
+		options:  *options,
+		conns:    map[ServiceConn]*pooledConn{},
+		changedC: make(chan struct{}),
+	}
+}
+
+// Get returns an idle conn if a valid one is available, and otherwise dials a new one
+func (pool *ConnPool) Get(ctx context.Context) (ServiceConn, error) {
+	for {
+		conn, waitC, err := pool.take()
+		if err != nil {
+			return nil, err
+		}
+
+		if conn != nil {
+			if pool.isValid(conn) {
+				return conn, nil
+			}
+			pool.discard(conn)
+			continue
+		}
+
+		if waitC == nil {
+			return pool.dialNew(ctx)
+		}
+
+		select {
+		case <-waitC:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Put hands a conn back to the pool once the caller is done with it. The conn is closed if the pool is closed or
+// already has MaxIdle idle conns
+func (pool *ConnPool) Put(conn ServiceConn) {
+	pool.lock.Lock()
+	entry, found := pool.conns[conn]
+	keep := found && !pool.closed && !conn.IsClosed() && len(pool.idle) < pool.options.MaxIdle
+	if keep {
+		entry.idleSince = time.Now()
+		pool.idle = append(pool.idle, entry)
+		pool.notifyChanged()
+	}
+	pool.lock.Unlock()
+
+	if !keep {
+		pool.discard(conn)
+	}
+}
+
+// IdleCount returns the number of idle conns in the pool
+func (pool *ConnPool) IdleCount() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.idle)
+}
+
+// OpenCount returns the number of open conns from the pool, idle or in use
+func (pool *ConnPool) OpenCount() int {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+	return len(pool.conns)
+}
+
+// Close closes the idle conns and fails future calls to Get. Conns in use are closed when they're put back
+func (pool *ConnPool) Close() error {
+	pool.lock.Lock()
+	pool.closed = true
+	idle := pool.idle
+	pool.idle = nil
+	pool.notifyChanged()
+	pool.lock.Unlock()
+
+	for _, entry := range idle {
+		pool.discard(entry.conn)
+	}
+	return nil
+}
+
+// take pops the most recently used idle conn. If there isn't one, it returns a nil wait channel if a new conn may
+// be dialed, or a channel which is closed when the pool next changes
+func (pool *ConnPool) take() (ServiceConn, chan struct{}, error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	if pool.closed {
+		return nil, nil, ErrConnPoolClosed
+	}
+
+	for len(pool.idle) > 0 {
+		entry := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if pool.options.IdleTimeout > 0 && time.Since(entry.idleSince) > pool.options.IdleTimeout {
+			pool.remove(entry.conn)
+			go func() { _ = entry.conn.Close() }()
+			continue
+		}
+		return entry.conn, nil, nil
+	}
+
+	if pool.options.MaxTotal > 0 && len(pool.conns)+pool.pending >= pool.options.MaxTotal {
+		return nil, pool.changedC, nil
+	}
+
+	pool.pending++
+	return nil, nil, nil
+}
+
+func (pool *ConnPool) dialNew(ctx context.Context) (ServiceConn, error) {
+	conn, err := pool.dial(ctx)
+
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.pending--
+	if err != nil {
+		pool.notifyChanged()
+		return nil, err
+	}
+
+	pool.conns[conn] = &pooledConn{conn: conn}
+	conn.OnClose(func(error) {
+		pool.lock.Lock()
+		defer pool.lock.Unlock()
+		pool.remove(conn)
+	})
+	return conn, nil
+}
+
+func (pool *ConnPool) isValid(conn ServiceConn) bool {
+	if conn.IsClosed() {
+		return false
+	}
+	return pool.options.Validate == nil || pool.options.Validate(conn)
+}
+
+func (pool *ConnPool) discard(conn ServiceConn) {
+	pool.lock.Lock()
+	pool.remove(conn)
+	pool.lock.Unlock()
+
+	if err := conn.Close(); err != nil {
+		Log().WithError(err).Debug("error closing pooled conn")
+	}
+}
+
+// remove drops a conn from the pool, if it's still there. Must be called with the lock held
+func (pool *ConnPool) remove(conn ServiceConn) {
+	if _, found := pool.conns[conn]; !found {
+		return
+	}
+	delete(pool.conns, conn)
+	for i, entry := range pool.idle {
+		if entry.conn == conn {
+			pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+			break
+		}
+	}
+	pool.notifyChanged()
+}
+
+// notifyChanged wakes up callers of Get waiting for a conn. Must be called with the lock held
+func (pool *ConnPool) notifyChanged() {
+	close(pool.changedC)
+	pool.changedC = make(chan struct{})
+}
@@ -0,0 +1,188 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// poolTestConn implements the parts of ServiceConn used by ConnPool. Unimplemented methods panic
+type poolTestConn struct {
+	ServiceConn
+	lock     sync.Mutex
+	closed   bool
+	handlers []func(error)
+}
+
+func (conn *poolTestConn) IsClosed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.closed
+}
+
+func (conn *poolTestConn) OnClose(handler func(cause error)) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.handlers = append(conn.handlers, handler)
+}
+
+func (conn *poolTestConn) Close() error {
+	conn.lock.Lock()
+	if conn.closed {
+		conn.lock.Unlock()
+		return nil
+	}
+	conn.closed = true
+	handlers := conn.handlers
+	conn.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(nil)
+	}
+	return nil
+}
+
+type poolTestDialer struct {
+	lock  sync.Mutex
+	conns []*poolTestConn
+}
+
+func (dialer *poolTestDialer) dial(context.Context) (ServiceConn, error) {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	conn := &poolTestConn{}
+	dialer.conns = append(dialer.conns, conn)
+	return conn, nil
+}
+
+func (dialer *poolTestDialer) dialCount() int {
+	dialer.lock.Lock()
+	defer dialer.lock.Unlock()
+	return len(dialer.conns)
+}
+
+func Test_ConnPoolReuse(t *testing.T) {
+	assert := require.New(t)
+	dialer := &poolTestDialer{}
+	pool := NewConnPool(dialer.dial, &ConnPoolOptions{MaxIdle: 1})
+
+	first, err := pool.Get(context.Background())
+	assert.NoError(err)
+	second, err := pool.Get(context.Background())
+	assert.NoError(err)
+	assert.Equal(2, dialer.dialCount())
+
+	// only one idle conn is kept
+	pool.Put(first)
+	pool.Put(second)
+	assert.Equal(1, pool.IdleCount())
+	assert.Equal(1, pool.OpenCount())
+	assert.True(second.IsClosed())
+
+	conn, err := pool.Get(context.Background())
+	assert.NoError(err)
+	assert.Same(first, conn)
+	assert.Equal(2, dialer.dialCount())
+
+	// conns closed while idle are evicted
+	pool.Put(conn)
+	assert.NoError(conn.Close())
+	assert.Equal(0, pool.IdleCount())
+	assert.Equal(0, pool.OpenCount())
+
+	assert.NoError(pool.Close())
+	_, err = pool.Get(context.Background())
+	assert.Equal(ErrConnPoolClosed, err)
+}
+
+func Test_ConnPoolValidateAndIdleTimeout(t *testing.T) {
+	assert := require.New(t)
+	dialer := &poolTestDialer{}
+	valid := true
+	pool := NewConnPool(dialer.dial, &ConnPoolOptions{
+		MaxIdle:     2,
+		IdleTimeout: 50 * time.Millisecond,
+		Validate:    func(ServiceConn) bool { return valid },
+	})
+	defer func() { _ = pool.Close() }()
+
+	conn, err := pool.Get(context.Background())
+	assert.NoError(err)
+	pool.Put(conn)
+
+	// a conn failing validation is closed and a new one dialed in its place
+	valid = false
+	redialed, err := pool.Get(context.Background())
+	assert.NoError(err)
+	assert.True(conn.IsClosed())
+	assert.Equal(2, dialer.dialCount())
+	assert.NotSame(conn, redialed)
+	assert.Same(dialer.conns[1], redialed)
+	assert.False(redialed.IsClosed())
+	assert.Equal(1, pool.OpenCount())
+	assert.Equal(0, pool.IdleCount())
+
+	valid = true
+	conn, err = pool.Get(context.Background())
+	assert.NoError(err)
+	pool.Put(conn)
+	time.Sleep(60 * time.Millisecond)
+
+	newConn, err := pool.Get(context.Background())
+	assert.NoError(err)
+	assert.NotSame(conn, newConn)
+	assert.Equal(4, dialer.dialCount())
+}
+
+func Test_ConnPoolMaxTotal(t *testing.T) {
+	assert := require.New(t)
+	dialer := &poolTestDialer{}
+	pool := NewConnPool(dialer.dial, &ConnPoolOptions{MaxIdle: 1, MaxTotal: 1})
+	defer func() { _ = pool.Close() }()
+
+	conn, err := pool.Get(context.Background())
+	assert.NoError(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = pool.Get(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+
+	doneC := make(chan ServiceConn, 1)
+	go func() {
+		conn, err := pool.Get(context.Background())
+		if err == nil {
+			doneC <- conn
+		}
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	pool.Put(conn)
+
+	select {
+	case got := <-doneC:
+		assert.Same(conn, got)
+	case <-time.After(time.Second):
+		assert.Fail("waiting Get not woken by Put")
+	}
+	assert.Equal(1, dialer.dialCount())
+}
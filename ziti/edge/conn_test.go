@@ -0,0 +1,499 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/channel2"
+	"github.com/stretchr/testify/require"
+)
+
+// mockChannel implements the parts of channel2.Channel used by MsgChannel. Unimplemented methods panic
+type mockChannel struct {
+	channel2.Channel
+	lock      sync.Mutex
+	sent      []*channel2.Message
+	timeouts  []time.Duration
+	holdSyncs bool
+	syncs     []chan error
+}
+
+func (ch *mockChannel) SendAndSync(m *channel2.Message) (chan error, error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.sent = append(ch.sent, m)
+	errC := make(chan error, 1)
+	if ch.holdSyncs {
+		ch.syncs = append(ch.syncs, errC)
+	} else {
+		errC <- nil
+	}
+	return errC, nil
+}
+
+func (ch *mockChannel) Send(m *channel2.Message) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.sent = append(ch.sent, m)
+	return nil
+}
+
+func (ch *mockChannel) SendWithTimeout(m *channel2.Message, timeout time.Duration) error {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.sent = append(ch.sent, m)
+	ch.timeouts = append(ch.timeouts, timeout)
+	return nil
+}
+
+func (ch *mockChannel) SendAndSyncWithPriority(m *channel2.Message, _ channel2.Priority) (chan error, error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.sent = append(ch.sent, m)
+	return make(chan error), nil // never acks
+}
+
+// releaseSync completes the oldest held send
+func (ch *mockChannel) releaseSync(err error) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.syncs[0] <- err
+	ch.syncs = ch.syncs[1:]
+}
+
+// releaseSyncWhenSent waits for a send to be held, then completes it
+func (ch *mockChannel) releaseSyncWhenSent(err error) {
+	for {
+		ch.lock.Lock()
+		held := len(ch.syncs)
+		ch.lock.Unlock()
+		if held > 0 {
+			ch.releaseSync(err)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (ch *mockChannel) sentCount() int {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return len(ch.sent)
+}
+
+func Test_SendStateTimeout(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+	msgCh.SetStateTimeout(50 * time.Millisecond)
+
+	start := time.Now()
+	err := msgCh.SendState(NewStateClosedMsg(1, ""))
+	elapsed := time.Since(start)
+
+	assert.Error(err)
+	assert.True(errors.Is(err, ErrStateSendTimeout))
+	assert.True(elapsed >= 50*time.Millisecond)
+	assert.True(elapsed < DefaultStateTimeout)
+	assert.Equal(1, len(ch.sent))
+}
+
+func Test_SendStateContext(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err := msgCh.SendStateContext(ctx, NewStateClosedMsg(1, ""))
+	assert.Equal(context.Canceled, err)
+	assert.True(time.Since(start) < DefaultStateTimeout)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = msgCh.SendStateContext(ctx, NewStateClosedMsg(1, ""))
+	assert.True(errors.Is(err, ErrStateSendTimeout))
+	assert.Equal(2, ch.sentCount())
+}
+
+func Test_WriteTimeout(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	// neither set, write syncs without a timeout
+	_, err := msgCh.Write([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal(0, len(ch.timeouts))
+
+	// rolling timeout only, applied fresh on each write
+	msgCh.SetWriteTimeout(time.Second)
+	for i := 0; i < 2; i++ {
+		_, err = msgCh.Write([]byte("hello"))
+		assert.NoError(err)
+		assert.True(ch.timeouts[i] > 900*time.Millisecond && ch.timeouts[i] <= time.Second)
+	}
+
+	// earlier absolute deadline wins
+	assert.NoError(msgCh.SetWriteDeadline(time.Now().Add(100 * time.Millisecond)))
+	_, err = msgCh.Write([]byte("hello"))
+	assert.NoError(err)
+	assert.True(ch.timeouts[2] <= 100*time.Millisecond)
+
+	// earlier rolling timeout wins
+	assert.NoError(msgCh.SetWriteDeadline(time.Now().Add(time.Hour)))
+	_, err = msgCh.Write([]byte("hello"))
+	assert.NoError(err)
+	assert.True(ch.timeouts[3] <= time.Second)
+
+	// clearing the rolling timeout falls back to the deadline
+	msgCh.SetWriteTimeout(0)
+	_, err = msgCh.Write([]byte("hello"))
+	assert.NoError(err)
+	assert.True(ch.timeouts[4] > 59*time.Minute)
+}
+
+func Test_AsyncWritesBlockAtMaxUnacked(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{holdSyncs: true}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+	msgCh.SetAsyncWrites(100)
+
+	data := make([]byte, 40)
+	for i := 0; i < 2; i++ {
+		n, err := msgCh.Write(data)
+		assert.NoError(err)
+		assert.Equal(len(data), n)
+	}
+	assert.Equal(80, msgCh.GetUnackedBytes())
+
+	// third write would put us over 100 bytes, so it should block until an ack frees space
+	doneC := make(chan error, 1)
+	go func() {
+		_, err := msgCh.Write(data)
+		doneC <- err
+	}()
+
+	select {
+	case <-doneC:
+		assert.Fail("write should have blocked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Equal(2, ch.sentCount())
+
+	ch.releaseSync(nil)
+
+	select {
+	case err := <-doneC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("write should have unblocked")
+	}
+	assert.Equal(3, ch.sentCount())
+	assert.Equal(80, msgCh.GetUnackedBytes())
+
+	// write deadlines apply while blocked
+	assert.NoError(msgCh.SetWriteDeadline(time.Now().Add(20 * time.Millisecond)))
+	_, err := msgCh.Write(data)
+	assert.Error(err)
+
+	// errors from async sends are returned on the next write
+	ch.releaseSync(errors.New("tx failed"))
+	ch.releaseSync(nil)
+	assert.NoError(msgCh.SetWriteDeadline(time.Time{}))
+	for start := time.Now(); msgCh.GetUnackedBytes() > 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(0, msgCh.GetUnackedBytes())
+	_, err = msgCh.Write(data)
+	assert.EqualError(err, "tx failed")
+}
+
+func Test_CostFromPercent(t *testing.T) {
+	assert := require.New(t)
+
+	for pct, expected := range map[float64]uint16{0: 0, 0.5: 32768, 0.8: 52428, 1: math.MaxUint16, 1.5: math.MaxUint16} {
+		cost, err := CostFromPercent(pct)
+		assert.NoError(err)
+		assert.Equal(expected, cost, "pct %v", pct)
+	}
+
+	_, err := CostFromPercent(-0.1)
+	assert.Error(err)
+	_, err = CostFromPercent(math.NaN())
+	assert.Error(err)
+}
+
+func Test_WriteNoSync(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{holdSyncs: true}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	// held syncs would block a normal write, so returning shows we didn't wait
+	data := []byte("hello")
+	n, err := msgCh.WriteNoSync(data)
+	assert.NoError(err)
+	assert.Equal(len(data), n)
+	assert.Equal(1, ch.sentCount())
+	assert.Equal(0, len(ch.syncs))
+
+	// the buffer is sent as is, not copied
+	assert.Equal(&data[0], &ch.sent[0].Body[0])
+}
+
+// depthChannel is a mockChannel which reports a send queue depth
+type depthChannel struct {
+	mockChannel
+	depth int
+}
+
+func (ch *depthChannel) SendQueueDepth() int {
+	return ch.depth
+}
+
+func Test_SendQueueDepth(t *testing.T) {
+	assert := require.New(t)
+
+	ch := &depthChannel{depth: 7}
+	assert.Equal(7, NewEdgeMsgChannel(ch, 1).SendQueueDepth())
+
+	// channels which don't report it are unknown, rather than empty
+	assert.Equal(-1, NewEdgeMsgChannel(&mockChannel{}, 1).SendQueueDepth())
+}
+
+func Test_RedactToken(t *testing.T) {
+	assert := require.New(t)
+
+	token := "6b1a9c3e-0f2d-4e5a-8b7c-1d2e3f4a5b6c"
+	assert.Equal("6b1a9c3e...", RedactToken(token))
+	assert.Equal("...", RedactToken("short"))
+	assert.Equal("", RedactToken(""))
+
+	ShowFullTokens.Set(true)
+	defer ShowFullTokens.Set(false)
+	assert.Equal(token, RedactToken(token))
+}
+
+func Test_GlobalConnId(t *testing.T) {
+	assert := require.New(t)
+	assert.Equal("router-3/42", GlobalConnId("router-3", 42))
+	assert.Equal("unknown/7", GlobalConnId("", 7))
+}
+
+func Test_WriteCancelledByClose(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{holdSyncs: true}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	errC := make(chan error, 1)
+	go func() {
+		_, err := msgCh.Write([]byte("hello"))
+		errC <- err
+	}()
+
+	for ch.sentCount() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	msgCh.CancelWrites()
+
+	select {
+	case err := <-errC:
+		assert.Equal(ErrConnClosed, err)
+	case <-time.After(time.Second):
+		assert.FailNow("blocked write not cancelled")
+	}
+
+	_, err := msgCh.Write([]byte("hello"))
+	assert.Equal(ErrConnClosed, err)
+	assert.Equal(1, ch.sentCount())
+}
+
+func Test_SetSendWindow(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{holdSyncs: true}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	assert.Error(msgCh.SetSendWindow(MinWindowSize), "sync writes have no send window")
+
+	msgCh.SetAsyncWrites(MinWindowSize)
+	assert.Error(msgCh.SetSendWindow(MinWindowSize - 1))
+	assert.Error(msgCh.SetSendWindow(MaxWindowSize + 1))
+
+	data := make([]byte, MinWindowSize/2)
+	for i := 0; i < 2; i++ {
+		_, err := msgCh.Write(data)
+		assert.NoError(err)
+	}
+
+	doneC := make(chan error, 1)
+	go func() {
+		_, err := msgCh.Write(data)
+		doneC <- err
+	}()
+
+	select {
+	case <-doneC:
+		assert.Fail("write should have blocked")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// widening the window lets the blocked write through
+	assert.NoError(msgCh.SetSendWindow(2 * MinWindowSize))
+	select {
+	case err := <-doneC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("write should have unblocked")
+	}
+	assert.Equal(3*len(data), msgCh.GetUnackedBytes())
+}
+
+func Test_DialOptionsValidate(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(DefaultDialOptions().Validate())
+
+	invalid := map[string]func(options *DialOptions){
+		"connect timeout":      func(options *DialOptions) { options.ConnectTimeout = 0 },
+		"per attempt timeout":  func(options *DialOptions) { options.PerAttemptTimeout = -time.Second },
+		"reply timeout":        func(options *DialOptions) { options.ReplyTimeout = -time.Second },
+		"compression":          func(options *DialOptions) { options.Compression = CompressionSnappy + 1 },
+		"max unacked bytes":    func(options *DialOptions) { options.MaxUnackedBytes = -1 },
+		"recv buffer size":     func(options *DialOptions) { options.RecvBufferSize = -1 },
+		"max message size":     func(options *DialOptions) { options.MaxMessageSize = -1 },
+		"max headers":          func(options *DialOptions) { options.MaxHeaders = -1 },
+		"max concurrent dials": func(options *DialOptions) { options.MaxConcurrentDials = -1 },
+	}
+	for field, apply := range invalid {
+		options := DefaultDialOptions()
+		apply(options)
+		err := options.Validate()
+		assert.Error(err, field)
+		assert.Contains(err.Error(), field)
+	}
+}
+
+func Test_ListenOptionsValidate(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(DefaultListenOptions().Validate())
+
+	invalid := map[string]func(options *ListenOptions){
+		"connect timeout":    func(options *ListenOptions) { options.ConnectTimeout = -time.Second },
+		"drain grace period": func(options *ListenOptions) { options.DrainGracePeriod = -time.Second },
+		"resume bind window": func(options *ListenOptions) { options.ResumeBindWindow = -time.Second },
+		"precedence":         func(options *ListenOptions) { options.Precedence = PrecedenceFailed + 1 },
+		"compression":        func(options *ListenOptions) { options.Compression = CompressionSnappy + 1 },
+		"max unacked bytes":  func(options *ListenOptions) { options.MaxUnackedBytes = -1 },
+		"recv buffer size":   func(options *ListenOptions) { options.RecvBufferSize = -1 },
+		"max message size":   func(options *ListenOptions) { options.MaxMessageSize = -1 },
+		"max connections":    func(options *ListenOptions) { options.MaxConnections = -1 },
+		"accept backpressure": func(options *ListenOptions) {
+			options.AcceptBackpressure = &AcceptBackpressure{HighWater: 5, LowWater: 5}
+		},
+	}
+	for field, apply := range invalid {
+		options := DefaultListenOptions()
+		apply(options)
+		err := options.Validate()
+		assert.Error(err, field)
+		assert.Contains(err.Error(), field)
+	}
+}
+
+func Test_DialOptionsClone(t *testing.T) {
+	assert := require.New(t)
+	assert.Nil((*DialOptions)(nil).Clone())
+
+	options := DefaultDialOptions()
+	options.Protocols = []string{"h2", "http/1.1"}
+	options.AppData = []byte("app")
+	options.Terminators = []Terminator{{Identity: "a"}, {Identity: "b"}}
+	options.TerminatorSelector = RandomTerminatorSelector()
+
+	clone := options.Clone()
+	assert.Equal(options.Protocols, clone.Protocols)
+	assert.Equal(options.AppData, clone.AppData)
+	assert.Equal(options.Terminators, clone.Terminators)
+	assert.NotNil(clone.TerminatorSelector)
+
+	clone.Protocols[0] = "h3"
+	clone.AppData[0] = 'A'
+	clone.Terminators[0].Identity = "c"
+	clone.ConnectTimeout = time.Second
+	assert.Equal([]string{"h2", "http/1.1"}, options.Protocols)
+	assert.Equal("app", string(options.AppData))
+	assert.Equal("a", options.Terminators[0].Identity)
+	assert.Equal(5*time.Second, options.ConnectTimeout)
+}
+
+func Test_ListenOptionsClone(t *testing.T) {
+	assert := require.New(t)
+	assert.Nil((*ListenOptions)(nil).Clone())
+
+	options := DefaultListenOptions()
+	options.AcceptRateLimit = NewAcceptRateLimit(1, 1)
+	clone := options.Clone()
+	clone.Cost = 10
+	assert.Equal(uint16(0), options.Cost)
+	assert.Same(options.AcceptRateLimit, clone.AcceptRateLimit)
+}
+
+func Test_DefaultWriteHeaders(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	assert.Error(msgCh.SetDefaultWriteHeaders(map[int32][]byte{SeqHeader: {1}}))
+	assert.Error(msgCh.SetDefaultWriteHeaders(map[int32][]byte{UUIDHeader: {1}}))
+	assert.NoError(msgCh.SetDefaultWriteHeaders(map[int32][]byte{2000: []byte("epoch-1"), 2001: []byte("shard-a")}))
+
+	_, err := msgCh.Write([]byte("one"))
+	assert.NoError(err)
+	_, err = msgCh.WriteNoSync([]byte("two"))
+	assert.NoError(err)
+	_, err = msgCh.WriteTracedWithHeaders([]byte("three"), nil, map[int32][]byte{2001: []byte("shard-b")})
+	assert.NoError(err)
+	msgCh.SetAsyncWrites(0)
+	_, err = msgCh.Write([]byte("four"))
+	assert.NoError(err)
+
+	assert.Equal(4, ch.sentCount())
+	for i, msg := range ch.sent {
+		assert.Equal("epoch-1", string(msg.Headers[2000]))
+		if i == 2 {
+			assert.Equal("shard-b", string(msg.Headers[2001]))
+		} else {
+			assert.Equal("shard-a", string(msg.Headers[2001]))
+		}
+	}
+
+	assert.NoError(msgCh.SetDefaultWriteHeaders(nil))
+	_, err = msgCh.Write([]byte("five"))
+	assert.NoError(err)
+	_, found := ch.sent[4].Headers[2000]
+	assert.False(found)
+}
@@ -0,0 +1,62 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+// ConnectRequest describes a dial as it arrives at the hosting side, for ListenOptions.ConnectHandler
+type ConnectRequest struct {
+	ServiceName string
+	// SourceIdentity is the dialer's identity, as reported by the edge router
+	SourceIdentity string
+	// AppData, Protocols and ClientHint are as the dialer passed them in its DialOptions
+	AppData    []byte
+	Protocols  []string
+	ClientHint string
+}
+
+// ConnectDecision is a ConnectHandler's answer to a dial, made with AcceptConnect or RejectConnect
+type ConnectDecision struct {
+	// Reject fails the dial if set. An error made with RejectWith reaches the dialer's Connect as a
+	// *DialRejectedError, while other errors only pass on their text
+	Reject error
+	// Protocol selects one of the protocols the dialer offered, in place of ListenOptions.ProtocolSelector. Empty
+	// leaves the choice to the ProtocolSelector, if there is one
+	Protocol string
+	// ReplyHeaders are added to the connect reply, where the dialer can read them with GetConnectHeader. Reserved
+	// keys, see IsReservedHeader, are left out
+	ReplyHeaders map[int32][]byte
+}
+
+// AcceptConnect accepts the dial, selecting protocol unless it's empty
+func AcceptConnect(protocol string) ConnectDecision {
+	return ConnectDecision{Protocol: protocol}
+}
+
+// RejectConnect rejects the dial, passing code and message back to the dialer as a *DialRejectedError
+func RejectConnect(code int, message string) ConnectDecision {
+	return ConnectDecision{Reject: RejectWith(code, message)}
+}
+
+// WithReplyHeader adds a header to the connect reply, returning the decision so calls can be chained
+func (decision ConnectDecision) WithReplyHeader(key int32, value []byte) ConnectDecision {
+	headers := make(map[int32][]byte, len(decision.ReplyHeaders)+1)
+	for k, v := range decision.ReplyHeaders {
+		headers[k] = v
+	}
+	headers[key] = value
+	decision.ReplyHeaders = headers
+	return decision
+}
@@ -0,0 +1,321 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edgetest
+
+import (
+	"crypto/x509"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/openziti/foundation/channel2"
+	"github.com/openziti/foundation/identity/identity"
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+// sequenceHeader carries the sending channel's sequence number. It's in the reflected range, so a reply built with
+// ReplyTo brings it back to the requester, where it becomes the reply's channel2.ReplyForHeader
+const sequenceHeader = channel2.MaxReflectedHeader
+
+const rxQueueSize = 64
+
+var errChannelClosed = errors.New("channel closed")
+
+// memoryChannel is one end of an in-memory channel2.Channel pair. It stands in for channel2's own channel and
+// memory underlay, which aren't safe to close while messages are in flight. Messages are copied on send, so the
+// two ends never share a message. Priorities are ignored, and peek, transform and error handlers are never called
+type memoryChannel struct {
+	id          *identity.TokenId
+	peer        *memoryChannel
+	rxQueue     chan *channel2.Message
+	closeNotify chan struct{}
+
+	lock            sync.Mutex
+	logicalName     string
+	closed          bool
+	sequence        uint32
+	receiveHandlers map[int32]channel2.ReceiveHandler
+	closeHandlers   []channel2.CloseHandler
+	waiters         map[uint32]chan *channel2.Message
+	userData        interface{}
+}
+
+// newMemoryChannelPair returns two connected channels, each delivering what the other sends
+func newMemoryChannelPair(logicalName string, id *identity.TokenId, peerLogicalName string, peerId *identity.TokenId) (*memoryChannel, *memoryChannel) {
+	ch := newMemoryChannel(logicalName, id)
+	peer := newMemoryChannel(peerLogicalName, peerId)
+	ch.peer = peer
+	peer.peer = ch
+	go ch.rxer()
+	go peer.rxer()
+	return ch, peer
+}
+
+func newMemoryChannel(logicalName string, id *identity.TokenId) *memoryChannel {
+	return &memoryChannel{
+		id:              id,
+		rxQueue:         make(chan *channel2.Message, rxQueueSize),
+		closeNotify:     make(chan struct{}),
+		logicalName:     logicalName,
+		receiveHandlers: map[int32]channel2.ReceiveHandler{},
+		waiters:         map[uint32]chan *channel2.Message{},
+	}
+}
+
+func (ch *memoryChannel) Id() *identity.TokenId {
+	return ch.id
+}
+
+func (ch *memoryChannel) LogicalName() string {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.logicalName
+}
+
+func (ch *memoryChannel) SetLogicalName(logicalName string) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.logicalName = logicalName
+}
+
+func (ch *memoryChannel) ConnectionId() string {
+	return ch.id.Token
+}
+
+func (ch *memoryChannel) Certificates() []*x509.Certificate {
+	return nil
+}
+
+func (ch *memoryChannel) Label() string {
+	return fmt.Sprintf("ch{%s}->{memory}", ch.LogicalName())
+}
+
+func (ch *memoryChannel) Bind(h channel2.BindHandler) error {
+	return h.BindChannel(ch)
+}
+
+func (ch *memoryChannel) AddPeekHandler(channel2.PeekHandler) {}
+
+func (ch *memoryChannel) AddTransformHandler(channel2.TransformHandler) {}
+
+func (ch *memoryChannel) AddReceiveHandler(h channel2.ReceiveHandler) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.receiveHandlers[h.ContentType()] = h
+}
+
+func (ch *memoryChannel) AddErrorHandler(channel2.ErrorHandler) {}
+
+func (ch *memoryChannel) AddCloseHandler(h channel2.CloseHandler) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.closeHandlers = append(ch.closeHandlers, h)
+}
+
+func (ch *memoryChannel) SetUserData(data interface{}) {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	ch.userData = data
+}
+
+func (ch *memoryChannel) GetUserData() interface{} {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.userData
+}
+
+func (ch *memoryChannel) Send(m *channel2.Message) error {
+	return ch.send(m, nil, nil)
+}
+
+func (ch *memoryChannel) SendWithPriority(m *channel2.Message, _ channel2.Priority) error {
+	return ch.send(m, nil, nil)
+}
+
+func (ch *memoryChannel) SendAndSync(m *channel2.Message) (chan error, error) {
+	syncC := make(chan error, 1)
+	syncC <- ch.send(m, nil, nil)
+	return syncC, nil
+}
+
+func (ch *memoryChannel) SendAndSyncWithPriority(m *channel2.Message, _ channel2.Priority) (chan error, error) {
+	return ch.SendAndSync(m)
+}
+
+func (ch *memoryChannel) SendWithTimeout(m *channel2.Message, timeout time.Duration) error {
+	return ch.send(m, nil, time.After(timeout))
+}
+
+func (ch *memoryChannel) SendAndWaitWithTimeout(m *channel2.Message, timeout time.Duration) (*channel2.Message, error) {
+	waitC, err := ch.SendAndWait(m)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-waitC:
+		return reply, nil
+	case <-ch.closeNotify:
+		return nil, errChannelClosed
+	case <-time.After(timeout):
+		return nil, errors.New("timeout waiting for response")
+	}
+}
+
+func (ch *memoryChannel) SendAndWait(m *channel2.Message) (chan *channel2.Message, error) {
+	waitC := make(chan *channel2.Message, 1)
+	if err := ch.send(m, waitC, nil); err != nil {
+		return nil, err
+	}
+	return waitC, nil
+}
+
+func (ch *memoryChannel) SendAndWaitWithPriority(m *channel2.Message, _ channel2.Priority) (chan *channel2.Message, error) {
+	return ch.SendAndWait(m)
+}
+
+func (ch *memoryChannel) SendForReply(msg channel2.TypedMessage, timeout time.Duration) (*channel2.Message, error) {
+	body, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	return ch.SendAndWaitWithTimeout(channel2.NewMessage(msg.GetContentType(), body), timeout)
+}
+
+func (ch *memoryChannel) SendForReplyAndDecode(msg channel2.TypedMessage, timeout time.Duration, result channel2.TypedMessage) error {
+	reply, err := ch.SendForReply(msg, timeout)
+	if err != nil {
+		return err
+	}
+	if reply.ContentType != result.GetContentType() {
+		return errors.Errorf("unexpected response type %v to request of type %v. expected %v",
+			reply.ContentType, msg.GetContentType(), result.GetContentType())
+	}
+	return proto.Unmarshal(reply.Body, result)
+}
+
+// send copies the message, stamps it with the next sequence and queues it on the peer. If waitC is set, the reply
+// to the message is delivered on it. A nil timeout waits until the message is queued or either end is closed
+func (ch *memoryChannel) send(m *channel2.Message, waitC chan *channel2.Message, timeout <-chan time.Time) error {
+	msg := channel2.NewMessage(m.ContentType, m.Body)
+	for k, v := range m.Headers {
+		msg.Headers[k] = v
+	}
+
+	// a reflected sequence means the message was built with ReplyTo from one the peer sent
+	if replyFor, found := msg.Headers[sequenceHeader]; found {
+		msg.Headers[channel2.ReplyForHeader] = replyFor
+	}
+
+	ch.lock.Lock()
+	if ch.closed {
+		ch.lock.Unlock()
+		return errChannelClosed
+	}
+	ch.sequence++
+	sequence := ch.sequence
+	if waitC != nil {
+		ch.waiters[sequence] = waitC
+	}
+	ch.lock.Unlock()
+	msg.PutUint32Header(sequenceHeader, sequence)
+
+	select {
+	case ch.peer.rxQueue <- msg:
+		return nil
+	case <-ch.closeNotify:
+	case <-ch.peer.closeNotify:
+	case <-timeout:
+		ch.removeWaiter(sequence)
+		return errors.New("write deadline exceeded")
+	}
+	ch.removeWaiter(sequence)
+	return errChannelClosed
+}
+
+func (ch *memoryChannel) removeWaiter(sequence uint32) chan *channel2.Message {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	waitC := ch.waiters[sequence]
+	delete(ch.waiters, sequence)
+	return waitC
+}
+
+func (ch *memoryChannel) rxer() {
+	for {
+		select {
+		case msg := <-ch.rxQueue:
+			ch.dispatch(msg)
+		case <-ch.closeNotify:
+			return
+		}
+	}
+}
+
+func (ch *memoryChannel) dispatch(msg *channel2.Message) {
+	if msg.IsReply() {
+		if waitC := ch.removeWaiter(uint32(msg.ReplyFor())); waitC != nil {
+			waitC <- msg
+			return
+		}
+	}
+
+	ch.lock.Lock()
+	handler, found := ch.receiveHandlers[msg.ContentType]
+	if !found {
+		handler, found = ch.receiveHandlers[channel2.AnyContentType]
+	}
+	ch.lock.Unlock()
+
+	if found {
+		handler.HandleReceive(msg, ch)
+	} else {
+		edge.Log().WithField("channel", ch.Label()).Warnf("dropped message [%d]", msg.ContentType)
+	}
+}
+
+func (ch *memoryChannel) Close() error {
+	ch.lock.Lock()
+	if ch.closed {
+		ch.lock.Unlock()
+		return nil
+	}
+	ch.closed = true
+	close(ch.closeNotify)
+	closeHandlers := ch.closeHandlers
+	ch.waiters = map[uint32]chan *channel2.Message{}
+	ch.lock.Unlock()
+
+	for _, h := range closeHandlers {
+		h.HandleClose(ch)
+	}
+
+	// closing either end closes the other, as a dropped underlay would
+	return ch.peer.Close()
+}
+
+func (ch *memoryChannel) IsClosed() bool {
+	ch.lock.Lock()
+	defer ch.lock.Unlock()
+	return ch.closed
+}
+
+// Underlay returns nil, there is no underlay beneath a memory channel
+func (ch *memoryChannel) Underlay() channel2.Underlay {
+	return nil
+}
@@ -0,0 +1,459 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package edgetest provides an in-memory stand-in for an edge router, so that dialing, binding and data flow
+// through the SDK can be exercised in-process without a controller, router or network.
+//
+// Channels returned by Router.Dial are the SDK side of an in-memory channel2.Channel and are used wherever the SDK
+// would use a channel to a real router, typically by wrapping them with impl.NewEdgeConnFactory. The router routes
+// a connect to the bind which used the same session token.
+package edgetest
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/openziti/foundation/channel2"
+	"github.com/openziti/foundation/identity/identity"
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+const DialTimeout = 5 * time.Second
+
+type Router struct {
+	name         string
+	lock         sync.Mutex
+	bindings     map[string]*Binding
+	circuits     map[endpoint]endpoint
+	channels     map[channel2.Channel]struct{}
+	connectDelay time.Duration
+	latency      time.Duration
+	dropConnects bool
+	closed       bool
+	closeNotify  chan struct{}
+	// pending tracks goroutines which send on the router's channels, so Close can wait for them
+	pending sync.WaitGroup
+}
+
+// Binding describes a bind the router has accepted from a hosting SDK
+type Binding struct {
+	Token      string
+	ConnId     uint32
+	PublicKey  []byte
+	Cost       uint16
+	Precedence edge.Precedence
+	// IdentitySecret is the terminator identity secret, as last bound or updated
+	IdentitySecret string
+	Headers        map[int32][]byte
+	ch             channel2.Channel
+}
+
+type endpoint struct {
+	ch     channel2.Channel
+	connId uint32
+}
+
+func NewRouter(name string) *Router {
+	return &Router{
+		name:        name,
+		bindings:    map[string]*Binding{},
+		circuits:    map[endpoint]endpoint{},
+		channels:    map[channel2.Channel]struct{}{},
+		closeNotify: make(chan struct{}),
+	}
+}
+
+func (router *Router) Name() string {
+	return router.name
+}
+
+// Dial creates a new in-memory channel to the router and returns the SDK side of it
+func (router *Router) Dial() (channel2.Channel, error) {
+	routerCh, sdkCh := newMemoryChannelPair("edgetest-"+router.name, &identity.TokenId{Token: router.name},
+		"ziti-sdk", &identity.TokenId{Token: "ziti-sdk"})
+	router.bind(routerCh)
+	return sdkCh, nil
+}
+
+// SetConnectDelay makes the router wait before handling each connect, to simulate a slow router
+func (router *Router) SetConnectDelay(delay time.Duration) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.connectDelay = delay
+}
+
+// SetDropConnects makes the router ignore connect requests, never replying to them, to simulate a router which
+// keeps the channel up but has stopped handling dials
+func (router *Router) SetDropConnects(drop bool) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.dropConnects = drop
+}
+
+// SetLatency delays each forwarded data and close message, to simulate a high latency link
+func (router *Router) SetLatency(latency time.Duration) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	router.latency = latency
+}
+
+// GetBinding returns the current bind for the given session token, if there is one
+func (router *Router) GetBinding(token string) (Binding, bool) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	if binding, found := router.bindings[token]; found {
+		return *binding, true
+	}
+	return Binding{}, false
+}
+
+// CircuitCount returns the number of connected dialer/host conn pairs
+func (router *Router) CircuitCount() int {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	return len(router.circuits) / 2
+}
+
+// Close stops the router's forwarding and connect goroutines, waits for them to finish, then closes all channels to
+// the router
+func (router *Router) Close() {
+	router.lock.Lock()
+	if router.closed {
+		router.lock.Unlock()
+		return
+	}
+	router.closed = true
+	close(router.closeNotify)
+	router.lock.Unlock()
+
+	router.pending.Wait()
+
+	router.lock.Lock()
+	var channels []channel2.Channel
+	for ch := range router.channels {
+		channels = append(channels, ch)
+	}
+	router.lock.Unlock()
+
+	// closing a channel calls back into HandleClose, which takes the lock
+	for _, ch := range channels {
+		_ = ch.Close()
+	}
+}
+
+// goLocked runs f on a goroutine which Close waits for. It does nothing once the router is closed. The router lock
+// must be held
+func (router *Router) goLocked(f func()) {
+	if router.closed {
+		return
+	}
+	router.pending.Add(1)
+	go func() {
+		defer router.pending.Done()
+		f()
+	}()
+}
+
+func (router *Router) bind(ch channel2.Channel) {
+	router.lock.Lock()
+	router.channels[ch] = struct{}{}
+	router.lock.Unlock()
+
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeBind, Handler: router.handleBind})
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeUnbind, Handler: router.handleUnbind})
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeUpdateBind, Handler: router.handleUpdateBind})
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeData, Handler: router.forward})
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeStateClosed, Handler: router.handleStateClosed})
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeStateAck, Handler: router.forward})
+	// connect waits on a reply from the host, which may be on this same channel, so it can't block the rx loop
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{Type: edge.ContentTypeConnect, Handler: func(msg *channel2.Message, ch channel2.Channel) {
+		router.lock.Lock()
+		defer router.lock.Unlock()
+		router.goLocked(func() { router.handleConnect(msg, ch) })
+	}})
+	ch.AddCloseHandler(router)
+}
+
+func (router *Router) handleBind(msg *channel2.Message, ch channel2.Channel) {
+	connId, _ := msg.GetUint32Header(edge.ConnIdHeader)
+	binding := &Binding{
+		Token:     string(msg.Body),
+		ConnId:    connId,
+		PublicKey: msg.Headers[edge.PublicKeyHeader],
+		Headers:   copyHeaders(msg, false),
+		ch:        ch,
+	}
+	if cost, found := msg.GetUint16Header(edge.CostHeader); found {
+		binding.Cost = cost
+	}
+	if precedence, found := msg.Headers[edge.PrecedenceHeader]; found && len(precedence) == 1 {
+		binding.Precedence = edge.Precedence(precedence[0])
+	}
+	binding.IdentitySecret = string(msg.Headers[edge.TerminatorIdentitySecretHeader])
+
+	router.lock.Lock()
+	router.bindings[binding.Token] = binding
+	router.lock.Unlock()
+
+	reply := edge.NewStateConnectedMsg(connId)
+	if identity, found := msg.Headers[edge.TerminatorIdentityHeader]; found {
+		reply.Headers[edge.TerminatorIdentityHeader] = identity
+	}
+	reply.ReplyTo(msg)
+	router.send(ch, reply)
+}
+
+func (router *Router) handleUnbind(msg *channel2.Message, _ channel2.Channel) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+	delete(router.bindings, string(msg.Body))
+}
+
+func (router *Router) handleUpdateBind(msg *channel2.Message, _ channel2.Channel) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	if binding, found := router.bindings[string(msg.Body)]; found {
+		if cost, found := msg.GetUint16Header(edge.CostHeader); found {
+			binding.Cost = cost
+		}
+		if precedence, found := msg.Headers[edge.PrecedenceHeader]; found && len(precedence) == 1 {
+			binding.Precedence = edge.Precedence(precedence[0])
+		}
+		if secret, found := msg.Headers[edge.TerminatorIdentitySecretHeader]; found {
+			binding.IdentitySecret = string(secret)
+		}
+	}
+}
+
+func (router *Router) handleConnect(msg *channel2.Message, ch channel2.Channel) {
+	connId, _ := msg.GetUint32Header(edge.ConnIdHeader)
+	token := string(msg.Body)
+	logger := edge.Log().WithField("connId", connId).WithField("router", router.name)
+
+	router.lock.Lock()
+	delay := router.connectDelay
+	drop := router.dropConnects
+	router.lock.Unlock()
+	if drop {
+		logger.Debug("dropping connect request")
+		return
+	}
+	select {
+	case <-time.After(delay):
+	case <-router.closeNotify:
+		return
+	}
+
+	router.lock.Lock()
+	binding, found := router.bindings[token]
+	router.lock.Unlock()
+
+	if !found {
+		router.replyClosed(ch, msg, connId, "no binding for session token")
+		return
+	}
+
+	if identity, requested := msg.Headers[edge.TerminatorIdentityHeader]; requested &&
+		string(identity) != string(binding.Headers[edge.TerminatorIdentityHeader]) {
+		router.replyClosed(ch, msg, connId, fmt.Sprintf("no terminator with identity %v", string(identity)))
+		return
+	}
+
+	if instanceId, requested := msg.Headers[edge.TerminatorInstanceIdHeader]; requested &&
+		string(instanceId) != string(binding.Headers[edge.TerminatorInstanceIdHeader]) {
+		router.replyClosed(ch, msg, connId, fmt.Sprintf("no terminator with instance id %v", string(instanceId)))
+		return
+	}
+
+	dial := edge.NewDialMsg(binding.ConnId, token)
+	for k, v := range copyHeaders(msg, true) {
+		dial.Headers[k] = v
+	}
+
+	dialReply, err := router.sendAndWait(binding.ch, dial)
+	if err != nil {
+		logger.WithError(err).Error("dial to host failed")
+		router.replyClosed(ch, msg, connId, err.Error())
+		return
+	}
+
+	result, err := edge.UnmarshalDialResult(dialReply)
+	if err != nil || !result.Success {
+		reason := "dial failed"
+		if err != nil {
+			reason = err.Error()
+		} else if result.Message != "" {
+			reason = result.Message
+		}
+		router.replyClosed(ch, msg, connId, reason)
+		return
+	}
+
+	dialer := endpoint{ch: ch, connId: connId}
+	host := endpoint{ch: binding.ch, connId: result.NewConnId}
+
+	router.lock.Lock()
+	router.circuits[dialer] = host
+	router.circuits[host] = dialer
+	router.lock.Unlock()
+
+	start := edge.NewStateConnectedMsg(result.NewConnId)
+	start.ReplyTo(dialReply)
+	router.send(binding.ch, start)
+
+	reply := edge.NewStateConnectedMsg(connId)
+	for k, v := range copyHeaders(dialReply, true) {
+		reply.Headers[k] = v
+	}
+	if binding.PublicKey != nil {
+		reply.Headers[edge.PublicKeyHeader] = binding.PublicKey
+	}
+	reply.ReplyTo(msg)
+	router.send(ch, reply)
+}
+
+func (router *Router) forward(msg *channel2.Message, ch channel2.Channel) {
+	connId, _ := msg.GetUint32Header(edge.ConnIdHeader)
+
+	router.lock.Lock()
+	peer, found := router.circuits[endpoint{ch: ch, connId: connId}]
+	latency := router.latency
+	router.lock.Unlock()
+
+	if !found {
+		edge.Log().WithField("connId", connId).Debugf("no circuit for message of type %v", msg.ContentType)
+		return
+	}
+
+	forwarded := channel2.NewMessage(msg.ContentType, msg.Body)
+	for k, v := range copyHeaders(msg, false) {
+		forwarded.Headers[k] = v
+	}
+	forwarded.PutUint32Header(edge.ConnIdHeader, peer.connId)
+	if latency > 0 {
+		// messages carry sequence numbers, so the receiving conn puts them back in order if timers fire out of order
+		router.lock.Lock()
+		defer router.lock.Unlock()
+		router.goLocked(func() {
+			select {
+			case <-time.After(latency):
+				router.send(peer.ch, forwarded)
+			case <-router.closeNotify:
+			}
+		})
+		return
+	}
+	router.send(peer.ch, forwarded)
+}
+
+func (router *Router) handleStateClosed(msg *channel2.Message, ch channel2.Channel) {
+	router.forward(msg, ch)
+
+	connId, _ := msg.GetUint32Header(edge.ConnIdHeader)
+	local := endpoint{ch: ch, connId: connId}
+
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	if peer, found := router.circuits[local]; found {
+		delete(router.circuits, local)
+		delete(router.circuits, peer)
+	}
+
+	for token, binding := range router.bindings {
+		if binding.ch == ch && binding.ConnId == connId {
+			delete(router.bindings, token)
+		}
+	}
+}
+
+func (router *Router) HandleClose(ch channel2.Channel) {
+	router.lock.Lock()
+	defer router.lock.Unlock()
+
+	delete(router.channels, ch)
+
+	for token, binding := range router.bindings {
+		if binding.ch == ch {
+			delete(router.bindings, token)
+		}
+	}
+
+	for local, peer := range router.circuits {
+		if local.ch == ch {
+			delete(router.circuits, local)
+			delete(router.circuits, peer)
+			if peer.ch != ch {
+				peer := peer
+				router.goLocked(func() {
+					router.send(peer.ch, edge.NewStateClosedMsg(peer.connId, "router channel closed"))
+				})
+			}
+		}
+	}
+}
+
+func (router *Router) replyClosed(ch channel2.Channel, request *channel2.Message, connId uint32, reason string) {
+	reply := edge.NewStateClosedMsg(connId, reason)
+	reply.ReplyTo(request)
+	router.send(ch, reply)
+}
+
+// sendAndWait sends a request and waits for the reply, giving up if the router is closed
+func (router *Router) sendAndWait(ch channel2.Channel, msg *channel2.Message) (*channel2.Message, error) {
+	replyC, err := ch.SendAndWait(msg)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-replyC:
+		return reply, nil
+	case <-router.closeNotify:
+		return nil, errors.New("router closed")
+	case <-time.After(DialTimeout):
+		return nil, errors.New("timeout waiting for response")
+	}
+}
+
+func (router *Router) send(ch channel2.Channel, msg *channel2.Message) {
+	if err := ch.Send(msg); err != nil {
+		edge.Log().WithField("router", router.name).WithError(err).Debugf("failed to send %v", msg.ContentType)
+	}
+}
+
+// copyHeaders copies the edge and application headers from a message, leaving out channel headers, including the
+// memory channel's sequence. If
+// skipRouting is set, the conn id and sequence headers are left out as well
+func copyHeaders(msg *channel2.Message, skipRouting bool) map[int32][]byte {
+	result := map[int32][]byte{}
+	for k, v := range msg.Headers {
+		if k == sequenceHeader || (k <= channel2.MaxReflectedHeader && k&channel2.ReflectedHeaderBitMask == 0) {
+			continue
+		}
+		if skipRouting && (k == edge.ConnIdHeader || k == edge.SeqHeader) {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+func (binding Binding) String() string {
+	return fmt.Sprintf("[Binding token=%v, connId=%v, cost=%v, precedence=%v]", binding.Token, binding.ConnId, binding.Cost, binding.Precedence)
+}
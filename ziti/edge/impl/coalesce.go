@@ -0,0 +1,121 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package impl
+
+import (
+	"sync"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+)
+
+// writeCoalescer gathers small writes into a buffer, which is sent as one data message once it fills to a frame or
+// the window passes. Writes are copied into the buffer, so the caller's data isn't retained
+type writeCoalescer struct {
+	lock   sync.Mutex
+	window time.Duration
+	send   func(data []byte) error
+	buf    []byte
+	timer  *time.Timer
+	err    error
+}
+
+func newWriteCoalescer(window time.Duration, send func(data []byte) error) *writeCoalescer {
+	return &writeCoalescer{
+		window: window,
+		send:   send,
+	}
+}
+
+// write adds data to the buffer, sending it if it fills a frame. A failed earlier send is returned instead
+func (coalescer *writeCoalescer) write(data []byte) (int, error) {
+	coalescer.lock.Lock()
+	defer coalescer.lock.Unlock()
+
+	if coalescer.err != nil {
+		return 0, coalescer.err
+	}
+
+	// a full frame on its own gains nothing from the copy
+	if len(coalescer.buf) == 0 && len(data) >= edge.WriteCoalesceFrameSize {
+		if err := coalescer.send(data); err != nil {
+			coalescer.err = err
+			return 0, err
+		}
+		return len(data), nil
+	}
+
+	coalescer.buf = append(coalescer.buf, data...)
+	if len(coalescer.buf) >= edge.WriteCoalesceFrameSize {
+		if err := coalescer.flushLocked(); err != nil {
+			return 0, err
+		}
+	} else if coalescer.timer == nil {
+		coalescer.timer = time.AfterFunc(coalescer.window, coalescer.flushOnTimer)
+	}
+	return len(data), nil
+}
+
+// flush sends whatever is buffered, returning the error from this or an earlier send
+func (coalescer *writeCoalescer) flush() error {
+	coalescer.lock.Lock()
+	defer coalescer.lock.Unlock()
+	if coalescer.err != nil {
+		return coalescer.err
+	}
+	return coalescer.flushLocked()
+}
+
+// discard drops whatever is buffered without sending it, and fails later writes with ErrConnClosed
+func (coalescer *writeCoalescer) discard() {
+	coalescer.lock.Lock()
+	defer coalescer.lock.Unlock()
+	if coalescer.timer != nil {
+		coalescer.timer.Stop()
+		coalescer.timer = nil
+	}
+	coalescer.buf = nil
+	if coalescer.err == nil {
+		coalescer.err = edge.ErrConnClosed
+	}
+}
+
+func (coalescer *writeCoalescer) flushOnTimer() {
+	if err := coalescer.flush(); err != nil {
+		edge.Log().WithError(err).Debug("failed to send coalesced writes")
+	}
+}
+
+// flushLocked sends the buffer. Must be called with the lock held
+func (coalescer *writeCoalescer) flushLocked() error {
+	if coalescer.timer != nil {
+		coalescer.timer.Stop()
+		coalescer.timer = nil
+	}
+	if len(coalescer.buf) == 0 {
+		return nil
+	}
+
+	// the buffer is handed off rather than reused, in case the send holds on to it
+	data := coalescer.buf
+	coalescer.buf = nil
+	if err := coalescer.send(data); err != nil {
+		coalescer.err = err
+		return err
+	}
+	return nil
+}
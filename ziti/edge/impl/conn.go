@@ -17,19 +17,21 @@
 package impl
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/michaelquigley/pfxlog"
 	"github.com/netfoundry/secretstream"
 	"github.com/netfoundry/secretstream/kx"
 	"github.com/openziti/foundation/channel2"
 	"github.com/openziti/foundation/util/concurrenz"
 	"github.com/openziti/foundation/util/sequence"
 	"github.com/openziti/foundation/util/sequencer"
+	"github.com/openziti/foundation/util/stringz"
 	"github.com/openziti/sdk-golang/ziti/edge"
 	"github.com/pkg/errors"
 )
@@ -40,6 +42,36 @@ func init() {
 	connSeq = sequence.NewSequence()
 }
 
+// MaxConnIdAttempts is the number of conn ids tried when registering a new conn before giving up
+const MaxConnIdAttempts = 3
+
+// nextConnId generates conn ids. Tests replace it to force collisions
+var nextConnId = func() uint32 {
+	return connSeq.Next()
+}
+
+// registerNewConn creates a conn with a fresh id and adds it to the mux. If the id is already in use, the conn is
+// recreated with a new id, up to MaxConnIdAttempts times
+func registerNewConn(router *routerConn, msgMux *edge.MsgMux, newConn func(id uint32) *edgeConn) (*edgeConn, error) {
+	var edgeCh *edgeConn
+	var err error
+	if router != nil && router.draining.Get() {
+		return newConn(0), edge.ErrRouterConnDraining
+	}
+	for attempt := 0; attempt < MaxConnIdAttempts; attempt++ {
+		edgeCh = newConn(nextConnId())
+		if err = msgMux.AddMsgSink(edgeCh); err == nil || !errors.Is(err, edge.ErrDuplicateSinkId) {
+			return edgeCh, err
+		}
+		if router != nil {
+			atomic.AddUint64(&router.stats.ConnIdCollisions, 1)
+		}
+		edge.Log().WithField("connId", edgeCh.GlobalId()).WithField("attempt", attempt+1).
+			Warn("conn id already in use, retrying with new id")
+	}
+	return edgeCh, errors.Wrapf(err, "unable to register conn after %v attempts", MaxConnIdAttempts)
+}
+
 type edgeConn struct {
 	edge.MsgChannel
 	readQ        sequencer.Sequencer
@@ -47,8 +79,38 @@ type edgeConn struct {
 	msgMux       *edge.MsgMux
 	hosting      sync.Map
 	closed       concurrenz.AtomicBoolean
-	serviceId    string
+	serviceName  string
 	readDeadline time.Time
+	readTimeout  time.Duration
+	router       *routerConn
+	stats        *edge.ConnStats
+	inbound      bool
+	compression  edge.Compression
+	protocol     string
+	instanceId   string
+	connHeaders  map[int32][]byte
+	arrived      time.Time
+	recvBufSize  int64
+	recvBuffered int64
+	bufferedLock sync.Mutex
+	bufferedDone bool
+	maxMsgSize   int
+	maxHeaders   int
+	readErr      error
+	readAhead    bool
+	strictOrder  bool
+	lastSeq      uint32
+	prefetchOnce sync.Once
+	prefetchC    chan prefetchResult
+	coalescer    *writeCoalescer
+	linger       time.Duration
+
+	closeLock     sync.Mutex
+	closeNotified bool
+	closeCause    error
+	closeHandlers []func(error)
+	draining      bool
+	drainHandlers []func()
 
 	keyPair  *kx.KeyPair
 	rxKey    []byte
@@ -56,44 +118,397 @@ type edgeConn struct {
 	sender   secretstream.Encryptor
 }
 
+func newEdgeConn(router *routerConn, ch channel2.Channel, msgMux *edge.MsgMux, id uint32, serviceName string) *edgeConn {
+	return &edgeConn{
+		MsgChannel:  *edge.NewEdgeMsgChannel(ch, id),
+		readQ:       sequencer.NewSingleWriterSeq(DefaultMaxOutOfOrderMsgs),
+		msgMux:      msgMux,
+		serviceName: serviceName,
+		router:      router,
+		stats:       &edge.ConnStats{},
+		recvBufSize: edge.DefaultRecvBufferSize,
+		maxMsgSize:  edge.DefaultMaxMessageSize,
+		maxHeaders:  edge.DefaultMaxHeaders,
+	}
+}
+
+func (conn *edgeConn) setMaxMessageSize(size int) {
+	if size > 0 {
+		conn.maxMsgSize = size
+	}
+}
+
+func (conn *edgeConn) setMaxHeaders(count int) {
+	if count > 0 {
+		conn.maxHeaders = count
+	}
+}
+
+// setWriteCoalesceWindow coalesces writes made from now on, if window is set
+func (conn *edgeConn) setWriteCoalesceWindow(window time.Duration) {
+	if window > 0 {
+		conn.coalescer = newWriteCoalescer(window, func(data []byte) error {
+			_, err := conn.write(data, true, 0)
+			return err
+		})
+	}
+}
+
+func (conn *edgeConn) setRecvBufferSize(size int) {
+	if size > 0 {
+		atomic.StoreInt64(&conn.recvBufSize, int64(size))
+	}
+}
+
+// reserveRecvBuffer accounts for n bytes of received data, returning false if that would exceed the receive buffer
+func (conn *edgeConn) reserveRecvBuffer(n int) bool {
+	conn.bufferedLock.Lock()
+	defer conn.bufferedLock.Unlock()
+	if atomic.LoadInt64(&conn.recvBuffered)+int64(n) > atomic.LoadInt64(&conn.recvBufSize) {
+		return false
+	}
+	conn.addRecvBufferedLocked(n)
+	return true
+}
+
+// addRecvBuffered adjusts the received data buffered by the conn, along with the mux's count across its conns
+func (conn *edgeConn) addRecvBuffered(delta int) {
+	conn.bufferedLock.Lock()
+	defer conn.bufferedLock.Unlock()
+	conn.addRecvBufferedLocked(delta)
+}
+
+// addRecvBufferedLocked is addRecvBuffered for callers holding bufferedLock. Once the conn has closed and handed its
+// buffered data back to the mux, only the conn's own count changes
+func (conn *edgeConn) addRecvBufferedLocked(delta int) {
+	atomic.AddInt64(&conn.recvBuffered, int64(delta))
+	if !conn.bufferedDone && conn.msgMux != nil {
+		conn.msgMux.AddBufferedBytes(delta)
+	}
+}
+
+// releaseRecvBuffered takes whatever the conn still has buffered off the mux's count, once it has closed
+func (conn *edgeConn) releaseRecvBuffered() {
+	conn.bufferedLock.Lock()
+	defer conn.bufferedLock.Unlock()
+	if !conn.bufferedDone && conn.msgMux != nil {
+		conn.msgMux.AddBufferedBytes(-int(atomic.LoadInt64(&conn.recvBuffered)))
+	}
+	conn.bufferedDone = true
+}
+
+func (conn *edgeConn) SetRecvWindow(size int) error {
+	if err := edge.CheckWindowSize(size); err != nil {
+		return err
+	}
+	conn.setRecvBufferSize(size)
+	return nil
+}
+
+// failRead closes the conn, with reads returning err rather than EOF
+func (conn *edgeConn) failRead(err error) {
+	conn.closeLock.Lock()
+	conn.readErr = err
+	conn.closeLock.Unlock()
+	_ = conn.close(false, err)
+}
+
+// getReadErr returns the error reads should fail with once the conn is closed
+func (conn *edgeConn) getReadErr() error {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+	if conn.readErr != nil {
+		return conn.readErr
+	}
+	return io.EOF
+}
+
+// getWriteErr returns the error writes should fail with once the conn is closed. If the conn was closed for a
+// known reason, such as the router conn closing, that's returned rather than err
+func (conn *edgeConn) getWriteErr(err error) error {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+	if conn.readErr != nil {
+		return conn.readErr
+	}
+	return err
+}
+
 func (conn *edgeConn) Write(data []byte) (int, error) {
-	if conn.sender != nil {
-		cipherData, err := conn.sender.Push(data, secretstream.TagMessage)
+	if conn.coalescer != nil {
+		if conn.closed.Get() {
+			return 0, conn.getWriteErr(edge.ErrConnClosed)
+		}
+		return conn.coalescer.write(data)
+	}
+	return conn.write(data, true, 0)
+}
+
+func (conn *edgeConn) WriteNoSync(data []byte) (int, error) {
+	if err := conn.flushCoalesced(); err != nil {
+		return 0, err
+	}
+	return conn.write(data, false, 0)
+}
+
+func (conn *edgeConn) WriteMessage(msg []byte) error {
+	if err := conn.flushCoalesced(); err != nil {
+		return err
+	}
+	_, err := conn.write(msg, true, conn.maxMsgSize)
+	return err
+}
+
+// flushCoalesced sends any coalesced writes, so that they stay ahead of data written some other way
+func (conn *edgeConn) flushCoalesced() error {
+	if conn.coalescer == nil {
+		return nil
+	}
+	return conn.coalescer.flush()
+}
+
+func (conn *edgeConn) ReadMessage() ([]byte, error) {
+	if conn.closed.Get() {
+		return nil, conn.getReadErr()
+	}
+	return conn.nextPayload()
+}
+
+func (conn *edgeConn) WriteWithReceipt(data []byte) (edge.Receipt, error) {
+	if err := conn.flushCoalesced(); err != nil {
+		return nil, err
+	}
+	if !edge.PeerSupports(conn, edge.CapabilityReceipts) {
+		if _, err := conn.write(data, true, conn.maxMsgSize); err != nil {
+			return nil, err
+		}
+		return edge.FailedReceipt(edge.ErrReceiptsUnsupported), nil
+	}
+
+	payload, hdrs, err := conn.encode(data, conn.maxMsgSize)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := conn.MsgChannel.WriteTracedWithReceipt(payload, nil, hdrs)
+	if err != nil {
+		if errors.Is(err, edge.ErrConnClosed) {
+			err = conn.getWriteErr(err)
+		}
+		return nil, err
+	}
+	conn.recordWrite(len(data), len(payload))
+	return receipt, nil
+}
+
+// encode compresses and encrypts data for the wire, returning the payload and any headers describing it. If maxSize
+// is set, data which would go on the wire as a larger message is rejected with ErrMessageTooLarge
+func (conn *edgeConn) encode(data []byte, maxSize int) ([]byte, map[int32][]byte, error) {
+	payload := data
+	var hdrs map[int32][]byte
+
+	if conn.compression != edge.CompressionNone {
+		compressed, err := conn.compression.Compress(data)
 		if err != nil {
-			return 0, err
+			return nil, nil, err
+		}
+		// only send compressed if it actually saves us something
+		if len(compressed) < len(data) {
+			payload = compressed
+			hdrs = map[int32][]byte{edge.CompressedHeader: {byte(conn.compression)}}
+		}
+	}
+
+	if conn.sender != nil {
+		var err error
+		if payload, err = conn.sender.Push(payload, secretstream.TagMessage); err != nil {
+			return nil, nil, err
 		}
+	}
 
-		_, err = conn.MsgChannel.Write(cipherData)
-		return len(data), err
+	if maxSize > 0 && len(payload) > maxSize {
+		return nil, nil, edge.ErrMessageTooLarge
+	}
+	return payload, hdrs, nil
+}
+
+// write sends data as a single data message. If maxSize is set, data which would go on the wire as a larger
+// message is rejected with ErrMessageTooLarge
+func (conn *edgeConn) write(data []byte, sync bool, maxSize int) (int, error) {
+	payload, hdrs, err := conn.encode(data, maxSize)
+	if err != nil {
+		return 0, err
+	}
+
+	if sync {
+		_, err = conn.MsgChannel.WriteTracedWithHeaders(payload, nil, hdrs)
 	} else {
-		return conn.MsgChannel.Write(data)
+		_, err = conn.MsgChannel.WriteNoSyncTraced(payload, nil, hdrs)
+	}
+	if err != nil {
+		if errors.Is(err, edge.ErrConnClosed) {
+			err = conn.getWriteErr(err)
+		}
+		return 0, err
+	}
+
+	conn.recordWrite(len(data), len(payload))
+	return len(data), nil
+}
+
+func (conn *edgeConn) Stats() edge.ConnStats {
+	return edge.ConnStats{
+		BytesRead:    atomic.LoadUint64(&conn.stats.BytesRead),
+		BytesWritten: atomic.LoadUint64(&conn.stats.BytesWritten),
+		MsgsRead:     atomic.LoadUint64(&conn.stats.MsgsRead),
+		MsgsWritten:  atomic.LoadUint64(&conn.stats.MsgsWritten),
+		UnackedBytes: uint64(conn.GetUnackedBytes()),
+
+		WireBytesRead:     atomic.LoadUint64(&conn.stats.WireBytesRead),
+		WireBytesWritten:  atomic.LoadUint64(&conn.stats.WireBytesWritten),
+		LargestMsgRead:    atomic.LoadUint64(&conn.stats.LargestMsgRead),
+		LargestMsgWritten: atomic.LoadUint64(&conn.stats.LargestMsgWritten),
+		ReorderedMsgs:     atomic.LoadUint64(&conn.stats.ReorderedMsgs),
+	}
+}
+
+// storeMax raises the value at addr to val, if it's larger
+func storeMax(addr *uint64, val uint64) {
+	for current := atomic.LoadUint64(addr); val > current; current = atomic.LoadUint64(addr) {
+		if atomic.CompareAndSwapUint64(addr, current, val) {
+			return
+		}
+	}
+}
+
+// recordRead updates the conn's read stats, and those of its router connection. n is the size of the data
+// delivered to the application and wireLen its size on the wire
+func (conn *edgeConn) recordRead(n, wireLen int) {
+	atomic.AddUint64(&conn.stats.BytesRead, uint64(n))
+	atomic.AddUint64(&conn.stats.MsgsRead, 1)
+	atomic.AddUint64(&conn.stats.WireBytesRead, uint64(wireLen))
+	storeMax(&conn.stats.LargestMsgRead, uint64(wireLen))
+	if conn.router != nil {
+		atomic.AddUint64(&conn.router.stats.BytesRead, uint64(n))
+		atomic.AddUint64(&conn.router.stats.MsgsRead, 1)
+	}
+}
+
+// recordWrite updates the conn's write stats, and those of its router connection. n is the size of the data
+// written by the application and wireLen its size on the wire
+func (conn *edgeConn) recordWrite(n, wireLen int) {
+	atomic.AddUint64(&conn.stats.BytesWritten, uint64(n))
+	atomic.AddUint64(&conn.stats.MsgsWritten, 1)
+	atomic.AddUint64(&conn.stats.WireBytesWritten, uint64(wireLen))
+	storeMax(&conn.stats.LargestMsgWritten, uint64(wireLen))
+	if conn.router != nil {
+		atomic.AddUint64(&conn.router.stats.BytesWritten, uint64(n))
+		atomic.AddUint64(&conn.router.stats.MsgsWritten, 1)
+	}
+}
+
+func (conn *edgeConn) IsInbound() bool {
+	return conn.inbound
+}
+
+func (conn *edgeConn) SelectedProtocol() string {
+	return conn.protocol
+}
+
+func (conn *edgeConn) TerminatorInstanceId() string {
+	return conn.instanceId
+}
+
+func (conn *edgeConn) GetConnectHeader(key int32) ([]byte, bool) {
+	val, found := conn.connHeaders[key]
+	return val, found
+}
+
+// setConnectHeaders keeps a copy of the headers from the connect handshake for GetConnectHeader
+func (conn *edgeConn) setConnectHeaders(msg *channel2.Message) {
+	conn.connHeaders = make(map[int32][]byte, len(msg.Headers))
+	for k, v := range msg.Headers {
+		conn.connHeaders[k] = v
+	}
+}
+
+func (conn *edgeConn) Router() edge.RouterConn {
+	if conn.router == nil {
+		return nil
+	}
+	return conn.router
+}
+
+func (conn *edgeConn) getRouterName() string {
+	if conn.router == nil {
+		return ""
 	}
+	return conn.router.routerName
+}
+
+func (conn *edgeConn) GlobalId() string {
+	return edge.GlobalConnId(conn.getRouterName(), conn.Id())
 }
 
 func (conn *edgeConn) Accept(event *edge.MsgEvent) {
 	conn.TraceMsg("Accept", event.Msg)
 	if event.Msg.ContentType == edge.ContentTypeDial {
-		pfxlog.Logger().WithFields(edge.GetLoggerFields(event.Msg)).Debug("received dial request")
+		edge.Log().WithFields(edge.GetLoggerFields(event.Msg)).Debug("received dial request")
 		go conn.newChildConnection(event)
+	} else if len(event.Msg.Headers) > conn.maxHeaders {
+		edge.Log().WithFields(edge.GetLoggerFields(event.Msg)).
+			Errorf("message with %v headers exceeds max headers of %v, closing connection", len(event.Msg.Headers), conn.maxHeaders)
+		conn.failRead(edge.ErrTooManyHeaders)
+	} else if event.Msg.ContentType == edge.ContentTypeStateAck {
+		conn.HandleAck(event.Seq)
 	} else if event.Msg.ContentType == edge.ContentTypeStateClosed && event.Seq == 0 {
-		_ = conn.close(true)
+		_ = conn.close(true, edge.ErrClosedByRemote)
+	} else if event.Msg.ContentType == edge.ContentTypeData && len(event.Msg.Body) > conn.maxMsgSize {
+		edge.Log().WithFields(edge.GetLoggerFields(event.Msg)).
+			Errorf("message of %v bytes exceeds max message size of %v bytes, closing connection", len(event.Msg.Body), conn.maxMsgSize)
+		conn.failRead(edge.ErrMessageTooLarge)
+	} else if err := conn.checkSeq(event.Seq); err != nil {
+		edge.Log().WithFields(edge.GetLoggerFields(event.Msg)).WithError(err).
+			Error("strict ordering violated, closing connection")
+		conn.failRead(err)
+	} else if event.Msg.ContentType == edge.ContentTypeData && !conn.reserveRecvBuffer(len(event.Msg.Body)) {
+		edge.Log().WithFields(edge.GetLoggerFields(event.Msg)).
+			Errorf("receive buffer size of %v bytes exceeded, closing connection", atomic.LoadInt64(&conn.recvBufSize))
+		conn.failRead(edge.ErrRecvBufferExceeded)
 	} else if err := conn.readQ.PutSequenced(event.Seq, event); err != nil {
-		pfxlog.Logger().WithFields(edge.GetLoggerFields(event.Msg)).WithError(err).
+		edge.Log().WithFields(edge.GetLoggerFields(event.Msg)).WithError(err).
 			Error("error pushing edge message to sequencer")
+		if event.Msg.ContentType == edge.ContentTypeData {
+			conn.addRecvBuffered(-len(event.Msg.Body))
+		}
 	}
 }
 
-func (conn *edgeConn) NewConn(service string) edge.Conn {
-	id := connSeq.Next()
+// checkSeq counts messages arriving behind a later one. With strict ordering anything but the next sequence number
+// is an error. It's only called from Accept, so lastSeq needs no locking
+func (conn *edgeConn) checkSeq(seq uint32) error {
+	expected := conn.lastSeq + 1
+	if seq < expected {
+		atomic.AddUint64(&conn.stats.ReorderedMsgs, 1)
+	} else {
+		conn.lastSeq = seq
+	}
 
-	edgeCh := &edgeConn{
-		MsgChannel: *edge.NewEdgeMsgChannel(conn.Channel, id),
-		readQ:      sequencer.NewSingleWriterSeq(DefaultMaxOutOfOrderMsgs),
-		msgMux:     conn.msgMux,
-		serviceId:  service,
+	if conn.strictOrder && seq != expected {
+		if seq < expected {
+			return errors.Wrapf(edge.ErrOutOfOrder, "duplicate or late message %v, expected %v", seq, expected)
+		}
+		return errors.Wrapf(edge.ErrOutOfOrder, "messages %v to %v missing", expected, seq-1)
 	}
+	return nil
+}
 
-	_ = conn.msgMux.AddMsgSink(edgeCh) // duplicate errors only happen on the server side, since client controls ids
+func (conn *edgeConn) NewConn(service string) edge.Conn {
+	edgeCh, err := registerNewConn(conn.router, conn.msgMux, func(id uint32) *edgeConn {
+		return newEdgeConn(conn.router, conn.Channel, conn.msgMux, id, service)
+	})
+	if err != nil {
+		edge.Log().Errorf("error adding message sink %s[%d]: %v", service, edgeCh.Id(), err)
+	}
 	return edgeCh
 }
 
@@ -106,7 +521,11 @@ func (conn *edgeConn) Network() string {
 }
 
 func (conn *edgeConn) String() string {
-	return conn.serviceId
+	return conn.serviceName
+}
+
+func (conn *edgeConn) ServiceName() string {
+	return conn.serviceName
 }
 
 func (conn *edgeConn) LocalAddr() net.Addr {
@@ -129,29 +548,157 @@ func (conn *edgeConn) SetReadDeadline(t time.Time) error {
 	return nil
 }
 
-func (conn *edgeConn) HandleMuxClose() error {
-	return conn.close(true)
+func (conn *edgeConn) SetReadTimeout(timeout time.Duration) {
+	conn.readTimeout = timeout
+}
+
+// getReadDeadline returns the deadline for the next read, which is the earlier of the read deadline and the read
+// timeout from now
+func (conn *edgeConn) getReadDeadline() time.Time {
+	deadline := conn.readDeadline
+	if conn.readTimeout > 0 {
+		timeoutDeadline := time.Now().Add(conn.readTimeout)
+		if deadline.IsZero() || timeoutDeadline.Before(deadline) {
+			deadline = timeoutDeadline
+		}
+	}
+	return deadline
+}
+
+func (conn *edgeConn) HandleMuxClose(cause error) error {
+	conn.closeLock.Lock()
+	if conn.readErr == nil {
+		conn.readErr = cause
+	}
+	conn.closeLock.Unlock()
+	return conn.close(true, cause)
 }
 
 func (conn *edgeConn) HandleClose(channel2.Channel) {
-	logger := pfxlog.Logger().WithField("connId", conn.Id())
+	logger := edge.Log().WithField("connId", conn.GlobalId())
 	defer logger.Debug("received HandleClose from underlying channel, marking conn closed")
 	conn.readQ.Close()
 	conn.closed.Set(true)
+	conn.CancelWrites()
+	conn.notifyClosed(edge.ErrRouterConnClosed)
+}
+
+func (conn *edgeConn) OnClose(handler func(cause error)) {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+
+	if conn.closeNotified {
+		go handler(conn.closeCause)
+	} else {
+		conn.closeHandlers = append(conn.closeHandlers, handler)
+	}
+}
+
+func (conn *edgeConn) OnDrain(handler func()) {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+
+	if conn.draining {
+		go handler()
+	} else {
+		conn.drainHandlers = append(conn.drainHandlers, handler)
+	}
+}
+
+// drain is called when the router conn is closing gracefully. Listeners hosted on the conn are closed, so no new
+// dials arrive, and drain handlers are told to finish up
+func (conn *edgeConn) drain() {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+
+	if conn.draining {
+		return
+	}
+	conn.draining = true
+
+	conn.hosting.Range(func(key, value interface{}) bool {
+		listener := value.(*edgeListener)
+		go func() { _ = listener.Close() }()
+		return true
+	})
+
+	for _, handler := range conn.drainHandlers {
+		go handler()
+	}
+	conn.drainHandlers = nil
+}
+
+func (conn *edgeConn) notifyClosed(cause error) {
+	conn.closeLock.Lock()
+	defer conn.closeLock.Unlock()
+
+	if conn.closeNotified {
+		return
+	}
+
+	conn.closeNotified = true
+	conn.closeCause = cause
+	for _, handler := range conn.closeHandlers {
+		go handler(cause)
+	}
+	conn.closeHandlers = nil
 }
 
 func (conn *edgeConn) Connect(session *edge.Session) (edge.ServiceConn, error) {
-	logger := pfxlog.Logger().WithField("connId", conn.Id())
+	return conn.ConnectWithOptions(session, nil)
+}
+
+func (conn *edgeConn) ConnectWithOptions(session *edge.Session, options *edge.DialOptions) (edge.ServiceConn, error) {
+	if options == nil {
+		options = edge.DialOptionsFor(conn.serviceName)
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if conn.router != nil && conn.router.draining.Get() {
+		return nil, edge.ErrRouterConnDraining
+	}
+
+	logger := edge.Log().WithField("connId", conn.GlobalId())
+
+	conn.setRecvBufferSize(options.RecvBufferSize)
+	conn.setMaxMessageSize(options.MaxMessageSize)
+	conn.setMaxHeaders(options.MaxHeaders)
+	conn.readAhead = options.ReadAhead
+	conn.strictOrder = options.StrictOrdering
 
 	connectRequest := edge.NewConnectMsg(conn.Id(), session.Token, conn.keyPair.Public())
+	if options.Compression != edge.CompressionNone {
+		connectRequest.Headers[edge.CompressionHeader] = []byte{byte(options.Compression)}
+	}
+	edge.PutProtocolsHeader(connectRequest, options.Protocols)
+	edge.PutCapabilitiesHeaders(connectRequest)
+	if options.ClientHint != "" {
+		connectRequest.Headers[edge.ClientHintHeader] = []byte(options.ClientHint)
+	}
+	if options.AppData != nil {
+		connectRequest.Headers[edge.AppDataHeader] = options.AppData
+	}
+	if options.TerminatorSelector != nil {
+		if terminator, ok := options.TerminatorSelector(options.Terminators); ok {
+			logger.Debugf("dialing terminator with identity [%v]", terminator.Identity)
+			connectRequest.Headers[edge.TerminatorIdentityHeader] = []byte(terminator.Identity)
+			if terminator.InstanceId != "" {
+				connectRequest.Headers[edge.TerminatorInstanceIdHeader] = []byte(terminator.InstanceId)
+			}
+		}
+	}
 	conn.TraceMsg("connect", connectRequest)
-	replyMsg, err := conn.SendAndWaitWithTimeout(connectRequest, 5*time.Second)
+	replyMsg, err := conn.SendAndWaitWithTimeout(connectRequest, options.GetReplyTimeout())
 	if err != nil {
 		logger.Error(err)
 		return nil, err
 	}
 
 	if replyMsg.ContentType == edge.ContentTypeStateClosed {
+		if rejected, ok := edge.ParseDialRejectedError(string(replyMsg.Body)); ok {
+			return nil, rejected
+		}
 		return nil, errors.Errorf("attempt to use closed connection: %v", string(replyMsg.Body))
 	}
 
@@ -159,6 +706,16 @@ func (conn *edgeConn) Connect(session *edge.Session) (edge.ServiceConn, error) {
 		return nil, errors.Errorf("unexpected response to connect attempt: %v", replyMsg.ContentType)
 	}
 
+	// if the host didn't agree to our compression (or doesn't know about it), we fall back to uncompressed
+	if compression := edge.GetCompressionHeader(replyMsg); compression != edge.CompressionNone && compression == options.Compression {
+		logger.Debugf("using %v compression", compression)
+		conn.compression = compression
+	}
+
+	conn.protocol = string(replyMsg.Headers[edge.ProtocolHeader])
+	conn.instanceId = string(replyMsg.Headers[edge.TerminatorInstanceIdHeader])
+	conn.setConnectHeaders(replyMsg)
+
 	// There is no race condition where we can receive the other side crypto header
 	// because the processing of the crypto header takes place in Conn.Read which
 	// can't happen until we return the conn to the user. So as long as we send
@@ -176,6 +733,12 @@ func (conn *edgeConn) Connect(session *edge.Session) (edge.ServiceConn, error) {
 	} else {
 		logger.Warn("connection is not end-to-end-encrypted")
 	}
+
+	if options.AsyncWrites {
+		conn.SetAsyncWrites(options.MaxUnackedBytes)
+	}
+	conn.setWriteCoalesceWindow(options.WriteCoalesceWindow)
+	conn.linger = options.Linger
 	logger.Debug("connected")
 
 	return conn, nil
@@ -200,7 +763,7 @@ func (conn *edgeConn) establishClientCrypto(keypair *kx.KeyPair, peerKey []byte)
 		return fmt.Errorf("failed to write crypto header: %v", err)
 	}
 
-	pfxlog.Logger().WithField("connId", conn.Id()).Debug("crypto established")
+	edge.Log().WithField("connId", conn.GlobalId()).Debug("crypto established")
 	return nil
 }
 
@@ -223,19 +786,33 @@ func (conn *edgeConn) establishServerCrypto(keypair *kx.KeyPair, peerKey []byte)
 }
 
 func (conn *edgeConn) Listen(session *edge.Session, serviceName string, options *edge.ListenOptions) (edge.Listener, error) {
-	logger := pfxlog.Logger().
-		WithField("connId", conn.Id()).
+	if options == nil {
+		options = edge.ListenOptionsFor(serviceName)
+	}
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if conn.router != nil && conn.router.draining.Get() {
+		return nil, edge.ErrRouterConnDraining
+	}
+
+	logger := edge.Log().
+		WithField("connId", conn.GlobalId()).
 		WithField("service", serviceName).
 		WithField("session", session.Token)
 
 	listener := &edgeListener{
 		baseListener: baseListener{
-			serviceName: serviceName,
-			acceptC:     make(chan net.Conn, 10),
-			errorC:      make(chan error, 1),
+			serviceName:  serviceName,
+			acceptC:      make(chan net.Conn, 10),
+			errorC:       make(chan error, 1),
+			closeNotify:  make(chan struct{}),
+			priority:     options.PriorityFunc,
+			backpressure: options.AcceptBackpressure,
 		},
 		token:    session.Token,
 		edgeChan: conn,
+		options:  options,
 	}
 	logger.Debug("adding listener for session")
 	conn.hosting.Store(session.Token, listener)
@@ -250,6 +827,15 @@ func (conn *edgeConn) Listen(session *edge.Session, serviceName string, options
 
 	logger.Debug("sending bind request to edge router")
 	bindRequest := edge.NewBindMsg(conn.Id(), session.Token, conn.keyPair.Public(), options.Cost, options.Precedence)
+	if options.Identity != "" {
+		bindRequest.Headers[edge.TerminatorIdentityHeader] = []byte(options.Identity)
+	}
+	if options.IdentitySecret != "" {
+		bindRequest.Headers[edge.TerminatorIdentitySecretHeader] = []byte(options.IdentitySecret)
+	}
+	if options.TerminatorInstanceId != "" {
+		bindRequest.Headers[edge.TerminatorInstanceIdHeader] = []byte(options.TerminatorInstanceId)
+	}
 	conn.TraceMsg("listen", bindRequest)
 	replyMsg, err := conn.SendAndWaitWithTimeout(bindRequest, 5*time.Second)
 	if err != nil {
@@ -268,6 +854,12 @@ func (conn *edgeConn) Listen(session *edge.Session, serviceName string, options
 		return nil, errors.Errorf("unexpected response to connect attempt: %v", replyMsg.ContentType)
 	}
 
+	listener.bound = string(replyMsg.Headers[edge.TerminatorIdentityHeader])
+	// routers which don't report the identity they bound with leave it out of the reply
+	if options.Identity != "" && listener.bound != "" && listener.bound != options.Identity {
+		logger.Warnf("requested terminator identity [%v], but router bound with identity [%v]", options.Identity, listener.bound)
+	}
+
 	success = true
 	logger.Debug("connected")
 
@@ -275,9 +867,9 @@ func (conn *edgeConn) Listen(session *edge.Session, serviceName string, options
 }
 
 func (conn *edgeConn) Read(p []byte) (int, error) {
-	log := pfxlog.Logger().WithField("connId", conn.Id())
+	log := edge.Log().WithField("connId", conn.GlobalId())
 	if conn.closed.Get() {
-		return 0, io.EOF
+		return 0, conn.getReadErr()
 	}
 
 	log.Debugf("read buffer = %d bytes", cap(p))
@@ -288,15 +880,141 @@ func (conn *edgeConn) Read(p []byte) (int, error) {
 		return n, nil
 	}
 
+	d, err := conn.nextPayload()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(d) <= cap(p) {
+		return copy(p, d), nil
+	}
+	conn.leftover = d[cap(p):]
+	log.Debugf("saving %d bytes for leftover", len(conn.leftover))
+	return copy(p, d), nil
+}
+
+// WriteTo implements io.WriterTo. It writes inbound data payloads directly to dst until the conn is closed,
+// which lets io.Copy skip its intermediate buffer
+func (conn *edgeConn) WriteTo(dst io.Writer) (int64, error) {
+	var total int64
+
+	if len(conn.leftover) > 0 {
+		n, err := dst.Write(conn.leftover)
+		total += int64(n)
+		conn.leftover = conn.leftover[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+
+	for !conn.closed.Get() {
+		d, err := conn.nextPayload()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return total, err
+		}
+
+		n, err := dst.Write(d)
+		total += int64(n)
+		if err != nil {
+			conn.leftover = d[n:]
+			return total, err
+		}
+		if n < len(d) {
+			conn.leftover = d[n:]
+			return total, io.ErrShortWrite
+		}
+	}
+
+	return total, nil
+}
+
+type prefetchResult struct {
+	data    []byte
+	wireLen int
+	err     error
+}
+
+// nextPayload returns the next data payload, from the read ahead if it's enabled or else from the read queue
+func (conn *edgeConn) nextPayload() ([]byte, error) {
+	deadline := conn.getReadDeadline()
+	if !conn.readAhead {
+		d, _, err := conn.readPayload(deadline)
+		return d, err
+	}
+
+	conn.prefetchOnce.Do(func() {
+		conn.prefetchC = make(chan prefetchResult, 1)
+		go conn.prefetch()
+	})
+
+	var deadlineC <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		deadlineC = timer.C
+	}
+
+	select {
+	case result, ok := <-conn.prefetchC:
+		if !ok {
+			return nil, conn.getReadErr()
+		}
+		conn.addRecvBuffered(-result.wireLen)
+		return result.data, result.err
+	case <-deadlineC:
+		return nil, edge.ErrReadTimeout
+	}
+}
+
+// prefetch reads payloads ahead of the application until the conn closes or a read fails. Read deadlines are
+// applied by nextPayload, so prefetching waits on the read queue without one
+func (conn *edgeConn) prefetch() {
+	defer close(conn.prefetchC)
+
+	ticker := time.NewTicker(getForwardPollInterval())
+	defer ticker.Stop()
+
+	for {
+		d, wireLen, err := conn.readPayload(time.Time{})
+		result := prefetchResult{data: d, wireLen: wireLen, err: err}
+		// payloads held here still count against the receive buffer, until nextPayload hands them out
+		conn.addRecvBuffered(wireLen)
+
+		for sent := false; !sent; {
+			select {
+			case conn.prefetchC <- result:
+				sent = true
+			case <-ticker.C:
+				if conn.closed.Get() {
+					return
+				}
+			}
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readPayload returns the next decrypted data payload from the read queue, handling crypto setup and remote close.
+// It also returns the size the payload had on the wire
+func (conn *edgeConn) readPayload(deadline time.Time) ([]byte, int, error) {
+	log := edge.Log().WithField("connId", conn.GlobalId())
+
 	for {
-		next, err := conn.readQ.GetNextWithDeadline(conn.readDeadline)
+		next, err := conn.readQ.GetNextWithDeadline(deadline)
 		if err == sequencer.ErrClosed {
 			log.Debug("sequencer closed, closing connection")
 			conn.closed.Set(true)
-			return 0, io.EOF
+			return nil, 0, conn.getReadErr()
+		} else if err == sequencer.ErrTimedOut {
+			return nil, 0, edge.ErrReadTimeout
 		} else if err != nil {
 			log.Debugf("unexepcted sequencer err (%v)", err)
-			return 0, err
+			return nil, 0, err
 		}
 
 		event := next.(*edge.MsgEvent)
@@ -313,13 +1031,15 @@ func (conn *edgeConn) Read(p []byte) (int, error) {
 
 		case edge.ContentTypeData:
 			d := event.Msg.Body
+			wireLen := len(d)
+			conn.addRecvBuffered(-wireLen)
 			log.Debugf("got buffer from sequencer %d bytes", len(d))
 
 			// first data message should contain crypto header
 			if conn.rxKey != nil {
 
 				if len(d) != secretstream.StreamHeaderBytes {
-					return 0, fmt.Errorf("failed to receive crypto header bytes: read[%d]", len(d))
+					return nil, 0, fmt.Errorf("failed to receive crypto header bytes: read[%d]", len(d))
 				}
 				conn.receiver, err = secretstream.NewDecryptor(conn.rxKey, d)
 				conn.rxKey = nil
@@ -330,15 +1050,27 @@ func (conn *edgeConn) Read(p []byte) (int, error) {
 				d, _, err = conn.receiver.Pull(d)
 				if err != nil {
 					log.Errorf("crypto failed: %v", err)
-					return 0, err
+					return nil, 0, err
+				}
+			}
+
+			if compression := edge.GetCompressedHeader(event.Msg); compression != edge.CompressionNone {
+				if d, err = compression.Decompress(d, conn.maxMsgSize); err == edge.ErrMessageTooLarge {
+					log.Errorf("message exceeds max message size of %v bytes once decompressed, closing connection", conn.maxMsgSize)
+					conn.failRead(err)
+					return nil, 0, err
+				} else if err != nil {
+					log.Errorf("decompression failed: %v", err)
+					return nil, 0, err
 				}
 			}
-			if len(d) <= cap(p) {
-				return copy(p, d), nil
+			conn.recordRead(len(d), wireLen)
+			if _, wanted := event.Msg.Headers[edge.ReceiptHeader]; wanted {
+				if err := conn.Channel.Send(edge.NewStateAckMsg(conn.Id(), event.Seq)); err != nil {
+					log.WithError(err).Debug("failed to send delivery receipt ack")
+				}
 			}
-			conn.leftover = d[cap(p):]
-			log.Debugf("saving %d bytes for leftover", len(conn.leftover))
-			return copy(p, d), nil
+			return d, wireLen, nil
 
 		default:
 			log.WithField("type", event.Msg.ContentType).Error("unexpected message")
@@ -347,9 +1079,52 @@ func (conn *edgeConn) Read(p []byte) (int, error) {
 }
 
 func (conn *edgeConn) Close() error {
+	return conn.CloseContext(context.Background())
+}
+
+func (conn *edgeConn) CloseContext(ctx context.Context) error {
+	// coalesced and async writes go out ahead of the close
+	var flushErr error
+	if !conn.closed.Get() {
+		flushErr = conn.flushCoalesced()
+		conn.drainWrites(ctx)
+	}
+	return conn.closeByEvent(ctx, flushErr)
+}
+
+func (conn *edgeConn) Abort() error {
+	if conn.coalescer != nil {
+		conn.coalescer.discard()
+	}
+	return conn.closeByEvent(context.Background(), nil)
+}
+
+// drainWrites waits up to the linger for async writes to reach the wire
+func (conn *edgeConn) drainWrites(ctx context.Context) {
+	if conn.linger <= 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, conn.linger)
+	defer cancel()
+	if err := conn.WaitForWrites(ctx); err != nil {
+		edge.Log().WithField("connId", conn.GlobalId()).WithError(err).
+			Debugf("linger passed with %v bytes not yet on the wire, closing anyway", conn.GetUnackedBytes())
+	}
+}
+
+// closeByEvent hands the close to the mux, returning flushErr if the close itself succeeds. The wait is bounded by
+// ctx and the state timeout, which also bound sending the close to the router
+func (conn *edgeConn) closeByEvent(ctx context.Context, flushErr error) error {
+	// unblock writes straight away, rather than once the close event is handled
+	conn.CancelWrites()
+
+	closeCtx, cancel := context.WithTimeout(ctx, conn.GetStateTimeout())
+	defer cancel()
+
 	event := &closeConnEvent{
 		conn:        conn,
 		remoteClose: false,
+		ctx:         closeCtx,
 		errorC:      make(chan error, 1),
 	}
 	conn.msgMux.Event(event)
@@ -358,29 +1133,52 @@ func (conn *edgeConn) Close() error {
 		if err != nil {
 			return err
 		}
-	case <-time.After(time.Second):
-		return errors.New("close timed out")
+	case <-closeCtx.Done():
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("close not completed before the state timeout (%w)", edge.ErrStateSendTimeout)
 	}
-	return nil
+	return flushErr
+}
+
+// closeLocal closes the conn without sending a close to the router, so it doesn't block on the network
+func (conn *edgeConn) closeLocal() {
+	// skipping the state message is all a remote close does differently
+	_ = conn.close(true, nil)
+}
+
+func (conn *edgeConn) close(closedByRemote bool, cause error) error {
+	return conn.closeContext(context.Background(), closedByRemote, cause)
 }
 
-func (conn *edgeConn) close(closedByRemote bool) error {
+// closeContext closes the conn, sending the close to the router unless it came from the remote side. The send
+// gives up when ctx is done, or after the state timeout, in which case the conn is still closed locally and the
+// send error is returned
+func (conn *edgeConn) closeContext(ctx context.Context, closedByRemote bool, cause error) error {
 	if !conn.closed.CompareAndSwap(false, true) {
 		return nil
 	}
 
-	log := pfxlog.Logger().WithField("connId", conn.Id())
+	log := edge.Log().WithField("connId", conn.GlobalId())
 	log.Debug("close: begin")
 	defer log.Debug("close: end")
+	defer conn.notifyClosed(cause)
 
+	conn.CancelWrites()
+
+	var sendErr error
 	if !closedByRemote {
 		msg := edge.NewStateClosedMsg(conn.Id(), "")
-		if err := conn.SendState(msg); err != nil {
-			log.WithError(err).Error("failed to send close message")
+		ctx, cancel := context.WithTimeout(ctx, conn.GetStateTimeout())
+		defer cancel()
+		if sendErr = conn.SendStateContext(ctx, msg); sendErr != nil {
+			log.WithError(sendErr).Error("failed to send close message")
 		}
 	}
 
 	conn.readQ.Close()
+	conn.releaseRecvBuffered()
 	go conn.msgMux.RemoveMsgSink(conn) // needs to be done async, otherwise we may deadlock
 
 	conn.hosting.Range(func(key, value interface{}) bool {
@@ -391,7 +1189,7 @@ func (conn *edgeConn) close(closedByRemote bool) error {
 		return true
 	})
 
-	return nil
+	return sendErr
 }
 
 func (conn *edgeConn) getListener(token string) (*edgeListener, bool) {
@@ -405,7 +1203,7 @@ func (conn *edgeConn) getListener(token string) (*edgeListener, bool) {
 func (conn *edgeConn) newChildConnection(event *edge.MsgEvent) {
 	message := event.Msg
 	token := string(message.Body)
-	logger := pfxlog.Logger().WithField("connId", conn.Id()).WithField("token", token)
+	logger := edge.Log().WithField("connId", conn.GlobalId()).WithField("token", token)
 	logger.Debug("looking up listener")
 	listener, found := conn.getListener(token)
 	if !found {
@@ -418,25 +1216,82 @@ func (conn *edgeConn) newChildConnection(event *edge.MsgEvent) {
 		return
 	}
 
-	logger.Debug("listener found. generating id for new connection")
-	id := connSeq.Next()
+	listener.dialStarted()
+	defer listener.dialDone()
+
+	// a dial carrying too many headers only fails the dial, as closing this conn would close the listener
+	if maxHeaders := listener.maxHeaders(); len(message.Headers) > maxHeaders {
+		logger.Warnf("dial request with %v headers exceeds max headers of %v, failing dial", len(message.Headers), maxHeaders)
+		reply := edge.NewDialFailedMsg(conn.Id(), edge.ErrTooManyHeaders.Error())
+		reply.ReplyTo(message)
+		if err := conn.SendWithTimeout(reply, time.Second*5); err != nil {
+			logger.Errorf("Failed to send reply to dial request: (%v)", err)
+		}
+		return
+	}
+
+	if !listener.admitDial() {
+		logger.Warn("accept rate limit exceeded, failing dial")
+		reply := edge.NewDialFailedMsg(conn.Id(), "accept rate limit exceeded")
+		reply.ReplyTo(message)
+		if err := conn.SendWithTimeout(reply, time.Second*5); err != nil {
+			logger.Errorf("Failed to send reply to dial request: (%v)", err)
+		}
+		return
+	}
+
+	if err := listener.admitByOptions(message); err != nil {
+		logger.WithError(err).Debug("dial rejected by listener")
+		reply := edge.NewDialFailedMsg(conn.Id(), err.Error())
+		reply.ReplyTo(message)
+		if err := conn.SendWithTimeout(reply, time.Second*5); err != nil {
+			logger.Errorf("Failed to send reply to dial request: (%v)", err)
+		}
+		return
+	}
 
-	edgeCh := &edgeConn{
-		MsgChannel: *edge.NewEdgeMsgChannel(conn.Channel, id),
-		readQ:      sequencer.NewSingleWriterSeq(DefaultMaxOutOfOrderMsgs),
-		msgMux:     conn.msgMux,
+	decision := listener.decideConnect(message)
+	if decision.Reject != nil {
+		logger.WithError(decision.Reject).Debug("dial rejected by connect handler")
+		reply := edge.NewDialFailedMsg(conn.Id(), decision.Reject.Error())
+		reply.ReplyTo(message)
+		if err := conn.SendWithTimeout(reply, time.Second*5); err != nil {
+			logger.Errorf("Failed to send reply to dial request: (%v)", err)
+		}
+		return
 	}
 
-	_ = conn.msgMux.AddMsgSink(edgeCh) // duplicate errors only happen on the server side, since client controls ids
+	logger.Debug("listener found. generating id for new connection")
+	edgeCh, err := registerNewConn(conn.router, conn.msgMux, func(id uint32) *edgeConn {
+		edgeCh := newEdgeConn(conn.router, conn.Channel, conn.msgMux, id, listener.serviceName)
+		edgeCh.inbound = true
+		edgeCh.arrived = time.Now()
+		if listener.options != nil {
+			edgeCh.setRecvBufferSize(listener.options.RecvBufferSize)
+			edgeCh.setMaxMessageSize(listener.options.MaxMessageSize)
+			edgeCh.setMaxHeaders(listener.options.MaxHeaders)
+			edgeCh.readAhead = listener.options.ReadAhead
+			edgeCh.strictOrder = listener.options.StrictOrdering
+		}
+		return edgeCh
+	})
+	if err != nil {
+		logger.WithError(err).Error("failed to register new connection")
+		reply := edge.NewDialFailedMsg(conn.Id(), err.Error())
+		reply.ReplyTo(message)
+		if err := conn.SendWithTimeout(reply, time.Second*5); err != nil {
+			logger.Errorf("Failed to send reply to dial request: (%v)", err)
+		}
+		return
+	}
 
-	newConnLogger := pfxlog.Logger().
-		WithField("connId", id).
-		WithField("parentConnId", conn.Id()).
+	newConnLogger := edge.Log().
+		WithField("connId", edgeCh.GlobalId()).
+		WithField("parentConnId", conn.GlobalId()).
 		WithField("token", token)
 	newConnLogger.Debug("new connection established")
 
 	clientKey := message.Headers[edge.PublicKeyHeader]
-	var err error
 	var txHeader []byte
 	if clientKey != nil {
 		newConnLogger.Debug("setting up crypto")
@@ -456,8 +1311,50 @@ func (conn *edgeConn) newChildConnection(event *edge.MsgEvent) {
 		return
 	}
 
+	edgeCh.setConnectHeaders(message)
 	reply := edge.NewDialSuccessMsg(conn.Id(), edgeCh.Id())
 	reply.ReplyTo(message)
+	edge.PutCapabilitiesHeaders(reply)
+	if listener.options != nil && listener.options.TerminatorInstanceId != "" {
+		edgeCh.instanceId = listener.options.TerminatorInstanceId
+		reply.Headers[edge.TerminatorInstanceIdHeader] = []byte(edgeCh.instanceId)
+	}
+
+	if compression := edge.GetCompressionHeader(message); compression != edge.CompressionNone {
+		if listener.options != nil && listener.options.Compression == compression {
+			newConnLogger.Debugf("using %v compression", compression)
+			edgeCh.compression = compression
+			reply.Headers[edge.CompressionHeader] = []byte{byte(compression)}
+		} else {
+			newConnLogger.Debugf("dialer requested unsupported compression %v, not compressing", compression)
+		}
+	}
+
+	if offered := edge.GetProtocolsHeader(message); len(offered) > 0 && listener.options != nil &&
+		(decision.Protocol != "" || listener.options.ProtocolSelector != nil) {
+		selected := decision.Protocol
+		if selected == "" {
+			selected = listener.options.ProtocolSelector(offered)
+		}
+		if selected != "" {
+			if stringz.Contains(offered, selected) {
+				newConnLogger.Debugf("selected protocol %v", selected)
+				edgeCh.protocol = selected
+				reply.Headers[edge.ProtocolHeader] = []byte(selected)
+			} else {
+				newConnLogger.Warnf("protocol selector returned %v, which wasn't offered by the dialer, ignoring", selected)
+			}
+		}
+	}
+
+	for k, v := range decision.ReplyHeaders {
+		if edge.IsReservedHeader(k) {
+			newConnLogger.Warnf("connect handler returned reserved reply header %v, ignoring", k)
+			continue
+		}
+		reply.Headers[k] = v
+	}
+
 	startMsg, err := conn.SendAndWaitWithTimeout(reply, time.Second*5)
 	if err != nil {
 		logger.Errorf("Failed to send reply to dial request: (%v)", err)
@@ -474,7 +1371,21 @@ func (conn *edgeConn) newChildConnection(event *edge.MsgEvent) {
 			}
 		}
 
-		listener.acceptC <- edgeCh
+		if listener.options != nil && listener.options.AsyncWrites {
+			edgeCh.SetAsyncWrites(listener.options.MaxUnackedBytes)
+		}
+		if listener.options != nil {
+			edgeCh.setWriteCoalesceWindow(listener.options.WriteCoalesceWindow)
+			edgeCh.linger = listener.options.Linger
+		}
+
+		select {
+		case listener.acceptC <- edgeCh:
+			listener.queueChanged()
+		case <-listener.closeNotify:
+			newConnLogger.Debug("listener closed before conn was accepted, closing conn")
+			_ = edgeCh.Close()
+		}
 	} else {
 		logger.Errorf("failed to receive start after dial. got %v", startMsg)
 	}
@@ -483,13 +1394,22 @@ func (conn *edgeConn) newChildConnection(event *edge.MsgEvent) {
 type closeConnEvent struct {
 	conn        *edgeConn
 	remoteClose bool
+	ctx         context.Context
 	errorC      chan error
 }
 
 func (event *closeConnEvent) Handle(*edge.MsgMux) {
-	if err := event.conn.close(event.remoteClose); err != nil {
+	var cause error
+	if event.remoteClose {
+		cause = edge.ErrClosedByRemote
+	}
+	ctx := event.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := event.conn.closeContext(ctx, event.remoteClose, cause); err != nil {
 		event.errorC <- err
-		pfxlog.Logger().Errorf("failure closing connection. connId = %v (%v)", event.conn.Id(), err)
+		edge.Log().Errorf("failure closing connection. connId = %v (%v)", event.conn.Id(), err)
 	}
 	close(event.errorC)
 }
@@ -0,0 +1,2755 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package impl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/channel2"
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/openziti/sdk-golang/ziti/edge/edgetest"
+	"github.com/stretchr/testify/require"
+)
+
+type testHarness struct {
+	router *edgetest.Router
+	host   edge.RouterConn
+	dialer edge.RouterConn
+}
+
+func newTestHarness(t testing.TB) *testHarness {
+	router := edgetest.NewRouter("test-router")
+
+	hostCh, err := router.Dial()
+	require.NoError(t, err)
+	dialerCh, err := router.Dial()
+	require.NoError(t, err)
+
+	return &testHarness{
+		router: router,
+		host:   NewEdgeConnFactory(router.Name(), "host", hostCh, nil),
+		dialer: NewEdgeConnFactory(router.Name(), "dialer", dialerCh, nil),
+	}
+}
+
+func (harness *testHarness) close() {
+	_ = harness.host.Close()
+	_ = harness.dialer.Close()
+	harness.router.Close()
+}
+
+func (harness *testHarness) listen(t testing.TB, session *edge.Session, options *edge.ListenOptions) edge.Listener {
+	listener, err := harness.host.NewConn("test-service").Listen(session, "test-service", options)
+	require.NoError(t, err)
+	return listener
+}
+
+func (harness *testHarness) dial(t testing.TB, session *edge.Session, options *edge.DialOptions) edge.ServiceConn {
+	conn, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, options)
+	require.NoError(t, err)
+	return conn
+}
+
+func acceptWithTimeout(t testing.TB, listener edge.Listener) edge.ServiceConn {
+	acceptC := make(chan edge.ServiceConn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			acceptC <- conn.(edge.ServiceConn)
+		}
+		close(acceptC)
+	}()
+
+	select {
+	case conn, ok := <-acceptC:
+		require.True(t, ok, "accept failed")
+		return conn
+	case <-time.After(time.Second):
+		require.FailNow(t, "timed out waiting for accept")
+	}
+	return nil
+}
+
+func Test_DialListenRoundTrip(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	binding, found := harness.router.GetBinding(session.Token)
+	assert.True(found)
+	assert.NotNil(binding.PublicKey)
+	assert.Equal("test-tok...", listener.BindToken())
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	assert.True(accepted.IsInbound())
+	assert.False(dialed.IsInbound())
+	assert.Equal("test-service", dialed.ServiceName())
+	assert.Equal("test-service", accepted.ServiceName())
+	assert.Equal(1, harness.router.CircuitCount())
+	assert.Equal(edge.GlobalConnId("test-router", dialed.(edge.Identifiable).Id()), dialed.(edge.Identifiable).GlobalId())
+
+	assert.NoError(dialed.SetReadDeadline(time.Now().Add(time.Second)))
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+
+	_, err := dialed.Write([]byte("hello"))
+	assert.NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(err)
+	assert.Equal("hello", string(buf))
+
+	_, err = accepted.Write([]byte("world"))
+	assert.NoError(err)
+	_, err = io.ReadFull(dialed, buf)
+	assert.NoError(err)
+	assert.Equal("world", string(buf))
+
+	dialerStats := harness.dialer.Stats()
+	assert.Equal(uint64(1), dialerStats.ActiveConns)
+	assert.Equal(uint64(5), dialerStats.BytesWritten)
+	assert.Equal(uint64(5), dialerStats.BytesRead)
+	hostStats := harness.host.Stats()
+	assert.Equal(uint64(2), hostStats.ActiveConns) // the listening conn and the accepted conn
+	assert.Equal(uint64(1), hostStats.MsgsWritten)
+	assert.Equal(uint64(1), hostStats.MsgsRead)
+
+	closedC := make(chan error, 1)
+	accepted.OnClose(func(cause error) {
+		closedC <- cause
+	})
+	assert.NoError(dialed.Close())
+
+	// the close is sequenced after the data, so the reader sees it as EOF
+	_, err = accepted.Read(buf)
+	assert.Equal(io.EOF, err)
+
+	select {
+	case cause := <-closedC:
+		assert.Equal(edge.ErrClosedByRemote, cause)
+	case <-time.After(time.Second):
+		assert.Fail("accepted conn not closed by remote close")
+	}
+	assert.Equal(0, harness.router.CircuitCount())
+}
+
+func Test_AcceptWithTimeout(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	start := time.Now()
+	_, err := listener.AcceptWithTimeout(20 * time.Millisecond)
+	assert.True(time.Since(start) >= 20*time.Millisecond)
+	netErr, ok := err.(net.Error)
+	assert.True(ok)
+	assert.True(netErr.Timeout())
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	conn, err := listener.AcceptWithTimeout(time.Second)
+	assert.NoError(err)
+	assert.NotNil(conn)
+
+	assert.NoError(listener.Close())
+	_, err = listener.AcceptWithTimeout(time.Second)
+	assert.Error(err)
+	assert.NotEqual(edge.ErrAcceptTimeout, err)
+}
+
+func Test_AcceptReturnsPromptlyOnClose(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	// make sure polling can't be what wakes up Accept
+	assert.NoError(SetPollInterval(time.Hour))
+	defer func() { _ = SetPollInterval(DefaultAcceptPollInterval) }()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	multi := NewMultiListener("test-service", func() *edge.Session { return session })
+	multi.AddListener(harness.listen(t, session, edge.DefaultListenOptions()), func() {})
+
+	edgeListener := harness.listen(t, &edge.Session{Id: "other-session", Token: "other-token"}, edge.DefaultListenOptions())
+
+	for _, listener := range []edge.Listener{multi, edgeListener} {
+		errC := make(chan error, 1)
+		go func() {
+			_, err := listener.Accept()
+			errC <- err
+		}()
+
+		time.Sleep(20 * time.Millisecond)
+		start := time.Now()
+		assert.NoError(listener.Close())
+
+		select {
+		case err := <-errC:
+			assert.Error(err)
+			assert.True(time.Since(start) < 100*time.Millisecond, "accept took %v to return", time.Since(start))
+		case <-time.After(time.Second):
+			assert.FailNow("accept didn't return after close")
+		}
+	}
+}
+
+func Test_AcceptAfterClose(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	waitForQueued := func(listener edge.Listener, count int) {
+		acceptC := listener.(*edgeListener).acceptC
+		deadline := time.Now().Add(time.Second)
+		for len(acceptC) < count && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(count, len(acceptC))
+	}
+
+	// conns which arrived before close are accepted before the closed error
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	for i := 0; i < 2; i++ {
+		conn := harness.dial(t, session, edge.DefaultDialOptions())
+		defer func() { _ = conn.Close() }()
+	}
+	waitForQueued(listener, 2)
+	assert.NoError(listener.Close())
+
+	for i := 0; i < 2; i++ {
+		conn, err := listener.Accept()
+		assert.NoError(err)
+		assert.NotNil(conn)
+		_ = conn.Close()
+	}
+	_, err := listener.Accept()
+	assert.Error(err)
+
+	// the same goes for TryAccept, with conns ordered by priority
+	prioritySession := &edge.Session{Id: "priority-session", Token: "priority-token"}
+	options := edge.DefaultListenOptions()
+	options.PriorityFunc = func(info edge.ConnInfo) int { return len(info.AppData) }
+	listener = harness.listen(t, prioritySession, options)
+	for _, appData := range []string{"a", "bbb"} {
+		dialOptions := edge.DefaultDialOptions()
+		dialOptions.AppData = []byte(appData)
+		conn := harness.dial(t, prioritySession, dialOptions)
+		defer func() { _ = conn.Close() }()
+	}
+	waitForQueued(listener, 2)
+	assert.NoError(listener.Close())
+
+	for _, expected := range []string{"bbb", "a"} {
+		conn, ok, err := listener.TryAccept()
+		assert.NoError(err)
+		assert.True(ok)
+		assert.Equal(expected, string(newConnInfo(conn).AppData))
+		_ = conn.Close()
+	}
+	_, ok, err := listener.TryAccept()
+	assert.False(ok)
+	assert.Error(err)
+}
+
+func Test_GracefulClose(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	defer func(period time.Duration) { drainQuietPeriod = period }(drainQuietPeriod)
+	drainQuietPeriod = 100 * time.Millisecond
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+
+	doneC := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		doneC <- listener.GracefulClose(context.Background())
+	}()
+
+	// the cost goes up first, while the bind is still in place
+	raised := false
+	for !raised && time.Since(start) < drainQuietPeriod {
+		binding, found := harness.router.GetBinding(session.Token)
+		assert.True(found, "bind removed before cost was raised")
+		raised = binding.Cost == math.MaxUint16
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.True(raised)
+	assert.False(listener.IsClosed())
+
+	select {
+	case err := <-doneC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.FailNow("graceful close didn't complete")
+	}
+	assert.True(time.Since(start) >= drainQuietPeriod)
+	assert.True(listener.IsClosed())
+
+	// the unbind follows the close
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		if _, found := harness.router.GetBinding(session.Token); !found {
+			break
+		}
+	}
+	_, found := harness.router.GetBinding(session.Token)
+	assert.False(found)
+}
+
+func Test_GracefulCloseCancelled(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := listener.GracefulClose(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < drainQuietPeriod)
+	assert.True(listener.IsClosed())
+}
+
+func Test_RefreshSessionRebinds(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	oldSession := &edge.Session{Id: "old-session", Token: "old-token"}
+	newSession := &edge.Session{Id: "new-session", Token: "new-token"}
+
+	multi := NewMultiListener("test-service", func() *edge.Session { return newSession })
+	defer func() { _ = multi.Close() }()
+
+	rebindC := make(chan edge.Listener, 1)
+	multi.SetRebindHandler(func(session *edge.Session, old, new edge.Listener) {
+		assert.Equal(newSession, session)
+		rebindC <- new
+	})
+
+	closeHandlerCalled := make(chan struct{}, 1)
+	old := harness.listen(t, oldSession, edge.DefaultListenOptions())
+	multi.AddListener(old, func() { closeHandlerCalled <- struct{}{} })
+
+	assert.NoError(multi.RefreshSession(newSession))
+
+	select {
+	case rebound := <-rebindC:
+		assert.Equal(edge.RedactToken(newSession.Token), rebound.BindToken())
+	case <-time.After(time.Second):
+		assert.FailNow("rebind handler not called")
+	}
+
+	_, found := harness.router.GetBinding(newSession.Token)
+	assert.True(found)
+	for start := time.Now(); time.Since(start) < time.Second; time.Sleep(5 * time.Millisecond) {
+		if _, found = harness.router.GetBinding(oldSession.Token); !found {
+			break
+		}
+	}
+	assert.False(found)
+	assert.True(old.IsClosed())
+	assert.False(multi.IsClosed())
+
+	select {
+	case <-closeHandlerCalled:
+		assert.Fail("close handler called for replaced listener")
+	default:
+	}
+
+	conn := harness.dial(t, newSession, edge.DefaultDialOptions())
+	defer func() { _ = conn.Close() }()
+	accepted := acceptWithTimeout(t, multi)
+	defer func() { _ = accepted.Close() }()
+}
+
+func Test_AcceptRateLimit(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.AcceptRateLimit = &edge.AcceptRateLimit{Rate: 10, Burst: 2, Reject: true}
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+
+	// the burst is let through and the rest are rejected
+	accepted := 0
+	for i := 0; i < 5; i++ {
+		conn, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, edge.DefaultDialOptions())
+		if err == nil {
+			accepted++
+			_ = conn.Close()
+		}
+	}
+	assert.Equal(2, accepted)
+
+	// once the rate allows it, dials are accepted again
+	time.Sleep(110 * time.Millisecond)
+	conn := harness.dial(t, session, edge.DefaultDialOptions())
+	_ = conn.Close()
+
+	// excess dials are held until the rate allows them, rather than rejected
+	queueSession := &edge.Session{Id: "queue-session", Token: "queue-token"}
+	options = edge.DefaultListenOptions()
+	options.AcceptRateLimit = edge.NewAcceptRateLimit(20, 1)
+	queueListener := harness.listen(t, queueSession, options)
+	defer func() { _ = queueListener.Close() }()
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		conn := harness.dial(t, queueSession, edge.DefaultDialOptions())
+		_ = conn.Close()
+	}
+	assert.True(time.Since(start) >= 140*time.Millisecond, "dials accepted faster than the rate, took %v", time.Since(start))
+}
+
+func Test_AcceptBackpressure(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	type event struct {
+		cleared         bool
+		depth, capacity int
+	}
+	eventC := make(chan event, 10)
+	nextEvent := func() event {
+		select {
+		case e := <-eventC:
+			return e
+		case <-time.After(time.Second):
+			assert.Fail("timed out waiting for backpressure event")
+			return event{}
+		}
+	}
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.AcceptBackpressure = edge.NewAcceptBackpressure(
+		func(depth, capacity int) { eventC <- event{depth: depth, capacity: capacity} },
+		func(depth, capacity int) { eventC <- event{cleared: true, depth: depth, capacity: capacity} },
+	)
+	options.AcceptBackpressure.HighWater = 3
+	options.AcceptBackpressure.LowWater = 1
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+
+	for i := 0; i < 3; i++ {
+		conn := harness.dial(t, session, edge.DefaultDialOptions())
+		defer func() { _ = conn.Close() }()
+	}
+	assert.Equal(event{depth: 3, capacity: 10}, nextEvent())
+
+	// nothing is reported between the marks
+	first := acceptWithTimeout(t, listener)
+	defer func() { _ = first.Close() }()
+	select {
+	case e := <-eventC:
+		assert.Fail("unexpected backpressure event", "%+v", e)
+	default:
+	}
+
+	conn := acceptWithTimeout(t, listener)
+	defer func() { _ = conn.Close() }()
+	assert.Equal(event{cleared: true, depth: 1, capacity: 10}, nextEvent())
+}
+
+func Test_DialRejectedWith(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.AdmitDial = func(info edge.ConnInfo) error {
+		switch string(info.AppData) {
+		case "over-quota":
+			return edge.RejectWith(429, "quota exceeded")
+		case "untyped":
+			return errors.New("not today")
+		}
+		return nil
+	}
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+
+	dialOptions := edge.DefaultDialOptions()
+	dialOptions.AppData = []byte("over-quota")
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, dialOptions)
+	var rejected *edge.DialRejectedError
+	assert.True(errors.As(err, &rejected), "expected a DialRejectedError, got %v", err)
+	assert.Equal(429, rejected.Code())
+	assert.Equal("quota exceeded", rejected.Message())
+
+	// other errors still fail the dial, without a code
+	dialOptions.AppData = []byte("untyped")
+	_, err = harness.dialer.NewConn("test-service").ConnectWithOptions(session, dialOptions)
+	assert.Error(err)
+	assert.False(errors.As(err, &rejected))
+	assert.Contains(err.Error(), "not today")
+
+	dialOptions.AppData = []byte("welcome")
+	conn := harness.dial(t, session, dialOptions)
+	defer func() { _ = conn.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	_ = accepted.Close()
+}
+
+func Test_WriteAfterCloseFails(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	assert.NoError(dialed.Close())
+	_, err := dialed.Write([]byte("hello"))
+	assert.True(errors.Is(err, edge.ErrConnClosed))
+}
+
+func Test_MuxOptions(t *testing.T) {
+	assert := require.New(t)
+	router := edgetest.NewRouter("test-router")
+	defer router.Close()
+
+	muxOptions := &edge.MsgMuxOptions{WorkerPoolSize: 2, WorkerQueueSize: 4}
+	hostCh, err := router.Dial()
+	assert.NoError(err)
+	dialerCh, err := router.Dial()
+	assert.NoError(err)
+	harness := &testHarness{
+		router: router,
+		host:   NewEdgeConnFactoryWithMuxOptions(router.Name(), "host", "", hostCh, nil, muxOptions),
+		dialer: NewEdgeConnFactoryWithMuxOptions(router.Name(), "dialer", "", dialerCh, nil, muxOptions),
+	}
+	defer harness.close()
+
+	// data is dispatched through the worker pool in order
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	for i := 0; i < 10; i++ {
+		_, err = dialed.Write([]byte{byte(i)})
+		assert.NoError(err)
+	}
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, 1)
+	for i := 0; i < 10; i++ {
+		_, err = io.ReadFull(accepted, buf)
+		assert.NoError(err)
+		assert.Equal(byte(i), buf[0])
+	}
+}
+
+func Test_ConnectBatch(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+	go func() {
+		// accepted conns are closed by the remote close when the dialed conns are closed
+		for {
+			if _, err := listener.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// dials are run two at a time
+	harness.router.SetConnectDelay(50 * time.Millisecond)
+	options := edge.DefaultDialOptions()
+	options.MaxConcurrentDials = 2
+	start := time.Now()
+	conns, errs := harness.dialer.ConnectBatch(context.Background(), session, "test-service", 4, options)
+	assert.Equal(4, len(conns))
+	assert.Equal(0, len(errs))
+	assert.True(time.Since(start) >= 100*time.Millisecond, "dials weren't bounded, took %v", time.Since(start))
+	for _, conn := range conns {
+		assert.NoError(conn.Close())
+	}
+
+	conns, errs = harness.dialer.ConnectBatch(context.Background(), &edge.Session{Token: "unbound"}, "test-service", 3, options)
+	assert.Equal(0, len(conns))
+	assert.Equal(3, len(errs))
+
+	// nothing is dialed for a count of zero or less
+	for _, count := range []int{0, -1} {
+		conns, errs = harness.dialer.ConnectBatch(context.Background(), session, "test-service", count, options)
+		assert.Equal(0, len(conns))
+		assert.Equal(0, len(errs))
+	}
+
+	// cancelling returns the dials still outstanding as failed
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	conns, errs = harness.dialer.ConnectBatch(ctx, session, "test-service", 3, options)
+	assert.Equal(0, len(conns))
+	assert.Equal(3, len(errs))
+	for _, err := range errs {
+		assert.Equal(context.DeadlineExceeded, err)
+	}
+}
+
+func Test_ReplyTimeout(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	// the router conn is up, but the connect is never answered
+	harness.router.SetDropConnects(true)
+	options := edge.DefaultDialOptions()
+	options.ReplyTimeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, options)
+	assert.Error(err)
+	assert.True(time.Since(start) < options.ConnectTimeout/2, "dial took %v", time.Since(start))
+
+	// without a reply timeout the wait is bounded by the connect timeout
+	options.ReplyTimeout = 0
+	options.ConnectTimeout = 100 * time.Millisecond
+	start = time.Now()
+	_, err = harness.dialer.NewConn("test-service").ConnectWithOptions(session, options)
+	assert.Error(err)
+	assert.True(time.Since(start) >= options.ConnectTimeout, "dial took %v", time.Since(start))
+
+	harness.router.SetDropConnects(false)
+	conn := harness.dial(t, session, edge.DefaultDialOptions())
+	_ = conn.Close()
+}
+
+func Test_ReadAhead(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.ReadAhead = true
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	// nothing to read yet, the read deadline still applies
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(20 * time.Millisecond)))
+	_, err := accepted.Read(make([]byte, 16))
+	assert.Error(err)
+
+	for i := 0; i < 5; i++ {
+		_, err = dialed.Write([]byte{byte(i)})
+		assert.NoError(err)
+	}
+
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	for i := 0; i < 5; i++ {
+		buf := make([]byte, 16)
+		n, err := accepted.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{byte(i)}, buf[:n])
+	}
+	assert.Equal(int64(0), atomic.LoadInt64(&accepted.(*edgeConn).recvBuffered))
+
+	assert.NoError(dialed.Close())
+	_, err = accepted.Read(make([]byte, 16))
+	assert.Equal(io.EOF, err)
+}
+
+// BenchmarkRequestResponse measures round trips to an echoing host, with and without read ahead on both sides
+func BenchmarkRequestResponse(b *testing.B) {
+	for _, readAhead := range []bool{false, true} {
+		b.Run(fmt.Sprintf("readAhead=%v", readAhead), func(b *testing.B) {
+			harness := newTestHarness(b)
+			defer harness.close()
+
+			session := &edge.Session{Id: "test-session", Token: "test-token"}
+			listenOptions := edge.DefaultListenOptions()
+			listenOptions.ReadAhead = readAhead
+			listener := harness.listen(b, session, listenOptions)
+			defer func() { _ = listener.Close() }()
+
+			dialOptions := edge.DefaultDialOptions()
+			dialOptions.ReadAhead = readAhead
+			dialed := harness.dial(b, session, dialOptions)
+			defer func() { _ = dialed.Close() }()
+			accepted := acceptWithTimeout(b, listener)
+
+			go func() {
+				_, _ = io.Copy(accepted, accepted)
+			}()
+
+			request := make([]byte, 1024)
+			response := make([]byte, len(request))
+			b.SetBytes(int64(len(request)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := dialed.Write(request); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.ReadFull(dialed, response); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func Test_SetRecvWindow(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	assert.Error(accepted.SetRecvWindow(edge.MinWindowSize - 1))
+	assert.Error(accepted.SetRecvWindow(edge.MaxWindowSize + 1))
+
+	// the narrowed window applies to data received afterwards
+	assert.NoError(accepted.SetRecvWindow(edge.MinWindowSize))
+	data := make([]byte, edge.MinWindowSize/2+1)
+	for i := 0; i < 2; i++ {
+		_, err := dialed.Write(data)
+		assert.NoError(err)
+	}
+
+	// don't read until both have arrived, or the first would be drained from the buffer before the second
+	deadline := time.Now().Add(time.Second)
+	for !accepted.(*edgeConn).closed.Get() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	var err error
+	for err == nil {
+		_, err = accepted.Read(make([]byte, len(data)))
+	}
+	assert.Equal(edge.ErrRecvBufferExceeded, err)
+}
+
+// BenchmarkSendWindow measures async write throughput through a router adding latency, with different send windows
+func BenchmarkSendWindow(b *testing.B) {
+	for _, window := range []int{edge.MinWindowSize, edge.DefaultMaxUnackedBytes} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			harness := newTestHarness(b)
+			defer harness.close()
+			harness.router.SetLatency(5 * time.Millisecond)
+
+			session := &edge.Session{Id: "test-session", Token: "test-token"}
+			listener := harness.listen(b, session, edge.DefaultListenOptions())
+			defer func() { _ = listener.Close() }()
+
+			options := edge.DefaultDialOptions()
+			options.AsyncWrites = true
+			dialed := harness.dial(b, session, options)
+			defer func() { _ = dialed.Close() }()
+			if err := dialed.SetSendWindow(window); err != nil {
+				b.Fatal(err)
+			}
+
+			accepted := acceptWithTimeout(b, listener)
+			if err := accepted.SetRecvWindow(edge.MaxWindowSize); err != nil {
+				b.Fatal(err)
+			}
+
+			data := make([]byte, 16*1024)
+			total := int64(len(data) * b.N)
+			doneC := make(chan error, 1)
+			go func() {
+				_, err := io.CopyN(ioutil.Discard, accepted, total)
+				doneC <- err
+			}()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := dialed.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := <-doneC; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// BenchmarkWriteCoalescing measures small write throughput with and without writes being coalesced
+func BenchmarkWriteCoalescing(b *testing.B) {
+	for _, window := range []time.Duration{0, time.Millisecond} {
+		b.Run(fmt.Sprintf("window=%v", window), func(b *testing.B) {
+			harness := newTestHarness(b)
+			defer harness.close()
+
+			session := &edge.Session{Id: "test-session", Token: "test-token"}
+			listener := harness.listen(b, session, edge.DefaultListenOptions())
+			defer func() { _ = listener.Close() }()
+
+			options := edge.DefaultDialOptions()
+			options.WriteCoalesceWindow = window
+			dialed := harness.dial(b, session, options)
+			accepted := acceptWithTimeout(b, listener)
+
+			data := make([]byte, 64)
+			total := int64(len(data) * b.N)
+			doneC := make(chan error, 1)
+			go func() {
+				_, err := io.CopyN(ioutil.Discard, accepted, total)
+				doneC <- err
+			}()
+
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := dialed.Write(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if err := dialed.Close(); err != nil {
+				b.Fatal(err)
+			}
+			if err := <-doneC; err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func Test_WriteCoalescing(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	options := edge.DefaultDialOptions()
+	options.WriteCoalesceWindow = 50 * time.Millisecond
+	dialed := harness.dial(t, session, options)
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	// a partial buffer goes out once the window passes, with no further writes to push it
+	start := time.Now()
+	data := []byte("abc")
+	for i := range data {
+		_, err := dialed.Write(data[i : i+1])
+		assert.NoError(err)
+	}
+	data[0] = 'x' // writes are copied, so this mustn't be sent
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	msg, err := accepted.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("abc", string(msg))
+	assert.True(time.Since(start) >= 40*time.Millisecond, "coalesced writes sent before the window, after %v", time.Since(start))
+	assert.Equal(uint64(1), dialed.Stats().MsgsWritten)
+
+	// a full frame goes out without waiting for the window
+	options.WriteCoalesceWindow = time.Hour
+	dialed = harness.dial(t, session, options)
+	accepted = acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	chunk := make([]byte, 1024)
+	for i := 0; i < edge.WriteCoalesceFrameSize/len(chunk); i++ {
+		_, err := dialed.Write(chunk)
+		assert.NoError(err)
+	}
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	msg, err = accepted.ReadMessage()
+	assert.NoError(err)
+	assert.Equal(edge.WriteCoalesceFrameSize, len(msg))
+
+	// closing sends what's still buffered
+	_, err = dialed.Write([]byte("tail"))
+	assert.NoError(err)
+	assert.NoError(dialed.Close())
+	msg, err = accepted.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("tail", string(msg))
+
+	_, err = dialed.Write([]byte("late"))
+	assert.Error(err)
+}
+
+func Test_CloseDrainsWrites(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	options := edge.DefaultDialOptions()
+	options.AsyncWrites = true
+	options.WriteCoalesceWindow = time.Hour
+	options.Linger = time.Second
+	dialed := harness.dial(t, session, options)
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	// everything written, coalesced or in flight, reaches the peer ahead of the close
+	chunk := make([]byte, 1000)
+	var written int
+	for i := 0; i < 200; i++ {
+		n, err := dialed.Write(chunk)
+		assert.NoError(err)
+		written += n
+	}
+	assert.NoError(dialed.Close())
+	assert.Equal(0, dialed.(*edgeConn).GetUnackedBytes())
+
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err := ioutil.ReadAll(accepted)
+	assert.NoError(err)
+	assert.Equal(written, len(received))
+
+	// aborting drops what's still coalesced
+	dialed = harness.dial(t, session, options)
+	accepted = acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	_, err = dialed.Write([]byte("dropped"))
+	assert.NoError(err)
+	assert.NoError(dialed.Abort())
+
+	assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+	received, err = ioutil.ReadAll(accepted)
+	assert.NoError(err)
+	assert.Empty(received)
+
+	_, err = dialed.Write([]byte("late"))
+	assert.Error(err)
+}
+
+func Test_MemoryBudget(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	const budget = 64 * 1024
+	const msgSize = 8 * 1024
+	harness.host.SetMemoryBudget(budget)
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	// no one conn comes near its receive buffer, but together they'd go well over the budget
+	const conns = 4
+	const msgsPerConn = 16
+	var dialed, accepted []edge.ServiceConn
+	for i := 0; i < conns; i++ {
+		dialed = append(dialed, harness.dial(t, session, edge.DefaultDialOptions()))
+		accepted = append(accepted, acceptWithTimeout(t, listener))
+	}
+
+	writeErrC := make(chan error, conns)
+	for _, conn := range dialed {
+		go func(conn edge.ServiceConn) {
+			data := make([]byte, msgSize)
+			for j := 0; j < msgsPerConn; j++ {
+				if _, err := conn.Write(data); err != nil {
+					writeErrC <- err
+					return
+				}
+			}
+			writeErrC <- nil
+		}(conn)
+	}
+
+	assert.Eventually(func() bool { return harness.host.Stats().ReadPauses > 0 }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	// the budget can be overshot by the message which reached it and the one behind it, which was read before the
+	// first was buffered. Messages carry some encryption overhead on top of msgSize
+	maxBuffered := uint64(budget + 2*(msgSize+1024))
+	assert.True(harness.host.Stats().BufferedBytes <= maxBuffered, "buffered %v bytes", harness.host.Stats().BufferedBytes)
+
+	// reading frees up the budget, letting the rest of the data through. The conns are read together, as one
+	// conn's data can be held up behind data for the others
+	readErrC := make(chan error, conns)
+	for _, conn := range accepted {
+		go func(conn edge.ServiceConn) {
+			_, err := io.CopyN(ioutil.Discard, conn, msgSize*msgsPerConn)
+			readErrC <- err
+		}(conn)
+	}
+	for i := 0; i < conns; i++ {
+		assert.NoError(<-readErrC)
+		assert.NoError(<-writeErrC)
+	}
+	assert.Equal(uint64(0), harness.host.Stats().BufferedBytes)
+
+	// data still buffered when a conn closes is given back
+	last := harness.dial(t, session, edge.DefaultDialOptions())
+	conn := acceptWithTimeout(t, listener)
+	_, err := last.Write(make([]byte, msgSize))
+	assert.NoError(err)
+	assert.Eventually(func() bool { return harness.host.Stats().BufferedBytes >= msgSize }, time.Second, time.Millisecond)
+	assert.NoError(conn.Close())
+	assert.Equal(uint64(0), harness.host.Stats().BufferedBytes)
+}
+
+func Test_DialWithoutBindFails(t *testing.T) {
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(&edge.Session{Token: "unbound"}, edge.DefaultDialOptions())
+	require.Error(t, err)
+}
+
+func Test_RecvBufferSizeExceeded(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.RecvBufferSize = 100
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	closedC := make(chan error, 1)
+	accepted.OnClose(func(cause error) {
+		closedC <- cause
+	})
+
+	// nothing is read on the accepted side, so the second write takes it over the limit
+	data := make([]byte, 60)
+	for i := 0; i < 2; i++ {
+		_, err := dialed.Write(data)
+		assert.NoError(err)
+	}
+
+	select {
+	case cause := <-closedC:
+		assert.Equal(edge.ErrRecvBufferExceeded, cause)
+	case <-time.After(time.Second):
+		assert.Fail("accepted conn not closed when receive buffer exceeded")
+	}
+
+	_, err := accepted.Read(make([]byte, 10))
+	assert.Equal(edge.ErrRecvBufferExceeded, err)
+}
+
+func Test_MaxMessageSizeExceeded(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.MaxMessageSize = 100
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	closedC := make(chan error, 1)
+	accepted.OnClose(func(cause error) {
+		closedC <- cause
+	})
+
+	_, err := dialed.Write(make([]byte, 100))
+	assert.NoError(err)
+	_, err = dialed.Write(make([]byte, 101))
+	assert.NoError(err)
+
+	select {
+	case cause := <-closedC:
+		assert.Equal(edge.ErrMessageTooLarge, cause)
+	case <-time.After(time.Second):
+		assert.Fail("accepted conn not closed on oversized message")
+	}
+
+	_, err = accepted.Read(make([]byte, 200))
+	assert.Equal(edge.ErrMessageTooLarge, err)
+}
+
+func Test_TooManyHeaders(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.MaxHeaders = 20
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	closedC := make(chan error, 1)
+	accepted.OnClose(func(cause error) {
+		closedC <- cause
+	})
+
+	headers := func(count int) map[int32][]byte {
+		result := map[int32][]byte{}
+		for i := 0; i < count; i++ {
+			result[int32(5000+i)] = []byte("x")
+		}
+		return result
+	}
+	_, err := dialed.(*edgeConn).WriteTracedWithHeaders([]byte("ok"), nil, headers(5))
+	assert.NoError(err)
+	_, err = dialed.(*edgeConn).WriteTracedWithHeaders([]byte("too many"), nil, headers(100))
+	assert.NoError(err)
+
+	select {
+	case cause := <-closedC:
+		assert.Equal(edge.ErrTooManyHeaders, cause)
+	case <-time.After(time.Second):
+		assert.Fail("accepted conn not closed on message with too many headers")
+	}
+
+	_, err = accepted.Read(make([]byte, 200))
+	assert.Equal(edge.ErrTooManyHeaders, err)
+
+	// dial requests with too many headers are failed, and the listener carries on
+	conn := harness.dialer.NewConn("test-service").(*edgeConn)
+	defer func() { _ = conn.Close() }()
+	connect := edge.NewConnectMsg(conn.Id(), session.Token, conn.keyPair.Public())
+	for k, v := range headers(100) {
+		connect.Headers[k] = v
+	}
+	reply, err := conn.SendAndWaitWithTimeout(connect, time.Second)
+	assert.NoError(err)
+	assert.Equal(int32(edge.ContentTypeStateClosed), reply.ContentType)
+	assert.Contains(string(reply.Body), edge.ErrTooManyHeaders.Error())
+
+	dialed = harness.dial(t, session, edge.DefaultDialOptions())
+	accepted = acceptWithTimeout(t, listener)
+	_ = accepted.Close()
+	_ = dialed.Close()
+}
+
+func Test_CorrelationId(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+	assert.Equal("", accepted.GetCorrelationId())
+
+	// once data has been read, the crypto header written as the conn was set up has arrived
+	_, err := dialed.Write([]byte("ping"))
+	assert.NoError(err)
+	_, err = accepted.Read(make([]byte, 16))
+	assert.NoError(err)
+
+	msgC := make(chan *channel2.Message, 16)
+	accepted.(*edgeConn).AddInboundInterceptor(func(msg *channel2.Message) error {
+		msgC <- msg
+		return nil
+	})
+
+	dialed.SetCorrelationId("request-1234")
+	for _, data := range []string{"one", "two", "three"} {
+		_, err := dialed.Write([]byte(data))
+		assert.NoError(err)
+	}
+	assert.NoError(dialed.(*edgeConn).WriteMessage([]byte("four")))
+	assert.NoError(dialed.Close())
+
+	sawClose := false
+	for i := 0; i < 5; i++ {
+		select {
+		case msg := <-msgC:
+			assert.Equal("request-1234", string(msg.Headers[edge.CorrelationIdHeader]), "message %v", i)
+			assert.Equal("request-1234", edge.GetLoggerFields(msg)["correlationId"])
+			sawClose = sawClose || msg.ContentType == edge.ContentTypeStateClosed
+		case <-time.After(time.Second):
+			assert.FailNow("timed out waiting for message", "%v", i)
+		}
+	}
+	assert.True(sawClose)
+	assert.Equal("request-1234", accepted.GetCorrelationId())
+}
+
+func Test_WriteWithReceipt(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	conn := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = conn.Close() }()
+	hosted := acceptWithTimeout(t, listener)
+	defer func() { _ = hosted.Close() }()
+
+	receipt, err := conn.WriteWithReceipt([]byte("hello"))
+	assert.NoError(err)
+
+	// the receipt only resolves once the peer has read the message
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, receipt.Wait(ctx))
+
+	msg, err := hosted.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("hello", string(msg))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(receipt.Wait(ctx))
+
+	// the data still goes through to a peer which doesn't send acks
+	dialed := conn.(*edgeConn)
+	caps := dialed.connHeaders[edge.CapabilitiesHeader]
+	dialed.connHeaders[edge.CapabilitiesHeader] = []byte(edge.CapabilityCompression)
+	receipt, err = conn.WriteWithReceipt([]byte("no receipt"))
+	assert.NoError(err)
+	assert.Equal(edge.ErrReceiptsUnsupported, receipt.Wait(ctx))
+	msg, err = hosted.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("no receipt", string(msg))
+	dialed.connHeaders[edge.CapabilitiesHeader] = caps
+
+	// receipts still waiting when the conn closes fail
+	receipt, err = conn.WriteWithReceipt([]byte("unread"))
+	assert.NoError(err)
+	assert.NoError(conn.Close())
+	assert.Equal(edge.ErrConnClosed, receipt.Wait(ctx))
+}
+
+func Test_ProtocolNegotiation(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.ProtocolSelector = func(offered []string) string {
+		for _, protocol := range offered {
+			if protocol == "h2" || protocol == "http/1.1" {
+				return protocol
+			}
+		}
+		return ""
+	}
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	dial := func(protocols ...string) (edge.ServiceConn, edge.ServiceConn) {
+		dialOptions := edge.DefaultDialOptions()
+		dialOptions.Protocols = protocols
+		dialed := harness.dial(t, session, dialOptions)
+		return dialed, acceptWithTimeout(t, listener)
+	}
+
+	dialed, accepted := dial("custom", "h2", "http/1.1")
+	assert.Equal("h2", dialed.SelectedProtocol())
+	assert.Equal("h2", accepted.SelectedProtocol())
+
+	// the raw handshake headers are available too
+	protocol, found := dialed.GetConnectHeader(edge.ProtocolHeader)
+	assert.True(found)
+	assert.Equal("h2", string(protocol))
+	offered, found := accepted.GetConnectHeader(edge.ProtocolsHeader)
+	assert.True(found)
+	assert.Equal("custom\nh2\nhttp/1.1", string(offered))
+	_, found = dialed.GetConnectHeader(1999)
+	assert.False(found)
+
+	dialed, accepted = dial("custom")
+	assert.Equal("", dialed.SelectedProtocol())
+	assert.Equal("", accepted.SelectedProtocol())
+
+	dialed, accepted = dial()
+	assert.Equal("", dialed.SelectedProtocol())
+	assert.Equal("", accepted.SelectedProtocol())
+}
+
+func Test_ConnectHandler(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	var requests []edge.ConnectRequest
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.ProtocolSelector = func([]string) string { return "http/1.1" }
+	listenOptions.ConnectHandler = func(req edge.ConnectRequest) edge.ConnectDecision {
+		requests = append(requests, req)
+		if req.ClientHint == "banned" {
+			return edge.RejectConnect(403, "tenant suspended")
+		}
+		return edge.AcceptConnect("h2").
+			WithReplyHeader(5000, []byte("tenant-a")).
+			WithReplyHeader(edge.ProtocolHeader, []byte("ignored"))
+	}
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	dialOptions := edge.DefaultDialOptions()
+	dialOptions.Protocols = []string{"http/1.1", "h2"}
+	dialOptions.ClientHint = "tenant-a"
+	dialOptions.AppData = []byte("app-data")
+	dialed := harness.dial(t, session, dialOptions)
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	// the handler's protocol takes precedence over the selector, and reserved reply headers are left out
+	assert.Equal("h2", dialed.SelectedProtocol())
+	assert.Equal("h2", accepted.SelectedProtocol())
+	stamped, found := dialed.GetConnectHeader(5000)
+	assert.True(found)
+	assert.Equal("tenant-a", string(stamped))
+	protocol, _ := dialed.GetConnectHeader(edge.ProtocolHeader)
+	assert.Equal("h2", string(protocol))
+
+	assert.Len(requests, 1)
+	assert.Equal("test-service", requests[0].ServiceName)
+	assert.Equal([]string{"http/1.1", "h2"}, requests[0].Protocols)
+	assert.Equal("tenant-a", requests[0].ClientHint)
+	assert.Equal("app-data", string(requests[0].AppData))
+
+	dialOptions.ClientHint = "banned"
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, dialOptions)
+	var rejected *edge.DialRejectedError
+	assert.True(errors.As(err, &rejected), "expected a DialRejectedError, got %v", err)
+	assert.Equal(403, rejected.Code())
+	assert.Equal("tenant suspended", rejected.Message())
+}
+
+func Test_DuplicateConnIdRecovery(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	existing := harness.dialer.NewConn("test-service")
+
+	defer func(f func() uint32) { nextConnId = f }(nextConnId)
+	ids := []uint32{existing.Id()}
+	nextConnId = func() uint32 {
+		if len(ids) > 0 {
+			id := ids[0]
+			ids = ids[1:]
+			return id
+		}
+		return connSeq.Next()
+	}
+
+	conn := harness.dialer.NewConn("test-service")
+	assert.NotEqual(existing.Id(), conn.Id())
+	assert.Equal(uint64(1), harness.dialer.Stats().ConnIdCollisions)
+	assert.Equal(uint64(2), harness.dialer.Stats().ActiveConns)
+
+	// gives up once every attempt collides
+	routerConn := harness.dialer.(*routerConn)
+	nextConnId = func() uint32 { return existing.Id() }
+	_, err := registerNewConn(routerConn, routerConn.msgMux, func(id uint32) *edgeConn {
+		return newEdgeConn(routerConn, routerConn.ch, routerConn.msgMux, id, "test-service")
+	})
+	assert.Error(err)
+	assert.True(errors.Is(err, edge.ErrDuplicateSinkId))
+	assert.Equal(uint64(1+MaxConnIdAttempts), harness.dialer.Stats().ConnIdCollisions)
+}
+
+func Test_MuxCloseCause(t *testing.T) {
+	for _, shutdown := range []bool{false, true} {
+		assert := require.New(t)
+		harness := newTestHarness(t)
+
+		session := &edge.Session{Id: "test-session", Token: "test-token"}
+		listener := harness.listen(t, session, edge.DefaultListenOptions())
+		dialed := harness.dial(t, session, edge.DefaultDialOptions())
+		acceptWithTimeout(t, listener)
+
+		closedC := make(chan error, 1)
+		dialed.OnClose(func(cause error) {
+			closedC <- cause
+		})
+
+		// closing the router conn locally is reported differently to the router going away
+		expected := edge.ErrRouterConnClosed
+		if shutdown {
+			expected = edge.ErrRouterConnShutdown
+			assert.NoError(harness.dialer.Close())
+		} else {
+			harness.router.Close()
+		}
+
+		select {
+		case cause := <-closedC:
+			assert.Equal(expected, cause)
+		case <-time.After(time.Second):
+			assert.FailNow("close handler not called")
+		}
+		_, err := dialed.Read(make([]byte, 16))
+		assert.Equal(expected, err)
+		_, err = dialed.Write([]byte("hello"))
+		assert.Equal(expected, err)
+
+		harness.close()
+	}
+}
+
+// Test_MultiListenerEventHandlerRace adds and removes child listeners while change handlers are running. It's only
+func Test_MultiListenerLifecycleEvents(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	oldSession := &edge.Session{Id: "old-session", Token: "old-token"}
+	newSession := &edge.Session{Id: "new-session", Token: "new-token"}
+	multi := NewMultiListener("test-service", func() *edge.Session { return newSession })
+	defer func() { _ = multi.Close() }()
+
+	eventC := make(chan edge.LifecycleEvent, 32)
+	multi.SetLifecycleHandler(func(event edge.LifecycleEvent) {
+		eventC <- event
+	})
+	next := func(expected edge.LifecycleEventType) edge.LifecycleEvent {
+		select {
+		case event := <-eventC:
+			assert.Equal(expected, event.Type, "got %v event, expected %v", event.Type, expected)
+			assert.False(event.Time.IsZero())
+			return event
+		case <-time.After(time.Second):
+			assert.FailNow("timed out waiting for event", "%v", expected)
+		}
+		return edge.LifecycleEvent{}
+	}
+
+	options := edge.DefaultListenOptions()
+	options.DrainGracePeriod = 20 * time.Millisecond
+	old := harness.listen(t, oldSession, options)
+	multi.NotifyBind("test-router", nil)
+	multi.AddListener(old, nil)
+	assert.Equal("test-router", next(edge.LifecycleBindSucceeded).Router)
+	event := next(edge.LifecycleChildAdded)
+	assert.Equal("test-router", event.Router)
+	assert.Equal(old, event.Listener)
+
+	bindErr := errors.New("bind refused")
+	multi.NotifyBind("other-router", bindErr)
+	event = next(edge.LifecycleBindFailed)
+	assert.Equal("other-router", event.Router)
+	assert.Equal(bindErr, event.Err)
+
+	conn := harness.dial(t, oldSession, edge.DefaultDialOptions())
+	defer func() { _ = conn.Close() }()
+	accepted := acceptWithTimeout(t, multi)
+	defer func() { _ = accepted.Close() }()
+	event = next(edge.LifecycleConnAccepted)
+	assert.Equal(accepted, event.Conn)
+	assert.Equal("test-router", event.Router)
+
+	// a rebind binds and adds the replacement before the old child is removed
+	assert.NoError(multi.RefreshSession(newSession))
+	next(edge.LifecycleBindSucceeded)
+	event = next(edge.LifecycleChildAdded)
+	rebound := event.Listener
+	assert.NotEqual(old, rebound)
+	assert.Equal(old, next(edge.LifecycleChildRemoved).Listener)
+
+	assert.NoError(multi.GracefulClose(context.Background()))
+	next(edge.LifecycleDraining)
+	// the child is removed by its forwarding goroutine, which may finish after the multi-listener has closed
+	var types []edge.LifecycleEventType
+	for i := 0; i < 3; i++ {
+		select {
+		case event = <-eventC:
+		case <-time.After(time.Second):
+			assert.FailNow("timed out waiting for close events", "got %v", types)
+		}
+		types = append(types, event.Type)
+		if event.Type == edge.LifecycleChildRemoved {
+			assert.Equal(rebound, event.Listener)
+		}
+	}
+	assert.ElementsMatch([]edge.LifecycleEventType{edge.LifecycleChildRemoved, edge.LifecycleDrained, edge.LifecycleClosed}, types)
+
+	// closing again doesn't repeat the closed event
+	assert.NoError(multi.Close())
+	select {
+	case event := <-eventC:
+		assert.Fail("unexpected event after close", "%v", event.Type)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+// useful under the race detector
+func Test_MultiListenerEventHandlerRace(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(SetPollInterval(time.Millisecond))
+	defer func() { _ = SetPollInterval(DefaultAcceptPollInterval) }()
+
+	multi := NewMultiListener("test-service", nil).(*multiListener)
+	var notifications int64
+	multi.SetConnectionChangeHandler(func(listeners []edge.Listener) {
+		for _, child := range listeners {
+			_ = child.IsClosed()
+		}
+		atomic.AddInt64(&notifications, 1)
+	})
+
+	// children are marked closed rather than closed, as closing sends an unbind to the router
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		child := &edgeListener{
+			baseListener: baseListener{
+				serviceName: "test-service",
+				acceptC:     make(chan net.Conn, 1),
+				errorC:      make(chan error, 1),
+				closeNotify: make(chan struct{}),
+			},
+			token: fmt.Sprintf("test-token-%v", i),
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			multi.AddListener(child, nil)
+			child.setClosed()
+		}()
+	}
+	wg.Wait()
+
+	// each child is notified once when added and once when removed
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&notifications) < 40 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(int64(40), atomic.LoadInt64(&notifications))
+	assert.NoError(multi.Close())
+}
+
+func Test_ReadTimeout(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	buf := make([]byte, 16)
+	readTimesOut := func(atLeast, before time.Duration) {
+		start := time.Now()
+		_, err := dialed.Read(buf)
+		elapsed := time.Since(start)
+		assert.Equal(edge.ErrReadTimeout, err)
+		netErr, ok := err.(net.Error)
+		assert.True(ok)
+		assert.True(netErr.Timeout())
+		assert.True(elapsed >= atLeast, "read returned after %v", elapsed)
+		assert.True(elapsed < before, "read returned after %v", elapsed)
+	}
+
+	dialed.SetReadTimeout(50 * time.Millisecond)
+	readTimesOut(50*time.Millisecond, 500*time.Millisecond)
+
+	// the conn is still open after a timeout, and each read gets the full timeout
+	assert.False(dialed.IsClosed())
+	for i := 0; i < 3; i++ {
+		time.AfterFunc(30*time.Millisecond, func() {
+			_, _ = accepted.Write([]byte("ping"))
+		})
+		n, err := dialed.Read(buf)
+		assert.NoError(err)
+		assert.Equal("ping", string(buf[:n]))
+	}
+
+	// whichever of the deadline and the timeout comes first applies
+	assert.NoError(dialed.SetReadDeadline(time.Now().Add(time.Hour)))
+	readTimesOut(50*time.Millisecond, 500*time.Millisecond)
+
+	dialed.SetReadTimeout(time.Hour)
+	assert.NoError(dialed.SetReadDeadline(time.Now().Add(50 * time.Millisecond)))
+	readTimesOut(40*time.Millisecond, 500*time.Millisecond)
+
+	dialed.SetReadTimeout(0)
+	assert.NoError(dialed.SetReadDeadline(time.Time{}))
+	time.AfterFunc(100*time.Millisecond, func() {
+		_, _ = accepted.Write([]byte("late"))
+	})
+	n, err := dialed.Read(buf)
+	assert.NoError(err)
+	assert.Equal("late", string(buf[:n]))
+}
+
+func Test_ClientHint(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	options := edge.DefaultDialOptions()
+	options.ClientHint = "tenant-a"
+	dialed := harness.dial(t, session, options)
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	hint, found := accepted.GetConnectHeader(edge.ClientHintHeader)
+	assert.True(found)
+	assert.Equal("tenant-a", string(hint))
+
+	plain := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = plain.Close() }()
+	accepted = acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+	_, found = accepted.GetConnectHeader(edge.ClientHintHeader)
+	assert.False(found)
+}
+
+func Test_CloseGracefully(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(SetPollInterval(10 * time.Millisecond))
+	defer func() { _ = SetPollInterval(DefaultAcceptPollInterval) }()
+
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	drainedC := make(chan bool, 1)
+	dialed.(edge.Drainable).OnDrain(func() {
+		drainedC <- dialed.IsClosed()
+	})
+
+	doneC := make(chan error, 1)
+	go func() {
+		doneC <- harness.dialer.CloseGracefully(context.Background())
+	}()
+
+	select {
+	case closed := <-drainedC:
+		assert.False(closed, "conn should be drained before it's closed")
+	case <-time.After(time.Second):
+		assert.Fail("drain handler not called")
+	}
+
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, edge.DefaultDialOptions())
+	assert.Equal(edge.ErrRouterConnDraining, err)
+	assert.False(harness.dialer.IsClosed())
+
+	// the conn is still usable while draining
+	_, err = dialed.Write([]byte("hello"))
+	assert.NoError(err)
+
+	assert.NoError(dialed.Close())
+	select {
+	case err := <-doneC:
+		assert.NoError(err)
+	case <-time.After(time.Second):
+		assert.Fail("CloseGracefully didn't return once conns were closed")
+	}
+	assert.True(harness.dialer.IsClosed())
+
+	// handlers registered after the drain are called straight away
+	calledC := make(chan struct{})
+	dialed.(edge.Drainable).OnDrain(func() { close(calledC) })
+	select {
+	case <-calledC:
+	case <-time.After(time.Second):
+		assert.Fail("late drain handler not called")
+	}
+}
+
+func Test_CloseGracefullyTimeout(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(context.DeadlineExceeded, harness.dialer.CloseGracefully(ctx))
+	assert.True(harness.dialer.IsClosed())
+}
+
+// unackedStateChannel holds back the sync for state messages, like a router which never takes the close
+type unackedStateChannel struct {
+	channel2.Channel
+}
+
+func (ch *unackedStateChannel) SendAndSyncWithPriority(m *channel2.Message, p channel2.Priority) (chan error, error) {
+	if m.ContentType == edge.ContentTypeStateClosed {
+		return make(chan error), nil
+	}
+	return ch.Channel.SendAndSyncWithPriority(m, p)
+}
+
+func Test_CloseHonorsStateTimeout(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	ch, err := harness.router.Dial()
+	assert.NoError(err)
+	dialer := NewEdgeConnFactory(harness.router.Name(), "unacked-dialer", &unackedStateChannel{Channel: ch}, nil)
+	defer func() { _ = dialer.Close() }()
+
+	dialed, err := dialer.NewConn("test-service").ConnectWithOptions(session, edge.DefaultDialOptions())
+	assert.NoError(err)
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	conn := dialed.(*edgeConn)
+	conn.SetStateTimeout(2 * time.Second)
+
+	// the close waits out the whole state timeout, rather than giving up while the close is still being sent
+	start := time.Now()
+	err = conn.Close()
+	elapsed := time.Since(start)
+	assert.True(errors.Is(err, edge.ErrStateSendTimeout), "unexpected error: %v", err)
+	assert.True(elapsed >= 2*time.Second, "close returned after %v", elapsed)
+	assert.True(elapsed < 3*time.Second, "close returned after %v", elapsed)
+	assert.True(conn.closed.Get())
+}
+
+func Test_BoundIdentity(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.Identity = "host-1"
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+	assert.Equal("host-1", listener.BoundIdentity())
+
+	other := &edge.Session{Id: "other-session", Token: "other-token"}
+	plain := harness.listen(t, other, edge.DefaultListenOptions())
+	defer func() { _ = plain.Close() }()
+	assert.Equal("", plain.BoundIdentity())
+}
+
+func Test_TerminatorInstanceId(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.Identity = "host-1"
+	options.TerminatorInstanceId = "pod-a"
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+	assert.Equal("pod-a", listener.TerminatorInstanceId())
+
+	binding, found := harness.router.GetBinding(session.Token)
+	assert.True(found)
+	assert.Equal("pod-a", string(binding.Headers[edge.TerminatorInstanceIdHeader]))
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+	assert.Equal("pod-a", accepted.TerminatorInstanceId())
+	assert.Equal("pod-a", dialed.TerminatorInstanceId())
+
+	// dials can ask for a particular instance
+	dialOptions := edge.DefaultDialOptions()
+	dialOptions.Terminators = []edge.Terminator{{Identity: "host-1", InstanceId: "pod-a"}}
+	dialOptions.TerminatorSelector = edge.RandomTerminatorSelector()
+	targeted := harness.dial(t, session, dialOptions)
+	defer func() { _ = targeted.Close() }()
+	accepted = acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+	assert.Equal("pod-a", targeted.TerminatorInstanceId())
+
+	dialOptions.Terminators[0].InstanceId = "pod-b"
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, dialOptions)
+	assert.Error(err)
+
+	// listeners bound without one report none
+	other := &edge.Session{Id: "other-session", Token: "other-token"}
+	plain := harness.listen(t, other, edge.DefaultListenOptions())
+	defer func() { _ = plain.Close() }()
+	assert.Equal("", plain.TerminatorInstanceId())
+	dialed = harness.dial(t, other, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	assert.Equal("", dialed.TerminatorInstanceId())
+}
+
+func Test_ServiceDefaults(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	dialDefaults := edge.DefaultDialOptions()
+	dialDefaults.ClientHint = "from-defaults"
+	listenDefaults := edge.DefaultListenOptions()
+	listenDefaults.TerminatorInstanceId = "pod-defaults"
+	edge.RegisterServiceDefaults("test-service", dialDefaults, listenDefaults)
+	defer edge.RegisterServiceDefaults("test-service", nil, nil)
+
+	// registered defaults apply when options are nil
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener, err := harness.host.NewConn("test-service").Listen(session, "test-service", nil)
+	assert.NoError(err)
+	defer func() { _ = listener.Close() }()
+	assert.Equal("pod-defaults", listener.TerminatorInstanceId())
+
+	dialed, err := harness.dialer.NewConn("test-service").Connect(session)
+	assert.NoError(err)
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+	hint, _ := accepted.GetConnectHeader(edge.ClientHintHeader)
+	assert.Equal("from-defaults", string(hint))
+
+	// explicit options take precedence
+	options := edge.DefaultDialOptions()
+	options.ClientHint = "explicit"
+	dialed = harness.dial(t, session, options)
+	defer func() { _ = dialed.Close() }()
+	accepted = acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+	hint, _ = accepted.GetConnectHeader(edge.ClientHintHeader)
+	assert.Equal("explicit", string(hint))
+
+	other := &edge.Session{Id: "other-session", Token: "other-token"}
+	plain := harness.listen(t, other, edge.DefaultListenOptions())
+	defer func() { _ = plain.Close() }()
+	assert.Equal("", plain.TerminatorInstanceId())
+
+	// clearing the defaults restores the SDK defaults
+	edge.RegisterServiceDefaults("test-service", nil, nil)
+	assert.Equal(edge.DefaultDialOptions(), edge.DialOptionsFor("test-service"))
+	assert.Equal(edge.DefaultListenOptions(), edge.ListenOptionsFor("test-service"))
+}
+
+func Test_MessageMode(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	options := edge.DefaultDialOptions()
+	options.MaxMessageSize = 1024
+	dialed := harness.dial(t, session, options)
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	messages := [][]byte{[]byte("one"), []byte("two"), make([]byte, 1000)}
+	for _, msg := range messages {
+		assert.NoError(dialed.WriteMessage(msg))
+	}
+	assert.Equal(edge.ErrMessageTooLarge, dialed.WriteMessage(make([]byte, 2048)))
+
+	for _, expected := range messages {
+		msg, err := accepted.ReadMessage()
+		assert.NoError(err)
+		assert.Equal(expected, msg)
+	}
+
+	assert.NoError(accepted.WriteMessage([]byte("reply")))
+	msg, err := dialed.ReadMessage()
+	assert.NoError(err)
+	assert.Equal("reply", string(msg))
+	assert.False(dialed.IsClosed())
+}
+
+func Test_ListenerPriority(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.PriorityFunc = func(info edge.ConnInfo) int {
+		return int(info.AppData[0] - '0')
+	}
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+
+	for _, appData := range []string{"1a", "3a", "2a", "3b"} {
+		dialOptions := edge.DefaultDialOptions()
+		dialOptions.AppData = []byte(appData)
+		dialed := harness.dial(t, session, dialOptions)
+		defer func() { _ = dialed.Close() }()
+	}
+
+	queued := listener.(*edgeListener).acceptC
+	assert.Eventually(func() bool { return len(queued) == 4 }, time.Second, time.Millisecond)
+
+	for _, expected := range []string{"3a", "3b", "2a", "1a"} {
+		accepted := acceptWithTimeout(t, listener)
+		appData, found := accepted.GetConnectHeader(edge.AppDataHeader)
+		assert.True(found)
+		assert.Equal(expected, string(appData))
+		_ = accepted.Close()
+	}
+}
+
+func Test_WireStats(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	for _, size := range []int{5, 100} {
+		assert.NoError(dialed.WriteMessage(make([]byte, size)))
+		_, err := accepted.ReadMessage()
+		assert.NoError(err)
+	}
+
+	written := dialed.Stats()
+	assert.Equal(uint64(2), written.MsgsWritten)
+	assert.Equal(uint64(105), written.BytesWritten)
+	// the conn is end-to-end encrypted, which adds to each message on the wire
+	assert.True(written.WireBytesWritten > written.BytesWritten)
+	assert.True(written.LargestMsgWritten > 100)
+
+	read := accepted.Stats()
+	assert.Equal(written.WireBytesWritten, read.WireBytesRead)
+	assert.Equal(written.LargestMsgWritten, read.LargestMsgRead)
+}
+
+func Test_Capabilities(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	for _, conn := range []edge.ServiceConn{dialed, accepted} {
+		assert.Equal(edge.Version(), edge.PeerVersion(conn))
+		assert.Equal(edge.Capabilities(), edge.PeerCapabilities(conn))
+		assert.True(edge.PeerSupports(conn, edge.CapabilityCompression))
+		assert.False(edge.PeerSupports(conn, "time-travel"))
+	}
+}
+
+// stalledChannel is a channel to an unresponsive router: sends wait out their timeout and syncs never complete
+type stalledChannel struct {
+	channel2.Channel
+}
+
+func (ch *stalledChannel) SendWithTimeout(_ *channel2.Message, timeout time.Duration) error {
+	time.Sleep(timeout)
+	return errors.New("timed out")
+}
+
+func (ch *stalledChannel) IsClosed() bool {
+	return false
+}
+
+func (ch *stalledChannel) SendAndSyncWithPriority(*channel2.Message, channel2.Priority) (chan error, error) {
+	return make(chan error), nil
+}
+
+func Test_CloseNoUnbind(t *testing.T) {
+	assert := require.New(t)
+	mux := edge.NewMsgMux()
+	defer mux.Close()
+
+	conn := newEdgeConn(nil, &stalledChannel{}, mux, 1, "test-service")
+	listener := &edgeListener{
+		baseListener: baseListener{
+			serviceName: "test-service",
+			acceptC:     make(chan net.Conn, 10),
+			errorC:      make(chan error, 1),
+			closeNotify: make(chan struct{}),
+		},
+		token:    "test-token",
+		edgeChan: conn,
+	}
+	conn.hosting.Store(listener.token, listener)
+
+	start := time.Now()
+	assert.NoError(listener.CloseNoUnbind())
+	assert.True(time.Since(start) < 100*time.Millisecond)
+
+	assert.True(listener.IsClosed())
+	assert.True(conn.closed.Get())
+	_, found := conn.getListener(listener.token)
+	assert.False(found)
+	_, err := listener.Accept()
+	assert.Error(err)
+	assert.NoError(listener.Close())
+}
+
+func Test_UpdateIdentitySecret(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	options := edge.DefaultListenOptions()
+	options.Identity = "host-1"
+	options.IdentitySecret = "first"
+	listener := harness.listen(t, session, options)
+	defer func() { _ = listener.Close() }()
+
+	binding, found := harness.router.GetBinding(session.Token)
+	assert.True(found)
+	assert.Equal("first", binding.IdentitySecret)
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	assert.NoError(listener.UpdateIdentitySecret("second"))
+	assert.Eventually(func() bool {
+		binding, found := harness.router.GetBinding(session.Token)
+		return found && binding.IdentitySecret == "second"
+	}, time.Second, time.Millisecond)
+	assert.Equal("second", listener.(*edgeListener).BindOptions(options).IdentitySecret)
+	assert.Equal("first", options.IdentitySecret)
+
+	// the bind and the accepted conn are unaffected
+	_, err := dialed.Write([]byte("hello"))
+	assert.NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(err)
+
+	again := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = again.Close() }()
+	acceptedAgain := acceptWithTimeout(t, listener)
+	_ = acceptedAgain.Close()
+}
+
+func Test_TerminatorSelector(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listenOptions := edge.DefaultListenOptions()
+	listenOptions.Identity = "host-2"
+	listener := harness.listen(t, session, listenOptions)
+	defer func() { _ = listener.Close() }()
+
+	options := edge.DefaultDialOptions()
+	options.Terminators = []edge.Terminator{{Identity: "host-1", Cost: 10}, {Identity: "host-2", Cost: 5}}
+	options.TerminatorSelector = edge.LowestCostTerminatorSelector()
+	dialed := harness.dial(t, session, options)
+	defer func() { _ = dialed.Close() }()
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	identity, found := accepted.GetConnectHeader(edge.TerminatorIdentityHeader)
+	assert.True(found)
+	assert.Equal("host-2", string(identity))
+
+	// picking a terminator which isn't there fails the dial, rather than going elsewhere
+	options.Terminators = options.Terminators[:1]
+	_, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, options)
+	assert.Error(err)
+}
+
+// limitedWriter writes at most limit bytes per call, returning err, if it's set, once it has
+type limitedWriter struct {
+	bytes.Buffer
+	limit int
+	err   error
+}
+
+func (writer *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) > writer.limit {
+		p = p[:writer.limit]
+	}
+	n, _ := writer.Buffer.Write(p)
+	return n, writer.err
+}
+
+func Test_WriteTo(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	connect := func() (edge.ServiceConn, *edgeConn) {
+		dialed := harness.dial(t, session, edge.DefaultDialOptions())
+		accepted := acceptWithTimeout(t, listener)
+		assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+		return dialed, accepted.(*edgeConn)
+	}
+
+	// bytes left over from a partial Read are written first, then payloads until the peer closes
+	dialed, accepted := connect()
+	_, err := dialed.Write([]byte("hello world"))
+	assert.NoError(err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(accepted, buf)
+	assert.NoError(err)
+	assert.Equal("hello", string(buf))
+	_, err = dialed.Write([]byte("!"))
+	assert.NoError(err)
+	assert.NoError(dialed.Close())
+
+	dst := &bytes.Buffer{}
+	n, err := accepted.WriteTo(dst)
+	assert.NoError(err)
+	assert.Equal(int64(7), n)
+	assert.Equal(" world!", dst.String())
+	_ = accepted.Close()
+
+	// a writer which takes less than it's given, without an error, is a short write
+	dialed, accepted = connect()
+	_, err = dialed.Write([]byte("abcdef"))
+	assert.NoError(err)
+	short := &limitedWriter{limit: 3}
+	n, err = accepted.WriteTo(short)
+	assert.Equal(io.ErrShortWrite, err)
+	assert.Equal(int64(3), n)
+	assert.Equal("abc", short.String())
+
+	// the rest of the payload is kept for the next read
+	_, err = io.ReadFull(accepted, buf[:3])
+	assert.NoError(err)
+	assert.Equal("def", string(buf[:3]))
+	_ = dialed.Close()
+	_ = accepted.Close()
+
+	// errors from dst are returned, with the unwritten bytes kept for the next read
+	dialed, accepted = connect()
+	defer func() { _ = dialed.Close() }()
+	defer func() { _ = accepted.Close() }()
+	_, err = dialed.Write([]byte("abcdef"))
+	assert.NoError(err)
+	failing := &limitedWriter{limit: 2, err: errors.New("write failed")}
+	n, err = accepted.WriteTo(failing)
+	assert.EqualError(err, "write failed")
+	assert.Equal(int64(2), n)
+	assert.Equal("ab", failing.String())
+
+	_, err = io.ReadFull(accepted, buf[:4])
+	assert.NoError(err)
+	assert.Equal("cdef", string(buf[:4]))
+}
+
+func Test_CopyWithProgress(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	accepted := acceptWithTimeout(t, listener)
+	defer func() { _ = accepted.Close() }()
+
+	size := 3*edge.ProgressReportBytes + 1000
+	received := make(chan []int64, 1)
+	go func() {
+		var reports []int64
+		_, _ = edge.WriteToWithProgress(accepted, ioutil.Discard, func(total int64) {
+			reports = append(reports, total)
+		})
+		received <- reports
+	}()
+
+	var sent []int64
+	n, err := edge.ReadFromWithProgress(dialed, bytes.NewReader(make([]byte, size)), func(total int64) {
+		sent = append(sent, total)
+	})
+	assert.NoError(err)
+	assert.Equal(int64(size), n)
+	assert.NoError(dialed.Close())
+
+	var reports []int64
+	select {
+	case reports = <-received:
+	case <-time.After(5 * time.Second):
+		assert.FailNow("copy from conn didn't finish")
+	}
+
+	for _, progress := range [][]int64{sent, reports} {
+		// at least one report per ProgressReportBytes, increasing, ending with the total
+		assert.True(len(progress) >= 3)
+		for i := 1; i < len(progress); i++ {
+			assert.True(progress[i] > progress[i-1])
+		}
+		assert.Equal(int64(size), progress[len(progress)-1])
+	}
+}
+
+func Test_Reordering(t *testing.T) {
+	assert := require.New(t)
+	mux := edge.NewMsgMux()
+	defer mux.Close()
+
+	conn := newEdgeConn(nil, &stalledChannel{}, mux, 1, "test-service")
+	for _, seq := range []uint32{1, 3, 2, 2} {
+		conn.Accept(&edge.MsgEvent{ConnId: 1, Seq: seq, Msg: edge.NewDataMsg(1, seq, []byte{byte(seq)})})
+	}
+
+	// late messages are put back in order, and the duplicate isn't delivered
+	for i := 1; i <= 3; i++ {
+		buf := make([]byte, 16)
+		assert.NoError(conn.SetReadDeadline(time.Now().Add(time.Second)))
+		n, err := conn.Read(buf)
+		assert.NoError(err)
+		assert.Equal([]byte{byte(i)}, buf[:n])
+	}
+	assert.Equal(uint64(2), conn.Stats().ReorderedMsgs)
+	assert.False(conn.closed.Get())
+}
+
+func Test_StrictOrdering(t *testing.T) {
+	for _, duplicate := range []bool{false, true} {
+		t.Run(fmt.Sprintf("duplicate=%v", duplicate), func(t *testing.T) {
+			assert := require.New(t)
+			harness := newTestHarness(t)
+			defer harness.close()
+
+			session := &edge.Session{Id: "test-session", Token: "test-token"}
+			listenOptions := edge.DefaultListenOptions()
+			listenOptions.StrictOrdering = true
+			listener := harness.listen(t, session, listenOptions)
+			defer func() { _ = listener.Close() }()
+
+			dialed := harness.dial(t, session, edge.DefaultDialOptions())
+			defer func() { _ = dialed.Close() }()
+			accepted := acceptWithTimeout(t, listener)
+			defer func() { _ = accepted.Close() }()
+
+			_, err := dialed.Write([]byte("in order"))
+			assert.NoError(err)
+			assert.NoError(accepted.SetReadDeadline(time.Now().Add(time.Second)))
+			buf := make([]byte, 16)
+			n, err := accepted.Read(buf)
+			assert.NoError(err)
+			assert.Equal("in order", string(buf[:n]))
+
+			conn := accepted.(*edgeConn)
+			seq := conn.lastSeq + 2
+			if duplicate {
+				seq = conn.lastSeq
+			}
+			conn.Accept(&edge.MsgEvent{ConnId: conn.Id(), Seq: seq, Msg: edge.NewDataMsg(conn.Id(), seq, []byte("bad"))})
+
+			_, err = accepted.Read(buf)
+			assert.True(errors.Is(err, edge.ErrOutOfOrder))
+			assert.True(conn.closed.Get())
+			if duplicate {
+				assert.Equal(uint64(1), conn.Stats().ReorderedMsgs)
+			}
+		})
+	}
+}
+
+func Test_UpdateCostAndPrecedenceContext(t *testing.T) {
+	assert := require.New(t)
+	mux := edge.NewMsgMux()
+	defer mux.Close()
+
+	multi := NewMultiListener("test-service", nil)
+	for i := 0; i < 3; i++ {
+		conn := newEdgeConn(nil, &stalledChannel{}, mux, uint32(i+1), "test-service")
+		child := &edgeListener{
+			baseListener: baseListener{
+				serviceName: "test-service",
+				acceptC:     make(chan net.Conn, 10),
+				errorC:      make(chan error, 1),
+				closeNotify: make(chan struct{}),
+			},
+			token:    fmt.Sprintf("test-token-%v", i),
+			edgeChan: conn,
+		}
+		conn.hosting.Store(child.token, child)
+		multi.AddListener(child, func() {})
+	}
+	defer func() { _ = multi.CloseNoUnbind() }()
+
+	// each child's update is stuck behind the router, but cancelling gives up on all of them straight away
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	err := multi.UpdateCostAndPrecedenceContext(ctx, 100, edge.PrecedenceFailed)
+	assert.Equal(context.Canceled, err)
+	assert.True(time.Since(start) < time.Second)
+}
+
+func Test_AcceptChannel(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	acceptC := listener.AcceptChannel()
+	assert.True(acceptC == listener.AcceptChannel())
+
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = dialed.Close() }()
+
+	select {
+	case result := <-acceptC:
+		assert.NoError(result.Err)
+		assert.NotNil(result.Conn)
+		_ = result.Conn.Close()
+	case <-time.After(time.Second):
+		assert.Fail("no conn delivered on accept channel")
+	}
+
+	assert.NoError(listener.Close())
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case result, ok := <-acceptC:
+			if !ok {
+				return
+			}
+			assert.Nil(result.Conn)
+			assert.Error(result.Err)
+		case <-timeout:
+			assert.Fail("accept channel not closed when listener closed")
+			return
+		}
+	}
+}
+
+func Test_RouterConnIdleReaping(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	pinnedCh, err := harness.router.Dial()
+	assert.NoError(err)
+	pinned := NewEdgeConnFactory(harness.router.Name(), "pinned", pinnedCh, nil)
+	defer func() { _ = pinned.Close() }()
+	pinned.SetPinned(true)
+
+	// the host carries a listening conn, the dialer's only conn has closed
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	listener := harness.listen(t, session, edge.DefaultListenOptions())
+	defer func() { _ = listener.Close() }()
+	dialed := harness.dial(t, session, edge.DefaultDialOptions())
+	assert.NoError(dialed.Close())
+
+	assert.Error(SetRouterConnIdleTimeout(-time.Second))
+	assert.NoError(SetRouterConnIdleTimeout(50 * time.Millisecond))
+	defer func() { _ = SetRouterConnIdleTimeout(0) }()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !harness.dialer.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(harness.dialer.IsClosed())
+	assert.False(harness.host.IsClosed())
+	assert.False(pinned.IsClosed())
+}
+
+func Test_MultiListenerCloseWhileForwarding(t *testing.T) {
+	assert := require.New(t)
+	assert.NoError(SetPollInterval(10 * time.Millisecond))
+	defer func() { _ = SetPollInterval(DefaultAcceptPollInterval) }()
+
+	// close while conns are still arriving, and once every child's accept queue is full
+	for _, waitForFull := range []bool{false, true} {
+		harness := newTestHarness(t)
+		multi := NewMultiListener("test-service", nil)
+
+		var sessions []*edge.Session
+		var children []*edgeListener
+		for i := 0; i < 8; i++ {
+			session := &edge.Session{Id: fmt.Sprintf("session-%v", i), Token: fmt.Sprintf("token-%v", i)}
+			sessions = append(sessions, session)
+			child := harness.listen(t, session, edge.DefaultListenOptions())
+			children = append(children, child.(*edgeListener))
+			multi.AddListener(child, func() {})
+		}
+
+		// nothing accepts from the multi-listener, so forwarders block and child accept queues fill up
+		var dialers sync.WaitGroup
+		stopC := make(chan struct{})
+		for _, session := range sessions {
+			dialers.Add(1)
+			go func(session *edge.Session) {
+				defer dialers.Done()
+				for i := 0; i < 13; i++ {
+					select {
+					case <-stopC:
+						return
+					default:
+					}
+					options := edge.DefaultDialOptions()
+					options.ConnectTimeout = 200 * time.Millisecond
+					// dialed conns are left for harness.close to clean up
+					_, _ = harness.dialer.NewConn("test-service").ConnectWithOptions(session, options)
+				}
+			}(session)
+		}
+
+		if waitForFull {
+			deadline := time.Now().Add(5 * time.Second)
+			for _, child := range children {
+				for len(child.acceptC) < cap(child.acceptC) && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+		}
+
+		closedC := make(chan error, 1)
+		go func() {
+			closedC <- multi.Close()
+		}()
+
+		select {
+		case <-closedC:
+		case <-time.After(5 * time.Second):
+			assert.FailNow("multi-listener close deadlocked")
+		}
+		assert.True(multi.IsClosed())
+
+		close(stopC)
+		dialers.Wait()
+		harness.close()
+	}
+}
+
+func Test_MultiListenerMetrics(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	multi := NewMultiListener("test-service", func() *edge.Session { return session })
+	defer func() { _ = multi.Close() }()
+
+	options := edge.DefaultListenOptions()
+	options.AcceptRateLimit = &edge.AcceptRateLimit{Rate: 1, Burst: 2, Reject: true}
+	multi.AddListener(harness.listen(t, session, options), nil)
+	assert.Equal(uint64(1), multi.Metrics().Children)
+
+	// the burst is accepted and the rest are rejected
+	for i := 0; i < 5; i++ {
+		conn, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, edge.DefaultDialOptions())
+		if err == nil {
+			defer func() { _ = conn.Close() }()
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for multi.Metrics().QueuedAccepts < 1 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	metrics := multi.Metrics()
+	assert.Equal(uint64(0), metrics.Accepts)
+	assert.Equal(uint64(3), metrics.Rejects)
+	assert.True(metrics.QueuedAccepts >= 1)
+
+	for i := 0; i < 2; i++ {
+		accepted := acceptWithTimeout(t, multi)
+		defer func() { _ = accepted.Close() }()
+	}
+	metrics = multi.Metrics()
+	assert.Equal(uint64(2), metrics.Accepts)
+	assert.Equal(uint64(3), metrics.Rejects)
+	assert.Equal(uint64(0), metrics.QueuedAccepts)
+	assert.Equal(map[string]uint64{"test-router": 2}, metrics.RouterAccepts)
+
+	// counts from removed children are kept
+	assert.NoError(multi.Close())
+	deadline = time.Now().Add(time.Second)
+	for multi.Metrics().Children > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	metrics = multi.Metrics()
+	assert.Equal(uint64(0), metrics.Children)
+	assert.Equal(uint64(2), metrics.Accepts)
+	assert.Equal(uint64(3), metrics.Rejects)
+}
+
+func Test_MultiListenerCloseConnsWhere(t *testing.T) {
+	assert := require.New(t)
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+	multi := NewMultiListener("test-service", func() *edge.Session { return session })
+	defer func() { _ = multi.Close() }()
+	multi.AddListener(harness.listen(t, session, edge.DefaultListenOptions()), nil)
+
+	var accepted []*edgeConn
+	for _, appData := range []string{"bad", "good", "bad"} {
+		options := edge.DefaultDialOptions()
+		options.AppData = []byte(appData)
+		conn, err := harness.dialer.NewConn("test-service").ConnectWithOptions(session, options)
+		assert.NoError(err)
+		defer func() { _ = conn.Close() }()
+
+		hosted := acceptWithTimeout(t, multi)
+		defer func() { _ = hosted.Close() }()
+		accepted = append(accepted, hosted.(*edgeConn))
+	}
+
+	var services []string
+	closed, err := multi.CloseConnsWhere(func(info edge.ConnInfo) bool {
+		services = append(services, info.ServiceName)
+		return string(info.AppData) == "bad"
+	})
+	assert.NoError(err)
+	assert.Equal(2, closed)
+	assert.Equal([]string{"test-service", "test-service", "test-service"}, services)
+
+	assert.True(accepted[0].closed.Get())
+	assert.False(accepted[1].closed.Get())
+	assert.True(accepted[2].closed.Get())
+
+	// closed conns are no longer tracked
+	count := 0
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		count = 0
+		closed, err = multi.CloseConnsWhere(func(edge.ConnInfo) bool {
+			count++
+			return false
+		})
+		assert.NoError(err)
+		assert.Equal(0, closed)
+		if count == 1 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(1, count)
+	assert.False(accepted[1].closed.Get())
+}
+
+func Test_DumpState(t *testing.T) {
+	assert := require.New(t)
+
+	_, err := DumpState()
+	assert.Error(err)
+
+	StateDumpEnabled.Set(true)
+	defer StateDumpEnabled.Set(false)
+
+	harness := newTestHarness(t)
+	defer harness.close()
+
+	session := &edge.Session{Id: "test-session", Token: "test-session-token"}
+	multi := NewMultiListener("test-service", func() *edge.Session { return session })
+	defer func() { _ = multi.Close() }()
+	multi.AddListener(harness.listen(t, session, edge.DefaultListenOptions()), nil)
+
+	conn := harness.dial(t, session, edge.DefaultDialOptions())
+	defer func() { _ = conn.Close() }()
+	hosted := acceptWithTimeout(t, multi)
+	defer func() { _ = hosted.Close() }()
+
+	dumpState := func() (string, *StateDump) {
+		raw, err := DumpState()
+		assert.NoError(err)
+		dump := &StateDump{}
+		assert.NoError(json.Unmarshal(raw, dump))
+		return string(raw), dump
+	}
+
+	raw, dump := dumpState()
+	for _, field := range []string{"routers", "listeners", "name", "key", "closed", "stats", "sinkCount", "sinks", "connId", "service", "children", "router", "token"} {
+		assert.Contains(raw, `"`+field+`"`)
+	}
+	assert.NotContains(raw, "test-session-token")
+
+	routers := map[string]RouterConnState{}
+	for _, router := range dump.Routers {
+		routers[router.Key] = router
+	}
+	assert.Len(routers, 2)
+
+	dialer := routers["dialer"]
+	assert.Equal("test-router", dialer.Name)
+	assert.False(dialer.Closed)
+	assert.Equal(1, dialer.SinkCount)
+	assert.Len(dialer.Sinks, 1)
+	assert.Equal(conn.(*edgeConn).Id(), dialer.Sinks[0].ConnId)
+	assert.Equal("test-service", dialer.Sinks[0].Service)
+	assert.False(dialer.Sinks[0].Closed)
+	assert.NotNil(dialer.Sinks[0].Stats)
+
+	// the host has the bound listener and the accepted conn
+	host := routers["host"]
+	assert.Equal(2, host.SinkCount)
+	assert.Len(host.Sinks, 2)
+
+	assert.Len(dump.Listeners, 1)
+	listener := dump.Listeners[0]
+	assert.Equal("test-service", listener.Service)
+	assert.False(listener.Closed)
+	assert.Len(listener.Children, 1)
+	assert.Equal("test-router", listener.Children[0].Router)
+	assert.Equal("test-ses...", listener.Children[0].Token)
+	assert.False(listener.Children[0].Closed)
+
+	edge.ShowFullTokens.Set(true)
+	defer edge.ShowFullTokens.Set(false)
+	_, dump = dumpState()
+	assert.Equal("test-session-token", dump.Listeners[0].Children[0].Token)
+
+	// closed objects are no longer tracked
+	assert.NoError(multi.Close())
+	assert.NoError(harness.dialer.Close())
+	_, dump = dumpState()
+	assert.Len(dump.Listeners, 0)
+	assert.Len(dump.Routers, 1)
+	assert.Equal("host", dump.Routers[0].Key)
+}
+
+func Test_MultipleErrors(t *testing.T) {
+	assert := require.New(t)
+
+	tests := []struct {
+		name     string
+		errs     MultipleErrors
+		error    string
+		detailed string
+	}{
+		{
+			name:     "none",
+			error:    "no errors occurred",
+			detailed: "no errors occurred",
+		},
+		{
+			name:     "one",
+			errs:     MultipleErrors{errors.New("router a unreachable")},
+			error:    "router a unreachable",
+			detailed: "router a unreachable",
+		},
+		{
+			name:     "several",
+			errs:     MultipleErrors{errors.New("router a unreachable"), errors.New("router b unreachable"), errors.New("router c unreachable")},
+			error:    "3 errors occurred 0: router a unreachable 1: router b unreachable 2: router c unreachable",
+			detailed: "3 errors occurred:\n  [0] router a unreachable\n  [1] router b unreachable\n  [2] router c unreachable",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(test.error, test.errs.Error(), test.name)
+		assert.Equal(test.detailed, test.errs.DetailedError(), test.name)
+	}
+}
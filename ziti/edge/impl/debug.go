@@ -0,0 +1,157 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package impl
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/openziti/foundation/util/concurrenz"
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+// StateDumpEnabled controls whether router connections and listeners are tracked for DumpState. Only objects
+// created while it is enabled are tracked, so it should be set before the context is used
+var StateDumpEnabled concurrenz.AtomicBoolean
+
+var trackedRouterConns sync.Map
+var trackedListeners sync.Map
+
+type StateDump struct {
+	Routers   []RouterConnState    `json:"routers"`
+	Listeners []MultiListenerState `json:"listeners"`
+}
+
+type RouterConnState struct {
+	Name             string           `json:"name"`
+	Key              string           `json:"key"`
+	TransportAddress string           `json:"transportAddress,omitempty"`
+	Closed           bool             `json:"closed"`
+	Stats            edge.RouterStats `json:"stats"`
+	SinkCount        int              `json:"sinkCount"`
+	Sinks            []SinkState      `json:"sinks"`
+}
+
+type SinkState struct {
+	ConnId  uint32          `json:"connId"`
+	Service string          `json:"service,omitempty"`
+	Closed  bool            `json:"closed"`
+	Stats   *edge.ConnStats `json:"stats,omitempty"`
+}
+
+type MultiListenerState struct {
+	Service  string          `json:"service"`
+	Closed   bool            `json:"closed"`
+	Children []ListenerState `json:"children"`
+}
+
+type ListenerState struct {
+	ConnId uint32 `json:"connId"`
+	Router string `json:"router"`
+	Token  string `json:"token"`
+	Closed bool   `json:"closed"`
+}
+
+// DumpState returns a JSON snapshot of the tracked router connections, their mux sinks and the multi-listeners.
+// It is safe to call concurrently with normal operation
+func DumpState() ([]byte, error) {
+	if !StateDumpEnabled.Get() {
+		return nil, errors.New("state dump is not enabled")
+	}
+
+	dump := &StateDump{}
+
+	trackedRouterConns.Range(func(key, value interface{}) bool {
+		dump.Routers = append(dump.Routers, key.(*routerConn).getState())
+		return true
+	})
+
+	trackedListeners.Range(func(key, value interface{}) bool {
+		dump.Listeners = append(dump.Listeners, key.(*multiListener).getState())
+		return true
+	})
+
+	return json.MarshalIndent(dump, "", "  ")
+}
+
+func trackRouterConn(conn *routerConn) {
+	if StateDumpEnabled.Get() {
+		trackedRouterConns.Store(conn, struct{}{})
+	}
+}
+
+func untrackRouterConn(conn *routerConn) {
+	trackedRouterConns.Delete(conn)
+}
+
+func trackListener(listener *multiListener) {
+	if StateDumpEnabled.Get() {
+		trackedListeners.Store(listener, struct{}{})
+	}
+}
+
+func untrackListener(listener *multiListener) {
+	trackedListeners.Delete(listener)
+}
+
+func (conn *routerConn) getState() RouterConnState {
+	state := RouterConnState{
+		Name:             conn.routerName,
+		Key:              conn.key,
+		TransportAddress: conn.transportAddr,
+		Closed:           conn.IsClosed(),
+		Stats:            conn.Stats(),
+	}
+
+	for _, sink := range conn.msgMux.GetSinks() {
+		sinkState := SinkState{ConnId: sink.Id()}
+		if edgeConn, ok := sink.(*edgeConn); ok {
+			stats := edgeConn.Stats()
+			sinkState.Service = edgeConn.serviceName
+			sinkState.Closed = edgeConn.closed.Get()
+			sinkState.Stats = &stats
+		}
+		state.Sinks = append(state.Sinks, sinkState)
+	}
+	state.SinkCount = len(state.Sinks)
+
+	return state
+}
+
+func (listener *multiListener) getState() MultiListenerState {
+	state := MultiListenerState{
+		Service: listener.serviceName,
+		Closed:  listener.closed.Get(),
+	}
+
+	listener.listenerLock.Lock()
+	defer listener.listenerLock.Unlock()
+
+	for child := range listener.listeners {
+		if childListener, ok := child.(*edgeListener); ok {
+			state.Children = append(state.Children, ListenerState{
+				ConnId: childListener.edgeChan.Id(),
+				Router: childListener.edgeChan.getRouterName(),
+				Token:  childListener.BindToken(),
+				Closed: childListener.closed.Get(),
+			})
+		}
+	}
+
+	return state
+}
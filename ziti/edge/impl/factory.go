@@ -17,10 +17,13 @@
 package impl
 
 import (
-	"github.com/michaelquigley/pfxlog"
+	"context"
+	"sync/atomic"
+	"time"
+
 	"github.com/netfoundry/secretstream/kx"
 	"github.com/openziti/foundation/channel2"
-	"github.com/openziti/foundation/util/sequencer"
+	"github.com/openziti/foundation/util/concurrenz"
 	"github.com/openziti/sdk-golang/ziti/edge"
 )
 
@@ -34,11 +37,18 @@ type RouterConnOwner interface {
 }
 
 type routerConn struct {
-	routerName string
-	key        string
-	ch         channel2.Channel
-	msgMux     *edge.MsgMux
-	owner      RouterConnOwner
+	routerName    string
+	key           string
+	transportAddr string
+	ch            channel2.Channel
+	msgMux        *edge.MsgMux
+	owner         RouterConnOwner
+	stats         *edge.RouterStats
+	draining      concurrenz.AtomicBoolean
+	pinned        concurrenz.AtomicBoolean
+
+	idleSince         time.Time
+	sinksAddedAtCheck uint64
 }
 
 func (conn *routerConn) Key() string {
@@ -49,19 +59,51 @@ func (conn *routerConn) GetRouterName() string {
 	return conn.routerName
 }
 
+func (conn *routerConn) TransportAddress() string {
+	return conn.transportAddr
+}
+
+func (conn *routerConn) SetPinned(pinned bool) {
+	conn.pinned.Set(pinned)
+}
+
+func (conn *routerConn) SetMemoryBudget(bytes int) {
+	conn.msgMux.SetMemoryBudget(bytes)
+}
+
 func (conn *routerConn) HandleClose(ch channel2.Channel) {
+	untrackRouterConn(conn)
+	reaper.conns.Delete(conn)
 	if conn.owner != nil {
 		conn.owner.OnClose(conn)
 	}
 }
 
 func NewEdgeConnFactory(routerName, key string, ch channel2.Channel, owner RouterConnOwner) edge.RouterConn {
+	return NewEdgeConnFactoryWithTransportAddress(routerName, key, "", ch, owner)
+}
+
+// NewEdgeConnFactoryWithTransportAddress is NewEdgeConnFactory for callers which know the remote address the
+// channel is connected to, which is then reported by TransportAddress
+func NewEdgeConnFactoryWithTransportAddress(routerName, key, transportAddr string, ch channel2.Channel, owner RouterConnOwner) edge.RouterConn {
+	return NewEdgeConnFactoryWithMuxOptions(routerName, key, transportAddr, ch, owner, nil)
+}
+
+// NewEdgeConnFactoryWithMuxOptions is NewEdgeConnFactoryWithTransportAddress with options for the router conn's
+// message mux. Nil options uses edge.DefaultMsgMuxOptions
+func NewEdgeConnFactoryWithMuxOptions(routerName, key, transportAddr string, ch channel2.Channel, owner RouterConnOwner,
+	muxOptions *edge.MsgMuxOptions) edge.RouterConn {
+	if muxOptions == nil {
+		muxOptions = edge.DefaultMsgMuxOptions()
+	}
 	connFactory := &routerConn{
-		key:        key,
-		routerName: routerName,
-		ch:         ch,
-		msgMux:     edge.NewMsgMux(),
-		owner:      owner,
+		key:           key,
+		routerName:    routerName,
+		transportAddr: transportAddr,
+		ch:            ch,
+		msgMux:        edge.NewMsgMuxWithOptions(muxOptions),
+		owner:         owner,
+		stats:         &edge.RouterStats{},
 	}
 
 	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{
@@ -74,40 +116,163 @@ func NewEdgeConnFactory(routerName, key string, ch channel2.Channel, owner Route
 		Handler: connFactory.msgMux.HandleReceive,
 	})
 
+	ch.AddReceiveHandler(&edge.FunctionReceiveAdapter{
+		Type:    edge.ContentTypeStateAck,
+		Handler: connFactory.msgMux.HandleReceive,
+	})
+
 	// Since data is the common message type, it gets to be dispatched directly
 	ch.AddReceiveHandler(connFactory.msgMux)
 	ch.AddCloseHandler(connFactory.msgMux)
 	ch.AddCloseHandler(connFactory)
 
+	trackRouterConn(connFactory)
+	reaper.conns.Store(connFactory, struct{}{})
+
 	return connFactory
 }
 
 func (conn *routerConn) NewConn(service string) edge.Conn {
-	id := connSeq.Next()
+	edgeCh, err := registerNewConn(conn, conn.msgMux, func(id uint32) *edgeConn {
+		edgeCh := newEdgeConn(conn, conn.ch, conn.msgMux, id, service)
+		var err error
+		if edgeCh.keyPair, err = kx.NewKeyPair(); err != nil {
+			edge.Log().Errorf("unable to setup encryption for edgeConn[%s] %v", service, err)
+		}
+		return edgeCh
+	})
+	if err != nil {
+		edge.Log().Warnf("error adding message sink %s[%d]: %v", service, edgeCh.Id(), err)
+	}
+	return edgeCh
+}
 
-	edgeCh := &edgeConn{
-		MsgChannel: *edge.NewEdgeMsgChannel(conn.ch, id),
-		readQ:      sequencer.NewSingleWriterSeq(DefaultMaxOutOfOrderMsgs),
-		msgMux:     conn.msgMux,
-		serviceId:  service,
+func (conn *routerConn) ConnectBatch(ctx context.Context, session *edge.Session, serviceName string, count int, options *edge.DialOptions) ([]edge.ServiceConn, []error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	if options == nil {
+		options = edge.DialOptionsFor(serviceName)
+	}
+	concurrency := edge.DefaultMaxConcurrentDials
+	if options.MaxConcurrentDials > 0 {
+		concurrency = options.MaxConcurrentDials
 	}
 
-	var err error
-	if edgeCh.keyPair, err = kx.NewKeyPair(); err != nil {
-		pfxlog.Logger().Errorf("unable to setup encryption for edgeConn[%s] %v", service, err)
+	type dialResult struct {
+		conn edge.ServiceConn
+		err  error
 	}
 
-	err = conn.msgMux.AddMsgSink(edgeCh) // duplicate errors only happen on the server side, since client controls ids
-	if err != nil {
-		pfxlog.Logger().Warnf("error adding message sink %s[%d]: %v", service, id, err)
+	// buffered so that dials never block on reporting, even once we've stopped collecting
+	resultC := make(chan dialResult, count)
+	slots := make(chan struct{}, concurrency)
+
+	var conns []edge.ServiceConn
+	var errs []error
+	collect := func(result dialResult) {
+		if result.err != nil {
+			errs = append(errs, result.err)
+		} else {
+			conns = append(conns, result.conn)
+		}
+	}
+
+	started, done := 0, 0
+	for done < count && ctx.Err() == nil {
+		startC := slots
+		if started == count {
+			startC = nil
+		}
+
+		select {
+		case startC <- struct{}{}:
+			started++
+			go func() {
+				serviceConn, err := conn.NewConn(serviceName).ConnectWithOptions(session, options)
+				<-slots
+				resultC <- dialResult{conn: serviceConn, err: err}
+			}()
+		case result := <-resultC:
+			done++
+			collect(result)
+		case <-ctx.Done():
+		}
+	}
+
+	// pick up dials which completed as ctx was done
+	for drained := false; done < started && !drained; {
+		select {
+		case result := <-resultC:
+			done++
+			collect(result)
+		default:
+			drained = true
+		}
+	}
+
+	if done < count {
+		for i := done; i < count; i++ {
+			errs = append(errs, ctx.Err())
+		}
+		go func(pending int) {
+			for i := 0; i < pending; i++ {
+				if result := <-resultC; result.err == nil {
+					_ = result.conn.Close()
+				}
+			}
+		}(started - done)
+	}
+
+	return conns, errs
+}
+
+func (conn *routerConn) Stats() edge.RouterStats {
+	return edge.RouterStats{
+		ActiveConns:      uint64(conn.msgMux.GetSinkCount()),
+		TotalConns:       conn.msgMux.GetSinksAdded(),
+		BytesRead:        atomic.LoadUint64(&conn.stats.BytesRead),
+		BytesWritten:     atomic.LoadUint64(&conn.stats.BytesWritten),
+		MsgsRead:         atomic.LoadUint64(&conn.stats.MsgsRead),
+		MsgsWritten:      atomic.LoadUint64(&conn.stats.MsgsWritten),
+		DispatchErrors:   conn.msgMux.GetDispatchErrors(),
+		ConnIdCollisions: atomic.LoadUint64(&conn.stats.ConnIdCollisions),
+		BufferedBytes:    uint64(conn.msgMux.GetBufferedBytes()),
+		ReadPauses:       conn.msgMux.GetReadPauses(),
 	}
-	return edgeCh
 }
 
 func (conn *routerConn) Close() error {
+	// closing the mux first lets conns tell a local shutdown apart from the router going away
+	conn.msgMux.CloseWithCause(edge.ErrRouterConnShutdown)
 	return conn.ch.Close()
 }
 
+func (conn *routerConn) CloseGracefully(ctx context.Context) error {
+	if conn.draining.CompareAndSwap(false, true) {
+		for _, sink := range conn.msgMux.GetSinks() {
+			if edgeCh, ok := sink.(*edgeConn); ok {
+				edgeCh.drain()
+			}
+		}
+	}
+
+	ticker := time.NewTicker(getForwardPollInterval())
+	defer ticker.Stop()
+
+	for conn.msgMux.GetSinkCount() > 0 && !conn.IsClosed() {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			edge.Log().WithField("router", conn.routerName).
+				Infof("closing router connection with %v conns still open", conn.msgMux.GetSinkCount())
+			_ = conn.Close()
+			return ctx.Err()
+		}
+	}
+	return conn.Close()
+}
+
 func (conn *routerConn) IsClosed() bool {
 	return conn.ch.IsClosed()
 }
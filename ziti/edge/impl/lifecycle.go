@@ -0,0 +1,87 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package impl
+
+import (
+	"sync"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+)
+
+// lifecycleDispatcher passes lifecycle events to the handler in the order they happened, from a goroutine of its
+// own so that the listener never waits on the handler
+type lifecycleDispatcher struct {
+	lock    sync.Mutex
+	handler func(edge.LifecycleEvent)
+	pending []edge.LifecycleEvent
+	running bool
+}
+
+func (dispatcher *lifecycleDispatcher) setHandler(handler func(edge.LifecycleEvent)) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+	dispatcher.handler = handler
+}
+
+func (dispatcher *lifecycleDispatcher) emit(event edge.LifecycleEvent) {
+	dispatcher.lock.Lock()
+	defer dispatcher.lock.Unlock()
+
+	if dispatcher.handler == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	dispatcher.pending = append(dispatcher.pending, event)
+	if !dispatcher.running {
+		dispatcher.running = true
+		go dispatcher.run()
+	}
+}
+
+func (dispatcher *lifecycleDispatcher) run() {
+	for {
+		dispatcher.lock.Lock()
+		if len(dispatcher.pending) == 0 || dispatcher.handler == nil {
+			dispatcher.pending = nil
+			dispatcher.running = false
+			dispatcher.lock.Unlock()
+			return
+		}
+		event := dispatcher.pending[0]
+		dispatcher.pending = dispatcher.pending[1:]
+		handler := dispatcher.handler
+		dispatcher.lock.Unlock()
+
+		handler(event)
+	}
+}
+
+// routerNameOf returns the name of the router a child listener or conn is on
+func routerNameOf(value interface{}) string {
+	switch v := value.(type) {
+	case *edgeListener:
+		if v.edgeChan != nil {
+			return v.edgeChan.getRouterName()
+		}
+	case *edgeConn:
+		return v.getRouterName()
+	}
+	return ""
+}
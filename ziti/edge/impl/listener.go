@@ -17,11 +17,14 @@
 package impl
 
 import (
+	"container/heap"
+	"context"
 	"fmt"
-	"github.com/michaelquigley/pfxlog"
+	"github.com/openziti/foundation/channel2"
 	"github.com/openziti/foundation/util/concurrenz"
 	"github.com/openziti/sdk-golang/ziti/edge"
 	"github.com/pkg/errors"
+	"math"
 	"net"
 	"reflect"
 	"strings"
@@ -30,11 +33,96 @@ import (
 	"time"
 )
 
+const (
+	DefaultAcceptPollInterval  = time.Second
+	DefaultForwardPollInterval = 250 * time.Millisecond
+)
+
+var acceptPollInterval = int64(DefaultAcceptPollInterval)
+var forwardPollInterval = int64(DefaultForwardPollInterval)
+
+// SetPollInterval sets how often blocked accept and forwarding loops wake up to check if their listener has closed,
+// which bounds how long they take to notice. It applies to loops started after the call
+func SetPollInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.Errorf("poll interval must be positive, got %v", interval)
+	}
+	atomic.StoreInt64(&acceptPollInterval, int64(interval))
+	atomic.StoreInt64(&forwardPollInterval, int64(interval))
+	return nil
+}
+
+func getAcceptPollInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&acceptPollInterval))
+}
+
+func getForwardPollInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&forwardPollInterval))
+}
+
 type baseListener struct {
 	serviceName string
 	acceptC     chan net.Conn
 	errorC      chan error
 	closed      concurrenz.AtomicBoolean
+	closeNotify chan struct{}
+	priority    func(info edge.ConnInfo) int
+	secret      atomic.Value
+	queueLock   sync.Mutex
+	queue       acceptQueue
+	queueSeq    uint64
+	resultOnce  sync.Once
+	resultC     chan edge.AcceptResult
+	// backpressure is told how many conns are waiting to be accepted, if it's set
+	backpressure     *edge.AcceptBackpressure
+	backpressureLock sync.Mutex
+	// onTaken and onAccept, if set, are called with each conn as it's taken off acceptC and as it's returned by
+	// Accept or TryAccept
+	onTaken  func(conn net.Conn)
+	onAccept func(conn net.Conn)
+}
+
+// BindOptions returns a copy of options updated with changes made while listening, such as a new identity secret,
+// for binding further listeners
+func (listener *baseListener) BindOptions(options *edge.ListenOptions) *edge.ListenOptions {
+	secret, ok := listener.secret.Load().(string)
+	if !ok || options == nil {
+		return options
+	}
+	updated := *options
+	updated.IdentitySecret = secret
+	return &updated
+}
+
+// setClosed marks the listener closed and wakes up callers blocked in Accept. It returns false if the listener
+// was already closed
+func (listener *baseListener) setClosed() bool {
+	if !listener.closed.CompareAndSwap(false, true) {
+		return false
+	}
+	close(listener.closeNotify)
+	listener.queueChanged()
+	return true
+}
+
+// queueChanged passes the number of conns waiting to be accepted on to the AcceptBackpressure, if there is one. A
+// closed listener no longer counts towards it
+func (listener *baseListener) queueChanged() {
+	if listener.backpressure == nil {
+		return
+	}
+
+	listener.backpressureLock.Lock()
+	defer listener.backpressureLock.Unlock()
+
+	capacity := 0
+	if !listener.closed.Get() {
+		capacity = cap(listener.acceptC)
+		if listener.priority != nil {
+			capacity += maxPriorityQueue
+		}
+	}
+	listener.backpressure.Update(listener, len(listener.acceptC)+listener.queueLen(), capacity)
 }
 
 func (listener *baseListener) Network() string {
@@ -54,40 +142,454 @@ func (listener *baseListener) IsClosed() bool {
 }
 
 func (listener *baseListener) Accept() (net.Conn, error) {
-	ticker := time.NewTicker(time.Second)
+	return listener.acceptUntil(nil)
+}
+
+func (listener *baseListener) AcceptWithTimeout(timeout time.Duration) (net.Conn, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return listener.acceptUntil(timer.C)
+}
+
+// acceptUntil waits for a connection until the listener closes or deadlineC fires. A nil deadlineC waits forever.
+// Conns which arrived before the listener closed are still returned, and the closed error only once they're gone
+func (listener *baseListener) acceptUntil(deadlineC <-chan time.Time) (net.Conn, error) {
+	conn, err := listener.waitForConn(deadlineC)
+	if conn != nil && listener.onAccept != nil {
+		listener.onAccept(conn)
+	}
+	return conn, err
+}
+
+func (listener *baseListener) waitForConn(deadlineC <-chan time.Time) (net.Conn, error) {
+	ticker := time.NewTicker(getAcceptPollInterval())
 	defer ticker.Stop()
 
 	for !listener.closed.Get() {
+		if conn := listener.nextQueued(); conn != nil {
+			listener.queueChanged()
+			return conn, nil
+		}
+
 		select {
 		case conn, ok := <-listener.acceptC:
 			if ok && conn != nil {
-				return conn, nil
+				listener.taken(conn)
+				if conn = listener.received(conn); conn != nil {
+					listener.queueChanged()
+					return conn, nil
+				}
 			} else {
-				listener.closed.Set(true)
+				listener.setClosed()
 			}
+		case <-listener.closeNotify:
+		case <-deadlineC:
+			return nil, edge.ErrAcceptTimeout
 		case <-ticker.C:
 		}
 	}
 
+	return listener.acceptClosed()
+}
+
+func (listener *baseListener) taken(conn net.Conn) {
+	if listener.onTaken != nil {
+		listener.onTaken(conn)
+	}
+}
+
+// acceptClosed returns the next conn left over from before the listener closed, or the closed error if there are
+// none left
+func (listener *baseListener) acceptClosed() (net.Conn, error) {
+	if conn := listener.takeLeftover(); conn != nil {
+		return conn, nil
+	}
+	return nil, listener.closedError()
+}
+
+// takeLeftover returns a conn which arrived but hasn't been accepted, without waiting, or nil if there isn't one
+func (listener *baseListener) takeLeftover() net.Conn {
+	if conn := listener.nextQueued(); conn != nil {
+		return conn
+	}
+	for {
+		select {
+		case conn, ok := <-listener.acceptC:
+			if !ok {
+				return nil
+			}
+			// skip the nil Close pushes to wake up Accept, in case a conn was queued behind it
+			if conn != nil {
+				listener.taken(conn)
+				return conn
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// AcceptChannel starts delivering accepted conns on the returned channel. Once the listener closes the closing
+// error is delivered, if there's room for it in the channel's buffer, and the channel is closed
+func (listener *baseListener) AcceptChannel() <-chan edge.AcceptResult {
+	listener.resultOnce.Do(func() {
+		listener.resultC = make(chan edge.AcceptResult, 1)
+		go listener.deliverAccepted()
+	})
+	return listener.resultC
+}
+
+func (listener *baseListener) deliverAccepted() {
+	defer close(listener.resultC)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case listener.resultC <- edge.AcceptResult{Err: err}:
+			default:
+			}
+			return
+		}
+
+		// conns left over after close are delivered if there's room for them
+		select {
+		case listener.resultC <- edge.AcceptResult{Conn: conn}:
+			continue
+		default:
+		}
+
+		select {
+		case listener.resultC <- edge.AcceptResult{Conn: conn}:
+		case <-listener.closeNotify:
+			// nobody took the conn before the listener closed, so nobody will close it
+			_ = conn.Close()
+		}
+	}
+}
+
+// TryAccept returns a connection if one is ready, without blocking. If no connection is queued it returns false.
+// As with Accept, conns which arrived before the listener closed are returned before the closed error
+func (listener *baseListener) TryAccept() (net.Conn, bool, error) {
+	conn, ok, err := listener.tryAccept()
+	if ok && listener.onAccept != nil {
+		listener.onAccept(conn)
+	}
+	return conn, ok, err
+}
+
+func (listener *baseListener) tryAccept() (net.Conn, bool, error) {
+	if listener.closed.Get() {
+		return listener.tryAcceptClosed()
+	}
+
+	if listener.priority != nil {
+		if conn := listener.nextQueued(); conn != nil {
+			listener.queueChanged()
+			return conn, true, nil
+		}
+		if listener.closed.Get() {
+			return listener.tryAcceptClosed()
+		}
+		return nil, false, nil
+	}
+
+	select {
+	case conn, ok := <-listener.acceptC:
+		if ok && conn != nil {
+			listener.taken(conn)
+			listener.queueChanged()
+			return conn, true, nil
+		}
+		listener.setClosed()
+		return listener.tryAcceptClosed()
+	default:
+		return nil, false, nil
+	}
+}
+
+func (listener *baseListener) tryAcceptClosed() (net.Conn, bool, error) {
+	conn, err := listener.acceptClosed()
+	return conn, conn != nil, err
+}
+
+// maxPriorityQueue bounds the conns pulled off acceptC to be ordered by priority, so that acceptC still pushes back
+// on new dials when the application falls behind
+const maxPriorityQueue = 10
+
+type queuedConn struct {
+	conn     net.Conn
+	priority int
+	seq      uint64
+}
+
+// acceptQueue is a heap of conns, highest priority first and then in arrival order
+type acceptQueue []*queuedConn
+
+func (q acceptQueue) Len() int { return len(q) }
+
+func (q acceptQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q acceptQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *acceptQueue) Push(x interface{}) { *q = append(*q, x.(*queuedConn)) }
+
+func (q *acceptQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return item
+}
+
+// received handles a conn taken off acceptC. Without a PriorityFunc it's returned as is. Otherwise it's queued
+// and the highest priority queued conn is returned instead
+func (listener *baseListener) received(conn net.Conn) net.Conn {
+	if listener.priority == nil {
+		return conn
+	}
+	listener.queueLock.Lock()
+	listener.enqueue(conn)
+	listener.queueLock.Unlock()
+	return listener.nextQueued()
+}
+
+// nextQueued moves any conns waiting on acceptC into the priority queue and returns the highest priority one. It
+// returns nil if there's no PriorityFunc or no conn is queued. Queued conns are still returned once the listener
+// has closed, so they aren't lost
+func (listener *baseListener) nextQueued() net.Conn {
+	if listener.priority == nil {
+		return nil
+	}
+
+	listener.queueLock.Lock()
+	defer listener.queueLock.Unlock()
+
+pull:
+	for len(listener.queue) < maxPriorityQueue {
+		select {
+		case conn, ok := <-listener.acceptC:
+			if !ok || conn == nil {
+				listener.setClosed()
+				break pull
+			}
+			listener.taken(conn)
+			listener.enqueue(conn)
+		default:
+			break pull
+		}
+	}
+
+	if len(listener.queue) == 0 {
+		return nil
+	}
+	return heap.Pop(&listener.queue).(*queuedConn).conn
+}
+
+// queueLen returns the number of conns in the priority queue
+func (listener *baseListener) queueLen() int {
+	listener.queueLock.Lock()
+	defer listener.queueLock.Unlock()
+	return len(listener.queue)
+}
+
+// enqueue adds a conn to the priority queue. Must be called with the queue lock held
+func (listener *baseListener) enqueue(conn net.Conn) {
+	listener.queueSeq++
+	heap.Push(&listener.queue, &queuedConn{
+		conn:     conn,
+		priority: listener.priority(newConnInfo(conn)),
+		seq:      listener.queueSeq,
+	})
+}
+
+func newConnInfo(conn net.Conn) edge.ConnInfo {
+	info := edge.ConnInfo{Arrived: time.Now()}
+	if edgeCh, ok := conn.(*edgeConn); ok {
+		info.SourceIdentity = string(edgeCh.connHeaders[edge.CallerIdHeader])
+		info.AppData = edgeCh.connHeaders[edge.AppDataHeader]
+		info.Label = edgeCh.GetCorrelationId()
+		info.ServiceName = edgeCh.serviceName
+		info.Stats = edgeCh.Stats()
+		if !edgeCh.arrived.IsZero() {
+			info.Arrived = edgeCh.arrived
+		}
+	}
+	return info
+}
+
+func (listener *baseListener) closedError() error {
 	select {
 	case err := <-listener.errorC:
-		return nil, fmt.Errorf("listener is closed (%w)", err)
+		return fmt.Errorf("listener is closed (%w)", err)
 	default:
 	}
 
-	return nil, errors.New("listener is closed")
+	return errors.New("listener is closed")
 }
 
+// drainQuietPeriod is how long GracefulClose waits without a dial arriving before it considers a listener drained
+var drainQuietPeriod = time.Second
+
 type edgeListener struct {
 	baseListener
-	token    string
-	edgeChan *edgeConn
+	token        string
+	edgeChan     *edgeConn
+	options      *edge.ListenOptions
+	bound        string
+	pendingDials int32
+	lastDial     int64
+	rejects      uint64
+}
+
+func (listener *edgeListener) dialStarted() {
+	atomic.AddInt32(&listener.pendingDials, 1)
+	atomic.StoreInt64(&listener.lastDial, time.Now().UnixNano())
+}
+
+func (listener *edgeListener) dialDone() {
+	atomic.AddInt32(&listener.pendingDials, -1)
+}
+
+func (listener *edgeListener) maxHeaders() int {
+	if listener.options != nil && listener.options.MaxHeaders > 0 {
+		return listener.options.MaxHeaders
+	}
+	return edge.DefaultMaxHeaders
+}
+
+// admitByOptions passes the dial to the options' AdmitDial, if set, returning the error it rejected the dial with
+func (listener *edgeListener) admitByOptions(message *channel2.Message) error {
+	if listener.options == nil || listener.options.AdmitDial == nil {
+		return nil
+	}
+	return listener.options.AdmitDial(edge.ConnInfo{
+		SourceIdentity: string(message.Headers[edge.CallerIdHeader]),
+		AppData:        message.Headers[edge.AppDataHeader],
+		Arrived:        time.Now(),
+		ServiceName:    listener.serviceName,
+	})
+}
+
+// decideConnect asks the ConnectHandler, if there is one, what to do with the dial
+func (listener *edgeListener) decideConnect(message *channel2.Message) edge.ConnectDecision {
+	if listener.options == nil || listener.options.ConnectHandler == nil {
+		return edge.ConnectDecision{}
+	}
+	return listener.options.ConnectHandler(edge.ConnectRequest{
+		ServiceName:    listener.serviceName,
+		SourceIdentity: string(message.Headers[edge.CallerIdHeader]),
+		AppData:        message.Headers[edge.AppDataHeader],
+		Protocols:      edge.GetProtocolsHeader(message),
+		ClientHint:     string(message.Headers[edge.ClientHintHeader]),
+	})
+}
+
+// admitDial applies the accept rate limit, if there is one, waiting for the rate to allow the dial unless excess
+// dials are rejected. It returns false if the dial should be failed
+func (listener *edgeListener) admitDial() bool {
+	if listener.options == nil || listener.options.AcceptRateLimit == nil {
+		return true
+	}
+	limit := listener.options.AcceptRateLimit
+
+	timeout := listener.options.ConnectTimeout
+	if timeout <= 0 {
+		timeout = edge.DialConnOptions{}.GetConnectTimeout()
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		ok, wait := limit.TryAcquire()
+		if ok {
+			return true
+		}
+		if limit.Reject || listener.closed.Get() || time.Now().Add(wait).After(deadline) {
+			atomic.AddUint64(&listener.rejects, 1)
+			return false
+		}
+		time.Sleep(wait)
+	}
+}
+
+func (listener *edgeListener) GracefulClose(ctx context.Context) error {
+	if listener.closed.Get() {
+		return nil
+	}
+
+	logger := edge.Log().WithField("connId", listener.edgeChan.GlobalId()).WithField("service", listener.edgeChan.serviceName)
+	if err := listener.UpdateCost(math.MaxUint16); err != nil {
+		logger.WithError(err).Warn("unable to raise cost before close, closing without draining")
+	} else {
+		logger.Debug("cost raised to max, draining listener")
+		if err := listener.drain(ctx); err != nil {
+			_ = listener.Close()
+			return err
+		}
+	}
+	return listener.Close()
+}
+
+// drain waits until no dials are in progress and none have arrived for drainQuietPeriod, or the grace period passes
+func (listener *edgeListener) drain(ctx context.Context) error {
+	gracePeriod := edge.DefaultDrainGracePeriod
+	if listener.options != nil && listener.options.DrainGracePeriod > 0 {
+		gracePeriod = listener.options.DrainGracePeriod
+	}
+
+	start := time.Now()
+	deadline := time.NewTimer(gracePeriod)
+	defer deadline.Stop()
+	ticker := time.NewTicker(drainQuietPeriod / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return nil
+		case <-ticker.C:
+			lastDial := time.Unix(0, atomic.LoadInt64(&listener.lastDial))
+			if atomic.LoadInt32(&listener.pendingDials) == 0 &&
+				time.Since(start) >= drainQuietPeriod && time.Since(lastDial) >= drainQuietPeriod {
+				return nil
+			}
+		}
+	}
+}
+
+func (listener *edgeListener) BindToken() string {
+	return edge.RedactToken(listener.token)
+}
+
+func (listener *edgeListener) BoundIdentity() string {
+	return listener.bound
+}
+
+func (listener *edgeListener) TerminatorInstanceId() string {
+	if listener.options == nil {
+		return ""
+	}
+	return listener.options.TerminatorInstanceId
 }
 
 func (listener *edgeListener) UpdateCost(cost uint16) error {
 	return listener.updateCostAndPrecedence(&cost, nil)
 }
 
+func (listener *edgeListener) UpdateCostPercent(pct float64) error {
+	cost, err := edge.CostFromPercent(pct)
+	if err != nil {
+		return err
+	}
+	return listener.UpdateCost(cost)
+}
+
 func (listener *edgeListener) UpdatePrecedence(precedence edge.Precedence) error {
 	return listener.updateCostAndPrecedence(nil, &precedence)
 }
@@ -96,28 +598,69 @@ func (listener *edgeListener) UpdateCostAndPrecedence(cost uint16, precedence ed
 	return listener.updateCostAndPrecedence(&cost, &precedence)
 }
 
+func (listener *edgeListener) UpdateCostAndPrecedenceContext(ctx context.Context, cost uint16, precedence edge.Precedence) error {
+	return listener.updateCostAndPrecedenceContext(ctx, &cost, &precedence)
+}
+
+func (listener *edgeListener) UpdateIdentitySecret(secret string) error {
+	logger := edge.Log().
+		WithField("connId", listener.edgeChan.GlobalId()).
+		WithField("service", listener.edgeChan.serviceName).
+		WithField("session", listener.token)
+
+	logger.Debug("sending identity secret update to edge router")
+	request := edge.NewUpdateBindMsg(listener.edgeChan.Id(), listener.token, nil, nil)
+	request.Headers[edge.TerminatorIdentitySecretHeader] = []byte(secret)
+	listener.edgeChan.TraceMsg("updateIdentitySecret", request)
+	if err := listener.edgeChan.SendWithTimeout(request, 5*time.Second); err != nil {
+		return err
+	}
+	listener.secret.Store(secret)
+	return nil
+}
+
 func (listener *edgeListener) updateCostAndPrecedence(cost *uint16, precedence *edge.Precedence) error {
-	logger := pfxlog.Logger().
-		WithField("connId", listener.edgeChan.Id()).
-		WithField("service", listener.edgeChan.serviceId).
+	return listener.updateCostAndPrecedenceContext(context.Background(), cost, precedence)
+}
+
+// updateCostAndPrecedenceContext sends an update bind request, waiting until it's on the wire, ctx is done or
+// the 5 second send timeout passes
+func (listener *edgeListener) updateCostAndPrecedenceContext(ctx context.Context, cost *uint16, precedence *edge.Precedence) error {
+	logger := edge.Log().
+		WithField("connId", listener.edgeChan.GlobalId()).
+		WithField("service", listener.edgeChan.serviceName).
 		WithField("session", listener.token)
 
 	logger.Debug("sending update bind request to edge router")
 	request := edge.NewUpdateBindMsg(listener.edgeChan.Id(), listener.token, cost, precedence)
 	listener.edgeChan.TraceMsg("updateCostAndPrecedence", request)
-	return listener.edgeChan.SendWithTimeout(request, 5*time.Second)
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	syncC, err := listener.edgeChan.SendAndSyncWithPriority(request, channel2.Standard)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-syncC:
+		return err
+	case <-ctx.Done():
+		logger.WithError(ctx.Err()).Debug("update bind request not sent")
+		return ctx.Err()
+	}
 }
 
 func (listener *edgeListener) Close() error {
-	if !listener.closed.CompareAndSwap(false, true) {
+	if !listener.setClosed() {
 		// already closed
 		return nil
 	}
 
 	edgeChan := listener.edgeChan
 
-	logger := pfxlog.Logger().
-		WithField("connId", listener.edgeChan.Id()).
+	logger := edge.Log().
+		WithField("connId", listener.edgeChan.GlobalId()).
 		WithField("sessionId", listener.token)
 
 	logger.Debug("removing listener for session")
@@ -128,7 +671,12 @@ func (listener *edgeListener) Close() error {
 			logger.WithError(err).Error("unable to close conn")
 		}
 
-		listener.acceptC <- nil // signal listeners that listener is closed
+		// signal listeners that listener is closed. Closing has already woken up Accept callers and forwarders, so
+		// don't wait if the accept queue is full
+		select {
+		case listener.acceptC <- nil:
+		default:
+		}
 	}()
 
 	unbindRequest := edge.NewUnbindMsg(edgeChan.Id(), listener.token)
@@ -141,31 +689,92 @@ func (listener *edgeListener) Close() error {
 	return nil
 }
 
+// CloseNoUnbind closes the listener and its conn without sending anything to the router, so it never blocks on
+// the network. The router drops the terminator once it notices the conn is gone or the session expires
+func (listener *edgeListener) CloseNoUnbind() error {
+	if !listener.setClosed() {
+		return nil
+	}
+
+	edge.Log().WithField("connId", listener.edgeChan.GlobalId()).WithField("sessionId", listener.token).
+		Debug("closing listener without unbinding")
+	listener.edgeChan.hosting.Delete(listener.token)
+	listener.edgeChan.closeLocal()
+
+	// closing has already woken up Accept callers, so don't wait if the accept queue is full
+	select {
+	case listener.acceptC <- nil:
+	default:
+	}
+	return nil
+}
+
 type MultiListener interface {
 	edge.Listener
 	AddListener(listener edge.Listener, closeHandler func())
+	// SetRebindHandler sets a callback for when RefreshSession replaces a child listener with one bound using
+	// the new session
+	SetRebindHandler(handler func(session *edge.Session, old, new edge.Listener))
+	// SetPriorityFunc orders conns waiting to be accepted, as for ListenOptions.PriorityFunc. It must be called
+	// before the listener is used
+	SetPriorityFunc(priority func(info edge.ConnInfo) int)
+	// BindOptions returns a copy of options with changes made while listening applied, such as
+	// UpdateIdentitySecret, for binding new child listeners
+	BindOptions(options *edge.ListenOptions) *edge.ListenOptions
+	RefreshSession(session *edge.Session) error
 	GetServiceName() string
 	CloseWithError(err error)
+	// SetLifecycleHandler sets a handler which is passed every lifecycle event of the listener, in the order they
+	// happened, from a goroutine of its own. It's the full stream which SetConnectionChangeHandler gives a part of
+	SetLifecycleHandler(handler func(event edge.LifecycleEvent))
+	// NotifyBind records the outcome of binding a child listener on the named router, for the lifecycle handler.
+	// Binds made by RefreshSession are recorded by the listener itself
+	NotifyBind(router string, err error)
+	// Metrics returns a snapshot of the listener's counters. Counts from children which have since been removed
+	// are included
+	Metrics() edge.MultiListenerMetrics
+	// CloseConnsWhere closes the conns handed out by Accept which are still open and which pred returns true for,
+	// returning how many were closed. The listener itself stays open
+	CloseConnsWhere(pred func(info edge.ConnInfo) bool) (int, error)
 }
 
 func NewMultiListener(serviceName string, getSessionF func() *edge.Session) MultiListener {
-	return &multiListener{
+	listener := &multiListener{
 		baseListener: baseListener{
 			serviceName: serviceName,
 			acceptC:     make(chan net.Conn),
 			errorC:      make(chan error),
+			closeNotify: make(chan struct{}),
 		},
-		listeners:   map[edge.Listener]struct{}{},
-		getSessionF: getSessionF,
+		listeners:     map[edge.Listener]struct{}{},
+		closeHandlers: map[edge.Listener]func(){},
+		getSessionF:   getSessionF,
+		conns:         map[net.Conn]struct{}{},
 	}
+	// counted by the accepting side, so the counts are up to date as soon as the caller has the conn
+	listener.onTaken = func(net.Conn) { atomic.AddInt64(&listener.waiting, -1) }
+	listener.onAccept = listener.countAccept
+	trackListener(listener)
+	return listener
 }
 
 type multiListener struct {
 	baseListener
-	listeners    map[edge.Listener]struct{}
-	listenerLock sync.Mutex
-	getSessionF  func() *edge.Session
-	eventHandler atomic.Value
+	listeners     map[edge.Listener]struct{}
+	closeHandlers map[edge.Listener]func()
+	listenerLock  sync.Mutex
+	getSessionF   func() *edge.Session
+	eventHandler  atomic.Value
+	rebindHandler atomic.Value
+	lifecycle     lifecycleDispatcher
+	accepts       uint64
+	// retiredRejects holds the rejects counted by children which have been removed
+	retiredRejects uint64
+	waiting        int64
+	routerAccepts  sync.Map
+	// conns holds the accepted conns which haven't closed yet
+	conns    map[net.Conn]struct{}
+	connLock sync.Mutex
 }
 
 func (listener *multiListener) SetConnectionChangeHandler(handler func([]edge.Listener)) {
@@ -180,7 +789,97 @@ func (listener *multiListener) GetConnectionChangeHandler() func([]edge.Listener
 	return val.(func([]edge.Listener))
 }
 
-func (listener *multiListener) notifyEventHandler() {
+func (listener *multiListener) Metrics() edge.MultiListenerMetrics {
+	metrics := edge.MultiListenerMetrics{
+		Accepts:       atomic.LoadUint64(&listener.accepts),
+		QueuedAccepts: uint64(atomic.LoadInt64(&listener.waiting)),
+		RouterAccepts: map[string]uint64{},
+	}
+
+	listener.listenerLock.Lock()
+	metrics.Rejects = atomic.LoadUint64(&listener.retiredRejects)
+	for child := range listener.listeners {
+		metrics.Children++
+		if childListener, ok := child.(*edgeListener); ok {
+			metrics.Rejects += atomic.LoadUint64(&childListener.rejects)
+			metrics.QueuedAccepts += uint64(childListener.queueLen())
+		}
+	}
+	listener.listenerLock.Unlock()
+
+	metrics.QueuedAccepts += uint64(listener.queueLen())
+	listener.routerAccepts.Range(func(key, value interface{}) bool {
+		metrics.RouterAccepts[key.(string)] = atomic.LoadUint64(value.(*uint64))
+		return true
+	})
+	return metrics
+}
+
+func (listener *multiListener) countAccept(conn net.Conn) {
+	atomic.AddUint64(&listener.accepts, 1)
+	counter, _ := listener.routerAccepts.LoadOrStore(routerNameOf(conn), new(uint64))
+	atomic.AddUint64(counter.(*uint64), 1)
+}
+
+// trackConn records an accepted conn until it closes, for CloseConnsWhere
+func (listener *multiListener) trackConn(conn net.Conn) {
+	serviceConn, ok := conn.(edge.ServiceConn)
+	if !ok {
+		return
+	}
+
+	listener.connLock.Lock()
+	listener.conns[conn] = struct{}{}
+	listener.connLock.Unlock()
+
+	serviceConn.OnClose(func(error) {
+		listener.connLock.Lock()
+		delete(listener.conns, conn)
+		listener.connLock.Unlock()
+	})
+}
+
+func (listener *multiListener) CloseConnsWhere(pred func(info edge.ConnInfo) bool) (int, error) {
+	listener.connLock.Lock()
+	conns := make([]net.Conn, 0, len(listener.conns))
+	for conn := range listener.conns {
+		conns = append(conns, conn)
+	}
+	listener.connLock.Unlock()
+
+	closed := 0
+	var resultErrors []error
+	for _, conn := range conns {
+		if edgeCh, ok := conn.(*edgeConn); (ok && edgeCh.closed.Get()) || !pred(newConnInfo(conn)) {
+			continue
+		}
+		if err := conn.Close(); err != nil {
+			resultErrors = append(resultErrors, err)
+			continue
+		}
+		closed++
+	}
+	return closed, listener.condenseErrors(resultErrors)
+}
+
+func (listener *multiListener) SetLifecycleHandler(handler func(event edge.LifecycleEvent)) {
+	listener.lifecycle.setHandler(handler)
+}
+
+func (listener *multiListener) NotifyBind(router string, err error) {
+	event := edge.LifecycleEvent{Type: edge.LifecycleBindSucceeded, Router: router}
+	if err != nil {
+		event.Type = edge.LifecycleBindFailed
+		event.Err = err
+	}
+	listener.lifecycle.emit(event)
+}
+
+// childChanged records a child being added or removed, passing the connection change handler a snapshot of the
+// child listeners, so it never sees the map itself. Must be called with listenerLock held
+func (listener *multiListener) childChanged(eventType edge.LifecycleEventType, child edge.Listener) {
+	listener.lifecycle.emit(edge.LifecycleEvent{Type: eventType, Router: routerNameOf(child), Listener: child})
+
 	if handler := listener.GetConnectionChangeHandler(); handler != nil {
 		var list []edge.Listener
 		for k := range listener.listeners {
@@ -194,6 +893,41 @@ func (listener *multiListener) GetCurrentSession() *edge.Session {
 	return listener.getSessionF()
 }
 
+// BindToken returns the token of the current session, which all of the child listeners bind with
+func (listener *multiListener) BindToken() string {
+	if session := listener.GetCurrentSession(); session != nil {
+		return edge.RedactToken(session.Token)
+	}
+	return ""
+}
+
+// BoundIdentity returns the identity reported by the first child listener that reported one. Children all bind with
+// the same options, so they only differ if the routers disagree
+func (listener *multiListener) BoundIdentity() string {
+	listener.listenerLock.Lock()
+	defer listener.listenerLock.Unlock()
+
+	for child := range listener.listeners {
+		if bound := child.BoundIdentity(); bound != "" {
+			return bound
+		}
+	}
+	return ""
+}
+
+// TerminatorInstanceId returns the instance id of any child listener, as they all bind with the same options
+func (listener *multiListener) TerminatorInstanceId() string {
+	listener.listenerLock.Lock()
+	defer listener.listenerLock.Unlock()
+
+	for child := range listener.listeners {
+		if instanceId := child.TerminatorInstanceId(); instanceId != "" {
+			return instanceId
+		}
+	}
+	return ""
+}
+
 func (listener *multiListener) UpdateCost(cost uint16) error {
 	listener.listenerLock.Lock()
 	defer listener.listenerLock.Unlock()
@@ -207,6 +941,31 @@ func (listener *multiListener) UpdateCost(cost uint16) error {
 	return listener.condenseErrors(resultErrors)
 }
 
+// UpdateIdentitySecret updates the secret on each child listener. The new secret is kept even if some of the
+// updates fail, so that listeners bound later use it
+func (listener *multiListener) UpdateIdentitySecret(secret string) error {
+	listener.secret.Store(secret)
+
+	listener.listenerLock.Lock()
+	defer listener.listenerLock.Unlock()
+
+	var resultErrors []error
+	for child := range listener.listeners {
+		if err := child.UpdateIdentitySecret(secret); err != nil {
+			resultErrors = append(resultErrors, err)
+		}
+	}
+	return listener.condenseErrors(resultErrors)
+}
+
+func (listener *multiListener) UpdateCostPercent(pct float64) error {
+	cost, err := edge.CostFromPercent(pct)
+	if err != nil {
+		return err
+	}
+	return listener.UpdateCost(cost)
+}
+
 func (listener *multiListener) UpdatePrecedence(precedence edge.Precedence) error {
 	listener.listenerLock.Lock()
 	defer listener.listenerLock.Unlock()
@@ -221,15 +980,27 @@ func (listener *multiListener) UpdatePrecedence(precedence edge.Precedence) erro
 }
 
 func (listener *multiListener) UpdateCostAndPrecedence(cost uint16, precedence edge.Precedence) error {
+	return listener.UpdateCostAndPrecedenceContext(context.Background(), cost, precedence)
+}
+
+// UpdateCostAndPrecedenceContext updates each child listener in turn. Once ctx is done the update in flight is
+// abandoned and the remaining children are skipped, so ctx.Err() is returned rather than the children's errors
+func (listener *multiListener) UpdateCostAndPrecedenceContext(ctx context.Context, cost uint16, precedence edge.Precedence) error {
 	listener.listenerLock.Lock()
 	defer listener.listenerLock.Unlock()
 
 	var resultErrors []error
 	for child := range listener.listeners {
-		if err := child.UpdateCostAndPrecedence(cost, precedence); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := child.UpdateCostAndPrecedenceContext(ctx, cost, precedence); err != nil {
 			resultErrors = append(resultErrors, err)
 		}
 	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	return listener.condenseErrors(resultErrors)
 }
 
@@ -254,86 +1025,262 @@ func (listener *multiListener) AddListener(netListener edge.Listener, closeHandl
 
 	edgeListener, ok := netListener.(*edgeListener)
 	if !ok {
-		pfxlog.Logger().Errorf("multi-listener expects only listeners created by the SDK, not %v", reflect.TypeOf(listener))
+		edge.Log().Errorf("multi-listener expects only listeners created by the SDK, not %v", reflect.TypeOf(listener))
 		return
 	}
 
 	listener.listenerLock.Lock()
 	defer listener.listenerLock.Unlock()
+
+	// Close may have run since the check above, in which case the child map is gone
+	if listener.closed.Get() {
+		go func() { _ = edgeListener.Close() }()
+		return
+	}
 	listener.listeners[edgeListener] = struct{}{}
+	listener.closeHandlers[edgeListener] = closeHandler
 
 	closer := func() {
 		listener.listenerLock.Lock()
 		defer listener.listenerLock.Unlock()
-		delete(listener.listeners, edgeListener)
+		// Close retires the rejects of the children it takes
+		if _, found := listener.listeners[edgeListener]; found {
+			delete(listener.listeners, edgeListener)
+			atomic.AddUint64(&listener.retiredRejects, atomic.LoadUint64(&edgeListener.rejects))
+		}
+
+		// if the listener was replaced by RefreshSession, its close handler has moved to the replacement
+		handler, found := listener.closeHandlers[edgeListener]
+		delete(listener.closeHandlers, edgeListener)
 
-		listener.notifyEventHandler()
-		go closeHandler()
+		listener.childChanged(edge.LifecycleChildRemoved, edgeListener)
+		if found && handler != nil {
+			go handler()
+		}
 	}
 
-	listener.notifyEventHandler()
+	listener.childChanged(edge.LifecycleChildAdded, edgeListener)
 
 	go listener.forward(edgeListener, closer)
 }
 
+func (listener *multiListener) SetRebindHandler(handler func(session *edge.Session, old, new edge.Listener)) {
+	listener.rebindHandler.Store(handler)
+}
+
+func (listener *multiListener) SetPriorityFunc(priority func(info edge.ConnInfo) int) {
+	listener.priority = priority
+}
+
+func (listener *multiListener) getRebindHandler() func(session *edge.Session, old, new edge.Listener) {
+	val := listener.rebindHandler.Load()
+	if val == nil {
+		return nil
+	}
+	return val.(func(session *edge.Session, old, new edge.Listener))
+}
+
+// RefreshSession rebinds the child listeners using the given session. Each child is bound with the new session
+// before the old bind is removed, so there's no gap where dials can't reach us
+func (listener *multiListener) RefreshSession(session *edge.Session) error {
+	listener.listenerLock.Lock()
+	var children []*edgeListener
+	for child := range listener.listeners {
+		if childListener, ok := child.(*edgeListener); ok && childListener.token != session.Token {
+			children = append(children, childListener)
+		}
+	}
+	listener.listenerLock.Unlock()
+
+	var resultErrors []error
+	for _, child := range children {
+		if err := listener.rebind(child, session); err != nil {
+			resultErrors = append(resultErrors, err)
+		}
+	}
+	return listener.condenseErrors(resultErrors)
+}
+
+func (listener *multiListener) rebind(child *edgeListener, session *edge.Session) error {
+	if child.edgeChan.router == nil {
+		return errors.Errorf("unable to rebind listener for service %v, no router connection", listener.serviceName)
+	}
+
+	conn := child.edgeChan.router.NewConn(listener.serviceName)
+	netListener, err := conn.Listen(session, listener.serviceName, child.BindOptions(child.options))
+	listener.NotifyBind(child.edgeChan.getRouterName(), err)
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrapf(err, "unable to rebind listener for service %v on router %v",
+			listener.serviceName, child.edgeChan.getRouterName())
+	}
+
+	listener.listenerLock.Lock()
+	_, found := listener.listeners[child]
+	closeHandler := listener.closeHandlers[child]
+	delete(listener.closeHandlers, child)
+	listener.listenerLock.Unlock()
+
+	if !found || listener.closed.Get() {
+		// closed while we were binding, so the replacement isn't needed
+		_ = netListener.Close()
+		return nil
+	}
+
+	listener.AddListener(netListener, closeHandler)
+	if handler := listener.getRebindHandler(); handler != nil {
+		handler(session, child, netListener)
+	}
+
+	if err := child.Close(); err != nil {
+		edge.Log().WithError(err).Errorf("failed to close listener replaced by rebind for service %v", listener.serviceName)
+	}
+	return nil
+}
+
 func (listener *multiListener) forward(edgeListener *edgeListener, closeHandler func()) {
 	defer func() {
 		if err := edgeListener.Close(); err != nil {
-			pfxlog.Logger().Errorf("failure closing edge listener: (%v)", err)
+			edge.Log().Errorf("failure closing edge listener: (%v)", err)
 		}
 		closeHandler()
 	}()
 
-	ticker := time.NewTicker(250 * time.Millisecond)
+	ticker := time.NewTicker(getForwardPollInterval())
 	defer ticker.Stop()
 
 	for !listener.closed.Get() && !edgeListener.closed.Get() {
+		if conn := edgeListener.nextQueued(); conn != nil {
+			edgeListener.queueChanged()
+			if !listener.accept(conn, ticker) {
+				_ = conn.Close()
+			}
+			continue
+		}
+
 		select {
 		case conn, ok := <-edgeListener.acceptC:
 			if !ok || conn == nil {
 				// closed, returning
 				return
 			}
-			listener.accept(conn, ticker)
+			if conn = edgeListener.received(conn); conn != nil {
+				edgeListener.queueChanged()
+				if !listener.accept(conn, ticker) {
+					_ = conn.Close()
+				}
+			}
+		case <-edgeListener.closeNotify:
+		case <-listener.closeNotify:
 		case <-ticker.C:
 			// lets us check if the listener is closed, and exit if it has
 		}
 	}
+
+	// conns which reached the child before it closed are still passed on, unless the multi-listener has closed too,
+	// in which case nobody will accept them
+	for conn := edgeListener.takeLeftover(); conn != nil; conn = edgeListener.takeLeftover() {
+		if !listener.accept(conn, ticker) {
+			_ = conn.Close()
+		}
+	}
 }
 
-func (listener *multiListener) accept(conn net.Conn, ticker *time.Ticker) {
+// accept passes a conn on to callers of Accept, returning false if the multi-listener closed first
+func (listener *multiListener) accept(conn net.Conn, ticker *time.Ticker) bool {
+	// taking the conn off acceptC stops it waiting, see NewMultiListener
+	atomic.AddInt64(&listener.waiting, 1)
+
+	// tracked before the hand off, so CloseConnsWhere sees the conn as soon as Accept returns it. If the hand off
+	// fails, the caller closes the conn, which stops tracking it
+	listener.trackConn(conn)
+
 	for !listener.closed.Get() {
 		select {
 		case listener.acceptC <- conn:
-			return
+			listener.lifecycle.emit(edge.LifecycleEvent{Type: edge.LifecycleConnAccepted, Router: routerNameOf(conn), Conn: conn})
+			return true
+		case <-listener.closeNotify:
+			atomic.AddInt64(&listener.waiting, -1)
+			return false
 		case <-ticker.C:
 			// lets us check if the listener is closed, and exit if it has
 		}
 	}
+	atomic.AddInt64(&listener.waiting, -1)
+	return false
 }
 
 func (listener *multiListener) Close() error {
-	listener.closed.Set(true)
+	var resultErrors []error
+	for _, child := range listener.closeAndTakeChildren() {
+		if err := child.Close(); err != nil {
+			resultErrors = append(resultErrors, err)
+		}
+	}
+	return listener.condenseErrors(resultErrors)
+}
+
+// CloseNoUnbind closes the multi-listener and its children without sending anything to the routers
+func (listener *multiListener) CloseNoUnbind() error {
+	var resultErrors []error
+	for _, child := range listener.closeAndTakeChildren() {
+		if err := child.CloseNoUnbind(); err != nil {
+			resultErrors = append(resultErrors, err)
+		}
+	}
+	return listener.condenseErrors(resultErrors)
+}
+
+// closeAndTakeChildren marks the multi-listener closed, which tells the forward goroutines to stop, and empties
+// the child map, returning the children for the caller to close. The children are closed without holding
+// listenerLock, as a forward goroutine exiting takes the lock to remove its child
+func (listener *multiListener) closeAndTakeChildren() []edge.Listener {
+	listener.setClosedWithError(nil)
 
 	listener.listenerLock.Lock()
 	defer listener.listenerLock.Unlock()
 
-	var resultErrors []error
+	var children []edge.Listener
 	for child := range listener.listeners {
-		if err := child.Close(); err != nil {
-			resultErrors = append(resultErrors, err)
+		children = append(children, child)
+		if edgeListener, ok := child.(*edgeListener); ok {
+			atomic.AddUint64(&listener.retiredRejects, atomic.LoadUint64(&edgeListener.rejects))
 		}
 	}
-
 	listener.listeners = nil
+	return children
+}
 
-	select {
-	case listener.acceptC <- nil:
-	default:
-		// If the queue is full, bail out, we're just popping a nil on the
-		// accept queue to let it return from accept more quickly
+// GracefulClose drains and closes the child listeners in parallel, then closes the multi-listener
+func (listener *multiListener) GracefulClose(ctx context.Context) error {
+	listener.listenerLock.Lock()
+	var children []edge.Listener
+	for child := range listener.listeners {
+		children = append(children, child)
 	}
+	listener.listenerLock.Unlock()
+
+	listener.lifecycle.emit(edge.LifecycleEvent{Type: edge.LifecycleDraining})
 
+	errC := make(chan error, len(children))
+	for _, child := range children {
+		go func(child edge.Listener) {
+			errC <- child.GracefulClose(ctx)
+		}(child)
+	}
+
+	var resultErrors []error
+	for range children {
+		if err := <-errC; err != nil {
+			resultErrors = append(resultErrors, err)
+		}
+	}
+	listener.lifecycle.emit(edge.LifecycleEvent{Type: edge.LifecycleDrained, Err: listener.condenseErrors(resultErrors)})
+
+	if err := listener.Close(); err != nil {
+		resultErrors = append(resultErrors, err)
+	}
 	return listener.condenseErrors(resultErrors)
 }
 
@@ -343,7 +1290,15 @@ func (listener *multiListener) CloseWithError(err error) {
 	default:
 	}
 
-	listener.closed.Set(true)
+	listener.setClosedWithError(err)
+}
+
+// setClosedWithError marks the listener closed, recording the close for the lifecycle handler the first time
+func (listener *multiListener) setClosedWithError(err error) {
+	if listener.setClosed() {
+		listener.lifecycle.emit(edge.LifecycleEvent{Type: edge.LifecycleClosed, Err: err})
+	}
+	untrackListener(listener)
 }
 
 type MultipleErrors []error
@@ -356,9 +1311,25 @@ func (e MultipleErrors) Error() string {
 		return e[0].Error()
 	}
 	buf := strings.Builder{}
-	buf.WriteString("multiple errors occurred")
+	buf.WriteString(fmt.Sprintf("%v errors occurred", len(e)))
 	for idx, err := range e {
 		buf.WriteString(fmt.Sprintf(" %v: %v", idx, err))
 	}
 	return buf.String()
 }
+
+// DetailedError formats the errors one per line, which is easier to read in logs than Error when the errors are long
+func (e MultipleErrors) DetailedError() string {
+	if len(e) == 0 {
+		return "no errors occurred"
+	}
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	buf := strings.Builder{}
+	buf.WriteString(fmt.Sprintf("%v errors occurred:", len(e)))
+	for idx, err := range e {
+		buf.WriteString(fmt.Sprintf("\n  [%v] %v", idx, err))
+	}
+	return buf.String()
+}
@@ -0,0 +1,113 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package impl
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+// minReapInterval stops very short idle timeouts turning the reaper into a busy loop
+const minReapInterval = 10 * time.Millisecond
+
+var routerConnIdleTimeout int64
+
+var reaper struct {
+	sync.Mutex
+	running bool
+	conns   sync.Map // *routerConn -> struct{}
+}
+
+// SetRouterConnIdleTimeout closes router connections which have carried no conns for longer than timeout, so that
+// processes which dialed many services don't keep a channel open to every router they used. Router connections
+// can be exempted with RouterConn.SetPinned. Zero, the default, turns reaping off
+func SetRouterConnIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.Errorf("router conn idle timeout must not be negative, got %v", timeout)
+	}
+	atomic.StoreInt64(&routerConnIdleTimeout, int64(timeout))
+
+	reaper.Lock()
+	defer reaper.Unlock()
+	if timeout > 0 && !reaper.running {
+		reaper.running = true
+		go runReaper()
+	}
+	return nil
+}
+
+func getRouterConnIdleTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&routerConnIdleTimeout))
+}
+
+func runReaper() {
+	for {
+		reaper.Lock()
+		timeout := getRouterConnIdleTimeout()
+		if timeout == 0 {
+			reaper.running = false
+			reaper.Unlock()
+			return
+		}
+		reaper.Unlock()
+
+		interval := timeout / 4
+		if interval < minReapInterval {
+			interval = minReapInterval
+		}
+		time.Sleep(interval)
+		reapIdleRouterConns(time.Now(), timeout)
+	}
+}
+
+func reapIdleRouterConns(now time.Time, timeout time.Duration) {
+	reaper.conns.Range(func(key, _ interface{}) bool {
+		conn := key.(*routerConn)
+		if conn.idleLongerThan(now, timeout) {
+			reaper.conns.Delete(conn)
+			edge.Log().WithField("router", conn.routerName).WithField("key", conn.key).
+				Debugf("closing router connection idle for longer than %v", timeout)
+			go func() {
+				if err := conn.Close(); err != nil {
+					edge.Log().WithError(err).Error("unable to close idle router connection")
+				}
+			}()
+		}
+		return true
+	})
+}
+
+// idleLongerThan reports whether the router connection has had no conns for longer than timeout. A conn opened
+// and closed between checks restarts the idle period. It's only called from the reaper, so the idle state
+// needs no locking
+func (conn *routerConn) idleLongerThan(now time.Time, timeout time.Duration) bool {
+	added := conn.msgMux.GetSinksAdded()
+	if conn.pinned.Get() || conn.msgMux.GetSinkCount() > 0 || added != conn.sinksAddedAtCheck {
+		conn.sinksAddedAtCheck = added
+		conn.idleSince = time.Time{}
+		return false
+	}
+	if conn.idleSince.IsZero() {
+		conn.idleSince = now
+		return false
+	}
+	return now.Sub(conn.idleSince) > timeout
+}
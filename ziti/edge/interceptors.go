@@ -0,0 +1,87 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/openziti/foundation/channel2"
+)
+
+// MsgInterceptor inspects, and may modify, a message going to or coming from the router. Returning an error aborts
+// an outbound message and drops an inbound one
+type MsgInterceptor func(msg *channel2.Message) error
+
+// msgInterceptors holds the interceptors added to a MsgChannel. It's held by pointer, so copies of the MsgChannel
+// share it. Interceptors are read without locking on every message, and the lock only serializes adding them
+type msgInterceptors struct {
+	lock     sync.Mutex
+	outbound atomic.Value
+	inbound  atomic.Value
+}
+
+// inboundInterceptable is implemented by message sinks built on MsgChannel, so the mux can run their inbound
+// interceptors before dispatching to them
+type inboundInterceptable interface {
+	interceptInbound(msg *channel2.Message) error
+}
+
+// AddOutboundInterceptor adds an interceptor which is called with each message before it's sent, including data and
+// state messages. Interceptors are called in the order they're added, on the writing goroutine, so they add to the
+// latency of every write. Messages don't have their sequence number yet, it's only assigned once they're passed
+func (ec *MsgChannel) AddOutboundInterceptor(interceptor MsgInterceptor) {
+	ec.interceptors.add(&ec.interceptors.outbound, interceptor)
+}
+
+// AddInboundInterceptor adds an interceptor which is called with each message received for the conn, before it's
+// handed to the conn. Interceptors are called in the order they're added, on the router's mux goroutine, so a
+// slow interceptor delays messages for every conn on the same router
+func (ec *MsgChannel) AddInboundInterceptor(interceptor MsgInterceptor) {
+	ec.interceptors.add(&ec.interceptors.inbound, interceptor)
+}
+
+func (ec *MsgChannel) interceptOutbound(msg *channel2.Message) error {
+	return ec.interceptors.run(&ec.interceptors.outbound, msg)
+}
+
+func (ec *MsgChannel) interceptInbound(msg *channel2.Message) error {
+	if id, found := msg.Headers[CorrelationIdHeader]; found {
+		ec.peerCorrelationId.Store(string(id))
+	}
+	return ec.interceptors.run(&ec.interceptors.inbound, msg)
+}
+
+func (interceptors *msgInterceptors) add(list *atomic.Value, interceptor MsgInterceptor) {
+	interceptors.lock.Lock()
+	defer interceptors.lock.Unlock()
+
+	current, _ := list.Load().([]MsgInterceptor)
+	updated := make([]MsgInterceptor, len(current), len(current)+1)
+	copy(updated, current)
+	list.Store(append(updated, interceptor))
+}
+
+func (interceptors *msgInterceptors) run(list *atomic.Value, msg *channel2.Message) error {
+	current, _ := list.Load().([]MsgInterceptor)
+	for _, interceptor := range current {
+		if err := interceptor(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/openziti/foundation/channel2"
+	"github.com/openziti/foundation/util/sequencer"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_OutboundInterceptors(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	var order []int
+	msgCh.AddOutboundInterceptor(func(msg *channel2.Message) error {
+		order = append(order, 1)
+		msg.Headers[UUIDHeader] = []byte("tagged")
+		return nil
+	})
+	msgCh.AddOutboundInterceptor(func(msg *channel2.Message) error {
+		order = append(order, 2)
+		if string(msg.Body) == "reject" {
+			return errors.New("rejected")
+		}
+		return nil
+	})
+
+	_, err := msgCh.Write([]byte("hello"))
+	assert.NoError(err)
+	assert.Equal([]int{1, 2}, order)
+	assert.Equal(1, ch.sentCount())
+	assert.Equal("tagged", string(ch.sent[0].Headers[UUIDHeader]))
+
+	// an interceptor error aborts the write before anything is sent
+	_, err = msgCh.Write([]byte("reject"))
+	assert.EqualError(err, "rejected")
+	_, err = msgCh.WriteNoSync([]byte("reject"))
+	assert.EqualError(err, "rejected")
+	assert.EqualError(msgCh.SendState(NewStateClosedMsg(1, "reject")), "rejected")
+	assert.Equal(1, ch.sentCount())
+
+	// aborted messages don't use up sequence numbers, so the peer doesn't wait on them before later writes
+	_, err = msgCh.Write([]byte("world"))
+	assert.NoError(err)
+	assert.Equal(2, ch.sentCount())
+
+	readQ := sequencer.NewSingleWriterSeq(16)
+	for _, msg := range ch.sent {
+		seq, _ := msg.GetUint32Header(SeqHeader)
+		assert.NoError(readQ.PutSequenced(seq, msg))
+	}
+	for _, expected := range []string{"hello", "world"} {
+		next, err := readQ.GetNextWithDeadline(time.Now().Add(time.Second))
+		assert.NoError(err)
+		assert.Equal(expected, string(next.(*channel2.Message).Body))
+	}
+
+	// copies of the channel share its interceptors
+	msgCopy := *msgCh
+	_, err = msgCopy.Write([]byte("reject"))
+	assert.EqualError(err, "rejected")
+}
+
+// interceptedSink is a message sink built on MsgChannel, as conns are
+type interceptedSink struct {
+	*MsgChannel
+	testSink
+}
+
+func (sink *interceptedSink) Id() uint32 {
+	return sink.testSink.Id()
+}
+
+func Test_InboundInterceptors(t *testing.T) {
+	assert := require.New(t)
+	mux := NewMsgMux()
+	defer mux.Close()
+
+	sink := &interceptedSink{
+		MsgChannel: NewEdgeMsgChannel(&mockChannel{}, 1),
+		testSink:   testSink{id: 1, acceptC: make(chan uint32, 10)},
+	}
+	sink.AddInboundInterceptor(func(msg *channel2.Message) error {
+		if string(msg.Body) == "drop" {
+			return errors.New("dropped")
+		}
+		return nil
+	})
+	assert.NoError(mux.AddMsgSink(sink))
+
+	send := func(seq uint32, body string) {
+		mux.Event(&MsgEvent{ConnId: 1, Seq: seq, Msg: channel2.NewMessage(ContentTypeData, []byte(body))})
+	}
+	send(1, "drop")
+	send(2, "keep")
+
+	select {
+	case seq := <-sink.acceptC:
+		assert.Equal(uint32(2), seq)
+	case <-time.After(time.Second):
+		assert.FailNow("message not dispatched")
+	}
+	assert.Equal(uint64(1), mux.GetDispatchErrors())
+}
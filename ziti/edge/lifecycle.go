@@ -0,0 +1,82 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"net"
+	"time"
+)
+
+// LifecycleEventType identifies what happened to a listener in a LifecycleEvent
+type LifecycleEventType int
+
+const (
+	// LifecycleBindSucceeded is a bind on Router succeeding, including rebinds for a refreshed session
+	LifecycleBindSucceeded LifecycleEventType = iota
+	// LifecycleBindFailed is a bind on Router failing with Err
+	LifecycleBindFailed
+	// LifecycleChildAdded is the child Listener on Router being added
+	LifecycleChildAdded
+	// LifecycleChildRemoved is the child Listener on Router being removed, after it closed
+	LifecycleChildRemoved
+	// LifecycleConnAccepted is Conn, which arrived through Router, being handed to Accept
+	LifecycleConnAccepted
+	// LifecycleDraining is GracefulClose starting to drain the children
+	LifecycleDraining
+	// LifecycleDrained is GracefulClose having drained the children, with Err set if any of them failed to drain
+	LifecycleDrained
+	// LifecycleClosed is the listener closing, with Err set if it was closed with an error
+	LifecycleClosed
+)
+
+func (t LifecycleEventType) String() string {
+	switch t {
+	case LifecycleBindSucceeded:
+		return "bind-succeeded"
+	case LifecycleBindFailed:
+		return "bind-failed"
+	case LifecycleChildAdded:
+		return "child-added"
+	case LifecycleChildRemoved:
+		return "child-removed"
+	case LifecycleConnAccepted:
+		return "conn-accepted"
+	case LifecycleDraining:
+		return "draining"
+	case LifecycleDrained:
+		return "drained"
+	case LifecycleClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// LifecycleEvent is one event in the stream passed to a listener's lifecycle handler. Type says which of the other
+// fields are set
+type LifecycleEvent struct {
+	Type LifecycleEventType
+	// Time is when the event happened
+	Time time.Time
+	// Router is the name of the edge router the event concerns, if any
+	Router string
+	// Listener is the child listener added or removed
+	Listener Listener
+	// Conn is the accepted conn
+	Conn net.Conn
+	// Err is why a bind failed, a drain failed or the listener was closed
+	Err error
+}
@@ -0,0 +1,179 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/michaelquigley/pfxlog"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is the logging interface used throughout the SDK. Use SetLogger to route SDK logging somewhere other than
+// pfxlog, with NewLogger to build one from a LeveledLogger
+type Logger interface {
+	WithField(key string, value interface{}) Logger
+	WithFields(fields map[string]interface{}) Logger
+	WithError(err error) Logger
+
+	Debug(args ...interface{})
+	Debugf(format string, args ...interface{})
+	Info(args ...interface{})
+	Infof(format string, args ...interface{})
+	Warn(args ...interface{})
+	Warnf(format string, args ...interface{})
+	Error(args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type loggerHolder struct {
+	logger Logger
+}
+
+var customLogger atomic.Value
+
+// SetLogger replaces the logger used by the SDK. Passing nil restores the default pfxlog logger. The sdkinfo
+// package, which edge depends on, still logs through logrus
+func SetLogger(logger Logger) {
+	customLogger.Store(loggerHolder{logger: logger})
+}
+
+// Log returns the logger the SDK should log through
+func Log() Logger {
+	if holder, ok := customLogger.Load().(loggerHolder); ok && holder.logger != nil {
+		return holder.logger
+	}
+	return pfxlogLogger{entry: pfxlog.Logger()}
+}
+
+// pfxlogLogger adapts a pfxlog/logrus entry to Logger
+type pfxlogLogger struct {
+	entry *logrus.Entry
+}
+
+func (l pfxlogLogger) WithField(key string, value interface{}) Logger {
+	return pfxlogLogger{entry: l.entry.WithField(key, value)}
+}
+
+func (l pfxlogLogger) WithFields(fields map[string]interface{}) Logger {
+	return pfxlogLogger{entry: l.entry.WithFields(fields)}
+}
+
+func (l pfxlogLogger) WithError(err error) Logger {
+	return pfxlogLogger{entry: l.entry.WithError(err)}
+}
+
+func (l pfxlogLogger) Debug(args ...interface{}) {
+	l.entry.Debug(args...)
+}
+
+func (l pfxlogLogger) Debugf(format string, args ...interface{}) {
+	l.entry.Debugf(format, args...)
+}
+
+func (l pfxlogLogger) Info(args ...interface{}) {
+	l.entry.Info(args...)
+}
+
+func (l pfxlogLogger) Infof(format string, args ...interface{}) {
+	l.entry.Infof(format, args...)
+}
+
+func (l pfxlogLogger) Warn(args ...interface{}) {
+	l.entry.Warn(args...)
+}
+
+func (l pfxlogLogger) Warnf(format string, args ...interface{}) {
+	l.entry.Warnf(format, args...)
+}
+
+func (l pfxlogLogger) Error(args ...interface{}) {
+	l.entry.Error(args...)
+}
+
+func (l pfxlogLogger) Errorf(format string, args ...interface{}) {
+	l.entry.Errorf(format, args...)
+}
+
+// LeveledLogger is the least a logger needs to back the SDK's logging. NewLogger adapts it to Logger, so wrapping
+// a zap or zerolog logger doesn't mean implementing every Logger method
+type LeveledLogger interface {
+	WithField(key string, value interface{}) LeveledLogger
+	Debug(msg string)
+	Info(msg string)
+	Warn(msg string)
+	Error(msg string)
+}
+
+// NewLogger returns a Logger which formats messages and passes them on to logger. WithFields and WithError are
+// mapped onto WithField, with errors under the "error" key
+func NewLogger(logger LeveledLogger) Logger {
+	return leveledLoggerAdapter{logger: logger}
+}
+
+type leveledLoggerAdapter struct {
+	logger LeveledLogger
+}
+
+func (l leveledLoggerAdapter) WithField(key string, value interface{}) Logger {
+	return leveledLoggerAdapter{logger: l.logger.WithField(key, value)}
+}
+
+func (l leveledLoggerAdapter) WithFields(fields map[string]interface{}) Logger {
+	logger := l.logger
+	for key, value := range fields {
+		logger = logger.WithField(key, value)
+	}
+	return leveledLoggerAdapter{logger: logger}
+}
+
+func (l leveledLoggerAdapter) WithError(err error) Logger {
+	return l.WithField("error", err)
+}
+
+func (l leveledLoggerAdapter) Debug(args ...interface{}) {
+	l.logger.Debug(fmt.Sprint(args...))
+}
+
+func (l leveledLoggerAdapter) Debugf(format string, args ...interface{}) {
+	l.logger.Debug(fmt.Sprintf(format, args...))
+}
+
+func (l leveledLoggerAdapter) Info(args ...interface{}) {
+	l.logger.Info(fmt.Sprint(args...))
+}
+
+func (l leveledLoggerAdapter) Infof(format string, args ...interface{}) {
+	l.logger.Info(fmt.Sprintf(format, args...))
+}
+
+func (l leveledLoggerAdapter) Warn(args ...interface{}) {
+	l.logger.Warn(fmt.Sprint(args...))
+}
+
+func (l leveledLoggerAdapter) Warnf(format string, args ...interface{}) {
+	l.logger.Warn(fmt.Sprintf(format, args...))
+}
+
+func (l leveledLoggerAdapter) Error(args ...interface{}) {
+	l.logger.Error(fmt.Sprint(args...))
+}
+
+func (l leveledLoggerAdapter) Errorf(format string, args ...interface{}) {
+	l.logger.Error(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,137 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type logLines struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *logLines) get() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+type recordingLogger struct {
+	fields map[string]interface{}
+	lines  *logLines
+}
+
+func (l recordingLogger) with(fields map[string]interface{}) Logger {
+	merged := map[string]interface{}{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return recordingLogger{fields: merged, lines: l.lines}
+}
+
+func (l recordingLogger) WithField(key string, value interface{}) Logger {
+	return l.with(map[string]interface{}{key: value})
+}
+
+func (l recordingLogger) WithFields(fields map[string]interface{}) Logger {
+	return l.with(fields)
+}
+
+func (l recordingLogger) WithError(err error) Logger {
+	return l.with(map[string]interface{}{"error": err})
+}
+
+func (l recordingLogger) log(level, msg string) {
+	l.lines.lock.Lock()
+	defer l.lines.lock.Unlock()
+	l.lines.lines = append(l.lines.lines, fmt.Sprintf("%v %v %v", level, msg, l.fields))
+}
+
+func (l recordingLogger) Debug(args ...interface{}) { l.log("debug", fmt.Sprint(args...)) }
+func (l recordingLogger) Debugf(format string, args ...interface{}) {
+	l.log("debug", fmt.Sprintf(format, args...))
+}
+func (l recordingLogger) Info(args ...interface{}) { l.log("info", fmt.Sprint(args...)) }
+func (l recordingLogger) Infof(format string, args ...interface{}) {
+	l.log("info", fmt.Sprintf(format, args...))
+}
+func (l recordingLogger) Warn(args ...interface{}) { l.log("warn", fmt.Sprint(args...)) }
+func (l recordingLogger) Warnf(format string, args ...interface{}) {
+	l.log("warn", fmt.Sprintf(format, args...))
+}
+func (l recordingLogger) Error(args ...interface{}) { l.log("error", fmt.Sprint(args...)) }
+func (l recordingLogger) Errorf(format string, args ...interface{}) {
+	l.log("error", fmt.Sprintf(format, args...))
+}
+
+func Test_SetLogger(t *testing.T) {
+	assert := require.New(t)
+
+	lines := &logLines{}
+	SetLogger(recordingLogger{lines: lines})
+	defer SetLogger(nil)
+
+	mux := NewMsgMux()
+	mux.RemoveMsgSinkById(7)
+	mux.Close()
+
+	assert.Contains(lines.get(), "debug queuing sink for removal from message mux map[connId:7]")
+
+	SetLogger(nil)
+	_, isDefault := Log().(pfxlogLogger)
+	assert.True(isDefault)
+}
+
+type leveledRecorder struct {
+	recordingLogger
+}
+
+func (l leveledRecorder) WithField(key string, value interface{}) LeveledLogger {
+	return leveledRecorder{recordingLogger: l.recordingLogger.with(map[string]interface{}{key: value}).(recordingLogger)}
+}
+
+func (l leveledRecorder) Debug(msg string) { l.log("debug", msg) }
+func (l leveledRecorder) Info(msg string)  { l.log("info", msg) }
+func (l leveledRecorder) Warn(msg string)  { l.log("warn", msg) }
+func (l leveledRecorder) Error(msg string) { l.log("error", msg) }
+
+func Test_NewLogger(t *testing.T) {
+	assert := require.New(t)
+
+	lines := &logLines{}
+	logger := NewLogger(leveledRecorder{recordingLogger: recordingLogger{lines: lines}})
+
+	logger.WithField("connId", 7).Debugf("closing %v", "conn")
+	logger.WithFields(map[string]interface{}{"router": "er"}).Info("connected")
+	logger.WithError(fmt.Errorf("refused")).Warnf("bind failed after %v attempts", 3)
+	logger.Error("failed", " hard")
+
+	assert.Equal([]string{
+		"debug closing conn map[connId:7]",
+		"info connected map[router:er]",
+		"warn bind failed after 3 attempts map[error:refused]",
+		"error failed hard map[]",
+	}, lines.get())
+}
@@ -0,0 +1,98 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"sync"
+)
+
+// memoryBudget tracks the inbound bytes buffered across all the sinks on a mux. Once they reach the limit, reads
+// from the channel are held until conns are read or closed and usage drops back under it
+type memoryBudget struct {
+	lock     sync.Mutex
+	limit    int64
+	used     int64
+	pauses   uint64
+	waiting  bool
+	changedC chan struct{}
+}
+
+func newMemoryBudget() *memoryBudget {
+	return &memoryBudget{changedC: make(chan struct{})}
+}
+
+func (budget *memoryBudget) setLimit(limit int64) {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	budget.limit = limit
+	budget.notifyChanged()
+}
+
+func (budget *memoryBudget) add(delta int64) {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	budget.used += delta
+	if delta < 0 {
+		budget.notifyChanged()
+	}
+}
+
+// waitForRoom blocks while usage is at or over the limit, or until closedC is closed
+func (budget *memoryBudget) waitForRoom(closedC <-chan struct{}) {
+	paused := false
+	for {
+		budget.lock.Lock()
+		if budget.limit <= 0 || budget.used < budget.limit {
+			budget.lock.Unlock()
+			return
+		}
+		if !paused {
+			paused = true
+			budget.pauses++
+		}
+		budget.waiting = true
+		changedC := budget.changedC
+		budget.lock.Unlock()
+
+		select {
+		case <-changedC:
+		case <-closedC:
+			return
+		}
+	}
+}
+
+func (budget *memoryBudget) getUsed() int64 {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	return budget.used
+}
+
+func (budget *memoryBudget) getPauses() uint64 {
+	budget.lock.Lock()
+	defer budget.lock.Unlock()
+	return budget.pauses
+}
+
+// notifyChanged wakes up a read waiting for room. Must be called with the lock held
+func (budget *memoryBudget) notifyChanged() {
+	if budget.waiting {
+		close(budget.changedC)
+		budget.changedC = make(chan struct{})
+		budget.waiting = false
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/openziti/foundation/util/uuidz"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"strings"
 )
 
 const (
@@ -37,22 +38,57 @@ const (
 	ContentTypeStateSessionEnded = 60792
 	ContentTypeProbe             = 60793
 	ContentTypeUpdateBind        = 60794
+	// ContentTypeStateAck acknowledges a data message sent with ReceiptHeader. Its SeqHeader holds the sequence
+	// number of the data message, rather than one of its own
+	ContentTypeStateAck = 60795
 
+	// Header keys from 1000 to 1999 are reserved for the SDK and edge routers, and keys up to 255 are used by
+	// channel2. Applications may use any other keys, see IsReservedHeader
 	ConnIdHeader       = 1000
 	SeqHeader          = 1001
 	SessionTokenHeader = 1002
 	PublicKeyHeader    = 1003
 	CostHeader         = 1004
 	PrecedenceHeader   = 1005
+	CompressionHeader  = 1006
+	CompressedHeader   = 1007
+	ProtocolsHeader    = 1008
+	ProtocolHeader     = 1009
+	ClientHintHeader   = 1010
+	// TerminatorIdentityHeader carries the identity to register the terminator with on bind, and the identity the
+	// router actually registered it with on the bind reply. On connect it asks for the terminator with that identity
+	TerminatorIdentityHeader = 1011
+	// AppDataHeader carries DialOptions.AppData from the dialer to the host
+	AppDataHeader = 1012
+	// CallerIdHeader is added to dial requests by the router, naming the identity which dialed
+	CallerIdHeader = 1013
+	// SdkVersionHeader and CapabilitiesHeader are sent by both ends of the connect handshake, see PeerCapabilities
+	SdkVersionHeader   = 1014
+	CapabilitiesHeader = 1015
+	// TerminatorIdentitySecretHeader carries ListenOptions.IdentitySecret on bind and bind updates
+	TerminatorIdentitySecretHeader = 1016
+	// TerminatorInstanceIdHeader carries ListenOptions.TerminatorInstanceId on bind, and back to the dialer on the
+	// dial reply. On connect it asks for the terminator with that instance id
+	TerminatorInstanceIdHeader = 1017
+	// CorrelationIdHeader carries the id set with SetCorrelationId on each message a conn sends
+	CorrelationIdHeader = 1018
+	// ReceiptHeader asks the peer to acknowledge a data message with a ContentTypeStateAck once it's read it
+	ReceiptHeader = 1019
 
 	PrecedenceDefault  Precedence = 0
-	PrecedenceRequired            = 1
-	PrecedenceFailed              = 2
+	PrecedenceRequired Precedence = 1
+	PrecedenceFailed   Precedence = 2
 
 	// Put this in the reflected range so replies will share the same UUID
 	UUIDHeader = 128
 )
 
+// IsReservedHeader returns true for header keys used by channel2, from 0 to 255, and by the SDK and edge routers,
+// from 1000 to 1999. Keys from 128 to 255 are also reflected onto replies
+func IsReservedHeader(key int32) bool {
+	return (key >= 0 && key <= channel2.MaxReflectedHeader) || (key >= 1000 && key <= 1999)
+}
+
 type Precedence byte
 
 var ContentTypeValue = map[string]int32{
@@ -65,6 +101,7 @@ var ContentTypeValue = map[string]int32{
 	"EdgeDialFailedType":     ContentTypeDialFailed,
 	"EdgeBindType":           ContentTypeBind,
 	"EdgeUnbindType":         ContentTypeUnbind,
+	"EdgeStateAckType":       ContentTypeStateAck,
 }
 
 var ContentTypeNames = map[int32]string{
@@ -78,6 +115,7 @@ var ContentTypeNames = map[int32]string{
 	ContentTypeBind:           "EdgeBindType",
 	ContentTypeUnbind:         "EdgeUnbindType",
 	ContentTypeProbe:          "EdgeProbeType",
+	ContentTypeStateAck:       "EdgeStateAckType",
 }
 
 type Sequenced interface {
@@ -164,6 +202,11 @@ func NewStateClosedMsg(connId uint32, message string) *channel2.Message {
 	return newMsg(ContentTypeStateClosed, connId, 0, []byte(message))
 }
 
+// NewStateAckMsg acknowledges the data message with sequence number seq
+func NewStateAckMsg(connId uint32, seq uint32) *channel2.Message {
+	return newMsg(ContentTypeStateAck, connId, seq, nil)
+}
+
 func NewDialMsg(connId uint32, token string) *channel2.Message {
 	return newMsg(ContentTypeDial, connId, 0, []byte(token))
 }
@@ -250,6 +293,20 @@ func UnmarshalDialResult(msg *channel2.Message) (*DialResult, error) {
 	return nil, errors.Errorf("unexpected response. received %v instead of dial result message", msg.ContentType)
 }
 
+// GetProtocolsHeader returns the protocols offered by a dialer, in order of preference
+func GetProtocolsHeader(msg *channel2.Message) []string {
+	if val, found := msg.Headers[ProtocolsHeader]; found && len(val) > 0 {
+		return strings.Split(string(val), "\n")
+	}
+	return nil
+}
+
+func PutProtocolsHeader(msg *channel2.Message, protocols []string) {
+	if len(protocols) > 0 {
+		msg.Headers[ProtocolsHeader] = []byte(strings.Join(protocols, "\n"))
+	}
+}
+
 func GetLoggerFields(msg *channel2.Message) logrus.Fields {
 	msgUUID := uuidz.ToString(msg.Headers[UUIDHeader])
 
@@ -266,6 +323,9 @@ func GetLoggerFields(msg *channel2.Message) logrus.Fields {
 	if msgUUID != "" {
 		fields["uuid"] = msgUUID
 	}
+	if correlationId, found := msg.Headers[CorrelationIdHeader]; found {
+		fields["correlationId"] = string(correlationId)
+	}
 
 	return fields
 }
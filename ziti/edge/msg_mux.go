@@ -17,23 +17,94 @@
 package edge
 
 import (
-	"github.com/michaelquigley/pfxlog"
+	"fmt"
 	"github.com/openziti/foundation/channel2"
 	"github.com/openziti/foundation/util/concurrenz"
 	"github.com/pkg/errors"
+	"sync/atomic"
 	"time"
 )
 
+// ErrDuplicateSinkId is returned, wrapped, by AddMsgSink when a sink with the same id is already registered
+var ErrDuplicateSinkId = errors.New("message sink id already in use")
+
+// ErrMuxClosed is the close cause given to sinks when a mux is closed with Close
+var ErrMuxClosed = errors.New("message mux closed")
+
 type MsgSink interface {
+	// HandleMuxClose is called when the mux closes, with the cause. ErrRouterConnClosed means the router channel
+	// closed under the mux, while ErrRouterConnShutdown means the router conn was closed locally
+	HandleMuxClose(cause error) error
+	Id() uint32
+	Accept(event *MsgEvent)
+}
+
+// LegacyMsgSink is a message sink whose HandleMuxClose doesn't take the close cause.
+//
+// Deprecated: implement MsgSink, or wrap existing sinks with AdaptLegacyMsgSink
+type LegacyMsgSink interface {
 	HandleMuxClose() error
 	Id() uint32
 	Accept(event *MsgEvent)
 }
 
+// AdaptLegacyMsgSink adapts a sink written before HandleMuxClose took a cause, so it can be added to a mux.
+//
+// Deprecated: implement MsgSink instead
+func AdaptLegacyMsgSink(sink LegacyMsgSink) MsgSink {
+	return legacyMsgSink{LegacyMsgSink: sink}
+}
+
+type legacyMsgSink struct {
+	LegacyMsgSink
+}
+
+func (sink legacyMsgSink) HandleMuxClose(error) error {
+	return sink.LegacyMsgSink.HandleMuxClose()
+}
+
+const DefaultMuxWorkerQueueSize = 64
+
+// MuxStallThreshold is how long the mux may spend handling a single event before Healthy reports it as stalled
+const MuxStallThreshold = 5 * time.Second
+
+// MsgMuxOptions configures how a MsgMux dispatches messages to its sinks
+type MsgMuxOptions struct {
+	// WorkerPoolSize is the number of goroutines messages are dispatched to sinks on. Messages for a given conn id
+	// are always handled by the same worker, so per-sink ordering is kept. Zero dispatches inline on the mux
+	// goroutine, so a slow sink delays dispatch to every other sink
+	WorkerPoolSize int
+	// WorkerQueueSize is the number of messages each worker can have queued before dispatch blocks. Zero uses
+	// DefaultMuxWorkerQueueSize
+	WorkerQueueSize int
+}
+
+func DefaultMsgMuxOptions() *MsgMuxOptions {
+	return &MsgMuxOptions{}
+}
+
 func NewMsgMux() *MsgMux {
+	return NewMsgMuxWithOptions(DefaultMsgMuxOptions())
+}
+
+func NewMsgMuxWithOptions(options *MsgMuxOptions) *MsgMux {
 	mux := &MsgMux{
 		eventC:  make(chan MuxEvent),
+		closedC: make(chan struct{}),
 		chanMap: make(map[uint32]MsgSink),
+		budget:  newMemoryBudget(),
+	}
+
+	if options != nil && options.WorkerPoolSize > 0 {
+		queueSize := options.WorkerQueueSize
+		if queueSize <= 0 {
+			queueSize = DefaultMuxWorkerQueueSize
+		}
+		for i := 0; i < options.WorkerPoolSize; i++ {
+			workerC := make(chan *msgDispatch, queueSize)
+			mux.workers = append(mux.workers, workerC)
+			go runDispatchWorker(mux, workerC)
+		}
 	}
 
 	mux.running.Set(true)
@@ -41,11 +112,44 @@ func NewMsgMux() *MsgMux {
 	return mux
 }
 
+type msgDispatch struct {
+	sink  MsgSink
+	event *MsgEvent
+}
+
+func runDispatchWorker(mux *MsgMux, workerC chan *msgDispatch) {
+	for dispatch := range workerC {
+		mux.dispatch(dispatch.sink, dispatch.event)
+	}
+}
+
+// dispatch hands an event to a sink. A panicking sink is logged and the message dropped, so it can't stop
+// dispatch to the other sinks
+func (mux *MsgMux) dispatch(sink MsgSink, event *MsgEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&mux.eventPanics, 1)
+			Log().WithField("connId", event.ConnId).Errorf("panic while dispatching message to sink: %v", r)
+		}
+	}()
+	sink.Accept(event)
+}
+
 type MsgMux struct {
-	closed  concurrenz.AtomicBoolean
-	running concurrenz.AtomicBoolean
-	eventC  chan MuxEvent
-	chanMap map[uint32]MsgSink
+	closed         concurrenz.AtomicBoolean
+	running        concurrenz.AtomicBoolean
+	eventC         chan MuxEvent
+	closedC        chan struct{}
+	chanMap        map[uint32]MsgSink
+	sinkCount      int64
+	sinksAdded     uint64
+	dispatchErrors uint64
+	eventPanics    uint64
+	lastEventAt    int64
+	handlingSince  int64
+	workers        []chan *msgDispatch
+	unknownSink    atomic.Value
+	budget         *memoryBudget
 }
 
 func (mux *MsgMux) ContentType() int32 {
@@ -54,21 +158,61 @@ func (mux *MsgMux) ContentType() int32 {
 
 func (mux *MsgMux) HandleReceive(msg *channel2.Message, _ channel2.Channel) {
 	if event, err := UnmarshalMsgEvent(msg); err != nil {
-		pfxlog.Logger().WithError(err).Errorf("error unmarshaling edge message headers. content type: %v", msg.ContentType)
+		atomic.AddUint64(&mux.dispatchErrors, 1)
+		Log().WithError(err).Errorf("error unmarshaling edge message headers. content type: %v", msg.ContentType)
 	} else {
-		mux.eventC <- event
+		if event.Msg.ContentType == ContentTypeData {
+			// holding up the channel's receive loop is what pushes back on the router
+			mux.budget.waitForRoom(mux.closedC)
+		}
+		mux.send(event)
+	}
+}
+
+// SetMemoryBudget caps the inbound data buffered across all the sinks on the mux, as counted with
+// AddBufferedBytes. Once it's reached, reads from the channel pause until usage drops back under it, which pushes
+// back on the router. Usage may go over the budget by the messages already read. Zero or less removes the cap
+func (mux *MsgMux) SetMemoryBudget(bytes int) {
+	mux.budget.setLimit(int64(bytes))
+}
+
+// AddBufferedBytes adjusts the count of inbound bytes buffered by sinks, which SetMemoryBudget applies to. Sinks
+// add data as it's buffered and remove it once it's read or dropped
+func (mux *MsgMux) AddBufferedBytes(delta int) {
+	mux.budget.add(int64(delta))
+}
+
+// GetBufferedBytes returns the inbound bytes currently buffered across the sinks
+func (mux *MsgMux) GetBufferedBytes() int64 {
+	return mux.budget.getUsed()
+}
+
+// GetReadPauses returns how many times reads from the channel have paused for the memory budget
+func (mux *MsgMux) GetReadPauses() uint64 {
+	return mux.budget.getPauses()
+}
+
+// send queues an event for the mux goroutine. It returns false if the mux closed before the event could be queued
+func (mux *MsgMux) send(event MuxEvent) bool {
+	select {
+	case mux.eventC <- event:
+		return true
+	case <-mux.closedC:
+		return false
 	}
 }
 
 func (mux *MsgMux) AddMsgSink(sink MsgSink) error {
 	if !mux.closed.Get() {
 		event := &muxAddSinkEvent{sink: sink, doneC: make(chan error)}
-		mux.eventC <- event
+		if !mux.send(event) {
+			return nil
+		}
 		err, ok := <-event.doneC // wait for event to be done processing
 		if ok && err != nil {
 			return err
 		}
-		pfxlog.Logger().WithField("connId", sink.Id()).Debug("added to msg mux")
+		Log().WithField("connId", sink.Id()).Debug("added to msg mux")
 	}
 	return nil
 }
@@ -78,66 +222,156 @@ func (mux *MsgMux) RemoveMsgSink(sink MsgSink) {
 }
 
 func (mux *MsgMux) RemoveMsgSinkById(sinkId uint32) {
-	log := pfxlog.Logger().WithField("connId", sinkId)
+	log := Log().WithField("connId", sinkId)
 	if mux.closed.Get() {
 		log.Debug("mux closed, sink already removed or being removed")
 	} else {
 		log.Debug("queuing sink for removal from message mux")
-		event := &muxRemoveSinkEvent{sinkId: sinkId}
-		mux.eventC <- event
+		mux.send(&muxRemoveSinkEvent{sinkId: sinkId})
 	}
 }
 
 func (mux *MsgMux) Close() {
+	mux.CloseWithCause(ErrMuxClosed)
+}
+
+// CloseWithCause closes the mux, passing cause on to each sink's HandleMuxClose
+func (mux *MsgMux) CloseWithCause(cause error) {
 	if !mux.closed.Get() {
-		mux.eventC <- &muxCloseEvent{}
+		mux.send(&muxCloseEvent{cause: cause})
 	}
 }
 
 func (mux *MsgMux) Event(event MuxEvent) {
 	if !mux.closed.Get() {
-		mux.eventC <- event
+		mux.send(event)
 	}
 }
 
+// GetSinks returns a snapshot of the sinks currently registered with the mux
+func (mux *MsgMux) GetSinks() []MsgSink {
+	if mux.closed.Get() {
+		return nil
+	}
+
+	event := &muxGetSinksEvent{doneC: make(chan []MsgSink, 1)}
+	mux.Event(event)
+
+	select {
+	case sinks := <-event.doneC:
+		return sinks
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+// GetSinkCount returns the number of sinks currently registered with the mux
+func (mux *MsgMux) GetSinkCount() int64 {
+	return atomic.LoadInt64(&mux.sinkCount)
+}
+
+// GetSinksAdded returns the number of sinks registered with the mux over its lifetime
+func (mux *MsgMux) GetSinksAdded() uint64 {
+	return atomic.LoadUint64(&mux.sinksAdded)
+}
+
+// SetUnknownSinkHandler sets a handler for messages whose conn id has no sink registered, which are otherwise
+// dropped with a debug log. It's called on the mux goroutine, so it mustn't block. A handler wanting to retry once a
+// late sink registers can hand the event back to the mux later with Event. Passing nil restores the default
+func (mux *MsgMux) SetUnknownSinkHandler(handler func(event *MsgEvent)) {
+	mux.unknownSink.Store(handler)
+}
+
+func (mux *MsgMux) getUnknownSinkHandler() func(event *MsgEvent) {
+	handler, _ := mux.unknownSink.Load().(func(event *MsgEvent))
+	return handler
+}
+
+// GetDispatchErrors returns the number of messages which couldn't be dispatched to a sink
+func (mux *MsgMux) GetDispatchErrors() uint64 {
+	return atomic.LoadUint64(&mux.dispatchErrors)
+}
+
 func (mux *MsgMux) IsClosed() bool {
 	return mux.closed.Get()
 }
 
 func (mux *MsgMux) HandleClose(_ channel2.Channel) {
-	mux.Close()
+	mux.CloseWithCause(ErrRouterConnClosed)
 }
 
 func (mux *MsgMux) handleEvents() {
 	defer mux.running.Set(false)
 	for event := range mux.eventC {
-		event.Handle(mux)
+		mux.handleEvent(event)
 		if mux.closed.GetUnsafe() {
 			return
 		}
 	}
 }
 
+// handleEvent runs a single event. A panicking event is logged and skipped, rather than stopping the event loop
+// and with it every conn on the router
+func (mux *MsgMux) handleEvent(event MuxEvent) {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&mux.lastEventAt, now)
+	atomic.StoreInt64(&mux.handlingSince, now)
+	defer func() {
+		atomic.StoreInt64(&mux.handlingSince, 0)
+		if r := recover(); r != nil {
+			atomic.AddUint64(&mux.eventPanics, 1)
+			Log().Errorf("panic while handling %T in msg mux: %v", event, r)
+		}
+	}()
+	event.Handle(mux)
+}
+
+// LastEventAt returns when the mux last started handling an event, or the zero time if it hasn't handled any
+func (mux *MsgMux) LastEventAt() time.Time {
+	if last := atomic.LoadInt64(&mux.lastEventAt); last != 0 {
+		return time.Unix(0, last)
+	}
+	return time.Time{}
+}
+
+// Healthy returns true if the mux event loop is running and hasn't been stuck on one event for longer than
+// MuxStallThreshold
+func (mux *MsgMux) Healthy() bool {
+	if !mux.running.Get() || mux.closed.Get() {
+		return false
+	}
+	since := atomic.LoadInt64(&mux.handlingSince)
+	return since == 0 || time.Since(time.Unix(0, since)) < MuxStallThreshold
+}
+
+// GetEventPanics returns the number of events and dispatches which panicked and were skipped
+func (mux *MsgMux) GetEventPanics() uint64 {
+	return atomic.LoadUint64(&mux.eventPanics)
+}
+
 func (mux *MsgMux) ExecuteClose() {
-	mux.closed.Set(true)
+	mux.executeClose(ErrMuxClosed)
+}
+
+func (mux *MsgMux) executeClose(cause error) {
+	if !mux.closed.CompareAndSwap(false, true) {
+		return
+	}
+	// frees anything trying to deliver events. eventC is never closed, so senders racing with close can't panic
+	close(mux.closedC)
+
+	// workers are only fed from the mux goroutine, which we're on, so they can be safely closed here
+	for _, workerC := range mux.workers {
+		close(workerC)
+	}
 	for _, val := range mux.chanMap {
-		if err := val.HandleMuxClose(); err != nil {
-			pfxlog.Logger().
+		if err := val.HandleMuxClose(cause); err != nil {
+			Log().
 				WithField("sinkId", val.Id()).
 				WithError(err).
 				Error("error while closing message sink")
 		}
 	}
-
-	// make sure that anything trying to deliver events is freed
-	for {
-		select {
-		case <-mux.eventC: // drop event
-		case <-time.After(time.Millisecond * 100):
-			close(mux.eventC)
-			return
-		}
-	}
 }
 
 type MuxEvent interface {
@@ -153,10 +387,12 @@ type muxAddSinkEvent struct {
 func (event *muxAddSinkEvent) Handle(mux *MsgMux) {
 	defer close(event.doneC)
 	if _, found := mux.chanMap[event.sink.Id()]; found {
-		event.doneC <- errors.Errorf("message sink with id %v already exists", event.sink.Id())
+		event.doneC <- fmt.Errorf("message sink with id %v already exists (%w)", event.sink.Id(), ErrDuplicateSinkId)
 	} else {
 		mux.chanMap[event.sink.Id()] = event.sink
-		pfxlog.Logger().
+		atomic.AddInt64(&mux.sinkCount, 1)
+		atomic.AddUint64(&mux.sinksAdded, 1)
+		Log().
 			WithField("connId", event.sink.Id()).
 			Debugf("Added sink to mux. Current sink count: %v", len(mux.chanMap))
 	}
@@ -168,27 +404,62 @@ type muxRemoveSinkEvent struct {
 }
 
 func (event *muxRemoveSinkEvent) Handle(mux *MsgMux) {
-	delete(mux.chanMap, event.sinkId)
-	pfxlog.Logger().WithField("connId", event.sinkId).Debug("removed from msg mux")
+	if _, found := mux.chanMap[event.sinkId]; found {
+		delete(mux.chanMap, event.sinkId)
+		atomic.AddInt64(&mux.sinkCount, -1)
+	}
+	Log().WithField("connId", event.sinkId).Debug("removed from msg mux")
+}
+
+// muxGetSinksEvent takes a snapshot of the current message sinks
+type muxGetSinksEvent struct {
+	doneC chan []MsgSink
+}
+
+func (event *muxGetSinksEvent) Handle(mux *MsgMux) {
+	sinks := make([]MsgSink, 0, len(mux.chanMap))
+	for _, sink := range mux.chanMap {
+		sinks = append(sinks, sink)
+	}
+	event.doneC <- sinks
 }
 
 func (event *MsgEvent) Handle(mux *MsgMux) {
-	logger := pfxlog.Logger().
+	logger := Log().
 		WithField("seq", event.Seq).
 		WithField("connId", event.ConnId)
 
 	logger.Debugf("dispatching %v", ContentTypeNames[event.Msg.ContentType])
 
-	if sink, found := mux.chanMap[event.ConnId]; found {
-		sink.Accept(event)
+	if sink, found := mux.chanMap[event.ConnId]; !found {
+		atomic.AddUint64(&mux.dispatchErrors, 1)
+		if handler := mux.getUnknownSinkHandler(); handler != nil {
+			handler(event)
+		} else {
+			logger.Debug("unable to dispatch msg received for unknown edge conn id")
+		}
+	} else if err := interceptInbound(sink, event.Msg); err != nil {
+		atomic.AddUint64(&mux.dispatchErrors, 1)
+		logger.WithError(err).Debug("msg dropped by inbound interceptor")
+	} else if len(mux.workers) > 0 {
+		mux.workers[event.ConnId%uint32(len(mux.workers))] <- &msgDispatch{sink: sink, event: event}
 	} else {
-		logger.Debug("unable to dispatch msg received for unknown edge conn id")
+		mux.dispatch(sink, event)
+	}
+}
+
+func interceptInbound(sink MsgSink, msg *channel2.Message) error {
+	if interceptable, ok := sink.(inboundInterceptable); ok {
+		return interceptable.interceptInbound(msg)
 	}
+	return nil
 }
 
 // muxCloseEvent handles closing the message multiplexer and all associated sinks
-type muxCloseEvent struct{}
+type muxCloseEvent struct {
+	cause error
+}
 
 func (event *muxCloseEvent) Handle(mux *MsgMux) {
-	mux.ExecuteClose()
+	mux.executeClose(event.cause)
 }
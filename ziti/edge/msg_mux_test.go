@@ -17,6 +17,7 @@
 package edge
 
 import (
+	"github.com/openziti/foundation/channel2"
 	"github.com/stretchr/testify/require"
 	"testing"
 	"time"
@@ -31,3 +32,207 @@ func Test_newMsgMux(t *testing.T) {
 	assert.NoError(mux.closed.WaitForState(true, time.Millisecond * 100, time.Millisecond * 5))
 	assert.NoError(mux.running.WaitForState(false, time.Millisecond * 150, time.Millisecond * 5))
 }
+
+type testSink struct {
+	id      uint32
+	delay   time.Duration
+	acceptC chan uint32
+}
+
+func (sink *testSink) HandleMuxClose(error) error {
+	return nil
+}
+
+func (sink *testSink) Id() uint32 {
+	return sink.id
+}
+
+func (sink *testSink) Accept(event *MsgEvent) {
+	time.Sleep(sink.delay)
+	sink.acceptC <- event.Seq
+}
+
+func Test_MsgMuxWorkerPool(t *testing.T) {
+	assert := require.New(t)
+	mux := NewMsgMuxWithOptions(&MsgMuxOptions{WorkerPoolSize: 2})
+	defer mux.Close()
+
+	slow := &testSink{id: 1, delay: 100 * time.Millisecond, acceptC: make(chan uint32, 10)}
+	fast := &testSink{id: 2, acceptC: make(chan uint32, 10)}
+	assert.NoError(mux.AddMsgSink(slow))
+	assert.NoError(mux.AddMsgSink(fast))
+
+	send := func(sink *testSink, seq uint32) {
+		mux.Event(&MsgEvent{ConnId: sink.id, Seq: seq, Msg: channel2.NewMessage(ContentTypeData, nil)})
+	}
+	for seq := uint32(1); seq <= 5; seq++ {
+		send(slow, seq)
+	}
+	for seq := uint32(1); seq <= 5; seq++ {
+		send(fast, seq)
+	}
+
+	// the fast sink isn't held up behind the slow one
+	for seq := uint32(1); seq <= 5; seq++ {
+		select {
+		case received := <-fast.acceptC:
+			assert.Equal(seq, received)
+		case <-time.After(50 * time.Millisecond):
+			assert.FailNow("fast sink dispatch blocked by slow sink")
+		}
+	}
+
+	// and the slow sink still gets its messages in order
+	for seq := uint32(1); seq <= 5; seq++ {
+		select {
+		case received := <-slow.acceptC:
+			assert.Equal(seq, received)
+		case <-time.After(time.Second):
+			assert.FailNow("slow sink dispatch timed out")
+		}
+	}
+}
+
+func Test_MsgMuxEventsRacingClose(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		mux := NewMsgMux()
+		sink := &testSink{id: 1, acceptC: make(chan uint32, 1000)}
+
+		doneC := make(chan struct{})
+		for j := 0; j < 10; j++ {
+			go func() {
+				defer func() { doneC <- struct{}{} }()
+				for k := 0; k < 20; k++ {
+					mux.Event(&MsgEvent{ConnId: sink.id, Msg: channel2.NewMessage(ContentTypeData, nil)})
+					_ = mux.AddMsgSink(sink)
+					mux.RemoveMsgSinkById(sink.id)
+				}
+			}()
+		}
+
+		mux.Close()
+		for j := 0; j < 10; j++ {
+			select {
+			case <-doneC:
+			case <-time.After(time.Second):
+				require.FailNow(t, "event senders blocked after mux close")
+			}
+		}
+		require.True(t, mux.IsClosed())
+	}
+}
+
+type legacyTestSink struct {
+	id      uint32
+	closedC chan struct{}
+}
+
+func (sink *legacyTestSink) HandleMuxClose() error {
+	close(sink.closedC)
+	return nil
+}
+
+func (sink *legacyTestSink) Id() uint32 {
+	return sink.id
+}
+
+func (sink *legacyTestSink) Accept(*MsgEvent) {}
+
+type causeSink struct {
+	testSink
+	causeC chan error
+}
+
+func (sink *causeSink) HandleMuxClose(cause error) error {
+	sink.causeC <- cause
+	return nil
+}
+
+func Test_MsgMuxCloseCause(t *testing.T) {
+	assert := require.New(t)
+	mux := NewMsgMux()
+
+	sink := &causeSink{testSink: testSink{id: 1}, causeC: make(chan error, 1)}
+	legacy := &legacyTestSink{id: 2, closedC: make(chan struct{})}
+	assert.NoError(mux.AddMsgSink(sink))
+	assert.NoError(mux.AddMsgSink(AdaptLegacyMsgSink(legacy)))
+
+	mux.CloseWithCause(ErrRouterConnShutdown)
+	select {
+	case cause := <-sink.causeC:
+		assert.Equal(ErrRouterConnShutdown, cause)
+	case <-time.After(time.Second):
+		assert.FailNow("sink not closed")
+	}
+	select {
+	case <-legacy.closedC:
+	case <-time.After(time.Second):
+		assert.FailNow("legacy sink not closed")
+	}
+}
+
+type panicSink struct {
+	testSink
+}
+
+func (sink *panicSink) Accept(*MsgEvent) {
+	panic("sink failed")
+}
+
+func Test_MsgMuxSurvivesPanickingSink(t *testing.T) {
+	for _, workers := range []int{0, 2} {
+		assert := require.New(t)
+		mux := NewMsgMuxWithOptions(&MsgMuxOptions{WorkerPoolSize: workers})
+		assert.True(mux.LastEventAt().IsZero())
+
+		bad := &panicSink{testSink: testSink{id: 1}}
+		good := &testSink{id: 2, acceptC: make(chan uint32, 1)}
+		assert.NoError(mux.AddMsgSink(bad))
+		assert.NoError(mux.AddMsgSink(good))
+
+		mux.Event(&MsgEvent{ConnId: 1, Seq: 1, Msg: channel2.NewMessage(ContentTypeData, nil)})
+		mux.Event(&MsgEvent{ConnId: 2, Seq: 2, Msg: channel2.NewMessage(ContentTypeData, nil)})
+
+		select {
+		case seq := <-good.acceptC:
+			assert.Equal(uint32(2), seq)
+		case <-time.After(time.Second):
+			assert.FailNow("mux stopped dispatching after a sink panicked")
+		}
+		// with workers the panic may be on another goroutine, so it can land after the good dispatch
+		assert.Eventually(func() bool { return mux.GetEventPanics() == 1 }, time.Second, time.Millisecond)
+		assert.True(mux.Healthy())
+		assert.False(mux.LastEventAt().IsZero())
+
+		mux.Close()
+		assert.NoError(mux.running.WaitForState(false, time.Second, time.Millisecond))
+		assert.False(mux.Healthy())
+	}
+}
+
+func Test_MsgMuxUnknownSinkHandler(t *testing.T) {
+	assert := require.New(t)
+	mux := NewMsgMux()
+	defer mux.Close()
+
+	unknownC := make(chan *MsgEvent, 1)
+	mux.SetUnknownSinkHandler(func(event *MsgEvent) {
+		unknownC <- event
+	})
+
+	sink := &testSink{id: 1, acceptC: make(chan uint32, 1)}
+	assert.NoError(mux.AddMsgSink(sink))
+
+	mux.Event(&MsgEvent{ConnId: 1, Seq: 1, Msg: channel2.NewMessage(ContentTypeData, nil)})
+	mux.Event(&MsgEvent{ConnId: 7, Seq: 2, Msg: channel2.NewMessage(ContentTypeData, nil)})
+
+	select {
+	case event := <-unknownC:
+		assert.Equal(uint32(7), event.ConnId)
+		assert.Equal(uint32(2), event.Seq)
+	case <-time.After(time.Second):
+		assert.FailNow("unknown sink handler not called")
+	}
+	assert.Equal(uint32(1), <-sink.acceptC)
+	assert.Equal(uint64(1), mux.GetDispatchErrors())
+}
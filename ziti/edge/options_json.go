@@ -0,0 +1,321 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func (p Precedence) String() string {
+	switch p {
+	case PrecedenceDefault:
+		return "default"
+	case PrecedenceRequired:
+		return "required"
+	case PrecedenceFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+func (p Precedence) MarshalText() ([]byte, error) {
+	if p > PrecedenceFailed {
+		return nil, errors.Errorf("invalid precedence %v", byte(p))
+	}
+	return []byte(p.String()), nil
+}
+
+func (p *Precedence) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "default":
+		*p = PrecedenceDefault
+	case "required":
+		*p = PrecedenceRequired
+	case "failed":
+		*p = PrecedenceFailed
+	default:
+		return errors.Errorf("invalid precedence '%v', must be one of default, required or failed", string(text))
+	}
+	return nil
+}
+
+func (c Compression) MarshalText() ([]byte, error) {
+	if c > CompressionSnappy {
+		return nil, errors.Errorf("invalid compression %v", byte(c))
+	}
+	return []byte(c.String()), nil
+}
+
+func (c *Compression) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "none":
+		*c = CompressionNone
+	case "gzip":
+		*c = CompressionGzip
+	case "snappy":
+		*c = CompressionSnappy
+	default:
+		return errors.Errorf("invalid compression '%v', must be one of none, gzip or snappy", string(text))
+	}
+	return nil
+}
+
+// jsonDuration reads and writes durations as strings such as "5s", in the format used by time.ParseDuration
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *jsonDuration) UnmarshalText(text []byte) error {
+	duration, err := time.ParseDuration(string(text))
+	if err != nil {
+		return errors.Wrapf(err, "invalid duration '%v'", string(text))
+	}
+	*d = jsonDuration(duration)
+	return nil
+}
+
+type acceptRateLimitJSON struct {
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+	Reject bool    `json:"reject,omitempty"`
+}
+
+type acceptBackpressureJSON struct {
+	HighWater int `json:"highWater,omitempty"`
+	LowWater  int `json:"lowWater,omitempty"`
+}
+
+type terminatorJSON struct {
+	Identity   string     `json:"identity,omitempty"`
+	InstanceId string     `json:"instanceId,omitempty"`
+	Cost       uint16     `json:"cost,omitempty"`
+	Precedence Precedence `json:"precedence"`
+}
+
+// listenOptionsJSON is the JSON form of ListenOptions. The func-typed fields, ProtocolSelector, RouterSelector,
+// PriorityFunc, AdmitDial, ConnectHandler and the AcceptBackpressure callbacks, can't be represented, so they're
+// left out
+type listenOptionsJSON struct {
+	Cost                  uint16                  `json:"cost"`
+	Precedence            Precedence              `json:"precedence"`
+	ConnectTimeout        jsonDuration            `json:"connectTimeout"`
+	Compression           Compression             `json:"compression"`
+	AsyncWrites           bool                    `json:"asyncWrites"`
+	MaxUnackedBytes       int                     `json:"maxUnackedBytes,omitempty"`
+	WriteCoalesceWindow   jsonDuration            `json:"writeCoalesceWindow,omitempty"`
+	Linger                jsonDuration            `json:"linger,omitempty"`
+	RecvBufferSize        int                     `json:"recvBufferSize,omitempty"`
+	MaxMessageSize        int                     `json:"maxMessageSize,omitempty"`
+	MaxHeaders            int                     `json:"maxHeaders,omitempty"`
+	ReadAhead             bool                    `json:"readAhead,omitempty"`
+	StrictOrdering        bool                    `json:"strictOrdering,omitempty"`
+	DrainGracePeriod      jsonDuration            `json:"drainGracePeriod,omitempty"`
+	MaxConnections        int                     `json:"maxConnections"`
+	ResumeBindWindow      jsonDuration            `json:"resumeBindWindow,omitempty"`
+	AcceptRateLimit       *acceptRateLimitJSON    `json:"acceptRateLimit,omitempty"`
+	AcceptBackpressure    *acceptBackpressureJSON `json:"acceptBackpressure,omitempty"`
+	Identity              string                  `json:"identity,omitempty"`
+	IdentitySecret        string                  `json:"identitySecret,omitempty"`
+	TerminatorInstanceId  string                  `json:"terminatorInstanceId,omitempty"`
+	BindUsingEdgeIdentity bool                    `json:"bindUsingEdgeIdentity,omitempty"`
+}
+
+// MarshalJSON writes durations as strings such as "5s" and precedence and compression by name. The func-typed
+// fields aren't written
+func (options *ListenOptions) MarshalJSON() ([]byte, error) {
+	result := &listenOptionsJSON{
+		Cost:                  options.Cost,
+		Precedence:            options.Precedence,
+		ConnectTimeout:        jsonDuration(options.ConnectTimeout),
+		Compression:           options.Compression,
+		AsyncWrites:           options.AsyncWrites,
+		MaxUnackedBytes:       options.MaxUnackedBytes,
+		WriteCoalesceWindow:   jsonDuration(options.WriteCoalesceWindow),
+		Linger:                jsonDuration(options.Linger),
+		RecvBufferSize:        options.RecvBufferSize,
+		MaxMessageSize:        options.MaxMessageSize,
+		MaxHeaders:            options.MaxHeaders,
+		ReadAhead:             options.ReadAhead,
+		StrictOrdering:        options.StrictOrdering,
+		DrainGracePeriod:      jsonDuration(options.DrainGracePeriod),
+		MaxConnections:        options.MaxConnections,
+		ResumeBindWindow:      jsonDuration(options.ResumeBindWindow),
+		Identity:              options.Identity,
+		IdentitySecret:        options.IdentitySecret,
+		TerminatorInstanceId:  options.TerminatorInstanceId,
+		BindUsingEdgeIdentity: options.BindUsingEdgeIdentity,
+	}
+	if limit := options.AcceptRateLimit; limit != nil {
+		result.AcceptRateLimit = &acceptRateLimitJSON{Rate: limit.Rate, Burst: limit.Burst, Reject: limit.Reject}
+	}
+	if pressure := options.AcceptBackpressure; pressure != nil {
+		result.AcceptBackpressure = &acceptBackpressureJSON{HighWater: pressure.HighWater, LowWater: pressure.LowWater}
+	}
+	return json.Marshal(result)
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON. Fields missing from the JSON keep their current values, so
+// options can be read over DefaultListenOptions. AcceptBackpressure keeps the callbacks it already has
+func (options *ListenOptions) UnmarshalJSON(data []byte) error {
+	current, err := options.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	result := &listenOptionsJSON{}
+	if err := json.Unmarshal(current, result); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return err
+	}
+
+	options.Cost = result.Cost
+	options.Precedence = result.Precedence
+	options.ConnectTimeout = time.Duration(result.ConnectTimeout)
+	options.Compression = result.Compression
+	options.AsyncWrites = result.AsyncWrites
+	options.MaxUnackedBytes = result.MaxUnackedBytes
+	options.WriteCoalesceWindow = time.Duration(result.WriteCoalesceWindow)
+	options.Linger = time.Duration(result.Linger)
+	options.RecvBufferSize = result.RecvBufferSize
+	options.MaxMessageSize = result.MaxMessageSize
+	options.MaxHeaders = result.MaxHeaders
+	options.ReadAhead = result.ReadAhead
+	options.StrictOrdering = result.StrictOrdering
+	options.DrainGracePeriod = time.Duration(result.DrainGracePeriod)
+	options.MaxConnections = result.MaxConnections
+	options.ResumeBindWindow = time.Duration(result.ResumeBindWindow)
+	options.Identity = result.Identity
+	options.IdentitySecret = result.IdentitySecret
+	options.TerminatorInstanceId = result.TerminatorInstanceId
+	options.BindUsingEdgeIdentity = result.BindUsingEdgeIdentity
+	options.AcceptRateLimit = nil
+	if limit := result.AcceptRateLimit; limit != nil {
+		options.AcceptRateLimit = NewAcceptRateLimit(limit.Rate, limit.Burst)
+		options.AcceptRateLimit.Reject = limit.Reject
+	}
+	currentPressure := options.AcceptBackpressure
+	options.AcceptBackpressure = nil
+	if pressure := result.AcceptBackpressure; pressure != nil {
+		options.AcceptBackpressure = &AcceptBackpressure{HighWater: pressure.HighWater, LowWater: pressure.LowWater}
+		if currentPressure != nil {
+			options.AcceptBackpressure.OnBackpressure = currentPressure.OnBackpressure
+			options.AcceptBackpressure.OnCleared = currentPressure.OnCleared
+		}
+	}
+	return nil
+}
+
+// dialOptionsJSON is the JSON form of DialOptions. TerminatorSelector can't be represented, so it's left out
+type dialOptionsJSON struct {
+	ConnectTimeout      jsonDuration     `json:"connectTimeout"`
+	PerAttemptTimeout   jsonDuration     `json:"perAttemptTimeout,omitempty"`
+	ReplyTimeout        jsonDuration     `json:"replyTimeout,omitempty"`
+	Compression         Compression      `json:"compression"`
+	AsyncWrites         bool             `json:"asyncWrites"`
+	MaxUnackedBytes     int              `json:"maxUnackedBytes,omitempty"`
+	WriteCoalesceWindow jsonDuration     `json:"writeCoalesceWindow,omitempty"`
+	Linger              jsonDuration     `json:"linger,omitempty"`
+	RecvBufferSize      int              `json:"recvBufferSize,omitempty"`
+	MaxMessageSize      int              `json:"maxMessageSize,omitempty"`
+	MaxHeaders          int              `json:"maxHeaders,omitempty"`
+	ReadAhead           bool             `json:"readAhead,omitempty"`
+	StrictOrdering      bool             `json:"strictOrdering,omitempty"`
+	Protocols           []string         `json:"protocols,omitempty"`
+	MaxConcurrentDials  int              `json:"maxConcurrentDials,omitempty"`
+	Migratable          bool             `json:"migratable,omitempty"`
+	Identity            string           `json:"identity,omitempty"`
+	ClientHint          string           `json:"clientHint,omitempty"`
+	AppData             []byte           `json:"appData,omitempty"`
+	Terminators         []terminatorJSON `json:"terminators,omitempty"`
+}
+
+// MarshalJSON writes durations as strings such as "5s", compression and precedence by name, and AppData as base64.
+// TerminatorSelector isn't written
+func (options *DialOptions) MarshalJSON() ([]byte, error) {
+	result := &dialOptionsJSON{
+		ConnectTimeout:      jsonDuration(options.ConnectTimeout),
+		PerAttemptTimeout:   jsonDuration(options.PerAttemptTimeout),
+		ReplyTimeout:        jsonDuration(options.ReplyTimeout),
+		Compression:         options.Compression,
+		AsyncWrites:         options.AsyncWrites,
+		MaxUnackedBytes:     options.MaxUnackedBytes,
+		WriteCoalesceWindow: jsonDuration(options.WriteCoalesceWindow),
+		Linger:              jsonDuration(options.Linger),
+		RecvBufferSize:      options.RecvBufferSize,
+		MaxMessageSize:      options.MaxMessageSize,
+		MaxHeaders:          options.MaxHeaders,
+		ReadAhead:           options.ReadAhead,
+		StrictOrdering:      options.StrictOrdering,
+		Protocols:           options.Protocols,
+		MaxConcurrentDials:  options.MaxConcurrentDials,
+		Migratable:          options.Migratable,
+		Identity:            options.Identity,
+		ClientHint:          options.ClientHint,
+		AppData:             options.AppData,
+	}
+	for _, terminator := range options.Terminators {
+		result.Terminators = append(result.Terminators, terminatorJSON(terminator))
+	}
+	return json.Marshal(result)
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON. Fields missing from the JSON keep their current values, so
+// options can be read over DefaultDialOptions
+func (options *DialOptions) UnmarshalJSON(data []byte) error {
+	current, err := options.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	result := &dialOptionsJSON{}
+	if err := json.Unmarshal(current, result); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, result); err != nil {
+		return err
+	}
+
+	options.ConnectTimeout = time.Duration(result.ConnectTimeout)
+	options.PerAttemptTimeout = time.Duration(result.PerAttemptTimeout)
+	options.ReplyTimeout = time.Duration(result.ReplyTimeout)
+	options.Compression = result.Compression
+	options.AsyncWrites = result.AsyncWrites
+	options.MaxUnackedBytes = result.MaxUnackedBytes
+	options.WriteCoalesceWindow = time.Duration(result.WriteCoalesceWindow)
+	options.Linger = time.Duration(result.Linger)
+	options.RecvBufferSize = result.RecvBufferSize
+	options.MaxMessageSize = result.MaxMessageSize
+	options.MaxHeaders = result.MaxHeaders
+	options.ReadAhead = result.ReadAhead
+	options.StrictOrdering = result.StrictOrdering
+	options.Protocols = result.Protocols
+	options.MaxConcurrentDials = result.MaxConcurrentDials
+	options.Migratable = result.Migratable
+	options.Identity = result.Identity
+	options.ClientHint = result.ClientHint
+	options.AppData = result.AppData
+	options.Terminators = nil
+	for _, terminator := range result.Terminators {
+		options.Terminators = append(options.Terminators, Terminator(terminator))
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ListenOptionsJSONRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	options := DefaultListenOptions()
+	options.Cost = 100
+	options.Precedence = PrecedenceRequired
+	options.Compression = CompressionSnappy
+	options.DrainGracePeriod = 30 * time.Second
+	options.AcceptRateLimit = &AcceptRateLimit{Rate: 10, Burst: 5, Reject: true}
+
+	data, err := json.Marshal(options)
+	assert.NoError(err)
+	assert.Contains(string(data), `"precedence":"required"`)
+	assert.Contains(string(data), `"connectTimeout":"5s"`)
+	assert.Contains(string(data), `"drainGracePeriod":"30s"`)
+
+	result := &ListenOptions{}
+	assert.NoError(json.Unmarshal(data, result))
+	assert.Equal(options.Cost, result.Cost)
+	assert.Equal(options.Precedence, result.Precedence)
+	assert.Equal(options.ConnectTimeout, result.ConnectTimeout)
+	assert.Equal(options.Compression, result.Compression)
+	assert.Equal(options.DrainGracePeriod, result.DrainGracePeriod)
+	assert.Equal(options.MaxConnections, result.MaxConnections)
+	assert.Equal(10.0, result.AcceptRateLimit.Rate)
+	assert.Equal(5, result.AcceptRateLimit.Burst)
+	assert.True(result.AcceptRateLimit.Reject)
+
+	// missing fields keep their defaults
+	result = DefaultListenOptions()
+	assert.NoError(json.Unmarshal([]byte(`{"precedence": "failed", "connectTimeout": "1m30s"}`), result))
+	assert.Equal(PrecedenceFailed, result.Precedence)
+	assert.Equal(90*time.Second, result.ConnectTimeout)
+	assert.Equal(3, result.MaxConnections)
+
+	assert.Error(json.Unmarshal([]byte(`{"precedence": "sometimes"}`), result))
+	assert.Error(json.Unmarshal([]byte(`{"connectTimeout": "soon"}`), result))
+	assert.Error(json.Unmarshal([]byte(`{"compression": "zip"}`), result))
+}
+
+func Test_DialOptionsJSONRoundTrip(t *testing.T) {
+	assert := require.New(t)
+
+	options := DefaultDialOptions()
+	options.PerAttemptTimeout = 1500 * time.Millisecond
+	options.ReplyTimeout = 2 * time.Second
+	options.Compression = CompressionGzip
+	options.Protocols = []string{"h2", "http/1.1"}
+
+	data, err := json.Marshal(options)
+	assert.NoError(err)
+	assert.Contains(string(data), `"perAttemptTimeout":"1.5s"`)
+	assert.Contains(string(data), `"replyTimeout":"2s"`)
+	assert.Contains(string(data), `"compression":"gzip"`)
+
+	result := &DialOptions{}
+	assert.NoError(json.Unmarshal(data, result))
+	assert.Equal(options, result)
+}
+
+// requireSerializableFieldsSet fails for any field of options left at its zero value, other than the func-typed ones,
+// so that a field added to the options must be added to the round trip tests, and with them to the JSON form
+func requireSerializableFieldsSet(t *testing.T, options interface{}) {
+	value := reflect.ValueOf(options).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); field.Kind() != reflect.Func {
+			require.False(t, field.IsZero(), "%v isn't set", value.Type().Field(i).Name)
+		}
+	}
+}
+
+// clearFuncFields zeroes the func-typed fields of options, which aren't serialized
+func clearFuncFields(options interface{}) {
+	value := reflect.ValueOf(options).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		if field := value.Field(i); field.Kind() == reflect.Func {
+			field.Set(reflect.Zero(field.Type()))
+		}
+	}
+}
+
+func Test_ListenOptionsJSONAllFields(t *testing.T) {
+	assert := require.New(t)
+
+	onBackpressure := func(queueDepth, capacity int) {}
+	options := &ListenOptions{
+		Cost:                  100,
+		Precedence:            PrecedenceRequired,
+		ConnectTimeout:        7 * time.Second,
+		Compression:           CompressionSnappy,
+		AsyncWrites:           true,
+		MaxUnackedBytes:       1024,
+		WriteCoalesceWindow:   2 * time.Millisecond,
+		Linger:                3 * time.Second,
+		RecvBufferSize:        4096,
+		MaxMessageSize:        8192,
+		MaxHeaders:            16,
+		ReadAhead:             true,
+		StrictOrdering:        true,
+		ProtocolSelector:      func(offered []string) string { return "" },
+		DrainGracePeriod:      30 * time.Second,
+		MaxConnections:        5,
+		ResumeBindWindow:      10 * time.Second,
+		RouterSelector:        func(available []RouterInfo) []RouterInfo { return available },
+		AcceptRateLimit:       &AcceptRateLimit{Rate: 10, Burst: 5, Reject: true},
+		AcceptBackpressure:    &AcceptBackpressure{HighWater: 8, LowWater: 2, OnBackpressure: onBackpressure},
+		Identity:              "host-1",
+		IdentitySecret:        "secret",
+		TerminatorInstanceId:  "pod-1",
+		BindUsingEdgeIdentity: true,
+		PriorityFunc:          func(info ConnInfo) int { return 0 },
+		AdmitDial:             func(info ConnInfo) error { return nil },
+		ConnectHandler:        func(req ConnectRequest) ConnectDecision { return ConnectDecision{} },
+	}
+	requireSerializableFieldsSet(t, options)
+
+	data, err := json.Marshal(options)
+	assert.NoError(err)
+
+	result := &ListenOptions{}
+	assert.NoError(json.Unmarshal(data, result))
+
+	expected := *options
+	clearFuncFields(&expected)
+	expected.AcceptBackpressure = &AcceptBackpressure{HighWater: 8, LowWater: 2}
+	assert.Equal(&expected, result)
+
+	// reading over options with backpressure callbacks keeps them
+	result = &ListenOptions{AcceptBackpressure: NewAcceptBackpressure(onBackpressure, nil)}
+	assert.NoError(json.Unmarshal(data, result))
+	assert.Equal(8, result.AcceptBackpressure.HighWater)
+	assert.NotNil(result.AcceptBackpressure.OnBackpressure)
+}
+
+func Test_DialOptionsJSONAllFields(t *testing.T) {
+	assert := require.New(t)
+
+	options := &DialOptions{
+		ConnectTimeout:      7 * time.Second,
+		PerAttemptTimeout:   time.Second,
+		ReplyTimeout:        2 * time.Second,
+		Compression:         CompressionGzip,
+		AsyncWrites:         true,
+		MaxUnackedBytes:     1024,
+		WriteCoalesceWindow: 2 * time.Millisecond,
+		Linger:              3 * time.Second,
+		RecvBufferSize:      4096,
+		MaxMessageSize:      8192,
+		MaxHeaders:          16,
+		ReadAhead:           true,
+		StrictOrdering:      true,
+		Protocols:           []string{"h2"},
+		MaxConcurrentDials:  4,
+		Migratable:          true,
+		Identity:            "client-1",
+		ClientHint:          "tenant-a",
+		AppData:             []byte{0, 1, 2},
+		Terminators:         []Terminator{{Identity: "host-1", InstanceId: "pod-1", Cost: 10, Precedence: PrecedenceFailed}},
+		TerminatorSelector:  LowestCostTerminatorSelector(),
+	}
+	requireSerializableFieldsSet(t, options)
+
+	data, err := json.Marshal(options)
+	assert.NoError(err)
+	assert.Contains(string(data), `"appData":"AAEC"`)
+
+	result := &DialOptions{}
+	assert.NoError(json.Unmarshal(data, result))
+
+	expected := *options
+	clearFuncFields(&expected)
+	assert.Equal(&expected, result)
+}
+
+func Test_PrecedenceText(t *testing.T) {
+	assert := require.New(t)
+
+	for _, precedence := range []Precedence{PrecedenceDefault, PrecedenceRequired, PrecedenceFailed} {
+		text, err := precedence.MarshalText()
+		assert.NoError(err)
+		var result Precedence
+		assert.NoError(result.UnmarshalText(text))
+		assert.Equal(precedence, result)
+	}
+
+	_, err := Precedence(7).MarshalText()
+	assert.Error(err)
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"io"
+	"time"
+)
+
+// Progress is reported at most this often by WriteToWithProgress and ReadFromWithProgress, unless
+// ProgressReportBytes have been transferred since the last report
+const (
+	ProgressReportInterval = 250 * time.Millisecond
+	ProgressReportBytes    = 1024 * 1024
+)
+
+const progressChunkSize = 64 * 1024
+
+// WriteToWithProgress copies data from conn to dst like conn.WriteTo, calling progress with the total bytes copied
+// so far every ProgressReportBytes or ProgressReportInterval, whichever comes first, and once more at the end.
+// progress is called on the copying goroutine, so it holds up the copy and mustn't block
+func WriteToWithProgress(conn ServiceConn, dst io.Writer, progress func(total int64)) (int64, error) {
+	counter := newProgressCounter(progress)
+	n, err := conn.WriteTo(&progressWriter{dst: dst, counter: counter})
+	counter.finish()
+	return n, err
+}
+
+// ReadFromWithProgress copies data from src to conn until src returns EOF, reporting progress as for
+// WriteToWithProgress. Data is written in chunks of up to progressChunkSize, each of which is one data message
+func ReadFromWithProgress(conn ServiceConn, src io.Reader, progress func(total int64)) (int64, error) {
+	counter := newProgressCounter(progress)
+	// hide any WriterTo on src, which would hand the whole payload over in one write
+	reader := struct{ io.Reader }{src}
+	n, err := io.CopyBuffer(&progressWriter{dst: conn, counter: counter}, reader, make([]byte, progressChunkSize))
+	counter.finish()
+	return n, err
+}
+
+type progressCounter struct {
+	progress     func(total int64)
+	total        int64
+	lastReported int64
+	lastReport   time.Time
+}
+
+func newProgressCounter(progress func(total int64)) *progressCounter {
+	return &progressCounter{progress: progress, lastReport: time.Now()}
+}
+
+func (counter *progressCounter) add(n int) {
+	counter.total += int64(n)
+	if counter.total-counter.lastReported >= ProgressReportBytes || time.Since(counter.lastReport) >= ProgressReportInterval {
+		counter.report()
+	}
+}
+
+func (counter *progressCounter) report() {
+	counter.lastReported = counter.total
+	counter.lastReport = time.Now()
+	counter.progress(counter.total)
+}
+
+// finish reports anything copied since the last report
+func (counter *progressCounter) finish() {
+	if counter.total != counter.lastReported {
+		counter.report()
+	}
+}
+
+type progressWriter struct {
+	dst     io.Writer
+	counter *progressCounter
+}
+
+func (writer *progressWriter) Write(p []byte) (int, error) {
+	n, err := writer.dst.Write(p)
+	writer.counter.add(n)
+	return n, err
+}
@@ -0,0 +1,85 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"sync"
+	"time"
+)
+
+// QualityStats are estimates of how the path a conn takes is performing, for applications which adapt to it.
+//
+// The edge protocol has no end to end acks, so the estimates come from the channel's send acknowledgements: the
+// time from a data message being handed to the router channel until the channel reports it written. That covers
+// queueing behind other traffic on the router connection and the local transmit, so it rises when the path to the
+// router backs up, but it isn't a round trip to the peer. Samples are smoothed as TCP smooths RTT (RFC 6298), with
+// gains of 1/8 for SmoothedRTT and 1/4 for Jitter. Writes made with WriteNoSync aren't sampled
+type QualityStats struct {
+	// SmoothedRTT is the smoothed send acknowledgement time. It's zero until the first sample
+	SmoothedRTT time.Duration `json:"smoothedRtt"`
+	// Jitter is the smoothed mean deviation of the samples from SmoothedRTT
+	Jitter time.Duration `json:"jitter"`
+	// LastRTT is the most recent sample
+	LastRTT time.Duration `json:"lastRtt"`
+	// Samples is the number of writes sampled
+	Samples uint64 `json:"samples"`
+	// SendFailures counts data messages the channel failed to send, including timeouts, as a loss indicator.
+	// Writes cancelled by the conn closing aren't counted
+	SendFailures uint64 `json:"sendFailures"`
+}
+
+type qualityEstimator struct {
+	lock  sync.Mutex
+	stats QualityStats
+}
+
+func newQualityEstimator() *qualityEstimator {
+	return &qualityEstimator{}
+}
+
+// record adds the outcome of a send which took elapsed to complete
+func (q *qualityEstimator) record(elapsed time.Duration, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if err != nil {
+		if err != ErrConnClosed {
+			q.stats.SendFailures++
+		}
+		return
+	}
+
+	if q.stats.Samples == 0 {
+		q.stats.SmoothedRTT = elapsed
+		q.stats.Jitter = elapsed / 2
+	} else {
+		deviation := q.stats.SmoothedRTT - elapsed
+		if deviation < 0 {
+			deviation = -deviation
+		}
+		q.stats.Jitter = (3*q.stats.Jitter + deviation) / 4
+		q.stats.SmoothedRTT = (7*q.stats.SmoothedRTT + elapsed) / 8
+	}
+	q.stats.LastRTT = elapsed
+	q.stats.Samples++
+}
+
+func (q *qualityEstimator) get() QualityStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.stats
+}
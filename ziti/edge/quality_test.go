@@ -0,0 +1,90 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_qualityEstimatorSmoothing(t *testing.T) {
+	assert := require.New(t)
+	q := newQualityEstimator()
+	assert.Equal(QualityStats{}, q.get())
+
+	// the first sample seeds the estimates
+	q.record(80*time.Millisecond, nil)
+	assert.Equal(80*time.Millisecond, q.get().SmoothedRTT)
+	assert.Equal(40*time.Millisecond, q.get().Jitter)
+
+	// srtt = 7/8 * 80 + 1/8 * 160 = 90, jitter = 3/4 * 40 + 1/4 * |80 - 160| = 50
+	q.record(160*time.Millisecond, nil)
+	assert.Equal(90*time.Millisecond, q.get().SmoothedRTT)
+	assert.Equal(50*time.Millisecond, q.get().Jitter)
+
+	// srtt = 7/8 * 90 + 1/8 * 10 = 80, jitter = 3/4 * 50 + 1/4 * |90 - 10| = 57.5
+	q.record(10*time.Millisecond, nil)
+	assert.Equal(80*time.Millisecond, q.get().SmoothedRTT)
+	assert.Equal(57500*time.Microsecond, q.get().Jitter)
+	assert.Equal(10*time.Millisecond, q.get().LastRTT)
+
+	// failures don't move the estimates, and closing isn't a failure
+	q.record(time.Second, errors.New("timed out"))
+	q.record(time.Second, ErrConnClosed)
+	stats := q.get()
+	assert.Equal(uint64(3), stats.Samples)
+	assert.Equal(uint64(1), stats.SendFailures)
+	assert.Equal(80*time.Millisecond, stats.SmoothedRTT)
+}
+
+func Test_QualityStatsFromSendAcks(t *testing.T) {
+	assert := require.New(t)
+	ch := &mockChannel{holdSyncs: true}
+	msgCh := NewEdgeMsgChannel(ch, 1)
+
+	for _, delay := range []time.Duration{20 * time.Millisecond, 60 * time.Millisecond} {
+		errC := make(chan error, 1)
+		go func() {
+			_, err := msgCh.Write([]byte("data"))
+			errC <- err
+		}()
+		for ch.sentCount() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(delay)
+		ch.releaseSync(nil)
+		assert.NoError(<-errC)
+		ch.lock.Lock()
+		ch.sent = nil
+		ch.lock.Unlock()
+	}
+
+	stats := msgCh.QualityStats()
+	assert.Equal(uint64(2), stats.Samples)
+	assert.True(stats.LastRTT >= 60*time.Millisecond, "last rtt %v", stats.LastRTT)
+	// 7/8 of the first sample plus 1/8 of the second
+	assert.True(stats.SmoothedRTT >= 25*time.Millisecond && stats.SmoothedRTT < stats.LastRTT, "srtt %v", stats.SmoothedRTT)
+	assert.Equal(uint64(0), stats.SendFailures)
+
+	go ch.releaseSyncWhenSent(errors.New("send failed"))
+	_, err := msgCh.Write([]byte("data"))
+	assert.Error(err)
+	assert.Equal(uint64(1), msgCh.QualityStats().SendFailures)
+}
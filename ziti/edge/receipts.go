@@ -0,0 +1,109 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReceiptsUnsupported is returned by Receipt.Wait when the peer didn't advertise CapabilityReceipts, so the
+// write went out without asking for an ack
+var ErrReceiptsUnsupported = errors.New("peer does not support delivery receipts")
+
+// Receipt is returned by WriteWithReceipt, and resolves once the peer acknowledges the message
+type Receipt interface {
+	// Wait blocks until the peer acknowledges the message, the conn closes or ctx is done. It returns nil once the
+	// peer has read the message
+	Wait(ctx context.Context) error
+}
+
+type receipt struct {
+	seq     uint32
+	doneC   chan struct{}
+	closedC chan struct{}
+}
+
+func newReceipt(closedC chan struct{}) *receipt {
+	return &receipt{
+		doneC:   make(chan struct{}),
+		closedC: closedC,
+	}
+}
+
+func (r *receipt) Wait(ctx context.Context) error {
+	select {
+	case <-r.doneC:
+		return nil
+	default:
+	}
+
+	select {
+	case <-r.doneC:
+		return nil
+	case <-r.closedC:
+		return ErrConnClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// failedReceipt is a Receipt which was never going to be acknowledged
+type failedReceipt struct {
+	err error
+}
+
+// FailedReceipt returns a Receipt whose Wait returns err straight away
+func FailedReceipt(err error) Receipt {
+	return failedReceipt{err: err}
+}
+
+func (r failedReceipt) Wait(context.Context) error {
+	return r.err
+}
+
+// receiptTracker holds the receipts waiting for an ack from the peer, keyed by the sequence number of their message
+type receiptTracker struct {
+	lock    sync.Mutex
+	pending map[uint32]*receipt
+}
+
+func (tracker *receiptTracker) add(r *receipt) {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	if tracker.pending == nil {
+		tracker.pending = map[uint32]*receipt{}
+	}
+	tracker.pending[r.seq] = r
+}
+
+func (tracker *receiptTracker) remove(seq uint32) *receipt {
+	tracker.lock.Lock()
+	defer tracker.lock.Unlock()
+	r := tracker.pending[seq]
+	delete(tracker.pending, seq)
+	return r
+}
+
+// ack resolves the receipt for the message with the given sequence number, if there is one
+func (tracker *receiptTracker) ack(seq uint32) {
+	if r := tracker.remove(seq); r != nil {
+		close(r.doneC)
+	}
+}
@@ -0,0 +1,66 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// DialRejectedError is returned by Connect when the hosting side rejected the dial with RejectWith, carrying the
+// application's code and message, such as a quota being exceeded or the host being in maintenance
+type DialRejectedError struct {
+	code    int
+	message string
+}
+
+// RejectWith returns an error for ListenOptions.AdmitDial which rejects the dial, passing code and message back to
+// the dialer as a *DialRejectedError
+func RejectWith(code int, message string) error {
+	return &DialRejectedError{code: code, message: message}
+}
+
+func (e *DialRejectedError) Code() int {
+	return e.code
+}
+
+func (e *DialRejectedError) Message() string {
+	return e.message
+}
+
+// Error is also how the rejection travels to the dialer, as the reason in the dial failure, so that routers which
+// only pass the reason on still deliver it
+func (e *DialRejectedError) Error() string {
+	return fmt.Sprintf("dial rejected by host (code %d): %s", e.code, e.message)
+}
+
+var dialRejectedPattern = regexp.MustCompile(`dial rejected by host \(code (-?\d+)\): (?s)(.*)$`)
+
+// ParseDialRejectedError finds a rejection made with RejectWith in the reason a dial failed with, which the
+// router may have wrapped in text of its own
+func ParseDialRejectedError(reason string) (*DialRejectedError, bool) {
+	match := dialRejectedPattern.FindStringSubmatch(reason)
+	if match == nil {
+		return nil, false
+	}
+	code, err := strconv.Atoi(match[1])
+	if err != nil {
+		return nil, false
+	}
+	return &DialRejectedError{code: code, message: match[2]}, true
+}
@@ -0,0 +1,42 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseDialRejectedError(t *testing.T) {
+	assert := require.New(t)
+
+	err := RejectWith(503, "down for maintenance: back at 10:00")
+	parsed, ok := ParseDialRejectedError(err.Error())
+	assert.True(ok)
+	assert.Equal(503, parsed.Code())
+	assert.Equal("down for maintenance: back at 10:00", parsed.Message())
+
+	// routers may wrap the reason the host gave
+	parsed, ok = ParseDialRejectedError("failed to dial: " + RejectWith(-1, "").Error())
+	assert.True(ok)
+	assert.Equal(-1, parsed.Code())
+	assert.Equal("", parsed.Message())
+
+	_, ok = ParseDialRejectedError("service not found")
+	assert.False(ok)
+}
@@ -0,0 +1,75 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import "sync"
+
+// serviceDefaults holds the options registered with RegisterServiceDefaults, by service name
+var serviceDefaults = &serviceDefaultsRegistry{
+	dial:   map[string]*DialOptions{},
+	listen: map[string]*ListenOptions{},
+}
+
+type serviceDefaultsRegistry struct {
+	lock   sync.RWMutex
+	dial   map[string]*DialOptions
+	listen map[string]*ListenOptions
+}
+
+// RegisterServiceDefaults sets the options used for the named service when dialing or listening with nil
+// options, so that a process using many services can tune each in one place. Options passed explicitly are used
+// as they are. The options are copied with Clone, so an AcceptRateLimit or AcceptBackpressure within them is
+// still shared by every listener they're used for. A nil dial or listen clears the defaults of that kind, so the SDK defaults apply again
+func RegisterServiceDefaults(serviceName string, dial *DialOptions, listen *ListenOptions) {
+	serviceDefaults.lock.Lock()
+	defer serviceDefaults.lock.Unlock()
+
+	if dial != nil {
+		serviceDefaults.dial[serviceName] = dial.Clone()
+	} else {
+		delete(serviceDefaults.dial, serviceName)
+	}
+	if listen != nil {
+		serviceDefaults.listen[serviceName] = listen.Clone()
+	} else {
+		delete(serviceDefaults.listen, serviceName)
+	}
+}
+
+// DialOptionsFor returns a copy of the dial options registered for the service, or DefaultDialOptions if there
+// aren't any
+func DialOptionsFor(serviceName string) *DialOptions {
+	serviceDefaults.lock.RLock()
+	defer serviceDefaults.lock.RUnlock()
+
+	if options, found := serviceDefaults.dial[serviceName]; found {
+		return options.Clone()
+	}
+	return DefaultDialOptions()
+}
+
+// ListenOptionsFor returns a copy of the listen options registered for the service, or DefaultListenOptions if
+// there aren't any
+func ListenOptionsFor(serviceName string) *ListenOptions {
+	serviceDefaults.lock.RLock()
+	defer serviceDefaults.lock.RUnlock()
+
+	if options, found := serviceDefaults.listen[serviceName]; found {
+		return options.Clone()
+	}
+	return DefaultListenOptions()
+}
@@ -0,0 +1,100 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"math/rand"
+	"sync/atomic"
+)
+
+// Terminator describes one of the hosts of a service, as bound with ListenOptions.Identity, Cost and Precedence.
+// If InstanceId is set, a dial routed to the terminator also asks for the host bound with that
+// ListenOptions.TerminatorInstanceId
+type Terminator struct {
+	Identity   string
+	InstanceId string
+	Cost       uint16
+	Precedence Precedence
+}
+
+// TerminatorSelector picks the terminator a dial should be routed to from the candidates in
+// DialOptions.Terminators. Returning false leaves the choice to the router
+type TerminatorSelector func(terminators []Terminator) (Terminator, bool)
+
+// RandomTerminatorSelector picks a terminator at random
+func RandomTerminatorSelector() TerminatorSelector {
+	return func(terminators []Terminator) (Terminator, bool) {
+		if len(terminators) == 0 {
+			return Terminator{}, false
+		}
+		return terminators[rand.Intn(len(terminators))], true
+	}
+}
+
+// LowestCostTerminatorSelector picks the terminator with the best precedence, and of those the lowest cost. Ties go
+// to the first candidate
+func LowestCostTerminatorSelector() TerminatorSelector {
+	return func(terminators []Terminator) (Terminator, bool) {
+		if len(terminators) == 0 {
+			return Terminator{}, false
+		}
+		best := terminators[0]
+		for _, terminator := range terminators[1:] {
+			if precedenceRank(terminator.Precedence) < precedenceRank(best.Precedence) ||
+				(terminator.Precedence == best.Precedence && terminator.Cost < best.Cost) {
+				best = terminator
+			}
+		}
+		return best, true
+	}
+}
+
+// RoundRobinTerminatorSelector cycles through the terminators in order. The position is shared by every dial
+// using the returned selector, so create one per service
+func RoundRobinTerminatorSelector() TerminatorSelector {
+	var next uint64
+	return func(terminators []Terminator) (Terminator, bool) {
+		if len(terminators) == 0 {
+			return Terminator{}, false
+		}
+		i := atomic.AddUint64(&next, 1) - 1
+		return terminators[i%uint64(len(terminators))], true
+	}
+}
+
+// HasPrecedenceConflict reports whether the terminators don't all have the same precedence. Dials only go to the
+// terminators with the best precedence, so with a conflict the others get no traffic while those are up
+func HasPrecedenceConflict(terminators []TerminatorState) bool {
+	for _, terminator := range terminators {
+		if terminator.Precedence != terminators[0].Precedence {
+			return true
+		}
+	}
+	return false
+}
+
+// precedenceRank orders precedences from most to least preferred
+func precedenceRank(precedence Precedence) int {
+	switch precedence {
+	case PrecedenceRequired:
+		return 0
+	case PrecedenceFailed:
+		return 2
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,91 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testTerminators = []Terminator{
+	{Identity: "a", Cost: 30},
+	{Identity: "b", Cost: 10},
+	{Identity: "c", Cost: 20},
+}
+
+func selectMany(selector TerminatorSelector, terminators []Terminator, count int) map[string]int {
+	picks := map[string]int{}
+	for i := 0; i < count; i++ {
+		if terminator, ok := selector(terminators); ok {
+			picks[terminator.Identity]++
+		}
+	}
+	return picks
+}
+
+func Test_RandomTerminatorSelector(t *testing.T) {
+	assert := require.New(t)
+	selector := RandomTerminatorSelector()
+
+	picks := selectMany(selector, testTerminators, 3000)
+	assert.Len(picks, 3)
+	for _, count := range picks {
+		// each should get about a third
+		assert.InDelta(1000, count, 200)
+	}
+
+	_, ok := selector(nil)
+	assert.False(ok)
+}
+
+func Test_LowestCostTerminatorSelector(t *testing.T) {
+	assert := require.New(t)
+	selector := LowestCostTerminatorSelector()
+
+	assert.Equal(map[string]int{"b": 10}, selectMany(selector, testTerminators, 10))
+
+	// precedence comes before cost
+	withPrecedence := []Terminator{
+		{Identity: "a", Cost: 30, Precedence: PrecedenceRequired},
+		{Identity: "b", Cost: 10, Precedence: PrecedenceFailed},
+		{Identity: "c", Cost: 20},
+	}
+	terminator, ok := selector(withPrecedence)
+	assert.True(ok)
+	assert.Equal("a", terminator.Identity)
+
+	_, ok = selector(nil)
+	assert.False(ok)
+}
+
+func Test_RoundRobinTerminatorSelector(t *testing.T) {
+	assert := require.New(t)
+	selector := RoundRobinTerminatorSelector()
+
+	var order []string
+	for i := 0; i < 6; i++ {
+		terminator, ok := selector(testTerminators)
+		assert.True(ok)
+		order = append(order, terminator.Identity)
+	}
+	assert.Equal([]string{"a", "b", "c", "a", "b", "c"}, order)
+	assert.Equal(map[string]int{"a": 100, "b": 100, "c": 100}, selectMany(RoundRobinTerminatorSelector(), testTerminators, 300))
+
+	_, ok := selector(nil)
+	assert.False(ok)
+}
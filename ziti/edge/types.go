@@ -18,7 +18,6 @@ package edge
 
 import (
 	"encoding/json"
-	"github.com/michaelquigley/pfxlog"
 	"github.com/mitchellh/mapstructure"
 	"github.com/pkg/errors"
 	"io"
@@ -67,18 +66,44 @@ type Service struct {
 	Tags        map[string]string                 `json:"tags"`
 }
 
+// HasPermission returns true if the current identity may create sessions of the given type for the service
+func (service *Service) HasPermission(sessionType SessionType) bool {
+	for _, permission := range service.Permissions {
+		if permission == string(sessionType) {
+			return true
+		}
+	}
+	return false
+}
+
+type ServiceInfo struct {
+	Id          string   `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// TerminatorState is a terminator of a service as the controller knows it, for diagnosing how dials are routed
+type TerminatorState struct {
+	Id         string      `json:"id"`
+	Identity   string      `json:"identity"`
+	Router     ApiIdentity `json:"router"`
+	Address    string      `json:"address"`
+	Cost       uint16      `json:"cost"`
+	Precedence Precedence  `json:"precedence"`
+}
+
 func (service *Service) GetConfigOfType(configType string, target interface{}) (bool, error) {
 	if service.Configs == nil {
-		pfxlog.Logger().Debugf("no service configs defined for service %v", service.Name)
+		Log().Debugf("no service configs defined for service %v", service.Name)
 		return false, nil
 	}
 	configMap, found := service.Configs[configType]
 	if !found {
-		pfxlog.Logger().Debugf("no service config of type %v defined for service %v", configType, service.Name)
+		Log().Debugf("no service config of type %v defined for service %v", configType, service.Name)
 		return false, nil
 	}
 	if err := mapstructure.Decode(configMap, target); err != nil {
-		pfxlog.Logger().WithError(err).Debugf("unable to decode service configuration for of type %v defined for service %v", configType, service.Name)
+		Log().WithError(err).Debugf("unable to decode service configuration for of type %v defined for service %v", configType, service.Name)
 		return true, errors.Errorf("unable to decode service config structure: %v", err)
 	}
 	return true, nil
@@ -53,3 +53,29 @@ func TestNetworkSessionDecode(t *testing.T) {
 		t.Errorf("decode network session = %+v, want %+v", ns, expected)
 	}
 }
+
+func TestTerminatorStateDecode(t *testing.T) {
+	resp := `
+{"meta":{"pagination":{"offset":0,"limit":100,"totalCount":2}},
+"data":[
+{"id":"t1","identity":"host-a","router":{"id":"r1","name":"er1"},"address":"hosted:a","cost":10,"precedence":"required"},
+{"id":"t2","identity":"host-b","router":{"id":"r1","name":"er1"},"address":"hosted:b","cost":0,"precedence":"default"}]}
+`
+	var terminators []*TerminatorState
+
+	meta, err := ApiResponseDecode(&terminators, strings.NewReader(resp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Pagination == nil || meta.Pagination.TotalCount != 2 {
+		t.Fatalf("decode pagination = %+v, want total count 2", meta.Pagination)
+	}
+
+	expected := []*TerminatorState{
+		{Id: "t1", Identity: "host-a", Router: ApiIdentity{Id: "r1", Name: "er1"}, Address: "hosted:a", Cost: 10, Precedence: PrecedenceRequired},
+		{Id: "t2", Identity: "host-b", Router: ApiIdentity{Id: "r1", Name: "er1"}, Address: "hosted:b", Cost: 0, Precedence: PrecedenceDefault},
+	}
+	if !reflect.DeepEqual(expected, terminators) {
+		t.Errorf("decode terminators = %+v, want %+v", terminators, expected)
+	}
+}
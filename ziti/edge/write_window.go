@@ -0,0 +1,130 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package edge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultMaxUnackedBytes = 4 * 1024 * 1024
+
+// writeWindow bounds the number of bytes written asynchronously which haven't yet been confirmed on the wire
+type writeWindow struct {
+	lock      sync.Mutex
+	current   int
+	max       int
+	releasedC chan struct{}
+	err       error
+}
+
+func newWriteWindow(max int) *writeWindow {
+	if max <= 0 {
+		max = DefaultMaxUnackedBytes
+	}
+	return &writeWindow{
+		max:       max,
+		releasedC: make(chan struct{}),
+	}
+}
+
+// acquire blocks until there's room in the window for n bytes, or closedC is closed. A single write larger than the
+// window is let through once the window is empty, otherwise it could never proceed
+func (window *writeWindow) acquire(n int, deadline time.Time, closedC <-chan struct{}) error {
+	var deadlineC <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		deadlineC = timer.C
+	}
+
+	for {
+		window.lock.Lock()
+		if window.err != nil {
+			err := window.err
+			window.lock.Unlock()
+			return err
+		}
+		if window.current == 0 || window.current+n <= window.max {
+			window.current += n
+			window.lock.Unlock()
+			return nil
+		}
+		releasedC := window.releasedC
+		window.lock.Unlock()
+
+		select {
+		case <-releasedC:
+		case <-deadlineC:
+			return errors.New("write deadline exceeded waiting for unacknowledged writes")
+		case <-closedC:
+			return ErrConnClosed
+		}
+	}
+}
+
+// release frees n bytes from the window once they're on the wire. The first error is kept and returned on subsequent
+// writes, since the write which caused it has already returned
+func (window *writeWindow) release(n int, err error) {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+
+	window.current -= n
+	if err != nil && window.err == nil {
+		window.err = err
+	}
+	close(window.releasedC)
+	window.releasedC = make(chan struct{})
+}
+
+// waitEmpty blocks until every byte in the window has been released, or ctx is done
+func (window *writeWindow) waitEmpty(ctx context.Context) error {
+	for {
+		window.lock.Lock()
+		if window.current <= 0 {
+			window.lock.Unlock()
+			return nil
+		}
+		releasedC := window.releasedC
+		window.lock.Unlock()
+
+		select {
+		case <-releasedC:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// setMax resizes the window, waking up writes waiting on it in case they now fit
+func (window *writeWindow) setMax(max int) {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+
+	window.max = max
+	close(window.releasedC)
+	window.releasedC = make(chan struct{})
+}
+
+func (window *writeWindow) getCurrent() int {
+	window.lock.Lock()
+	defer window.lock.Unlock()
+	return window.current
+}
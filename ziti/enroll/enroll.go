@@ -31,12 +31,12 @@ import (
 	"github.com/Jeffail/gabs"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/fullsailor/pkcs7"
-	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/foundation/identity/certtools"
 	"github.com/openziti/foundation/identity/identity"
 	nfpem "github.com/openziti/foundation/util/pem"
 	"github.com/openziti/foundation/util/x509"
 	"github.com/openziti/sdk-golang/ziti/config"
+	"github.com/openziti/sdk-golang/ziti/edge"
 	"github.com/pkg/errors"
 	"io/ioutil"
 	"net/http"
@@ -129,7 +129,7 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 			}
 		} else {
 			cfg.ID.Key = enFlags.KeyFile
-			pfxlog.Logger().Infof("using engine : %s\n", strings.Split(enFlags.KeyFile, ":")[0])
+			edge.Log().Infof("using engine : %s\n", strings.Split(enFlags.KeyFile, ":")[0])
 		}
 	} else {
 		key, err = generateKey()
@@ -146,7 +146,7 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 	allowedCerts := make([]*x509.Certificate, 0)
 
 	if strings.TrimSpace(enFlags.AdditionalCAs) != "" {
-		pfxlog.Logger().Debug("adding certificates from the provided ca override file")
+		edge.Log().Debug("adding certificates from the provided ca override file")
 		caPEMs, _ := ioutil.ReadFile(enFlags.AdditionalCAs)
 		for _, xcert := range nfpem.PemToX509(string(caPEMs)) {
 			allowedCerts = append(allowedCerts, xcert)
@@ -190,7 +190,7 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 					// don't try to fetch certs again
 					shouldFetchCerts = false
 
-					pfxlog.Logger().Debug("fetching certificates from server")
+					edge.Log().Debug("fetching certificates from server")
 					rootCaPool := x509.NewCertPool()
 					rootCaPool.AddCert(enFlags.Token.SignatureCert)
 
@@ -223,13 +223,13 @@ func Enroll(enFlags EnrollmentFlags) (*config.Config, error) {
 
 func generateKey() (crypto.PrivateKey, error) {
 	p384 := elliptic.P384()
-	pfxlog.Logger().Infof("generating %s key", p384.Params().Name)
+	edge.Log().Infof("generating %s key", p384.Params().Name)
 	return ecdsa.GenerateKey(p384, rand.Reader)
 }
 
 func useSystemCasIfEmpty(caPool *x509.CertPool) *x509.CertPool {
 	if len(caPool.Subjects()) < 1 {
-		pfxlog.Logger().Debugf("no cas provided in caPool. using system provided cas")
+		edge.Log().Debugf("no cas provided in caPool. using system provided cas")
 		//this means that there were no ca's in the jwt and none fetched and added... fallback to using
 		//the system defined ca pool in this case
 		return nil
@@ -298,7 +298,7 @@ func enrollOTT(token *config.EnrollmentClaims, cfg *config.Config, caPool *x509.
 				cfg.ID.Cert = "pem:" + string(body)
 			}
 		} else {
-			pfxlog.Logger().Warnf("more than one content-type detected. Using response as pem. content-types: %s", strings.Join(contentTypes, ", "))
+			edge.Log().Warnf("more than one content-type detected. Using response as pem. content-types: %s", strings.Join(contentTypes, ", "))
 			cfg.ID.Cert = "pem:" + string(body)
 		}
 
@@ -391,7 +391,7 @@ func enrollCAAuto(enFlags EnrollmentFlags, cfg *config.Config, caPool *x509.Cert
 			}
 			pb, merr := json.Marshal(user)
 			if merr != nil {
-				pfxlog.Logger().Warnf("problem converting name to json. Using the default name: %s", merr)
+				edge.Log().Warnf("problem converting name to json. Using the default name: %s", merr)
 			}
 			postBody = pb
 		}
@@ -452,7 +452,8 @@ func FetchCertificates(urlRoot string, rootCaPool *x509.CertPool) []*x509.Certif
 
 	certStoreUrl, err := url.Parse(urlRoot)
 	if err != nil {
-		pfxlog.Logger().WithError(err).WithField("url", urlRoot).Panic("could not parse base url to retrieve CA store")
+		edge.Log().WithError(err).WithField("url", urlRoot).Error("could not parse base url to retrieve CA store")
+		panic(errors.Wrapf(err, "could not parse base url %v to retrieve CA store", urlRoot))
 	}
 
 	certStoreUrl.Path = path.Join(certStoreUrl.Path, ".well-known/est/cacerts") //specified by rfc7030
@@ -461,18 +462,18 @@ func FetchCertificates(urlRoot string, rootCaPool *x509.CertPool) []*x509.Certif
 
 	if respErr != nil {
 		//if an error occurs, log the issue and just return a nil slice of certs
-		pfxlog.Logger().Errorf("unable to retrieve certificates from server at %s. %s", urlRoot, respErr)
+		edge.Log().Errorf("unable to retrieve certificates from server at %s. %s", urlRoot, respErr)
 		return nil
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
-			pfxlog.Logger().WithError(err).Error("could not close response body during certificate lookup")
+			edge.Log().WithError(err).Error("could not close response body during certificate lookup")
 		}
 	}()
 
 	pkcs7b64, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		pfxlog.Logger().Warnf("could not read response. no certificates added from %s", urlRoot)
+		edge.Log().Warnf("could not read response. no certificates added from %s", urlRoot)
 		return nil
 	}
 
@@ -482,13 +483,13 @@ func FetchCertificates(urlRoot string, rootCaPool *x509.CertPool) []*x509.Certif
 		if pkcs7Certs != nil {
 			certs, parseErr := pkcs7.Parse(pkcs7Certs)
 			if parseErr != nil {
-				pfxlog.Logger().Warnf("could not parse certificates. no certificates added from %s", urlRoot)
+				edge.Log().Warnf("could not parse certificates. no certificates added from %s", urlRoot)
 				return nil
 			}
 			return certs.Certificates
 		}
 	} else {
-		pfxlog.Logger().Debugf("no certificates added from url. http response: %d, url: %s", resp.StatusCode, urlRoot)
+		edge.Log().Debugf("no certificates added from url. http response: %d, url: %s", resp.StatusCode, urlRoot)
 	}
 	return nil
 }
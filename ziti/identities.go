@@ -0,0 +1,89 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ziti
+
+import (
+	"sync"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+// identities holds the contexts registered with RegisterIdentity, which DialOptions.Identity selects between
+var identities = &identityRegistry{contexts: map[string]Context{}}
+
+type identityRegistry struct {
+	lock     sync.RWMutex
+	contexts map[string]Context
+}
+
+// RegisterIdentity makes a context available to dials from any context under the given name, for processes
+// holding several identities. Dials with DialOptions.Identity set to the name are made through that context, and
+// so through router connections authenticated as its identity. The context authenticates and connects to routers
+// on first use, as it would for its own dials
+func RegisterIdentity(name string, context Context) error {
+	if name == "" {
+		return errors.New("identity name must not be empty")
+	}
+	if context == nil {
+		return errors.Errorf("no context given for identity '%s'", name)
+	}
+
+	identities.lock.Lock()
+	defer identities.lock.Unlock()
+
+	if existing, found := identities.contexts[name]; found && existing != context {
+		return errors.Errorf("identity '%s' is already registered", name)
+	}
+	identities.contexts[name] = context
+	return nil
+}
+
+// UnregisterIdentity removes a context registered with RegisterIdentity. It doesn't close the context
+func UnregisterIdentity(name string) {
+	identities.lock.Lock()
+	defer identities.lock.Unlock()
+	delete(identities.contexts, name)
+}
+
+// GetIdentity returns the context registered under the given name
+func GetIdentity(name string) (Context, bool) {
+	identities.lock.RLock()
+	defer identities.lock.RUnlock()
+	context, found := identities.contexts[name]
+	return context, found
+}
+
+// selectIdentity returns the context a dial with the given options should be made through, and the options to
+// dial it with. If the options name another identity, the dial is handed to its context with the identity cleared
+func (context *contextImpl) selectIdentity(options *edge.DialOptions) (Context, *edge.DialOptions, error) {
+	if options == nil || options.Identity == "" {
+		return nil, options, nil
+	}
+
+	selected, found := GetIdentity(options.Identity)
+	if !found {
+		return nil, nil, errors.Errorf("identity '%s' is not registered", options.Identity)
+	}
+	if selected == Context(context) {
+		return nil, options, nil
+	}
+
+	selectedOptions := *options
+	selectedOptions.Identity = ""
+	return selected, &selectedOptions, nil
+}
@@ -0,0 +1,221 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ziti
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+// PartialListenError is returned by Listen along with a working listener when the service was bound on some edge
+// routers, but binding failed on others. The listener keeps trying to bind on more routers in the background
+type PartialListenError struct {
+	Listener edge.Listener
+	// Errors holds the bind failures, keyed by edge router name
+	Errors map[string]error
+}
+
+func (e *PartialListenError) Error() string {
+	var routers []string
+	for router := range e.Errors {
+		routers = append(routers, router)
+	}
+	sort.Strings(routers)
+
+	buf := strings.Builder{}
+	buf.WriteString(fmt.Sprintf("bind failed on %v edge router(s)", len(routers)))
+	for _, router := range routers {
+		buf.WriteString(fmt.Sprintf(" %v: %v", router, e.Errors[router]))
+	}
+	return buf.String()
+}
+
+type routerBindState struct {
+	pendingConnects int
+	binding         bool
+	bound           bool
+	err             error
+}
+
+func (state *routerBindState) resolved() bool {
+	return state.bound || (state.pendingConnects == 0 && !state.binding)
+}
+
+// initialBinds tracks the outcome of the first round of binds made by a listenerManager, so that Listen can report
+// whether they succeeded. Once done, it ignores further updates. All methods are safe to call on a nil tracker
+type initialBinds struct {
+	lock      sync.Mutex
+	expected  int
+	started   bool
+	routers   map[string]*routerBindState
+	succeeded int
+	closed    bool
+	closeErr  error
+	done      bool
+	doneC     chan struct{}
+}
+
+func newInitialBinds() *initialBinds {
+	return &initialBinds{
+		routers: map[string]*routerBindState{},
+		doneC:   make(chan struct{}),
+	}
+}
+
+func (binds *initialBinds) update(f func()) {
+	if binds == nil {
+		return
+	}
+
+	binds.lock.Lock()
+	defer binds.lock.Unlock()
+
+	if binds.done {
+		return
+	}
+
+	f()
+
+	if binds.closed || (binds.started && binds.allResolved()) {
+		binds.done = true
+		close(binds.doneC)
+	}
+}
+
+func (binds *initialBinds) allResolved() bool {
+	if binds.expected > 0 && binds.succeeded >= binds.expected {
+		return true
+	}
+	if len(binds.routers) == 0 {
+		return false
+	}
+	for _, state := range binds.routers {
+		if !state.resolved() {
+			return false
+		}
+	}
+	return true
+}
+
+func (binds *initialBinds) getRouter(router string) *routerBindState {
+	state, found := binds.routers[router]
+	if !found {
+		state = &routerBindState{}
+		binds.routers[router] = state
+	}
+	return state
+}
+
+// start records how many binds we're aiming for. It's called once the connects for the first round are underway
+func (binds *initialBinds) start(expected int) {
+	binds.update(func() {
+		binds.started = true
+		binds.expected = expected
+	})
+}
+
+func (binds *initialBinds) connecting(router string) {
+	binds.update(func() {
+		binds.getRouter(router).pendingConnects++
+	})
+}
+
+// connected records the outcome of a router connect attempt. If used is false, the connection wasn't needed
+func (binds *initialBinds) connected(router string, used bool, err error) {
+	binds.update(func() {
+		state := binds.getRouter(router)
+		if state.pendingConnects > 0 {
+			state.pendingConnects--
+		}
+		if used {
+			state.binding = true
+		} else if err != nil && !state.bound {
+			state.err = err
+		}
+	})
+}
+
+func (binds *initialBinds) bound(router string) {
+	binds.update(func() {
+		state := binds.getRouter(router)
+		state.binding = false
+		state.bound = true
+		state.err = nil
+		binds.succeeded++
+	})
+}
+
+func (binds *initialBinds) bindFailed(router string, err error) {
+	binds.update(func() {
+		state := binds.getRouter(router)
+		state.binding = false
+		if err == nil {
+			err = errors.New("bind failed")
+		}
+		state.err = err
+	})
+}
+
+// listenerClosed is called when the listener closes, which ends the first round of binds regardless of their state
+func (binds *initialBinds) listenerClosed(err error) {
+	binds.update(func() {
+		binds.closed = true
+		if binds.closeErr == nil {
+			binds.closeErr = err
+		}
+	})
+}
+
+// result waits for the first round of binds and returns nil if all expected binds succeeded, a PartialListenError
+// if only some did, or an error if none did. If the timeout passes first, binds still in progress aren't counted
+func (binds *initialBinds) result(serviceName string, listener edge.Listener, timeout time.Duration) error {
+	select {
+	case <-binds.doneC:
+	case <-time.After(timeout):
+	}
+
+	binds.lock.Lock()
+	defer binds.lock.Unlock()
+
+	failures := map[string]error{}
+	for router, state := range binds.routers {
+		if !state.bound && state.err != nil {
+			failures[router] = state.err
+		}
+	}
+
+	if binds.succeeded == 0 || binds.closed {
+		if binds.closeErr != nil {
+			return errors.Errorf("unable to bind service '%s' (%v)", serviceName, binds.closeErr)
+		}
+		if len(failures) > 0 {
+			return errors.Errorf("unable to bind service '%s' on any edge router (%v)", serviceName, &PartialListenError{Errors: failures})
+		}
+		return errors.Errorf("unable to bind service '%s' on any edge router", serviceName)
+	}
+
+	if len(failures) > 0 && (binds.succeeded < binds.expected || !binds.done) {
+		return &PartialListenError{Listener: listener, Errors: failures}
+	}
+	return nil
+}
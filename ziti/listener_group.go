@@ -0,0 +1,237 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ziti
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/openziti/sdk-golang/ziti/edge/impl"
+	"github.com/pkg/errors"
+)
+
+// MaxConcurrentCostUpdates bounds how many listeners BulkUpdateCost updates at once
+const MaxConcurrentCostUpdates = 16
+
+// ErrListenerGroupClosed is returned by ListenerGroup.Accept once every listener in the group has closed
+var ErrListenerGroupClosed = errors.New("all listeners in group closed")
+
+// ListenerGroup holds the listeners created by ListenMany, keyed by service name, so they can be managed together
+type ListenerGroup struct {
+	listeners  map[string]edge.Listener
+	acceptOnce sync.Once
+	acceptC    chan net.Conn
+	closeOnce  sync.Once
+	closeC     chan struct{}
+}
+
+func newListenerGroup() *ListenerGroup {
+	return &ListenerGroup{
+		listeners: map[string]edge.Listener{},
+		acceptC:   make(chan net.Conn),
+		closeC:    make(chan struct{}),
+	}
+}
+
+// listenMany calls listen for each service concurrently. Services which fail to bind are left out of the group and
+// their errors returned as impl.MultipleErrors. Listeners returned along with an error, such as a
+// PartialListenError, are kept
+func listenMany(serviceNames []string, listen func(serviceName string) (edge.Listener, error)) (*ListenerGroup, error) {
+	group := newListenerGroup()
+	errs := map[string]error{}
+
+	unique := map[string]struct{}{}
+	for _, serviceName := range serviceNames {
+		unique[serviceName] = struct{}{}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for serviceName := range unique {
+		wg.Add(1)
+		go func(serviceName string) {
+			defer wg.Done()
+			listener, err := listen(serviceName)
+
+			lock.Lock()
+			defer lock.Unlock()
+			if listener != nil {
+				group.listeners[serviceName] = listener
+			}
+			if err != nil {
+				errs[serviceName] = errors.Wrapf(err, "failed to listen on service '%s'", serviceName)
+			}
+		}(serviceName)
+	}
+	wg.Wait()
+
+	if len(errs) == 0 {
+		return group, nil
+	}
+
+	var failed []string
+	for serviceName := range errs {
+		failed = append(failed, serviceName)
+	}
+	sort.Strings(failed)
+
+	var result impl.MultipleErrors
+	for _, serviceName := range failed {
+		result = append(result, errs[serviceName])
+	}
+	return group, result
+}
+
+// Listeners returns the listeners in the group, keyed by service name
+func (group *ListenerGroup) Listeners() map[string]edge.Listener {
+	result := make(map[string]edge.Listener, len(group.listeners))
+	for serviceName, listener := range group.listeners {
+		result[serviceName] = listener
+	}
+	return result
+}
+
+// Get returns the listener for the given service, if it's in the group
+func (group *ListenerGroup) Get(serviceName string) (edge.Listener, bool) {
+	listener, found := group.listeners[serviceName]
+	return listener, found
+}
+
+// Accept returns the next conn accepted on any of the listeners. ServiceName on the conn says which service it's
+// for. Once Accept has been called, conns should only be accepted through the group, as it accepts on each of the
+// listeners in the background
+func (group *ListenerGroup) Accept() (edge.ServiceConn, error) {
+	group.acceptOnce.Do(group.startAccepting)
+	select {
+	case conn, ok := <-group.acceptC:
+		if !ok {
+			return nil, ErrListenerGroupClosed
+		}
+		select {
+		case <-group.closeC:
+			// the group closed while the conn was being handed over
+			_ = conn.Close()
+			return nil, ErrListenerGroupClosed
+		default:
+		}
+		return conn.(edge.ServiceConn), nil
+	case <-group.closeC:
+		return nil, ErrListenerGroupClosed
+	}
+}
+
+func (group *ListenerGroup) startAccepting() {
+	var wg sync.WaitGroup
+	for _, listener := range group.listeners {
+		wg.Add(1)
+		go func(listener edge.Listener) {
+			defer wg.Done()
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					// listeners only fail accepts once they're closing, so there's nothing more to forward
+					if !listener.IsClosed() {
+						edge.Log().WithError(err).Debug("error accepting on listener in group, no longer forwarding")
+					}
+					return
+				}
+				select {
+				case group.acceptC <- conn:
+				case <-group.closeC:
+					// nobody is going to accept it, so don't leave the dialer hanging
+					_ = conn.Close()
+					return
+				}
+			}
+		}(listener)
+	}
+
+	go func() {
+		wg.Wait()
+		close(group.acceptC)
+	}()
+}
+
+// UpdateCostAll sets the cost on every listener in the group, as BulkUpdateCost does
+func (group *ListenerGroup) UpdateCostAll(cost uint16) error {
+	listeners := make([]edge.Listener, 0, len(group.listeners))
+	for _, listener := range group.listeners {
+		listeners = append(listeners, listener)
+	}
+	return BulkUpdateCost(listeners, cost)
+}
+
+// BulkUpdateCost sets the cost on each of the listeners concurrently, at most MaxConcurrentCostUpdates at a time,
+// so that draining a host isn't held up by each update waiting out its own send timeout. The updates are
+// independent, so some may succeed while others fail. Failures are returned as impl.MultipleErrors, in the order
+// of the listeners
+func BulkUpdateCost(listeners []edge.Listener, cost uint16) error {
+	errs := make([]error, len(listeners))
+	slots := make(chan struct{}, MaxConcurrentCostUpdates)
+
+	var wg sync.WaitGroup
+	for i, listener := range listeners {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(i int, listener edge.Listener) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := listener.UpdateCost(cost); err != nil {
+				errs[i] = errors.Wrapf(err, "failed to update cost of %v", describeListener(i, listener))
+			}
+		}(i, listener)
+	}
+	wg.Wait()
+
+	var result impl.MultipleErrors
+	for _, err := range errs {
+		if err != nil {
+			result = append(result, err)
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// describeListener names a listener in errors by its service, if it has one, and otherwise by its position
+func describeListener(i int, listener edge.Listener) string {
+	if named, ok := listener.(interface{ GetServiceName() string }); ok {
+		return fmt.Sprintf("listener for service '%s'", named.GetServiceName())
+	}
+	return fmt.Sprintf("listener %v", i)
+}
+
+// CloseAll closes every listener in the group, returning any failures as impl.MultipleErrors. Conns accepted in the
+// background but not yet returned by Accept are closed
+func (group *ListenerGroup) CloseAll() error {
+	group.closeOnce.Do(func() { close(group.closeC) })
+	var result impl.MultipleErrors
+	for serviceName, listener := range group.listeners {
+		if err := listener.Close(); err != nil {
+			result = append(result, errors.Wrapf(err, "failed to close listener for service '%s'", serviceName))
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
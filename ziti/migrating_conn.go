@@ -0,0 +1,545 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ziti
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/pkg/errors"
+)
+
+// migrationRetryInterval is how long to wait between redials while migrating a conn
+var migrationRetryInterval = 250 * time.Millisecond
+
+// migratingConn moves a dialed conn to a new router when the router under it fails, for DialOptions.Migratable.
+// Only router failures lead to a migration, as any other close means one side or the other closed the conn
+type migratingConn struct {
+	redial      func() (edge.ServiceConn, error)
+	timeout     time.Duration
+	maxBuffered int
+
+	lock         sync.Mutex
+	conn         edge.ServiceConn
+	generation   int
+	migrating    bool
+	closed       bool
+	done         bool
+	pending      [][]byte
+	pendingBytes int
+	changedC     chan struct{}
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	writeTimeout  time.Duration
+	readTimeout   time.Duration
+	sendWindow    int
+	recvWindow    int
+	correlationId string
+
+	closeNotified   bool
+	closeCause      error
+	closeHandlers   []func(error)
+	migrateHandlers []func(from, to edge.RouterConn)
+	migrations      int
+}
+
+func newMigratingConn(conn edge.ServiceConn, redial func() (edge.ServiceConn, error), options *edge.DialOptions) *migratingConn {
+	result := &migratingConn{
+		redial:      redial,
+		timeout:     options.ConnectTimeout,
+		maxBuffered: options.MaxUnackedBytes,
+		conn:        conn,
+		changedC:    make(chan struct{}),
+	}
+	if result.timeout <= 0 {
+		result.timeout = edge.DefaultDialOptions().ConnectTimeout
+	}
+	if result.maxBuffered <= 0 {
+		result.maxBuffered = edge.DefaultMaxUnackedBytes
+	}
+	result.watch(conn)
+	return result
+}
+
+func (conn *migratingConn) watch(underlying edge.ServiceConn) {
+	underlying.OnClose(func(cause error) {
+		conn.underlyingClosed(underlying, cause)
+	})
+}
+
+func (conn *migratingConn) underlyingClosed(underlying edge.ServiceConn, cause error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if underlying != conn.conn || conn.closed || conn.done {
+		return
+	}
+
+	if errors.Is(cause, edge.ErrRouterConnClosed) {
+		conn.migrating = true
+		conn.notifyChanged()
+		go conn.migrate(underlying.Router())
+		return
+	}
+
+	conn.finish(cause)
+}
+
+func (conn *migratingConn) migrate(from edge.RouterConn) {
+	logger := edge.Log().WithField("service", conn.ServiceName())
+	if from != nil {
+		logger = logger.WithField("router", from.GetRouterName())
+	}
+	logger.Info("router failed, migrating conn")
+
+	deadline := time.Now().Add(conn.timeout)
+	var newConn edge.ServiceConn
+	var err error
+	for {
+		if newConn, err = conn.redial(); err == nil {
+			break
+		}
+		if time.Now().Add(migrationRetryInterval).After(deadline) {
+			break
+		}
+		logger.WithError(err).Debug("redial failed, retrying")
+		time.Sleep(migrationRetryInterval)
+	}
+
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if err != nil {
+		logger.WithError(err).Error("unable to migrate conn, closing")
+		if !conn.closed {
+			conn.finish(fmt.Errorf("%w (%v)", edge.ErrMigrationFailed, err))
+		}
+		return
+	}
+
+	conn.applySettings(newConn)
+
+	// writes made while flushing are still buffered, so they stay behind the ones being flushed
+	for len(conn.pending) > 0 && !conn.closed {
+		pending := conn.pending
+		conn.pending = nil
+		conn.pendingBytes = 0
+		conn.lock.Unlock()
+
+		for _, data := range pending {
+			if _, err = newConn.Write(data); err != nil {
+				break
+			}
+		}
+
+		conn.lock.Lock()
+		if err != nil {
+			logger.WithError(err).Error("unable to write buffered data after migrating, closing")
+			conn.finish(err)
+			_ = newConn.Close()
+			return
+		}
+	}
+
+	if conn.closed {
+		_ = newConn.Close()
+		return
+	}
+
+	conn.conn = newConn
+	conn.generation++
+	conn.migrations++
+	conn.migrating = false
+	conn.notifyChanged()
+	conn.watch(newConn)
+
+	for _, handler := range conn.migrateHandlers {
+		go handler(from, newConn.Router())
+	}
+	logger.Info("conn migrated")
+}
+
+// applySettings carries deadlines and windows over to a new underlying conn. Must be called with the lock held
+func (conn *migratingConn) applySettings(underlying edge.ServiceConn) {
+	_ = underlying.SetReadDeadline(conn.readDeadline)
+	_ = underlying.SetWriteDeadline(conn.writeDeadline)
+	underlying.SetWriteTimeout(conn.writeTimeout)
+	underlying.SetReadTimeout(conn.readTimeout)
+	if conn.sendWindow > 0 {
+		_ = underlying.SetSendWindow(conn.sendWindow)
+	}
+	if conn.recvWindow > 0 {
+		_ = underlying.SetRecvWindow(conn.recvWindow)
+	}
+	if conn.correlationId != "" {
+		underlying.SetCorrelationId(conn.correlationId)
+	}
+}
+
+// finish marks the conn as closed for good. Must be called with the lock held
+func (conn *migratingConn) finish(cause error) {
+	conn.done = true
+	conn.migrating = false
+	conn.pending = nil
+	conn.pendingBytes = 0
+	conn.notifyChanged()
+	conn.notifyClosed(cause)
+}
+
+// notifyChanged wakes up reads and writes waiting on a migration. Must be called with the lock held
+func (conn *migratingConn) notifyChanged() {
+	close(conn.changedC)
+	conn.changedC = make(chan struct{})
+}
+
+// notifyClosed calls the close handlers, once. Must be called with the lock held
+func (conn *migratingConn) notifyClosed(cause error) {
+	if conn.closeNotified {
+		return
+	}
+	conn.closeNotified = true
+	conn.closeCause = cause
+	for _, handler := range conn.closeHandlers {
+		go handler(cause)
+	}
+}
+
+func (conn *migratingConn) current() (edge.ServiceConn, int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.conn, conn.generation
+}
+
+// await waits for the underlying conn from the given generation to be dealt with after it closed. If untilMigrated
+// is set it waits for it to be replaced, otherwise it also returns once a migration starts. It returns false if the
+// conn won't be migrated
+func (conn *migratingConn) await(generation int, untilMigrated bool) bool {
+	for {
+		conn.lock.Lock()
+		if conn.generation != generation || (conn.migrating && !untilMigrated) {
+			conn.lock.Unlock()
+			return true
+		}
+		if conn.closed || conn.done {
+			conn.lock.Unlock()
+			return false
+		}
+		changedC := conn.changedC
+		conn.lock.Unlock()
+		<-changedC
+	}
+}
+
+func (conn *migratingConn) Read(p []byte) (int, error) {
+	for {
+		underlying, generation := conn.current()
+		n, err := underlying.Read(p)
+		if err == nil || n > 0 || !underlying.IsClosed() || !conn.await(generation, true) {
+			return n, err
+		}
+	}
+}
+
+func (conn *migratingConn) WriteTo(dst io.Writer) (int64, error) {
+	var total int64
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			written, writeErr := dst.Write(buf[:n])
+			total += int64(written)
+			if writeErr != nil {
+				return total, writeErr
+			}
+			if written < n {
+				return total, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return total, nil
+		} else if err != nil {
+			return total, err
+		}
+	}
+}
+
+func (conn *migratingConn) Write(data []byte) (int, error) {
+	return conn.write(data, edge.ServiceConn.Write)
+}
+
+func (conn *migratingConn) WriteNoSync(data []byte) (int, error) {
+	return conn.write(data, edge.ServiceConn.WriteNoSync)
+}
+
+func (conn *migratingConn) ReadMessage() ([]byte, error) {
+	for {
+		underlying, generation := conn.current()
+		msg, err := underlying.ReadMessage()
+		if err == nil || !underlying.IsClosed() || !conn.await(generation, true) {
+			return msg, err
+		}
+	}
+}
+
+// WriteMessage keeps message boundaries across a migration, as messages buffered while migrating are each
+// flushed with a single write
+func (conn *migratingConn) WriteMessage(msg []byte) error {
+	_, err := conn.write(msg, func(underlying edge.ServiceConn, data []byte) (int, error) {
+		if err := underlying.WriteMessage(data); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	})
+	return err
+}
+
+// WriteWithReceipt writes as WriteMessage does. Data written while the conn is migrating is buffered and sent
+// without asking for an ack, so its receipt's Wait returns ErrReceiptsUnsupported, and a receipt still waiting when
+// the conn migrates fails with ErrConnClosed
+func (conn *migratingConn) WriteWithReceipt(msg []byte) (edge.Receipt, error) {
+	receipt := edge.FailedReceipt(edge.ErrReceiptsUnsupported)
+	_, err := conn.write(msg, func(underlying edge.ServiceConn, data []byte) (int, error) {
+		r, err := underlying.WriteWithReceipt(data)
+		if err != nil {
+			return 0, err
+		}
+		receipt = r
+		return len(data), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+func (conn *migratingConn) write(data []byte, write func(edge.ServiceConn, []byte) (int, error)) (int, error) {
+	for {
+		conn.lock.Lock()
+		if conn.closed || conn.done {
+			conn.lock.Unlock()
+			return 0, edge.ErrConnClosed
+		}
+
+		if conn.migrating {
+			if conn.pendingBytes == 0 || conn.pendingBytes+len(data) <= conn.maxBuffered {
+				buf := make([]byte, len(data))
+				copy(buf, data)
+				conn.pending = append(conn.pending, buf)
+				conn.pendingBytes += len(buf)
+				conn.lock.Unlock()
+				return len(data), nil
+			}
+			changedC := conn.changedC
+			conn.lock.Unlock()
+			<-changedC
+			continue
+		}
+
+		underlying, generation := conn.conn, conn.generation
+		conn.lock.Unlock()
+
+		n, err := write(underlying, data)
+		if err == nil || !underlying.IsClosed() || !conn.await(generation, false) {
+			return n, err
+		}
+	}
+}
+
+func (conn *migratingConn) Close() error {
+	return conn.CloseContext(context.Background())
+}
+
+func (conn *migratingConn) CloseContext(ctx context.Context) error {
+	return conn.closeWith(func(underlying edge.ServiceConn) error {
+		return underlying.CloseContext(ctx)
+	})
+}
+
+func (conn *migratingConn) Abort() error {
+	return conn.closeWith(edge.ServiceConn.Abort)
+}
+
+// closeWith marks the conn closed, dropping writes buffered during a migration, then closes the current conn
+func (conn *migratingConn) closeWith(closeUnderlying func(underlying edge.ServiceConn) error) error {
+	conn.lock.Lock()
+	if conn.closed {
+		conn.lock.Unlock()
+		return nil
+	}
+	conn.closed = true
+	conn.pending = nil
+	conn.pendingBytes = 0
+	underlying := conn.conn
+	conn.notifyChanged()
+	conn.notifyClosed(nil)
+	conn.lock.Unlock()
+
+	return closeUnderlying(underlying)
+}
+
+func (conn *migratingConn) IsClosed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.closed || conn.done
+}
+
+func (conn *migratingConn) OnClose(handler func(cause error)) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	if conn.closeNotified {
+		go handler(conn.closeCause)
+	} else {
+		conn.closeHandlers = append(conn.closeHandlers, handler)
+	}
+}
+
+func (conn *migratingConn) OnMigrate(handler func(from, to edge.RouterConn)) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.migrateHandlers = append(conn.migrateHandlers, handler)
+}
+
+func (conn *migratingConn) Migrations() int {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.migrations
+}
+
+func (conn *migratingConn) SetDeadline(t time.Time) error {
+	if err := conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+func (conn *migratingConn) SetReadDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.readDeadline = t
+	return conn.conn.SetReadDeadline(t)
+}
+
+func (conn *migratingConn) SetWriteDeadline(t time.Time) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.writeDeadline = t
+	return conn.conn.SetWriteDeadline(t)
+}
+
+func (conn *migratingConn) SetWriteTimeout(timeout time.Duration) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.writeTimeout = timeout
+	conn.conn.SetWriteTimeout(timeout)
+}
+
+func (conn *migratingConn) SetReadTimeout(timeout time.Duration) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.readTimeout = timeout
+	conn.conn.SetReadTimeout(timeout)
+}
+
+func (conn *migratingConn) SetCorrelationId(id string) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.correlationId = id
+	conn.conn.SetCorrelationId(id)
+}
+
+func (conn *migratingConn) GetCorrelationId() string {
+	underlying, _ := conn.current()
+	return underlying.GetCorrelationId()
+}
+
+func (conn *migratingConn) SetSendWindow(size int) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if err := conn.conn.SetSendWindow(size); err != nil {
+		return err
+	}
+	conn.sendWindow = size
+	return nil
+}
+
+func (conn *migratingConn) SetRecvWindow(size int) error {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if err := conn.conn.SetRecvWindow(size); err != nil {
+		return err
+	}
+	conn.recvWindow = size
+	return nil
+}
+
+func (conn *migratingConn) LocalAddr() net.Addr {
+	underlying, _ := conn.current()
+	return underlying.LocalAddr()
+}
+
+func (conn *migratingConn) RemoteAddr() net.Addr {
+	underlying, _ := conn.current()
+	return underlying.RemoteAddr()
+}
+
+// Stats returns the stats of the current underlying conn, so they start again from zero after a migration
+func (conn *migratingConn) Stats() edge.ConnStats {
+	underlying, _ := conn.current()
+	return underlying.Stats()
+}
+
+// QualityStats returns the estimates of the current underlying conn, which describe the path through its router
+func (conn *migratingConn) QualityStats() edge.QualityStats {
+	underlying, _ := conn.current()
+	return underlying.QualityStats()
+}
+
+func (conn *migratingConn) IsInbound() bool {
+	return false
+}
+
+func (conn *migratingConn) ServiceName() string {
+	underlying, _ := conn.current()
+	return underlying.ServiceName()
+}
+
+func (conn *migratingConn) Router() edge.RouterConn {
+	underlying, _ := conn.current()
+	return underlying.Router()
+}
+
+func (conn *migratingConn) SelectedProtocol() string {
+	underlying, _ := conn.current()
+	return underlying.SelectedProtocol()
+}
+
+func (conn *migratingConn) TerminatorInstanceId() string {
+	underlying, _ := conn.current()
+	return underlying.TerminatorInstanceId()
+}
+
+func (conn *migratingConn) GetConnectHeader(key int32) ([]byte, bool) {
+	underlying, _ := conn.current()
+	return underlying.GetConnectHeader(key)
+}
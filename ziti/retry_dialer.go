@@ -0,0 +1,199 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ziti
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/openziti/sdk-golang/ziti/edge/api"
+	"github.com/pkg/errors"
+)
+
+// ServiceNotFoundError is returned when dialing a service the identity can't see, by name or, if ById is set, by id
+type ServiceNotFoundError struct {
+	Service string
+	ById    bool
+}
+
+func (e *ServiceNotFoundError) Error() string {
+	if e.ById {
+		return fmt.Sprintf("service with id '%s' not found", e.Service)
+	}
+	return fmt.Sprintf("service '%s' not found", e.Service)
+}
+
+// IsRetryableDialError reports whether a failed dial may succeed if it's tried again. Dials refused by policy, by
+// the controller rejecting the identity, by the host with edge.RejectWith, or for a service which isn't there won't
+// succeed on retry. Anything else, such as timeouts, routers going away or services without terminators, may be
+// the network changing under the dial, so it's worth retrying
+func IsRetryableDialError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var rejected *edge.DialRejectedError
+	var notFound *ServiceNotFoundError
+	return !errors.As(err, &rejected) &&
+		!errors.As(err, &notFound) &&
+		!errors.As(err, &api.NotAccessible{}) &&
+		!errors.As(err, &api.NotFound{}) &&
+		!errors.As(err, &api.AuthFailure{})
+}
+
+const (
+	DefaultRetryDialTimeout         = 30 * time.Second
+	DefaultRetryDialInitialInterval = 100 * time.Millisecond
+	DefaultRetryDialMaxInterval     = 5 * time.Second
+	DefaultRetryDialMultiplier      = 2.0
+	DefaultRetryDialJitter          = 0.2
+)
+
+type RetryDialerOptions struct {
+	// DialOptions are used for each attempt, with the connect timeout cut short if less than that remains of
+	// Timeout. Nil uses edge.DialOptionsFor the service
+	DialOptions *edge.DialOptions
+	// Timeout bounds the dial as a whole, attempts and waits between them included. Zero uses
+	// DefaultRetryDialTimeout
+	Timeout time.Duration
+	// InitialInterval is the wait before the first retry. Each wait after is Multiplier times the one before, up
+	// to MaxInterval. Zero values use the defaults
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	// Jitter randomizes each wait by up to this fraction of it in either direction, so that clients which failed
+	// together don't retry together. Zero waits exactly as scheduled
+	Jitter float64
+	// IsRetryable decides which failures are retried. Nil uses IsRetryableDialError
+	IsRetryable func(err error) bool
+	// OnRetry, if set, is called after each failed attempt which will be retried, with the attempt number
+	// starting at 1, the error and the wait before the next attempt
+	OnRetry func(attempt int, err error, wait time.Duration)
+}
+
+func DefaultRetryDialerOptions() *RetryDialerOptions {
+	return &RetryDialerOptions{
+		Timeout:         DefaultRetryDialTimeout,
+		InitialInterval: DefaultRetryDialInitialInterval,
+		MaxInterval:     DefaultRetryDialMaxInterval,
+		Multiplier:      DefaultRetryDialMultiplier,
+		Jitter:          DefaultRetryDialJitter,
+	}
+}
+
+// RetryDialer dials services through a Context, retrying failures which may be transient with exponential
+// backoff, so that applications can dial through router churn without retry loops of their own
+type RetryDialer struct {
+	context Context
+	options RetryDialerOptions
+}
+
+func NewRetryDialer(context Context, options *RetryDialerOptions) *RetryDialer {
+	if options == nil {
+		options = DefaultRetryDialerOptions()
+	}
+	dialer := &RetryDialer{context: context, options: *options}
+	if dialer.options.Timeout <= 0 {
+		dialer.options.Timeout = DefaultRetryDialTimeout
+	}
+	if dialer.options.InitialInterval <= 0 {
+		dialer.options.InitialInterval = DefaultRetryDialInitialInterval
+	}
+	if dialer.options.MaxInterval <= 0 {
+		dialer.options.MaxInterval = DefaultRetryDialMaxInterval
+	}
+	if dialer.options.Multiplier <= 0 {
+		dialer.options.Multiplier = DefaultRetryDialMultiplier
+	}
+	return dialer
+}
+
+func (dialer *RetryDialer) Dial(serviceName string) (edge.ServiceConn, error) {
+	return dialer.DialContext(context.Background(), serviceName)
+}
+
+// DialContext dials the service until an attempt succeeds, fails in a way which isn't retryable, or the next
+// attempt would start after Timeout or ctx's deadline, returning the last attempt's error. If ctx is canceled
+// first, ctx.Err() is returned. An attempt in progress isn't interrupted by ctx, but its connect timeout is cut to
+// fit the deadline
+func (dialer *RetryDialer) DialContext(ctx context.Context, serviceName string) (edge.ServiceConn, error) {
+	options := dialer.options
+	dialOptions := options.DialOptions
+	if dialOptions == nil {
+		dialOptions = edge.DialOptionsFor(serviceName)
+	}
+	isRetryable := options.IsRetryable
+	if isRetryable == nil {
+		isRetryable = IsRetryableDialError
+	}
+
+	expBackoff := backoff.NewExponentialBackOff()
+	expBackoff.InitialInterval = options.InitialInterval
+	expBackoff.MaxInterval = options.MaxInterval
+	expBackoff.Multiplier = options.Multiplier
+	expBackoff.RandomizationFactor = options.Jitter
+	expBackoff.MaxElapsedTime = options.Timeout
+
+	deadline := time.Now().Add(options.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	var conn edge.ServiceConn
+	var lastErr error
+	attempts := 0
+	operation := func() error {
+		if ctx.Err() != nil {
+			return backoff.Permanent(ctx.Err())
+		}
+		attemptOptions := *dialOptions
+		if remaining := time.Until(deadline); remaining < attemptOptions.ConnectTimeout {
+			attemptOptions.ConnectTimeout = remaining
+		}
+		if attemptOptions.ConnectTimeout <= 0 {
+			if lastErr == nil {
+				lastErr = errors.Errorf("unable to dial service '%s', no time left to dial in", serviceName)
+			}
+			return backoff.Permanent(lastErr)
+		}
+
+		attempts++
+		var err error
+		if conn, err = dialer.context.DialWithOptions(serviceName, &attemptOptions); err == nil {
+			return nil
+		}
+		lastErr = err
+		if !isRetryable(err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+
+	notify := func(err error, wait time.Duration) {
+		edge.Log().WithError(err).Debugf("dial of service '%s' failed on attempt %v, retrying in %v", serviceName, attempts, wait)
+		if options.OnRetry != nil {
+			options.OnRetry(attempts, err, wait)
+		}
+	}
+
+	if err := backoff.RetryNotify(operation, backoff.WithContext(expBackoff, ctx), notify); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,105 @@
+/*
+	Copyright 2019 NetFoundry, Inc.
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+
+	https://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package ziti
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openziti/foundation/metrics"
+	"github.com/openziti/sdk-golang/ziti/edge"
+)
+
+// routerRetryDelay is how long a router whose connect failed is moved behind the other routers a RouterSelector
+// picked, so that one unreachable router doesn't hold up binding on the rest
+var routerRetryDelay = 5 * time.Second
+
+// bindableRouters returns the session's edge routers which may be bound on, in the order to bind on them. Without
+// a RouterSelector that's every router, in the session's order
+func (mgr *listenerManager) bindableRouters() []edge.EdgeRouter {
+	if mgr.session == nil {
+		return nil
+	}
+	if mgr.options.RouterSelector == nil {
+		return mgr.session.EdgeRouters
+	}
+
+	latencies := mgr.context.routerLatencies()
+	byName := map[string]edge.EdgeRouter{}
+	var available []edge.RouterInfo
+	for _, edgeRouter := range mgr.session.EdgeRouters {
+		byName[edgeRouter.Name] = edgeRouter
+		available = append(available, newRouterInfo(edgeRouter, latencies))
+	}
+
+	var selected, retries []edge.EdgeRouter
+	for _, info := range mgr.options.RouterSelector(available) {
+		edgeRouter, found := byName[info.Name]
+		if !found {
+			continue
+		}
+		// routers the selector returns more than once are bound in the first position they're returned in
+		delete(byName, info.Name)
+		if failedAt, failed := mgr.connectFailures[info.Name]; failed && time.Since(failedAt) < routerRetryDelay {
+			retries = append(retries, edgeRouter)
+		} else {
+			selected = append(selected, edgeRouter)
+		}
+	}
+	return append(selected, retries...)
+}
+
+func newRouterInfo(edgeRouter edge.EdgeRouter, latencies map[string]time.Duration) edge.RouterInfo {
+	var urls []string
+	for _, routerUrl := range edgeRouter.Urls {
+		urls = append(urls, routerUrl)
+	}
+	sort.Strings(urls)
+
+	info := edge.RouterInfo{Name: edgeRouter.Name}
+	if len(urls) > 0 {
+		info.Address = urls[0]
+	}
+	for _, routerUrl := range urls {
+		if latency := latencies[routerUrl]; latency > 0 && (info.Latency == 0 || latency < info.Latency) {
+			info.Latency = latency
+		}
+	}
+	return info
+}
+
+// routerLatencies returns the mean latency measured to each router url with an open router connection
+func (context *contextImpl) routerLatencies() map[string]time.Duration {
+	latencies := map[string]time.Duration{}
+	if context == nil || context.metrics == nil {
+		return latencies
+	}
+
+	context.metrics.EachMetric(func(name string, metric metrics.Metric) {
+		if !strings.HasPrefix(name, "latency.") {
+			return
+		}
+		if histogram, ok := metric.(interface {
+			Count() int64
+			Mean() float64
+		}); ok && histogram.Count() > 0 {
+			latencies[strings.TrimPrefix(name, "latency.")] = time.Duration(histogram.Mean())
+		}
+	})
+	return latencies
+}
@@ -21,7 +21,6 @@ import (
 	errors2 "errors"
 	"fmt"
 	"github.com/cenkalti/backoff/v4"
-	"github.com/michaelquigley/pfxlog"
 	"github.com/openziti/foundation/channel2"
 	"github.com/openziti/foundation/identity/identity"
 	"github.com/openziti/foundation/metrics"
@@ -33,11 +32,11 @@ import (
 	"github.com/openziti/sdk-golang/ziti/sdkinfo"
 	cmap "github.com/orcaman/concurrent-map"
 	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
 	"net/url"
 	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -48,15 +47,57 @@ const (
 type Context interface {
 	Authenticate() error
 	Dial(serviceName string) (edge.ServiceConn, error)
+	// DialWithOptions dials the service. Nil options, here and for the other dial and listen methods, uses the
+	// service's defaults as registered with edge.RegisterServiceDefaults, or the SDK defaults if there aren't any
+	DialWithOptions(serviceName string, options *edge.DialOptions) (edge.ServiceConn, error)
+	// DialById dials the service with the given id. Unlike dialing by name, it isn't affected by the service
+	// being renamed
+	DialById(serviceId string, options *edge.DialOptions) (edge.ServiceConn, error)
 	Listen(serviceName string) (edge.Listener, error)
+	// ListenWithOptions binds the service and waits for the first round of binds to complete. If only some of them
+	// succeed, the listener is returned along with a *PartialListenError describing the failures. Session creation
+	// and the router connects are each bounded by options.ConnectTimeout, so this can block for up to twice that
 	ListenWithOptions(serviceName string, options *edge.ListenOptions) (edge.Listener, error)
+	// ListenById hosts the service with the given id
+	ListenById(serviceId string, options *edge.ListenOptions) (edge.Listener, error)
+	// ListenMany binds each of the services, returning their listeners as a group. Services which couldn't be bound
+	// are left out of the group and their failures returned as impl.MultipleErrors
+	ListenMany(serviceNames []string, options *edge.ListenOptions) (*ListenerGroup, error)
 	GetServiceId(serviceName string) (string, bool, error)
 	GetServices() ([]edge.Service, error)
 	GetService(serviceName string) (*edge.Service, bool)
+	// ListDialableServices returns the services the current identity may dial. It's answered from the locally
+	// cached service list, which is refreshed every Options.RefreshInterval, so it makes no controller calls
+	ListDialableServices() ([]edge.ServiceInfo, error)
+	// ListBindableServices returns the services the current identity may host. Like ListDialableServices,
+	// it's answered from the locally cached service list
+	ListBindableServices() ([]edge.ServiceInfo, error)
+
+	// CanDial reports whether the identity may dial the service and its session has at least one edge router,
+	// without dialing. Sessions are cached, so once one exists the edge router list is only as fresh as the last
+	// session refresh. Terminators aren't checked, so the service may still not have a host
+	CanDial(serviceName string) (bool, error)
+
+	// GetTerminatorState asks the controller for the service's terminators, with the identity, cost and precedence
+	// each was bound with. It's meant for diagnosing routing, such as finding hosts whose precedences conflict with
+	// edge.HasPrecedenceConflict, and isn't cached, so each call goes to the controller
+	GetTerminatorState(serviceName string) ([]edge.TerminatorState, error)
+
+	// PrewarmRouters connects to the edge routers of the service's dial session ahead of the first dial, so that
+	// dials don't wait for a router connection to be set up. Router connections are shared by all dials, so later
+	// dials to any service through those routers reuse them. Routers are connected at most
+	// options.MaxConcurrentDials at a time, within options.ConnectTimeout. Nil options uses the service's defaults.
+	// It succeeds if at least one router connected
+	PrewarmRouters(serviceName string, options *edge.DialOptions) error
 
 	GetSession(id string) (*edge.Session, error)
 	GetBindSession(id string) (*edge.Session, error)
 
+	// SetSessionExpiryHandler sets a callback for when the api session, which service sessions depend on, is
+	// within Options.SessionExpiryWarning of expiring. It's called once per expiry time. The SDK refreshes the api
+	// session itself 10 seconds before it expires, so the handler is only a chance to act ahead of that
+	SetSessionExpiryHandler(handler func(timeUntilExpiry time.Duration))
+
 	Metrics() metrics.Registry
 	// Close closes any connections open to edge routers
 	Close()
@@ -80,10 +121,14 @@ type contextImpl struct {
 	metrics metrics.Registry
 
 	firstAuthOnce sync.Once
+	expiryHandler atomic.Value
+
+	// routerChannelOpener replaces openRouterChannel's transport dial when set, so tests can supply channels
+	routerChannelOpener func(ingressUrl string) (channel2.Channel, string, error)
 }
 
 func (context *contextImpl) OnClose(factory edge.RouterConn) {
-	logrus.Debugf("connection to router [%s] was closed", factory.Key())
+	edge.Log().Debugf("connection to router [%s] was closed", factory.Key())
 	context.routerConnections.Remove(factory.Key())
 }
 
@@ -121,7 +166,7 @@ func (context *contextImpl) ensureConfigPresent() error {
 		return errors.Errorf("unable to configure ziti as config environment variable %v not populated", configEnvVarName)
 	}
 
-	logrus.Infof("loading Ziti configuration from %s", confFile)
+	edge.Log().Infof("loading Ziti configuration from %s", confFile)
 	cfg, err := config.NewFromFile(confFile)
 	if err != nil {
 		return errors.Errorf("error loading config file specified by ${%s}: %v", configEnvVarName, err)
@@ -194,7 +239,7 @@ func (context *contextImpl) processServiceUpdates(services []*edge.Service) {
 }
 
 func (context *contextImpl) refreshSessions() {
-	log := pfxlog.Logger()
+	log := edge.Log()
 	edgeRouters := make(map[string]string)
 	context.sessions.Range(func(key, value interface{}) bool {
 		log.Debugf("refreshing session for %s", key)
@@ -219,11 +264,31 @@ func (context *contextImpl) refreshSessions() {
 
 }
 
+func (context *contextImpl) SetSessionExpiryHandler(handler func(timeUntilExpiry time.Duration)) {
+	context.expiryHandler.Store(handler)
+}
+
+// expiryWarningDelay returns how long until the session expiry handler is due for the given expiry time
+func (context *contextImpl) expiryWarningDelay(expireTime time.Time) time.Duration {
+	warning := context.options.SessionExpiryWarning
+	if warning <= 0 {
+		warning = config.DefaultSessionExpiryWarning
+	}
+	return time.Until(expireTime) - warning
+}
+
+func (context *contextImpl) notifySessionExpiry(expireTime time.Time) {
+	if handler, ok := context.expiryHandler.Load().(func(time.Duration)); ok && handler != nil {
+		go handler(time.Until(expireTime))
+	}
+}
+
 func (context *contextImpl) runSessionRefresh() {
-	log := pfxlog.Logger()
+	log := edge.Log()
 	svcUpdateTick := time.NewTicker(context.options.RefreshInterval)
 	expireTime := context.apiSession.Expires
 	sleepDuration := expireTime.Sub(time.Now()) - (10 * time.Second)
+	expiryWarning := time.NewTimer(context.expiryWarningDelay(expireTime))
 	for {
 
 		select {
@@ -234,11 +299,24 @@ func (context *contextImpl) runSessionRefresh() {
 
 				sleepDuration = 5 * time.Second
 			} else {
+				if !exp.Equal(expireTime) {
+					if !expiryWarning.Stop() {
+						select {
+						case <-expiryWarning.C:
+						default:
+						}
+					}
+					expiryWarning.Reset(context.expiryWarningDelay(*exp))
+				}
 				expireTime = *exp
 				sleepDuration = expireTime.Sub(time.Now()) - (10 * time.Second)
 				log.Debugf("apiSession refreshed, new expiration[%s]", expireTime)
 			}
 
+		case <-expiryWarning.C:
+			log.Debugf("apiSession expires in %v", time.Until(expireTime))
+			context.notifySessionExpiry(expireTime)
+
 		case <-svcUpdateTick.C:
 			log.Debug("refreshing services")
 			services, err := context.getServices()
@@ -254,7 +332,7 @@ func (context *contextImpl) runSessionRefresh() {
 
 func (context *contextImpl) EnsureAuthenticated(options edge.ConnOptions) error {
 	operation := func() error {
-		pfxlog.Logger().Infof("attempting to establish new api session")
+		edge.Log().Infof("attempting to establish new api session")
 		err := context.Authenticate()
 		if err != nil && errors2.As(err, &api.AuthFailure{}) {
 			return backoff.Permanent(err)
@@ -274,16 +352,16 @@ func (context *contextImpl) Authenticate() error {
 	}
 
 	if context.apiSession != nil {
-		logrus.Debug("previous apiSession detected, checking if valid")
+		edge.Log().Debug("previous apiSession detected, checking if valid")
 		if _, err := context.ctrlClt.Refresh(); err == nil {
-			logrus.Debug("previous apiSession refreshed")
+			edge.Log().Debug("previous apiSession refreshed")
 			return nil
 		} else {
-			logrus.WithError(err).Info("previous apiSession failed to refresh, attempting to authenticate")
+			edge.Log().WithError(err).Info("previous apiSession failed to refresh, attempting to authenticate")
 		}
 	}
 
-	logrus.Debug("attempting to authenticate")
+	edge.Log().Debug("attempting to authenticate")
 	context.services = sync.Map{}
 	context.sessions = sync.Map{}
 
@@ -318,6 +396,21 @@ func (context *contextImpl) Authenticate() error {
 }
 
 func (context *contextImpl) Dial(serviceName string) (edge.ServiceConn, error) {
+	return context.DialWithOptions(serviceName, nil)
+}
+
+func (context *contextImpl) DialWithOptions(serviceName string, options *edge.DialOptions) (edge.ServiceConn, error) {
+	if options == nil {
+		options = edge.DialOptionsFor(serviceName)
+	}
+	selected, selectedOptions, err := context.selectIdentity(options)
+	if err != nil {
+		return nil, err
+	}
+	if selected != nil {
+		return selected.DialWithOptions(serviceName, selectedOptions)
+	}
+
 	if err := context.initialize(); err != nil {
 		return nil, errors.Errorf("failed to initialize context: (%v)", err)
 	}
@@ -328,7 +421,57 @@ func (context *contextImpl) Dial(serviceName string) (edge.ServiceConn, error) {
 
 	serviceId, ok := context.getServiceId(serviceName)
 	if !ok {
-		return nil, errors.Errorf("service '%s' not found", serviceName)
+		return nil, &ServiceNotFoundError{Service: serviceName}
+	}
+
+	return context.dialService(serviceId, serviceName, options)
+}
+
+func (context *contextImpl) DialById(serviceId string, options *edge.DialOptions) (edge.ServiceConn, error) {
+	selected, selectedOptions, err := context.selectIdentity(options)
+	if err != nil {
+		return nil, err
+	}
+	if selected != nil {
+		return selected.DialById(serviceId, selectedOptions)
+	}
+
+	if err := context.initialize(); err != nil {
+		return nil, errors.Errorf("failed to initialize context: (%v)", err)
+	}
+
+	if err := context.ensureApiSession(); err != nil {
+		return nil, fmt.Errorf("failed to dial: %v", err)
+	}
+
+	service, ok := context.getServiceById(serviceId)
+	if !ok {
+		return nil, &ServiceNotFoundError{Service: serviceId, ById: true}
+	}
+
+	if options == nil {
+		options = edge.DialOptionsFor(service.Name)
+	}
+	return context.dialService(serviceId, service.Name, options)
+}
+
+func (context *contextImpl) dialService(serviceId, serviceName string, options *edge.DialOptions) (edge.ServiceConn, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	if options.Migratable {
+		// redials happen for as long as the conn is open, so they mustn't see later changes to the caller's options
+		redialOptions := options.Clone()
+		redialOptions.Migratable = false
+		redial := func() (edge.ServiceConn, error) {
+			return context.dialService(serviceId, serviceName, redialOptions)
+		}
+		conn, err := redial()
+		if err != nil {
+			return nil, err
+		}
+		return newMigratingConn(conn, redial, options), nil
 	}
 
 	var conn edge.ServiceConn
@@ -339,24 +482,178 @@ func (context *contextImpl) Dial(serviceName string) (edge.ServiceConn, error) {
 		if err != nil {
 			continue
 		}
-		pfxlog.Logger().Infof("connecting via session id [%s] token [%s]", session.Id, session.Token)
-		conn, err = context.dialSession(serviceName, session)
+		edge.Log().Infof("connecting via session id [%s] token [%s]", session.Id, session.Token)
+		conn, err = context.dialSession(serviceName, session, options)
+		var rejected *edge.DialRejectedError
+		if errors.As(err, &rejected) {
+			// the host turned the dial away, so another session won't help
+			return nil, rejected
+		}
 		if err != nil {
 			context.deleteServiceSessions(serviceId)
 			continue
 		}
 		return conn, err
 	}
-	return nil, errors.Errorf("unable to dial service '%s' (%v)", serviceName, err)
+	// the cause is wrapped so callers such as RetryDialer can tell what went wrong
+	return nil, fmt.Errorf("unable to dial service '%s' (%w)", serviceName, err)
 }
 
-func (context *contextImpl) dialSession(service string, session *edge.Session) (edge.ServiceConn, error) {
-	edgeConnFactory, err := context.getEdgeRouterConn(session, edge.DialConnOptions{})
+func (context *contextImpl) dialSession(service string, session *edge.Session, options *edge.DialOptions) (edge.ServiceConn, error) {
+	if options.PerAttemptTimeout > 0 {
+		session, routerC, err := context.connectEdgeRouters(session)
+		if err != nil {
+			return nil, err
+		}
+		return dialWithFailover(service, session, options, routerC, countRouterUrls(session))
+	}
+
+	edgeConnFactory, err := context.getEdgeRouterConn(session, options)
 	if err != nil {
 		return nil, err
 	}
 	edgeConn := edgeConnFactory.NewConn(service)
-	return edgeConn.Connect(session)
+	return edgeConn.ConnectWithOptions(session, options)
+}
+
+// dialWithFailover tries to connect through each router as it becomes available, giving each attempt up to
+// PerAttemptTimeout, until one succeeds, all expected routers have failed or the overall ConnectTimeout passes
+func dialWithFailover(service string, session *edge.Session, options *edge.DialOptions, routerC <-chan *edgeRouterConnResult, expected int) (edge.ServiceConn, error) {
+	logger := edge.Log().WithField("service", service)
+	deadline := time.Now().Add(options.ConnectTimeout)
+	timer := time.NewTimer(options.ConnectTimeout)
+	defer timer.Stop()
+
+	var lastErr error
+	for pending := expected; pending > 0; pending-- {
+		select {
+		case result := <-routerC:
+			if result.routerConnection == nil {
+				lastErr = result.err
+				continue
+			}
+
+			attemptOptions := *options
+			attemptOptions.ConnectTimeout = options.PerAttemptTimeout
+			if remaining := time.Until(deadline); remaining < attemptOptions.ConnectTimeout {
+				attemptOptions.ConnectTimeout = remaining
+			}
+			if attemptOptions.ConnectTimeout <= 0 {
+				continue
+			}
+
+			edgeConn := result.routerConnection.NewConn(service)
+			conn, err := edgeConn.ConnectWithOptions(session, &attemptOptions)
+			if err == nil {
+				return conn, nil
+			}
+			_ = edgeConn.Close()
+			var rejected *edge.DialRejectedError
+			if errors.As(err, &rejected) {
+				return nil, err
+			}
+			logger.WithError(err).Debugf("dial via edge router %v failed, trying next router", result.routerName)
+			lastErr = err
+		case <-timer.C:
+			if lastErr != nil {
+				return nil, fmt.Errorf("unable to dial service '%s' in time (%w)", service, lastErr)
+			}
+			return nil, errors.Errorf("unable to dial service '%s' in time", service)
+		}
+	}
+
+	if lastErr != nil {
+		return nil, fmt.Errorf("unable to dial service '%s' via any edge router (%w)", service, lastErr)
+	}
+	return nil, errors.Errorf("unable to dial service '%s' in time", service)
+}
+
+func (context *contextImpl) PrewarmRouters(serviceName string, options *edge.DialOptions) error {
+	if options == nil {
+		options = edge.DialOptionsFor(serviceName)
+	}
+	selected, selectedOptions, err := context.selectIdentity(options)
+	if err != nil {
+		return err
+	}
+	if selected != nil {
+		return selected.PrewarmRouters(serviceName, selectedOptions)
+	}
+	if err := options.Validate(); err != nil {
+		return err
+	}
+
+	if err := context.initialize(); err != nil {
+		return errors.Errorf("failed to initialize context: (%v)", err)
+	}
+
+	if err := context.ensureApiSession(); err != nil {
+		return fmt.Errorf("failed to prewarm: %v", err)
+	}
+
+	serviceId, ok := context.getServiceId(serviceName)
+	if !ok {
+		return &ServiceNotFoundError{Service: serviceName}
+	}
+
+	session, err := context.GetSession(serviceId)
+	if err != nil {
+		return err
+	}
+	return context.prewarmSession(serviceName, session, options)
+}
+
+// prewarmSession connects to the session's edge routers, at most options.MaxConcurrentDials at a time, and waits up to
+// the connect timeout for them. Connected routers stay in routerConnections, where dials pick them up
+func (context *contextImpl) prewarmSession(serviceName string, session *edge.Session, options *edge.DialOptions) error {
+	session, err := context.refreshEdgeRouters(session)
+	if err != nil {
+		return err
+	}
+
+	concurrency := options.MaxConcurrentDials
+	if concurrency <= 0 {
+		concurrency = edge.DefaultMaxConcurrentDials
+	}
+	urlCount := countRouterUrls(session)
+	resultC := make(chan *edgeRouterConnResult, urlCount)
+	semaphore := make(chan struct{}, concurrency)
+
+	for _, edgeRouter := range session.EdgeRouters {
+		for _, routerUrl := range edgeRouter.Urls {
+			go func(routerName, routerUrl string) {
+				semaphore <- struct{}{}
+				defer func() { <-semaphore }()
+				context.connectEdgeRouter(routerName, routerUrl, resultC)
+			}(edgeRouter.Name, routerUrl)
+		}
+	}
+
+	timeout := time.After(options.ConnectTimeout)
+	connected := 0
+	var lastErr error
+waitLoop:
+	for i := 0; i < urlCount; i++ {
+		select {
+		case result := <-resultC:
+			if result.routerConnection != nil {
+				connected++
+			} else {
+				lastErr = result.err
+			}
+		case <-timeout:
+			break waitLoop
+		}
+	}
+
+	if connected == 0 {
+		if lastErr != nil {
+			return errors.Errorf("unable to prewarm edge routers for service '%s' (%v)", serviceName, lastErr)
+		}
+		return errors.Errorf("unable to prewarm edge routers for service '%s' in time", serviceName)
+	}
+	edge.Log().WithField("service", serviceName).Debugf("prewarmed %v of %v edge router urls", connected, urlCount)
+	return nil
 }
 
 func (context *contextImpl) ensureApiSession() error {
@@ -369,10 +666,13 @@ func (context *contextImpl) ensureApiSession() error {
 }
 
 func (context *contextImpl) Listen(serviceName string) (edge.Listener, error) {
-	return context.ListenWithOptions(serviceName, edge.DefaultListenOptions())
+	return context.ListenWithOptions(serviceName, nil)
 }
 
 func (context *contextImpl) ListenWithOptions(serviceName string, options *edge.ListenOptions) (edge.Listener, error) {
+	if options == nil {
+		options = edge.ListenOptionsFor(serviceName)
+	}
 	if err := context.initialize(); err != nil {
 		return nil, errors.Errorf("failed to initialize context: (%v)", err)
 	}
@@ -382,40 +682,76 @@ func (context *contextImpl) ListenWithOptions(serviceName string, options *edge.
 	}
 
 	if id, ok, _ := context.GetServiceId(serviceName); ok {
-		return context.listenSession(id, serviceName, options), nil
+		return context.listenSession(id, serviceName, options)
 	}
 	return nil, errors.Errorf("service '%s' not found in ZT", serviceName)
 }
 
-func (context *contextImpl) listenSession(serviceId, serviceName string, options *edge.ListenOptions) edge.Listener {
-	listenerMgr := newListenerManager(serviceId, serviceName, context, options)
-	return listenerMgr.listener
+func (context *contextImpl) ListenMany(serviceNames []string, options *edge.ListenOptions) (*ListenerGroup, error) {
+	return listenMany(serviceNames, func(serviceName string) (edge.Listener, error) {
+		return context.ListenWithOptions(serviceName, options)
+	})
 }
 
-func (context *contextImpl) getEdgeRouterConn(session *edge.Session, options edge.ConnOptions) (edge.RouterConn, error) {
-	logger := pfxlog.Logger().WithField("ns", session.Token)
+func (context *contextImpl) ListenById(serviceId string, options *edge.ListenOptions) (edge.Listener, error) {
+	if err := context.initialize(); err != nil {
+		return nil, errors.Errorf("failed to initialize context: (%v)", err)
+	}
 
-	if refreshedSession, err := context.refreshSession(session.Id); err != nil {
-		if _, isNotFound := err.(*api.NotFound); isNotFound {
-			sessionKey := fmt.Sprintf("%s:%s", session.Service.Id, session.Type)
-			context.sessions.Delete(sessionKey)
-		}
+	if err := context.ensureApiSession(); err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
 
-		return nil, fmt.Errorf("no edge routers available, refresh errored: %v", err)
-	} else {
-		if len(refreshedSession.EdgeRouters) == 0 {
-			return nil, errors.New("no edge routers available, refresh yielded no new edge routers")
+	if service, ok := context.getServiceById(serviceId); ok {
+		if options == nil {
+			options = edge.ListenOptionsFor(service.Name)
 		}
+		return context.listenSession(serviceId, service.Name, options)
+	}
+	return nil, errors.Errorf("service with id '%s' not found in ZT", serviceId)
+}
 
-		session = refreshedSession
+func (context *contextImpl) listenSession(serviceId, serviceName string, options *edge.ListenOptions) (edge.Listener, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
 	}
+	options = context.resolveBindIdentity(options)
 
-	ch := make(chan *edgeRouterConnResult, 1)
+	listenerMgr := newListenerManager(serviceId, serviceName, context, options)
 
-	for _, edgeRouter := range session.EdgeRouters {
-		for _, routerUrl := range edgeRouter.Urls {
-			go context.connectEdgeRouter(edgeRouter.Name, routerUrl, ch)
-		}
+	// session creation and router connects are each bounded by the connect timeout
+	err := listenerMgr.initial.result(serviceName, listenerMgr.listener, 2*options.GetConnectTimeout())
+	if err == nil {
+		return listenerMgr.listener, nil
+	}
+	if partialErr, ok := err.(*PartialListenError); ok {
+		return listenerMgr.listener, partialErr
+	}
+	_ = listenerMgr.listener.Close()
+	return nil, err
+}
+
+// resolveBindIdentity returns options with Identity set to the edge identity's name if BindUsingEdgeIdentity is set.
+// The caller's options aren't modified
+func (context *contextImpl) resolveBindIdentity(options *edge.ListenOptions) *edge.ListenOptions {
+	if !options.BindUsingEdgeIdentity || context.apiSession == nil || context.apiSession.Identity == nil {
+		return options
+	}
+	name := context.apiSession.Identity.Name
+	if options.Identity != "" && options.Identity != name {
+		edge.Log().Warnf("listen options identity [%v] overridden by edge identity [%v]", options.Identity, name)
+	}
+	resolved := *options
+	resolved.Identity = name
+	return &resolved
+}
+
+func (context *contextImpl) getEdgeRouterConn(session *edge.Session, options edge.ConnOptions) (edge.RouterConn, error) {
+	logger := edge.Log().WithField("ns", session.Token)
+
+	_, ch, err := context.connectEdgeRouters(session)
+	if err != nil {
+		return nil, err
 	}
 
 	timeout := time.After(options.GetConnectTimeout())
@@ -432,14 +768,59 @@ func (context *contextImpl) getEdgeRouterConn(session *edge.Session, options edg
 	}
 }
 
+// connectEdgeRouters refreshes the session and starts connecting to each of its edge routers. Results are
+// delivered on the returned channel, which has room for one per router url
+func (context *contextImpl) connectEdgeRouters(session *edge.Session) (*edge.Session, chan *edgeRouterConnResult, error) {
+	session, err := context.refreshEdgeRouters(session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ch := make(chan *edgeRouterConnResult, countRouterUrls(session))
+
+	for _, edgeRouter := range session.EdgeRouters {
+		for _, routerUrl := range edgeRouter.Urls {
+			go context.connectEdgeRouter(edgeRouter.Name, routerUrl, ch)
+		}
+	}
+
+	return session, ch, nil
+}
+
+// refreshEdgeRouters refreshes the session, so that connects go to its current edge routers
+func (context *contextImpl) refreshEdgeRouters(session *edge.Session) (*edge.Session, error) {
+	if refreshedSession, err := context.refreshSession(session.Id); err != nil {
+		if _, isNotFound := err.(*api.NotFound); isNotFound {
+			sessionKey := fmt.Sprintf("%s:%s", session.Service.Id, session.Type)
+			context.sessions.Delete(sessionKey)
+		}
+
+		return nil, fmt.Errorf("no edge routers available, refresh errored: %v", err)
+	} else {
+		if len(refreshedSession.EdgeRouters) == 0 {
+			return nil, errors.New("no edge routers available, refresh yielded no new edge routers")
+		}
+
+		return refreshedSession, nil
+	}
+}
+
+func countRouterUrls(session *edge.Session) int {
+	urlCount := 0
+	for _, edgeRouter := range session.EdgeRouters {
+		urlCount += len(edgeRouter.Urls)
+	}
+	return urlCount
+}
+
 func (context *contextImpl) connectEdgeRouter(routerName, ingressUrl string, ret chan *edgeRouterConnResult) {
-	logger := pfxlog.Logger()
+	logger := edge.Log()
 
 	if edgeConn, found := context.routerConnections.Get(ingressUrl); found {
 		conn := edgeConn.(edge.RouterConn)
 		if !conn.IsClosed() {
 			if ret != nil {
-				ret <- &edgeRouterConnResult{routerUrl: ingressUrl, routerConnection: conn}
+				ret <- &edgeRouterConnResult{routerName: routerName, routerUrl: ingressUrl, routerConnection: conn}
 			}
 			return
 		} else {
@@ -447,31 +828,21 @@ func (context *contextImpl) connectEdgeRouter(routerName, ingressUrl string, ret
 		}
 	}
 
-	ingAddr, err := transport.ParseAddress(ingressUrl)
-	if err != nil {
-		logger.WithError(err).Errorf("failed to parse url[%s]", ingressUrl)
-		if ret != nil {
-			ret <- &edgeRouterConnResult{routerUrl: ingressUrl, err: err}
-		}
-		return
-	}
-
-	id := context.id
-	dialer := channel2.NewClassicDialer(identity.NewIdentity(id), ingAddr, map[int32][]byte{
-		edge.SessionTokenHeader: []byte(context.apiSession.Token),
-	})
-
-	ch, err := channel2.NewChannel("ziti-sdk", dialer, nil)
+	ch, remoteAddr, err := context.openRouterChannel(ingressUrl)
 	if err != nil {
 		logger.Error(err)
 		select {
-		case ret <- &edgeRouterConnResult{routerUrl: ingressUrl, err: err}:
+		case ret <- &edgeRouterConnResult{routerName: routerName, routerUrl: ingressUrl, err: err}:
 		default:
 		}
 		return
 	}
 
-	edgeConn := impl.NewEdgeConnFactory(routerName, ingressUrl, ch, context)
+	var muxOptions *edge.MsgMuxOptions
+	if context.options != nil {
+		muxOptions = context.options.MsgMuxOptions
+	}
+	edgeConn := impl.NewEdgeConnFactoryWithMuxOptions(routerName, ingressUrl, remoteAddr, ch, context, muxOptions)
 	logger.Debugf("connected to %s", ingressUrl)
 
 	useConn := context.routerConnections.Upsert(ingressUrl, edgeConn,
@@ -479,7 +850,7 @@ func (context *contextImpl) connectEdgeRouter(routerName, ingressUrl string, ret
 			if exist { // use the routerConnection already in the map, close new one
 				go func() {
 					if err := newV.(edge.RouterConn).Close(); err != nil {
-						pfxlog.Logger().Errorf("unable to close router connection (%v)", err)
+						edge.Log().Errorf("unable to close router connection (%v)", err)
 					}
 				}()
 				return oldV
@@ -489,11 +860,58 @@ func (context *contextImpl) connectEdgeRouter(routerName, ingressUrl string, ret
 		})
 
 	select {
-	case ret <- &edgeRouterConnResult{routerUrl: ingressUrl, routerConnection: useConn.(edge.RouterConn)}:
+	case ret <- &edgeRouterConnResult{routerName: routerName, routerUrl: ingressUrl, routerConnection: useConn.(edge.RouterConn)}:
 	default:
 	}
 }
 
+// openRouterChannel sets up a channel to the edge router at ingressUrl, returning it along with the address dialed
+func (context *contextImpl) openRouterChannel(ingressUrl string) (channel2.Channel, string, error) {
+	if context.routerChannelOpener != nil {
+		return context.routerChannelOpener(ingressUrl)
+	}
+
+	ingAddr, err := transport.ParseAddress(ingressUrl)
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to parse url[%s]", ingressUrl)
+	}
+
+	dialedAddr := &dialRecordingAddress{Address: ingAddr}
+	dialer := channel2.NewClassicDialer(identity.NewIdentity(context.id), dialedAddr, map[int32][]byte{
+		edge.SessionTokenHeader: []byte(context.apiSession.Token),
+	})
+
+	ch, err := channel2.NewChannel("ziti-sdk", dialer, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	return ch, dialedAddr.getRemoteAddr(), nil
+}
+
+// dialRecordingAddress records the remote address of the last connection dialed through it, which may differ from
+// the address it was given when that's a name resolving to multiple hosts
+type dialRecordingAddress struct {
+	transport.Address
+	lock       sync.Mutex
+	remoteAddr string
+}
+
+func (addr *dialRecordingAddress) Dial(name string, i *identity.TokenId, tcfg transport.Configuration) (transport.Connection, error) {
+	conn, err := addr.Address.Dial(name, i, tcfg)
+	if err == nil && conn.Conn() != nil {
+		addr.lock.Lock()
+		addr.remoteAddr = conn.Conn().RemoteAddr().String()
+		addr.lock.Unlock()
+	}
+	return conn, err
+}
+
+func (addr *dialRecordingAddress) getRemoteAddr() string {
+	addr.lock.Lock()
+	defer addr.lock.Unlock()
+	return addr.remoteAddr
+}
+
 func (context *contextImpl) GetServiceId(name string) (string, bool, error) {
 	if err := context.initialize(); err != nil {
 		return "", false, errors.Errorf("failed to initialize context: (%v)", err)
@@ -513,7 +931,7 @@ func (context *contextImpl) GetService(name string) (*edge.Service, bool) {
 	}
 
 	if err := context.ensureApiSession(); err != nil {
-		pfxlog.Logger().Warnf("failed to get service: %v", err)
+		edge.Log().Warnf("failed to get service: %v", err)
 		return nil, false
 	}
 
@@ -532,6 +950,19 @@ func (context *contextImpl) getServiceId(name string) (string, bool) {
 	return "", false
 }
 
+// getServiceById looks up a cached service by id. Services are keyed by name, so this is a scan
+func (context *contextImpl) getServiceById(id string) (*edge.Service, bool) {
+	var result *edge.Service
+	context.services.Range(func(key, value interface{}) bool {
+		if svc := value.(*edge.Service); svc.Id == id {
+			result = svc
+			return false
+		}
+		return true
+	})
+	return result, result != nil
+}
+
 func (context *contextImpl) GetServices() ([]edge.Service, error) {
 	if err := context.initialize(); err != nil {
 		return nil, errors.Errorf("failed to initialize context: (%v)", err)
@@ -550,6 +981,70 @@ func (context *contextImpl) GetServices() ([]edge.Service, error) {
 	return res, nil
 }
 
+func (context *contextImpl) CanDial(serviceName string) (bool, error) {
+	service, found := context.GetService(serviceName)
+	if !found || !service.HasPermission(edge.SessionDial) {
+		return false, nil
+	}
+
+	session, err := context.GetSession(service.Id)
+	if err != nil {
+		return false, err
+	}
+
+	for _, edgeRouter := range session.EdgeRouters {
+		if len(edgeRouter.Urls) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (context *contextImpl) GetTerminatorState(serviceName string) ([]edge.TerminatorState, error) {
+	service, found := context.GetService(serviceName)
+	if !found {
+		return nil, errors.Errorf("service '%s' not found in ZT", serviceName)
+	}
+
+	terminators, err := context.ctrlClt.GetServiceTerminators(service.Id)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get terminators for service '%s'", serviceName)
+	}
+
+	result := make([]edge.TerminatorState, 0, len(terminators))
+	for _, terminator := range terminators {
+		result = append(result, *terminator)
+	}
+	return result, nil
+}
+
+func (context *contextImpl) ListDialableServices() ([]edge.ServiceInfo, error) {
+	return context.listServicesWithPermission(edge.SessionDial)
+}
+
+func (context *contextImpl) ListBindableServices() ([]edge.ServiceInfo, error) {
+	return context.listServicesWithPermission(edge.SessionBind)
+}
+
+func (context *contextImpl) listServicesWithPermission(sessionType edge.SessionType) ([]edge.ServiceInfo, error) {
+	services, err := context.GetServices()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []edge.ServiceInfo
+	for _, svc := range services {
+		if svc.HasPermission(sessionType) {
+			result = append(result, edge.ServiceInfo{
+				Id:          svc.Id,
+				Name:        svc.Name,
+				Permissions: append([]string(nil), svc.Permissions...),
+			})
+		}
+	}
+	return result, nil
+}
+
 func (context *contextImpl) getServices() ([]*edge.Service, error) {
 	return context.ctrlClt.GetServices()
 }
@@ -624,7 +1119,7 @@ func (context *contextImpl) deleteServiceSessions(svcId string) {
 }
 
 func (context *contextImpl) Close() {
-	logger := pfxlog.Logger()
+	logger := edge.Log()
 
 	// remove any closed connections
 	for entry := range context.routerConnections.IterBuffered() {
@@ -650,13 +1145,25 @@ func newListenerManager(serviceId, serviceName string, context *contextImpl, opt
 		context:           context,
 		options:           options,
 		routerConnections: map[string]edge.RouterConn{},
+		listeners:         map[string]edge.Listener{},
 		connects:          map[string]time.Time{},
+		connectFailures:   map[string]time.Time{},
+		resumes:           map[string]time.Time{},
 		connectChan:       make(chan *edgeRouterConnResult, 3),
 		eventChan:         make(chan listenerEvent),
 		disconnectedTime:  &now,
+		initial:           newInitialBinds(),
 	}
 
 	listenerMgr.listener = impl.NewMultiListener(serviceName, listenerMgr.GetCurrentSession)
+	listenerMgr.listener.SetPriorityFunc(options.PriorityFunc)
+	listenerMgr.listener.SetRebindHandler(func(session *edge.Session, old, new edge.Listener) {
+		select {
+		case listenerMgr.eventChan <- &listenerRebindEvent{session: session, old: old, new: new}:
+		case <-time.After(5 * time.Second):
+			edge.Log().Warnf("timed out recording rebind of service %v", serviceName)
+		}
+	})
 
 	go listenerMgr.run()
 
@@ -669,17 +1176,24 @@ type listenerManager struct {
 	session            *edge.Session
 	options            *edge.ListenOptions
 	routerConnections  map[string]edge.RouterConn
+	listeners          map[string]edge.Listener
 	connects           map[string]time.Time
+	connectFailures    map[string]time.Time
+	resumes            map[string]time.Time // router name -> when to give up resuming its bind
 	listener           impl.MultiListener
 	connectChan        chan *edgeRouterConnResult
 	eventChan          chan listenerEvent
 	sessionRefreshTime time.Time
 	disconnectedTime   *time.Time
+	initial            *initialBinds
 }
 
 func (mgr *listenerManager) run() {
+	defer mgr.initial.listenerClosed(nil)
+
 	mgr.createSessionWithBackoff()
 	mgr.makeMoreListeners()
+	mgr.initial.start(mgr.expectedBinds())
 
 	ticker := time.NewTicker(250 * time.Millisecond)
 	refreshTicker := time.NewTicker(30 * time.Second)
@@ -696,6 +1210,7 @@ func (mgr *listenerManager) run() {
 		case <-refreshTicker.C:
 			mgr.refreshSession()
 		case <-ticker.C:
+			mgr.checkResumes()
 			mgr.makeMoreListeners()
 		}
 	}
@@ -705,40 +1220,48 @@ func (mgr *listenerManager) handleRouterConnectResult(result *edgeRouterConnResu
 	delete(mgr.connects, result.routerUrl)
 	routerConnection := result.routerConnection
 	if routerConnection == nil {
+		mgr.connectFailures[result.routerName] = time.Now()
+		mgr.initial.connected(result.routerName, false, result.err)
 		return
 	}
+	delete(mgr.connectFailures, result.routerName)
 
-	if len(mgr.routerConnections) < mgr.options.MaxConnections {
+	if !mgr.atMaxConnections() {
 		if _, ok := mgr.routerConnections[routerConnection.GetRouterName()]; !ok {
 			mgr.routerConnections[routerConnection.GetRouterName()] = routerConnection
+			mgr.initial.connected(result.routerName, true, nil)
 			go mgr.createListener(routerConnection, mgr.session)
+		} else {
+			mgr.initial.connected(result.routerName, false, nil)
 		}
 	} else {
-		pfxlog.Logger().Debugf("ignoring connection to %v, already have max connections %v", result.routerUrl, len(mgr.routerConnections))
+		mgr.initial.connected(result.routerName, false, nil)
+		edge.Log().Debugf("ignoring connection to %v, already have max connections %v", result.routerUrl, len(mgr.routerConnections))
 	}
 }
 
 func (mgr *listenerManager) createListener(routerConnection edge.RouterConn, session *edge.Session) {
 	start := time.Now()
-	logger := pfxlog.Logger()
+	logger := edge.Log()
 	serviceName := mgr.listener.GetServiceName()
 	edgeConn := routerConnection.NewConn(serviceName)
-	listener, err := edgeConn.Listen(session, serviceName, mgr.options)
+	listener, err := edgeConn.Listen(session, serviceName, mgr.listener.BindOptions(mgr.options))
 	elapsed := time.Now().Sub(start)
 	logger.Debugf("listener established to %v in %vms", routerConnection.Key(), elapsed.Milliseconds())
+	mgr.listener.NotifyBind(routerConnection.GetRouterName(), err)
 	if err == nil {
 		mgr.listener.AddListener(listener, func() {
 			mgr.eventChan <- &routerConnectionListenFailedEvent{
 				router: routerConnection.GetRouterName(),
 			}
 		})
-		mgr.eventChan <- listenSuccessEvent{}
+		mgr.eventChan <- &listenSuccessEvent{router: routerConnection.GetRouterName(), listener: listener}
 	} else {
 		logger.Errorf("creating listener failed: %v", err)
 		if err := edgeConn.Close(); err != nil {
-			pfxlog.Logger().Errorf("failed to close edgeConn %v for service '%v' (%v)", edgeConn.Id(), serviceName, err)
+			edge.Log().Errorf("failed to close edgeConn %v for service '%v' (%v)", edgeConn.Id(), serviceName, err)
 		}
-		mgr.eventChan <- &routerConnectionListenFailedEvent{router: routerConnection.GetRouterName()}
+		mgr.eventChan <- &routerConnectionListenFailedEvent{router: routerConnection.GetRouterName(), err: err}
 	}
 }
 
@@ -751,36 +1274,143 @@ func (mgr *listenerManager) makeMoreListeners() {
 	if len(mgr.session.EdgeRouters) == 0 && len(mgr.routerConnections) == 0 {
 		now := time.Now()
 		if mgr.disconnectedTime.Add(mgr.options.ConnectTimeout).Before(now) {
-			pfxlog.Logger().Warn("disconnected for longer than configured connect timeout. closing")
+			edge.Log().Warn("disconnected for longer than configured connect timeout. closing")
 			err := errors.New("disconnected for longer than connect timeout. closing")
-			mgr.listener.CloseWithError(err)
+			mgr.closeWithError(err)
 			return
 		}
 
 		if mgr.sessionRefreshTime.Add(time.Second).Before(now) {
-			pfxlog.Logger().Warnf("no edge routers available, polling more frequently")
+			edge.Log().Warnf("no edge routers available, polling more frequently")
 			mgr.refreshSession()
 		}
 	}
 
-	if mgr.listener.IsClosed() || len(mgr.routerConnections) >= mgr.options.MaxConnections || len(mgr.session.EdgeRouters) <= len(mgr.routerConnections) {
+	if mgr.listener.IsClosed() || mgr.atMaxConnections() || len(mgr.session.EdgeRouters) <= len(mgr.routerConnections) {
 		return
 	}
 
-	for _, edgeRouter := range mgr.session.EdgeRouters {
+	routers := mgr.bindableRouters()
+	if len(routers) == 0 && len(mgr.routerConnections) == 0 {
+		mgr.closeWithError(errors.Errorf("router selector chose none of the %v available edge routers", len(mgr.session.EdgeRouters)))
+		return
+	}
+
+	// with a selector, only as many routers as are still needed are connected to, so that they're bound in order
+	remaining := -1
+	if mgr.options.RouterSelector != nil && mgr.options.MaxConnections > 0 {
+		remaining = mgr.options.MaxConnections - len(mgr.routerConnections)
+	}
+
+	for _, edgeRouter := range routers {
+		if remaining == 0 {
+			break
+		}
 		if _, ok := mgr.routerConnections[edgeRouter.Name]; ok {
 			// already connected to this router
 			continue
 		}
+		if remaining > 0 {
+			remaining--
+		}
+		mgr.connectRouter(edgeRouter)
+	}
+}
 
-		for _, routerUrl := range edgeRouter.Urls {
-			if _, ok := mgr.connects[routerUrl]; ok {
-				// this url already has a connect in progress
-				continue
+// connectRouter connects to each of the router's urls which doesn't already have a connect in progress
+func (mgr *listenerManager) connectRouter(edgeRouter edge.EdgeRouter) {
+	for _, routerUrl := range edgeRouter.Urls {
+		if _, ok := mgr.connects[routerUrl]; ok {
+			// this url already has a connect in progress
+			continue
+		}
+
+		mgr.connects[routerUrl] = time.Now()
+		mgr.initial.connecting(edgeRouter.Name)
+		go mgr.context.connectEdgeRouter(edgeRouter.Name, routerUrl, mgr.connectChan)
+	}
+}
+
+// resumeBind starts reconnecting to a router whose conn dropped, so the bind is made again there with the current
+// session, for up to ResumeBindWindow. It returns false if the bind shouldn't be resumed
+func (mgr *listenerManager) resumeBind(routerName string) bool {
+	if mgr.options.ResumeBindWindow <= 0 || mgr.listener.IsClosed() || mgr.session == nil {
+		return false
+	}
+
+	for _, edgeRouter := range mgr.session.EdgeRouters {
+		if edgeRouter.Name == routerName {
+			if _, resuming := mgr.resumes[routerName]; !resuming {
+				mgr.resumes[routerName] = time.Now().Add(mgr.options.ResumeBindWindow)
 			}
+			edge.Log().Debugf("conn to router %v dropped, resuming bind of service %v", routerName, mgr.listener.GetServiceName())
+			mgr.connectRouter(edgeRouter)
+			return true
+		}
+	}
+	return false
+}
 
-			mgr.connects[routerUrl] = time.Now()
-			go mgr.context.connectEdgeRouter(edgeRouter.Name, routerUrl, mgr.connectChan)
+// checkResumes retries connects for binds being resumed, and falls back to refreshing the session once a bind
+// couldn't be resumed within ResumeBindWindow
+func (mgr *listenerManager) checkResumes() {
+	expired := false
+	now := time.Now()
+	for routerName, deadline := range mgr.resumes {
+		if now.After(deadline) {
+			edge.Log().Debugf("unable to resume bind of service %v on router %v in time", mgr.listener.GetServiceName(), routerName)
+			delete(mgr.resumes, routerName)
+			expired = true
+		} else if _, connected := mgr.routerConnections[routerName]; !connected {
+			for _, edgeRouter := range mgr.session.EdgeRouters {
+				if edgeRouter.Name == routerName {
+					mgr.connectRouter(edgeRouter)
+				}
+			}
+		}
+	}
+	if expired {
+		mgr.refreshSession()
+	}
+}
+
+// expectedBinds returns the number of routers we'd like to bind on, given the routers currently available
+func (mgr *listenerManager) expectedBinds() int {
+	routers := mgr.bindableRouters()
+	if mgr.options.MaxConnections > 0 && mgr.options.MaxConnections < len(routers) {
+		return mgr.options.MaxConnections
+	}
+	return len(routers)
+}
+
+// atMaxConnections reports whether the configured number of router bindings has been reached. A MaxConnections
+// of zero means unlimited, so we bind on every available router
+func (mgr *listenerManager) atMaxConnections() bool {
+	return mgr.options.MaxConnections > 0 && len(mgr.routerConnections) >= mgr.options.MaxConnections
+}
+
+// unbindRemovedRouters closes listeners on routers which are no longer part of the session, or which the
+// RouterSelector no longer picks. Only used when MaxConnections is unlimited, as otherwise we keep whatever bindings
+// we've already established
+func (mgr *listenerManager) unbindRemovedRouters() {
+	if mgr.options.MaxConnections > 0 || mgr.session == nil {
+		return
+	}
+
+	available := map[string]struct{}{}
+	for _, edgeRouter := range mgr.bindableRouters() {
+		available[edgeRouter.Name] = struct{}{}
+	}
+
+	for routerName, listener := range mgr.listeners {
+		if _, found := available[routerName]; !found {
+			edge.Log().Debugf("router %v no longer available for service %v, unbinding", routerName, mgr.listener.GetServiceName())
+			delete(mgr.listeners, routerName)
+			go func(listener edge.Listener) {
+				if err := listener.Close(); err != nil {
+					edge.Log().Errorf("failed to close listener on removed router (%v)", err)
+				}
+			}(listener)
 		}
 	}
 }
@@ -789,11 +1419,11 @@ func (mgr *listenerManager) refreshSession() {
 	session, err := mgr.context.refreshSession(mgr.session.Id)
 	if err != nil {
 		if errors2.Is(err, api.NotAuthorized) {
-			pfxlog.Logger().Debugf("failure refreshing bind session for service %v (%v)", mgr.listener.GetServiceName(), err)
+			edge.Log().Debugf("failure refreshing bind session for service %v (%v)", mgr.listener.GetServiceName(), err)
 			if err := mgr.context.EnsureAuthenticated(mgr.options); err != nil {
 				err := fmt.Errorf("unable to establish API session (%w)", err)
 				if len(mgr.routerConnections) == 0 {
-					mgr.listener.CloseWithError(err)
+					mgr.closeWithError(err)
 				}
 				return
 			}
@@ -802,19 +1432,23 @@ func (mgr *listenerManager) refreshSession() {
 		session, err = mgr.context.refreshSession(mgr.session.Id)
 		if err != nil {
 			if errors2.Is(err, api.NotAuthorized) {
-				pfxlog.Logger().Errorf(
+				edge.Log().Errorf(
 					"failure refreshing bind session even after re-authenticating api session. service %v (%v)",
 					mgr.listener.GetServiceName(), err)
 				if len(mgr.routerConnections) == 0 {
-					mgr.listener.CloseWithError(err)
+					mgr.closeWithError(err)
 				}
 				return
 			}
 
-			pfxlog.Logger().Errorf("failed to to refresh session %v: (%v)", mgr.session.Id, err)
+			edge.Log().Errorf("failed to to refresh session %v: (%v)", mgr.session.Id, err)
 
-			// try to create new session
+			// try to create new session, moving existing binds over to it
+			oldToken := mgr.session.Token
 			mgr.createSessionWithBackoff()
+			if mgr.session.Token != oldToken && len(mgr.listeners) > 0 {
+				go mgr.rotateSession(mgr.session)
+			}
 		}
 	}
 
@@ -823,6 +1457,15 @@ func (mgr *listenerManager) refreshSession() {
 		session.Token = mgr.session.Token
 		mgr.session = session
 		mgr.sessionRefreshTime = time.Now()
+		mgr.unbindRemovedRouters()
+	}
+}
+
+// rotateSession rebinds the existing listeners with a new session. It must not be called from the run loop, as
+// rebinds are reported back to it as events
+func (mgr *listenerManager) rotateSession(session *edge.Session) {
+	if err := mgr.listener.RefreshSession(session); err != nil {
+		edge.Log().WithError(err).Errorf("failed to rebind service %v with new session", mgr.listener.GetServiceName())
 	}
 }
 
@@ -837,7 +1480,7 @@ func (mgr *listenerManager) createSessionWithBackoff() {
 
 func (mgr *listenerManager) createSession() error {
 	start := time.Now()
-	logger := pfxlog.Logger()
+	logger := edge.Log()
 	logger.Debugf("establishing bind session to service %v", mgr.listener.GetServiceName())
 	session, err := mgr.context.GetBindSession(mgr.serviceId)
 	if err != nil {
@@ -846,14 +1489,14 @@ func (mgr *listenerManager) createSession() error {
 			if err := mgr.context.EnsureAuthenticated(mgr.options); err != nil {
 				err := fmt.Errorf("unable to establish API session (%w)", err)
 				if len(mgr.routerConnections) == 0 {
-					mgr.listener.CloseWithError(err)
+					mgr.closeWithError(err)
 				}
 				return backoff.Permanent(err)
 			}
 		} else if errors2.As(err, &api.NotAccessible{}) {
 			logger.Warnf("session create failure not recoverable, not retrying")
 			if len(mgr.routerConnections) == 0 {
-				mgr.listener.CloseWithError(err)
+				mgr.closeWithError(err)
 			}
 			return backoff.Permanent(err)
 		}
@@ -866,6 +1509,11 @@ func (mgr *listenerManager) createSession() error {
 	return nil
 }
 
+func (mgr *listenerManager) closeWithError(err error) {
+	mgr.initial.listenerClosed(err)
+	mgr.listener.CloseWithError(err)
+}
+
 func (mgr *listenerManager) GetCurrentSession() *edge.Session {
 	if mgr.listener.IsClosed() {
 		return nil
@@ -895,29 +1543,66 @@ type listenerEvent interface {
 
 type routerConnectionListenFailedEvent struct {
 	router string
+	err    error
 }
 
 func (event *routerConnectionListenFailedEvent) handle(mgr *listenerManager) {
-	pfxlog.Logger().Infof("child listener connection closed. parent listener closed: %v", mgr.listener.IsClosed())
+	mgr.initial.bindFailed(event.router, event.err)
+	edge.Log().Infof("child listener connection closed. parent listener closed: %v", mgr.listener.IsClosed())
 	delete(mgr.routerConnections, event.router)
+	delete(mgr.listeners, event.router)
 	now := time.Now()
 	if len(mgr.routerConnections) == 0 {
 		mgr.disconnectedTime = &now
 	}
+
+	// a listener which closed after binding lost its router conn, while a failed bind goes straight to a refresh
+	if event.err == nil && mgr.resumeBind(event.router) {
+		return
+	}
+	delete(mgr.resumes, event.router)
 	mgr.refreshSession()
 	mgr.makeMoreListeners()
 }
 
 type edgeRouterConnResult struct {
+	routerName       string
 	routerUrl        string
 	routerConnection edge.RouterConn
 	err              error
 }
 
-type listenSuccessEvent struct{}
+type listenSuccessEvent struct {
+	router   string
+	listener edge.Listener
+}
 
-func (event listenSuccessEvent) handle(mgr *listenerManager) {
+func (event *listenSuccessEvent) handle(mgr *listenerManager) {
+	if _, resuming := mgr.resumes[event.router]; resuming {
+		edge.Log().Debugf("resumed bind of service %v on router %v", mgr.listener.GetServiceName(), event.router)
+		delete(mgr.resumes, event.router)
+	}
+	mgr.initial.bound(event.router)
 	mgr.disconnectedTime = nil
+	mgr.listeners[event.router] = event.listener
+}
+
+// listenerRebindEvent records a child listener being replaced by one bound with a new session
+type listenerRebindEvent struct {
+	session *edge.Session
+	old     edge.Listener
+	new     edge.Listener
+}
+
+func (event *listenerRebindEvent) handle(mgr *listenerManager) {
+	if mgr.session == nil || mgr.session.Token != event.session.Token {
+		mgr.session = event.session
+	}
+	for router, listener := range mgr.listeners {
+		if listener == event.old {
+			mgr.listeners[router] = event.new
+		}
+	}
 }
 
 type getSessionEvent struct {
@@ -1,12 +1,28 @@
 package ziti
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"github.com/openziti/foundation/channel2"
+	"github.com/openziti/foundation/identity/identity"
+	"github.com/openziti/foundation/metrics"
+	"github.com/openziti/foundation/transport/tcp"
+	"github.com/openziti/foundation/util/concurrenz"
 	"github.com/openziti/sdk-golang/ziti/config"
 	"github.com/openziti/sdk-golang/ziti/edge"
+	"github.com/openziti/sdk-golang/ziti/edge/api"
+	"github.com/openziti/sdk-golang/ziti/edge/edgetest"
+	"github.com/openziti/sdk-golang/ziti/edge/impl"
+	cmap "github.com/orcaman/concurrent-map"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func Test_contextImpl_processServiceUpdates(t *testing.T) {
@@ -83,3 +99,1186 @@ func Test_contextImpl_processServiceUpdates(t *testing.T) {
 	assert.Equal(t, len(services), len(callbacks))
 	assert.Equal(t, config.ServiceChanged, callbacks[services[0].Name])
 }
+
+type testListener struct {
+	edge.Listener
+	closed concurrenz.AtomicBoolean
+}
+
+func (l *testListener) Close() error {
+	l.closed.Set(true)
+	return nil
+}
+
+func (l *testListener) IsClosed() bool {
+	return l.closed.Get()
+}
+
+func Test_listenerManager_unlimitedMaxConnections(t *testing.T) {
+	req := require.New(t)
+
+	mgr := &listenerManager{
+		options:           &edge.ListenOptions{MaxConnections: 0},
+		routerConnections: map[string]edge.RouterConn{},
+		listeners:         map[string]edge.Listener{},
+		listener:          impl.NewMultiListener("test", nil),
+	}
+
+	setRouters := func(names ...string) {
+		mgr.session = &edge.Session{}
+		for _, name := range names {
+			mgr.session.EdgeRouters = append(mgr.session.EdgeRouters, edge.EdgeRouter{Name: name})
+		}
+	}
+
+	bind := func(names ...string) map[string]*testListener {
+		result := map[string]*testListener{}
+		for _, name := range names {
+			listener := &testListener{}
+			mgr.routerConnections[name] = nil
+			(&listenSuccessEvent{router: name, listener: listener}).handle(mgr)
+			result[name] = listener
+		}
+		return result
+	}
+
+	setRouters("a", "b", "c", "d", "e")
+	listeners := bind("a", "b", "c", "d", "e")
+	req.False(mgr.atMaxConnections())
+
+	// routers c and e go away
+	setRouters("a", "b", "d")
+	mgr.unbindRemovedRouters()
+
+	for name, listener := range listeners {
+		if name == "c" || name == "e" {
+			req.NoError(listener.closed.WaitForState(true, time.Second, time.Millisecond*5), "listener %v should be closed", name)
+		} else {
+			req.False(listener.IsClosed(), "listener %v should be open", name)
+		}
+	}
+	req.Equal(3, len(mgr.listeners))
+
+	// new routers appear
+	setRouters("a", "b", "d", "f")
+	newListeners := bind("f")
+	mgr.unbindRemovedRouters()
+	req.False(newListeners["f"].IsClosed())
+	req.Equal(4, len(mgr.listeners))
+
+	// bounded listeners don't unbind and do respect the max
+	mgr.options.MaxConnections = 3
+	setRouters("a")
+	mgr.unbindRemovedRouters()
+	req.Equal(4, len(mgr.listeners))
+	req.True(mgr.atMaxConnections())
+}
+
+func Test_initialBinds(t *testing.T) {
+	listener := &testListener{}
+	connectErr := errors.New("connect failed")
+	bindErr := errors.New("bind failed")
+
+	t.Run("all succeed", func(t *testing.T) {
+		req := require.New(t)
+		binds := newInitialBinds()
+		binds.connecting("a")
+		binds.connecting("b")
+		binds.start(2)
+		binds.connected("a", true, nil)
+		binds.connected("b", true, nil)
+		binds.bound("a")
+		binds.bound("b")
+		req.NoError(binds.result("test", listener, time.Second))
+	})
+
+	t.Run("surplus router failures are ignored", func(t *testing.T) {
+		req := require.New(t)
+		binds := newInitialBinds()
+		binds.connecting("a")
+		binds.connecting("b")
+		binds.start(1)
+		binds.connected("a", true, nil)
+		binds.bound("a")
+		req.NoError(binds.result("test", listener, time.Second))
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		req := require.New(t)
+		binds := newInitialBinds()
+		binds.connecting("a")
+		binds.connecting("b")
+		binds.connecting("c")
+		binds.start(3)
+		binds.connected("a", true, nil)
+		binds.bound("a")
+		binds.connected("b", false, connectErr)
+		binds.connected("c", true, nil)
+		binds.bindFailed("c", bindErr)
+
+		err := binds.result("test", listener, time.Second)
+		partialErr, ok := err.(*PartialListenError)
+		req.True(ok, "expected partial listen error, got %v", err)
+		req.Equal(listener, partialErr.Listener)
+		req.Equal(map[string]error{"b": connectErr, "c": bindErr}, partialErr.Errors)
+	})
+
+	t.Run("all fail", func(t *testing.T) {
+		req := require.New(t)
+		binds := newInitialBinds()
+		binds.connecting("a")
+		binds.connecting("b")
+		binds.start(2)
+		binds.connected("a", false, connectErr)
+		binds.connected("b", true, nil)
+		binds.bindFailed("b", bindErr)
+
+		err := binds.result("test", listener, time.Second)
+		req.Error(err)
+		_, ok := err.(*PartialListenError)
+		req.False(ok)
+	})
+
+	t.Run("listener closed", func(t *testing.T) {
+		req := require.New(t)
+		binds := newInitialBinds()
+		binds.listenerClosed(errors.New("no session"))
+		err := binds.result("test", listener, time.Second)
+		req.Error(err)
+		req.Contains(err.Error(), "no session")
+	})
+}
+
+func Test_dialWithFailover(t *testing.T) {
+	req := require.New(t)
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+
+	routerC := make(chan *edgeRouterConnResult, 2)
+	for _, name := range []string{"slow", "fast"} {
+		router := edgetest.NewRouter(name)
+		defer router.Close()
+		if name == "slow" {
+			router.SetConnectDelay(time.Second)
+		}
+
+		hostCh, err := router.Dial()
+		req.NoError(err)
+		host := impl.NewEdgeConnFactory(name, "host-"+name, hostCh, nil)
+		listener, err := host.NewConn("test-service").Listen(session, "test-service", edge.DefaultListenOptions())
+		req.NoError(err)
+		defer func() { _ = listener.Close() }()
+
+		dialerCh, err := router.Dial()
+		req.NoError(err)
+		dialer := impl.NewEdgeConnFactory(name, "dialer-"+name, dialerCh, nil)
+		routerC <- &edgeRouterConnResult{routerName: name, routerConnection: dialer}
+	}
+
+	options := edge.DefaultDialOptions()
+	options.ConnectTimeout = 2 * time.Second
+	options.PerAttemptTimeout = 100 * time.Millisecond
+
+	// the slow router is offered first, but only holds up the dial for one attempt
+	start := time.Now()
+	conn, err := dialWithFailover("test-service", session, options, routerC, 2)
+	req.NoError(err)
+	req.True(time.Since(start) < 500*time.Millisecond)
+	req.Equal("fast", conn.Router().GetRouterName())
+	_ = conn.Close()
+
+	// the overall connect timeout still applies when no router works out
+	options.ConnectTimeout = 50 * time.Millisecond
+	_, err = dialWithFailover("test-service", session, options, make(chan *edgeRouterConnResult), 1)
+	req.Error(err)
+
+	// once every router has failed the dial gives up, rather than waiting out the connect timeout
+	unbound := edgetest.NewRouter("unbound")
+	defer unbound.Close()
+	unboundCh, err := unbound.Dial()
+	req.NoError(err)
+	connectErr := errors.New("router unreachable")
+	routerC = make(chan *edgeRouterConnResult, 2)
+	routerC <- &edgeRouterConnResult{routerName: "unreachable", err: connectErr}
+	routerC <- &edgeRouterConnResult{routerName: "unbound", routerConnection: impl.NewEdgeConnFactory("unbound", "dialer-unbound", unboundCh, nil)}
+
+	options.ConnectTimeout = 5 * time.Second
+	start = time.Now()
+	_, err = dialWithFailover("test-service", session, options, routerC, 2)
+	req.Error(err)
+	req.True(time.Since(start) < time.Second, "dial took %v", time.Since(start))
+	req.Contains(err.Error(), "no binding for session token")
+
+	routerC = make(chan *edgeRouterConnResult, 1)
+	routerC <- &edgeRouterConnResult{routerName: "unreachable", err: connectErr}
+	_, err = dialWithFailover("test-service", session, options, routerC, 1)
+	req.True(errors.Is(err, connectErr), "unexpected error: %v", err)
+}
+
+func Test_contextImpl_CanDial(t *testing.T) {
+	req := require.New(t)
+
+	ctx := &contextImpl{apiSession: &edge.ApiSession{}}
+	ctx.initDone.Do(func() {})
+
+	addService := func(name string, permissions ...string) {
+		ctx.services.Store(name, &edge.Service{Id: name + "-id", Name: name, Permissions: permissions})
+	}
+	addSession := func(serviceName string, routers ...edge.EdgeRouter) {
+		ctx.sessions.Store(serviceName+"-id:"+string(edge.SessionDial), &edge.Session{EdgeRouters: routers})
+	}
+
+	addService("dialable", string(edge.SessionDial))
+	addSession("dialable", edge.EdgeRouter{Name: "er", Urls: map[string]string{"tls": "tls:localhost:3022"}})
+	addService("no-routers", string(edge.SessionDial))
+	addSession("no-routers")
+	addService("bind-only", string(edge.SessionBind))
+
+	for name, expected := range map[string]bool{"dialable": true, "no-routers": false, "bind-only": false, "missing": false} {
+		canDial, err := ctx.CanDial(name)
+		req.NoError(err)
+		req.Equal(expected, canDial, "service %v", name)
+	}
+}
+
+func Test_dialRecordingAddress(t *testing.T) {
+	req := require.New(t)
+
+	netListener, err := net.Listen("tcp", "127.0.0.1:0")
+	req.NoError(err)
+	defer func() { _ = netListener.Close() }()
+	go func() {
+		if conn, err := netListener.Accept(); err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	tcpAddr, err := tcp.AddressParser{}.Parse("tcp:" + netListener.Addr().String())
+	req.NoError(err)
+
+	addr := &dialRecordingAddress{Address: tcpAddr}
+	req.Equal("", addr.getRemoteAddr())
+
+	conn, err := addr.Dial("test", &identity.TokenId{Token: "test"}, nil)
+	req.NoError(err)
+	defer func() { _ = conn.Close() }()
+	req.Equal(netListener.Addr().String(), addr.getRemoteAddr())
+}
+
+func Test_contextImpl_sessionExpiryHandler(t *testing.T) {
+	req := require.New(t)
+
+	ctx := &contextImpl{options: &config.Options{SessionExpiryWarning: time.Minute}}
+	expireTime := time.Now().Add(90 * time.Second)
+	delay := ctx.expiryWarningDelay(expireTime)
+	req.True(delay > 29*time.Second && delay <= 30*time.Second, "delay %v", delay)
+
+	ctx.options = &config.Options{}
+	delay = ctx.expiryWarningDelay(expireTime)
+	req.True(delay > 90*time.Second-config.DefaultSessionExpiryWarning-time.Second, "delay %v", delay)
+
+	// no handler set
+	ctx.notifySessionExpiry(expireTime)
+
+	calledC := make(chan time.Duration, 1)
+	ctx.SetSessionExpiryHandler(func(timeUntilExpiry time.Duration) {
+		calledC <- timeUntilExpiry
+	})
+	ctx.notifySessionExpiry(expireTime)
+
+	select {
+	case timeUntilExpiry := <-calledC:
+		req.True(timeUntilExpiry > 89*time.Second && timeUntilExpiry <= 90*time.Second)
+	case <-time.After(time.Second):
+		req.Fail("session expiry handler not called")
+	}
+}
+
+func Test_migratingConn(t *testing.T) {
+	req := require.New(t)
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+
+	acceptedC := make(chan edge.ServiceConn, 2)
+	var dialers []edge.RouterConn
+	var routers []*edgetest.Router
+	for _, name := range []string{"first", "second"} {
+		router := edgetest.NewRouter(name)
+		defer router.Close()
+		routers = append(routers, router)
+
+		hostCh, err := router.Dial()
+		req.NoError(err)
+		host := impl.NewEdgeConnFactory(name, "host-"+name, hostCh, nil)
+		listener, err := host.NewConn("test-service").Listen(session, "test-service", edge.DefaultListenOptions())
+		req.NoError(err)
+		defer func() { _ = listener.Close() }()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				acceptedC <- conn.(edge.ServiceConn)
+			}
+		}()
+
+		dialerCh, err := router.Dial()
+		req.NoError(err)
+		dialers = append(dialers, impl.NewEdgeConnFactory(name, "dialer-"+name, dialerCh, nil))
+	}
+
+	accept := func() edge.ServiceConn {
+		select {
+		case conn := <-acceptedC:
+			return conn
+		case <-time.After(time.Second):
+			req.FailNow("timed out waiting for conn")
+			return nil
+		}
+	}
+	read := func(conn net.Conn) string {
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		req.NoError(err)
+		return string(buf[:n])
+	}
+
+	options := edge.DefaultDialOptions()
+	options.ConnectTimeout = time.Second
+	options.Migratable = true
+	first, err := dialers[0].NewConn("test-service").ConnectWithOptions(session, options)
+	req.NoError(err)
+	conn := newMigratingConn(first, func() (edge.ServiceConn, error) {
+		return dialers[1].NewConn("test-service").ConnectWithOptions(session, options)
+	}, options)
+	var migratable edge.MigratableConn = conn
+
+	migratedC := make(chan string, 1)
+	migratable.OnMigrate(func(from, to edge.RouterConn) {
+		migratedC <- from.GetRouterName() + "->" + to.GetRouterName()
+	})
+	closedC := make(chan error, 1)
+	migratable.OnClose(func(cause error) {
+		closedC <- cause
+	})
+
+	_, err = conn.Write([]byte("one"))
+	req.NoError(err)
+	req.Equal("one", read(accept()))
+
+	// the router going away moves the conn over to the other router, and the host sees a new conn
+	routers[0].Close()
+	select {
+	case migration := <-migratedC:
+		req.Equal("first->second", migration)
+	case <-time.After(time.Second):
+		req.FailNow("conn not migrated")
+	}
+	req.Equal(1, conn.Migrations())
+	req.Equal("second", conn.Router().GetRouterName())
+	req.False(conn.IsClosed())
+
+	_, err = conn.Write([]byte("two"))
+	req.NoError(err)
+	hosted := accept()
+	req.Equal("two", read(hosted))
+
+	_, err = hosted.Write([]byte("three"))
+	req.NoError(err)
+	req.Equal("three", read(conn))
+
+	// a close from the host isn't migrated
+	req.NoError(hosted.Close())
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 8))
+	req.Equal(io.EOF, err)
+	select {
+	case <-closedC:
+	case <-time.After(time.Second):
+		req.FailNow("close handler not called")
+	}
+	req.Equal(1, conn.Migrations())
+	req.True(conn.IsClosed())
+}
+
+func Test_migratingConnFailure(t *testing.T) {
+	req := require.New(t)
+	session := &edge.Session{Id: "test-session", Token: "test-token"}
+
+	router := edgetest.NewRouter("router")
+	defer router.Close()
+	hostCh, err := router.Dial()
+	req.NoError(err)
+	host := impl.NewEdgeConnFactory("router", "host", hostCh, nil)
+	listener, err := host.NewConn("test-service").Listen(session, "test-service", edge.DefaultListenOptions())
+	req.NoError(err)
+	defer func() { _ = listener.Close() }()
+
+	dialerCh, err := router.Dial()
+	req.NoError(err)
+	dialer := impl.NewEdgeConnFactory("router", "dialer", dialerCh, nil)
+
+	options := edge.DefaultDialOptions()
+	options.ConnectTimeout = 50 * time.Millisecond
+	first, err := dialer.NewConn("test-service").ConnectWithOptions(session, options)
+	req.NoError(err)
+	conn := newMigratingConn(first, func() (edge.ServiceConn, error) {
+		return nil, errors.New("no routers available")
+	}, options)
+
+	closedC := make(chan error, 1)
+	conn.OnClose(func(cause error) {
+		closedC <- cause
+	})
+
+	router.Close()
+	select {
+	case cause := <-closedC:
+		req.True(errors.Is(cause, edge.ErrMigrationFailed))
+	case <-time.After(time.Second):
+		req.FailNow("close handler not called")
+	}
+
+	_, err = conn.Write([]byte("lost"))
+	req.Equal(edge.ErrConnClosed, err)
+}
+
+func Test_listenMany(t *testing.T) {
+	req := require.New(t)
+	router := edgetest.NewRouter("router")
+	defer router.Close()
+
+	hostCh, err := router.Dial()
+	req.NoError(err)
+	host := impl.NewEdgeConnFactory("router", "host", hostCh, nil)
+	dialerCh, err := router.Dial()
+	req.NoError(err)
+	dialer := impl.NewEdgeConnFactory("router", "dialer", dialerCh, nil)
+
+	sessionFor := func(serviceName string) *edge.Session {
+		return &edge.Session{Id: serviceName, Token: serviceName + "-token"}
+	}
+
+	group, err := listenMany([]string{"one", "two", "missing", "two"}, func(serviceName string) (edge.Listener, error) {
+		if serviceName == "missing" {
+			return nil, errors.New("service not found")
+		}
+		return host.NewConn(serviceName).Listen(sessionFor(serviceName), serviceName, edge.DefaultListenOptions())
+	})
+	req.Error(err)
+	multipleErrors, ok := err.(impl.MultipleErrors)
+	req.True(ok)
+	req.Len(multipleErrors, 1)
+	req.Contains(multipleErrors[0].Error(), "missing")
+
+	req.Len(group.Listeners(), 2)
+	_, found := group.Get("missing")
+	req.False(found)
+
+	for _, serviceName := range []string{"one", "two"} {
+		conn, err := dialer.NewConn(serviceName).ConnectWithOptions(sessionFor(serviceName), edge.DefaultDialOptions())
+		req.NoError(err)
+		defer func() { _ = conn.Close() }()
+
+		accepted, err := group.Accept()
+		req.NoError(err)
+		req.Equal(serviceName, accepted.ServiceName())
+		_ = accepted.Close()
+	}
+
+	req.NoError(group.CloseAll())
+	for _, listener := range group.Listeners() {
+		req.True(listener.IsClosed())
+	}
+
+	acceptErrC := make(chan error, 1)
+	go func() {
+		_, err := group.Accept()
+		acceptErrC <- err
+	}()
+	select {
+	case err := <-acceptErrC:
+		req.Equal(ErrListenerGroupClosed, err)
+	case <-time.After(time.Second):
+		req.Fail("accept not woken by CloseAll")
+	}
+}
+
+// groupTestListener hands out the conns sent on acceptC. Unimplemented methods panic
+type groupTestListener struct {
+	edge.Listener
+	acceptC chan net.Conn
+	closed  concurrenz.AtomicBoolean
+}
+
+func (listener *groupTestListener) Accept() (net.Conn, error) {
+	if conn, ok := <-listener.acceptC; ok {
+		return conn, nil
+	}
+	return nil, errors.New("listener closed")
+}
+
+func (listener *groupTestListener) Close() error {
+	if listener.closed.CompareAndSwap(false, true) {
+		close(listener.acceptC)
+	}
+	return nil
+}
+
+func (listener *groupTestListener) IsClosed() bool {
+	return listener.closed.Get()
+}
+
+type groupTestConn struct {
+	edge.ServiceConn
+	closed concurrenz.AtomicBoolean
+}
+
+func (conn *groupTestConn) Close() error {
+	conn.closed.Set(true)
+	return nil
+}
+
+func Test_ListenerGroupCloseAllWithPendingConn(t *testing.T) {
+	req := require.New(t)
+
+	listener := &groupTestListener{acceptC: make(chan net.Conn)}
+	group := newListenerGroup()
+	group.listeners["test-service"] = listener
+
+	first := &groupTestConn{}
+	go func() { listener.acceptC <- first }()
+	accepted, err := group.Accept()
+	req.NoError(err)
+	req.Equal(first, accepted)
+
+	// the forwarder takes this conn from the listener, but it's never accepted from the group
+	pending := &groupTestConn{}
+	listener.acceptC <- pending
+
+	req.NoError(group.CloseAll())
+
+	acceptErrC := make(chan error, 1)
+	go func() {
+		_, err := group.Accept()
+		acceptErrC <- err
+	}()
+	select {
+	case err := <-acceptErrC:
+		req.Equal(ErrListenerGroupClosed, err)
+	case <-time.After(time.Second):
+		req.FailNow("accept not woken by CloseAll")
+	}
+	deadline := time.Now().Add(time.Second)
+	for !pending.closed.Get() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	req.True(pending.closed.Get(), "pending conn not closed")
+	req.False(first.closed.Get())
+}
+
+// costTestListener records cost updates, tracking how many are in progress at once. Unimplemented methods panic
+type costTestListener struct {
+	edge.Listener
+	serviceName string
+	fail        bool
+	cost        uint16
+	active      *int32
+	maxActive   *int32
+}
+
+func (listener *costTestListener) GetServiceName() string {
+	return listener.serviceName
+}
+
+func (listener *costTestListener) UpdateCost(cost uint16) error {
+	active := atomic.AddInt32(listener.active, 1)
+	defer atomic.AddInt32(listener.active, -1)
+	for {
+		max := atomic.LoadInt32(listener.maxActive)
+		if active <= max || atomic.CompareAndSwapInt32(listener.maxActive, max, active) {
+			break
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if listener.fail {
+		return errors.New("router not responding")
+	}
+	listener.cost = cost
+	return nil
+}
+
+func Test_BulkUpdateCost(t *testing.T) {
+	req := require.New(t)
+
+	var active, maxActive int32
+	var listeners []edge.Listener
+	for i := 0; i < 2*MaxConcurrentCostUpdates; i++ {
+		listeners = append(listeners, &costTestListener{
+			serviceName: fmt.Sprintf("service-%v", i),
+			fail:        i == 3 || i == 20,
+			active:      &active,
+			maxActive:   &maxActive,
+		})
+	}
+
+	start := time.Now()
+	err := BulkUpdateCost(listeners, 1000)
+	elapsed := time.Since(start)
+
+	// updates run in parallel, up to the bound
+	req.Equal(int32(MaxConcurrentCostUpdates), atomic.LoadInt32(&maxActive))
+	req.True(elapsed < time.Duration(len(listeners))*20*time.Millisecond/2, "updates took %v", elapsed)
+
+	req.Error(err)
+	multipleErrors, ok := err.(impl.MultipleErrors)
+	req.True(ok)
+	req.Len(multipleErrors, 2)
+	req.Contains(multipleErrors[0].Error(), "service-3")
+	req.Contains(multipleErrors[1].Error(), "service-20")
+	req.Contains(multipleErrors[1].Error(), "router not responding")
+
+	for _, listener := range listeners {
+		if testListener := listener.(*costTestListener); !testListener.fail {
+			req.Equal(uint16(1000), testListener.cost)
+		}
+	}
+
+	req.NoError(BulkUpdateCost(nil, 1000))
+}
+
+// identityTestContext records the dials handed to it. Unimplemented methods panic
+type identityTestContext struct {
+	Context
+	dialed  []string
+	options []*edge.DialOptions
+}
+
+func (context *identityTestContext) DialWithOptions(serviceName string, options *edge.DialOptions) (edge.ServiceConn, error) {
+	context.dialed = append(context.dialed, serviceName)
+	context.options = append(context.options, options)
+	return nil, errors.New("dialed by test context")
+}
+
+func Test_dialWithIdentity(t *testing.T) {
+	req := require.New(t)
+
+	other := &identityTestContext{}
+	req.NoError(RegisterIdentity("other", other))
+	defer UnregisterIdentity("other")
+	req.Error(RegisterIdentity("other", &identityTestContext{}))
+	req.Error(RegisterIdentity("", other))
+
+	ctx := &contextImpl{}
+	options := edge.DefaultDialOptions()
+	options.Identity = "other"
+	_, err := ctx.DialWithOptions("test-service", options)
+	req.EqualError(err, "dialed by test context")
+	req.Equal([]string{"test-service"}, other.dialed)
+	req.Equal("", other.options[0].Identity)
+	req.Equal("other", options.Identity)
+
+	options.Identity = "missing"
+	_, err = ctx.DialWithOptions("test-service", options)
+	req.EqualError(err, "identity 'missing' is not registered")
+
+	// naming the dialing context's own identity dials as normal
+	req.NoError(RegisterIdentity("self", ctx))
+	defer UnregisterIdentity("self")
+	selected, selectedOptions, err := ctx.selectIdentity(&edge.DialOptions{Identity: "self"})
+	req.NoError(err)
+	req.Nil(selected)
+	req.Equal("self", selectedOptions.Identity)
+}
+
+func Test_resolveBindIdentity(t *testing.T) {
+	assert := require.New(t)
+	ctx := &contextImpl{apiSession: &edge.ApiSession{Identity: &edge.ApiIdentity{Name: "edge-identity"}}}
+
+	options := edge.DefaultListenOptions()
+	options.Identity = "explicit"
+	assert.Same(options, ctx.resolveBindIdentity(options))
+
+	options.BindUsingEdgeIdentity = true
+	resolved := ctx.resolveBindIdentity(options)
+	assert.Equal("edge-identity", resolved.Identity)
+	assert.Equal("explicit", options.Identity)
+}
+
+// sessionTestClient is a controller client which only refreshes a single session
+type sessionTestClient struct {
+	api.Client
+	session   *edge.Session
+	refreshes int32
+}
+
+func (client *sessionTestClient) RefreshSession(string) (*edge.Session, error) {
+	atomic.AddInt32(&client.refreshes, 1)
+	refreshed := *client.session
+	refreshed.Token = ""
+	return &refreshed, nil
+}
+
+func (client *sessionTestClient) CreateSession(string, edge.SessionType) (*edge.Session, error) {
+	created := *client.session
+	return &created, nil
+}
+
+func Test_PrewarmRouters(t *testing.T) {
+	req := require.New(t)
+	router := edgetest.NewRouter("er")
+	defer router.Close()
+
+	session := &edge.Session{
+		Id:          "test-session",
+		Token:       "test-token",
+		Type:        edge.SessionDial,
+		Service:     edge.ApiIdentity{Id: "test-service-id", Name: "test-service"},
+		EdgeRouters: []edge.EdgeRouter{{Name: "er", Urls: map[string]string{"tls": "tls:er:3022"}}},
+	}
+
+	hostCh, err := router.Dial()
+	req.NoError(err)
+	host := impl.NewEdgeConnFactory("er", "host", hostCh, nil)
+	listener, err := host.NewConn("test-service").Listen(session, "test-service", edge.DefaultListenOptions())
+	req.NoError(err)
+	defer func() { _ = listener.Close() }()
+
+	var opened int32
+	ctx := &contextImpl{
+		apiSession:        &edge.ApiSession{Token: "api-token"},
+		ctrlClt:           &sessionTestClient{session: session},
+		routerConnections: cmap.New(),
+		metrics:           metrics.NewRegistry("test", nil),
+		routerChannelOpener: func(ingressUrl string) (channel2.Channel, string, error) {
+			atomic.AddInt32(&opened, 1)
+			ch, err := router.Dial()
+			return ch, ingressUrl, err
+		},
+	}
+	ctx.initDone.Do(func() {})
+	defer ctx.Close()
+	ctx.services.Store("test-service", &edge.Service{Id: "test-service-id", Name: "test-service"})
+	ctx.sessions.Store("test-service-id:"+string(edge.SessionDial), session)
+
+	req.NoError(ctx.PrewarmRouters("test-service", nil))
+	req.Equal(int32(1), atomic.LoadInt32(&opened))
+	req.Equal(1, ctx.routerConnections.Count())
+
+	// the dial reuses the prewarmed router connection rather than setting up a channel of its own
+	conn, err := ctx.Dial("test-service")
+	req.NoError(err)
+	defer func() { _ = conn.Close() }()
+	req.Equal(int32(1), atomic.LoadInt32(&opened))
+	req.Equal("er", conn.Router().GetRouterName())
+
+	req.Error(ctx.PrewarmRouters("missing", nil))
+}
+
+func Test_DialById_ListenById(t *testing.T) {
+	req := require.New(t)
+	router := edgetest.NewRouter("er")
+	defer router.Close()
+
+	newSession := func(sessionType edge.SessionType) *edge.Session {
+		return &edge.Session{
+			Id:          "test-session",
+			Token:       "test-token",
+			Type:        sessionType,
+			Service:     edge.ApiIdentity{Id: "test-service-id", Name: "test-service"},
+			EdgeRouters: []edge.EdgeRouter{{Name: "er", Urls: map[string]string{"tls": "tls:er:3022"}}},
+		}
+	}
+
+	ctx := &contextImpl{
+		apiSession:        &edge.ApiSession{Token: "api-token"},
+		ctrlClt:           &sessionTestClient{session: newSession(edge.SessionBind)},
+		routerConnections: cmap.New(),
+		metrics:           metrics.NewRegistry("test", nil),
+		routerChannelOpener: func(ingressUrl string) (channel2.Channel, string, error) {
+			ch, err := router.Dial()
+			return ch, ingressUrl, err
+		},
+	}
+	ctx.initDone.Do(func() {})
+	defer ctx.Close()
+	ctx.services.Store("test-service", &edge.Service{Id: "test-service-id", Name: "test-service"})
+	ctx.sessions.Store("test-service-id:"+string(edge.SessionDial), newSession(edge.SessionDial))
+
+	listener, err := ctx.ListenById("test-service-id", nil)
+	req.NoError(err)
+	defer func() { _ = listener.Close() }()
+	req.Equal("test-service", listener.Addr().String())
+
+	conn, err := ctx.DialById("test-service-id", nil)
+	req.NoError(err)
+	defer func() { _ = conn.Close() }()
+
+	accepted, err := listener.AcceptWithTimeout(time.Second)
+	req.NoError(err)
+	_ = accepted.Close()
+
+	// lookups are by id only, so a service name doesn't match
+	_, err = ctx.DialById("test-service", nil)
+	var notFound *ServiceNotFoundError
+	req.True(errors.As(err, &notFound), "unexpected error: %v", err)
+	req.Equal("test-service", notFound.Service)
+	req.True(notFound.ById)
+	req.False(IsRetryableDialError(err))
+
+	_, err = ctx.ListenById("missing-id", nil)
+	req.EqualError(err, "service with id 'missing-id' not found in ZT")
+}
+
+func Test_ListDialableAndBindableServices(t *testing.T) {
+	req := require.New(t)
+
+	ctx := &contextImpl{apiSession: &edge.ApiSession{}}
+	ctx.initDone.Do(func() {})
+
+	addService := func(name string, permissions ...string) {
+		ctx.services.Store(name, &edge.Service{Id: name + "-id", Name: name, Permissions: permissions})
+	}
+	addService("dial-only", string(edge.SessionDial))
+	addService("bind-only", string(edge.SessionBind))
+	addService("dial-and-bind", string(edge.SessionBind), string(edge.SessionDial))
+	addService("no-permissions")
+
+	names := func(infos []edge.ServiceInfo) []string {
+		var result []string
+		for _, info := range infos {
+			req.Equal(info.Name+"-id", info.Id)
+			result = append(result, info.Name)
+		}
+		return result
+	}
+
+	dialable, err := ctx.ListDialableServices()
+	req.NoError(err)
+	req.ElementsMatch([]string{"dial-only", "dial-and-bind"}, names(dialable))
+
+	bindable, err := ctx.ListBindableServices()
+	req.NoError(err)
+	req.ElementsMatch([]string{"bind-only", "dial-and-bind"}, names(bindable))
+
+	for _, info := range bindable {
+		if info.Name == "dial-and-bind" {
+			req.Equal([]string{string(edge.SessionBind), string(edge.SessionDial)}, info.Permissions)
+		}
+	}
+}
+
+func Test_listenerManager_routerSelector(t *testing.T) {
+	req := require.New(t)
+
+	var lock sync.Mutex
+	var opened []string
+	ctx := &contextImpl{
+		routerConnections: cmap.New(),
+		routerChannelOpener: func(ingressUrl string) (channel2.Channel, string, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			opened = append(opened, ingressUrl)
+			return nil, "", errors.New("unreachable")
+		},
+	}
+	getOpened := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), opened...)
+	}
+
+	var offered []edge.RouterInfo
+	mgr := &listenerManager{
+		context: ctx,
+		options: &edge.ListenOptions{
+			MaxConnections: 1,
+			// prefer c over a, and never bind on b
+			RouterSelector: func(available []edge.RouterInfo) []edge.RouterInfo {
+				offered = available
+				return []edge.RouterInfo{available[2], available[0]}
+			},
+		},
+		session: &edge.Session{EdgeRouters: []edge.EdgeRouter{
+			{Name: "a", Urls: map[string]string{"tls": "tls:a:3022"}},
+			{Name: "b", Urls: map[string]string{"tls": "tls:b:3022"}},
+			{Name: "c", Urls: map[string]string{"tls": "tls:c:3022"}},
+		}},
+		routerConnections: map[string]edge.RouterConn{},
+		listeners:         map[string]edge.Listener{},
+		connects:          map[string]time.Time{},
+		connectFailures:   map[string]time.Time{},
+		connectChan:       make(chan *edgeRouterConnResult, 3),
+		listener:          impl.NewMultiListener("test", nil),
+	}
+	defer func() { _ = mgr.listener.Close() }()
+
+	handleConnectResult := func() {
+		select {
+		case result := <-mgr.connectChan:
+			mgr.handleRouterConnectResult(result)
+		case <-time.After(time.Second):
+			req.Fail("timed out waiting for router connect")
+		}
+	}
+
+	// only the first choice is connected to
+	mgr.makeMoreListeners()
+	handleConnectResult()
+	req.Equal([]string{"tls:c:3022"}, getOpened())
+	req.Equal(edge.RouterInfo{Name: "a", Address: "tls:a:3022"}, offered[0])
+	req.Equal(1, mgr.expectedBinds())
+
+	// once it fails, the next choice is tried ahead of it
+	mgr.makeMoreListeners()
+	handleConnectResult()
+	req.Equal([]string{"tls:c:3022", "tls:a:3022"}, getOpened())
+}
+
+func Test_listenResumesBind(t *testing.T) {
+	req := require.New(t)
+	router := edgetest.NewRouter("er")
+	defer router.Close()
+
+	session := &edge.Session{
+		Id:          "test-session",
+		Token:       "test-token",
+		Type:        edge.SessionBind,
+		Service:     edge.ApiIdentity{Id: "test-service-id", Name: "test-service"},
+		EdgeRouters: []edge.EdgeRouter{{Name: "er", Urls: map[string]string{"tls": "tls:er:3022"}}},
+	}
+	client := &sessionTestClient{session: session}
+
+	var lock sync.Mutex
+	var opened []channel2.Channel
+	ctx := &contextImpl{
+		apiSession:        &edge.ApiSession{Token: "api-token"},
+		ctrlClt:           client,
+		routerConnections: cmap.New(),
+		metrics:           metrics.NewRegistry("test", nil),
+		routerChannelOpener: func(ingressUrl string) (channel2.Channel, string, error) {
+			ch, err := router.Dial()
+			lock.Lock()
+			defer lock.Unlock()
+			opened = append(opened, ch)
+			return ch, ingressUrl, err
+		},
+	}
+	ctx.initDone.Do(func() {})
+	defer ctx.Close()
+	ctx.services.Store("test-service", &edge.Service{Id: "test-service-id", Name: "test-service"})
+
+	options := edge.DefaultListenOptions()
+	options.ResumeBindWindow = 5 * time.Second
+	listener, err := ctx.ListenWithOptions("test-service", options)
+	req.NoError(err)
+	defer func() { _ = listener.Close() }()
+
+	dialerCh, err := router.Dial()
+	req.NoError(err)
+	dialer := impl.NewEdgeConnFactory("er", "dialer", dialerCh, nil)
+	dialSession := &edge.Session{Id: "dial-session", Token: "test-token"}
+
+	// drop the router conn, which the listener should bind over again without going back to the controller
+	refreshes := atomic.LoadInt32(&client.refreshes)
+	lock.Lock()
+	req.Len(opened, 1)
+	req.NoError(opened[0].Close())
+	lock.Unlock()
+
+	var conn edge.ServiceConn
+	deadline := time.Now().Add(2 * time.Second)
+	for conn == nil {
+		if conn, err = dialer.NewConn("test-service").ConnectWithOptions(dialSession, edge.DefaultDialOptions()); err != nil {
+			req.True(time.Now().Before(deadline), "bind not resumed: %v", err)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	defer func() { _ = conn.Close() }()
+
+	accepted, err := listener.AcceptWithTimeout(time.Second)
+	req.NoError(err)
+	_ = accepted.Close()
+
+	binding, found := router.GetBinding("test-token")
+	req.True(found)
+	req.Equal("test-token", binding.Token)
+	req.Equal(refreshes, atomic.LoadInt32(&client.refreshes))
+	lock.Lock()
+	req.Len(opened, 2)
+	lock.Unlock()
+}
+
+func Test_listenRouterSelectorChoosesNone(t *testing.T) {
+	req := require.New(t)
+
+	session := &edge.Session{
+		Id:          "test-session",
+		Token:       "test-token",
+		Type:        edge.SessionBind,
+		Service:     edge.ApiIdentity{Id: "test-service-id", Name: "test-service"},
+		EdgeRouters: []edge.EdgeRouter{{Name: "er", Urls: map[string]string{"tls": "tls:er:3022"}}},
+	}
+	ctx := &contextImpl{
+		apiSession:        &edge.ApiSession{Token: "api-token"},
+		ctrlClt:           &sessionTestClient{session: session},
+		routerConnections: cmap.New(),
+		routerChannelOpener: func(ingressUrl string) (channel2.Channel, string, error) {
+			return nil, "", errors.New("no router connect expected")
+		},
+	}
+	ctx.initDone.Do(func() {})
+	defer ctx.Close()
+	ctx.services.Store("test-service", &edge.Service{Id: "test-service-id", Name: "test-service"})
+
+	options := edge.DefaultListenOptions()
+	options.RouterSelector = func([]edge.RouterInfo) []edge.RouterInfo { return nil }
+	listener, err := ctx.ListenWithOptions("test-service", options)
+	req.Nil(listener)
+	req.Error(err)
+	req.Contains(err.Error(), "router selector chose none of the 1 available edge routers")
+}
+
+// terminatorTestClient is a controller client which returns a fixed set of terminators for a single service
+type terminatorTestClient struct {
+	api.Client
+	serviceId   string
+	terminators []*edge.TerminatorState
+}
+
+func (client *terminatorTestClient) GetServiceTerminators(svcId string) ([]*edge.TerminatorState, error) {
+	if svcId != client.serviceId {
+		return nil, api.NotFound{}
+	}
+	return client.terminators, nil
+}
+
+func Test_GetTerminatorState(t *testing.T) {
+	req := require.New(t)
+
+	terminators := []*edge.TerminatorState{
+		{Id: "t1", Identity: "host-a", Router: edge.ApiIdentity{Id: "r1", Name: "er1"}, Cost: 10, Precedence: edge.PrecedenceRequired},
+		{Id: "t2", Identity: "host-b", Router: edge.ApiIdentity{Id: "r2", Name: "er2"}, Cost: 0, Precedence: edge.PrecedenceDefault},
+	}
+	ctx := &contextImpl{
+		apiSession: &edge.ApiSession{Token: "api-token"},
+		ctrlClt:    &terminatorTestClient{serviceId: "test-service-id", terminators: terminators},
+	}
+	ctx.initDone.Do(func() {})
+	ctx.services.Store("test-service", &edge.Service{Id: "test-service-id", Name: "test-service"})
+
+	states, err := ctx.GetTerminatorState("test-service")
+	req.NoError(err)
+	req.Equal([]edge.TerminatorState{*terminators[0], *terminators[1]}, states)
+	req.True(edge.HasPrecedenceConflict(states))
+	req.False(edge.HasPrecedenceConflict(states[1:]))
+	req.False(edge.HasPrecedenceConflict(nil))
+
+	_, err = ctx.GetTerminatorState("other-service")
+	req.Error(err)
+	req.Contains(err.Error(), "service 'other-service' not found")
+}
+
+// retryTestContext fails dials with the scripted errors in turn, then succeeds. Unimplemented methods panic
+type retryTestContext struct {
+	Context
+	errs     []error
+	attempts []time.Time
+	options  []*edge.DialOptions
+}
+
+func (context *retryTestContext) DialWithOptions(serviceName string, options *edge.DialOptions) (edge.ServiceConn, error) {
+	context.attempts = append(context.attempts, time.Now())
+	context.options = append(context.options, options)
+	if len(context.attempts) <= len(context.errs) {
+		return nil, context.errs[len(context.attempts)-1]
+	}
+	return nil, nil
+}
+
+func Test_IsRetryableDialError(t *testing.T) {
+	req := require.New(t)
+	wrap := func(err error) error {
+		return fmt.Errorf("unable to dial service 'test' (%w)", err)
+	}
+
+	req.True(IsRetryableDialError(errors.New("timeout waiting for message reply")))
+	req.True(IsRetryableDialError(wrap(errors.New("service test has no terminators"))))
+	req.True(IsRetryableDialError(wrap(api.NotAuthorized)))
+	req.False(IsRetryableDialError(nil))
+	req.False(IsRetryableDialError(wrap(api.NotAccessible{})))
+	req.False(IsRetryableDialError(api.AuthFailure{}))
+	req.False(IsRetryableDialError(wrap(edge.RejectWith(403, "go away"))))
+	req.False(IsRetryableDialError(&ServiceNotFoundError{Service: "test"}))
+	req.False(IsRetryableDialError(context.Canceled))
+}
+
+func Test_RetryDialer(t *testing.T) {
+	req := require.New(t)
+	transient := errors.New("timeout waiting for message reply")
+	options := &RetryDialerOptions{
+		Timeout:         time.Second,
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     25 * time.Millisecond,
+		Multiplier:      2,
+	}
+	var waits []time.Duration
+	options.OnRetry = func(attempt int, err error, wait time.Duration) {
+		req.Equal(len(waits)+1, attempt)
+		req.Equal(transient, err)
+		waits = append(waits, wait)
+	}
+
+	// transient failures are retried on the backoff schedule until a dial succeeds
+	ctx := &retryTestContext{errs: []error{transient, transient, transient, transient}}
+	_, err := NewRetryDialer(ctx, options).Dial("test")
+	req.NoError(err)
+	req.Len(ctx.attempts, 5)
+	expected := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond, 25 * time.Millisecond}
+	req.Equal(expected, waits)
+	for i, wait := range expected {
+		req.True(ctx.attempts[i+1].Sub(ctx.attempts[i]) >= wait, "attempt %v came after %v", i+2, ctx.attempts[i+1].Sub(ctx.attempts[i]))
+	}
+
+	// permanent failures aren't retried, and reach the caller intact
+	options.OnRetry = nil
+	for _, permanent := range []error{
+		fmt.Errorf("unable to dial service 'test' (%w)", api.NotAccessible{}),
+		edge.RejectWith(403, "go away"),
+	} {
+		ctx = &retryTestContext{errs: []error{permanent}}
+		_, err = NewRetryDialer(ctx, options).Dial("test")
+		req.Equal(permanent, err)
+		req.Len(ctx.attempts, 1)
+	}
+
+	// once the timeout is reached, the last failure is returned, and attempts are cut short to fit
+	options.Timeout = 60 * time.Millisecond
+	ctx = &retryTestContext{errs: make([]error, 100)}
+	for i := range ctx.errs {
+		ctx.errs[i] = transient
+	}
+	start := time.Now()
+	_, err = NewRetryDialer(ctx, options).Dial("test")
+	req.Equal(transient, err)
+	req.True(len(ctx.attempts) > 1)
+	req.True(time.Since(start) < 500*time.Millisecond)
+	req.True(ctx.options[0].ConnectTimeout <= options.Timeout)
+
+	// a context deadline bounds the retries like the timeout does, and cancellation stops them
+	options.Timeout = time.Second
+	ctx = &retryTestContext{errs: ctx.errs}
+	deadlineCtx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = NewRetryDialer(ctx, options).DialContext(deadlineCtx, "test")
+	req.Equal(transient, err)
+	req.True(time.Since(start) < 500*time.Millisecond)
+
+	ctx = &retryTestContext{errs: ctx.errs}
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(15*time.Millisecond, cancel)
+	_, err = NewRetryDialer(ctx, options).DialContext(cancelCtx, "test")
+	req.Equal(context.Canceled, err)
+}